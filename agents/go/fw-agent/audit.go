@@ -0,0 +1,98 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// auditTimeout bounds each audit write.
+const auditTimeout = 10 * time.Second
+
+// AuditRecord is one entry of the audit trail written to
+// Config.AuditCollection: a claim of a task by this agent, or what became
+// of it. Records are only ever inserted.
+type AuditRecord struct {
+	TaskID     string `bson:"task_id"`
+	StepID     string `bson:"step_id,omitempty"`
+	WorkflowID string `bson:"workflow_id,omitempty"`
+	Facet      string `bson:"facet"`
+	TaskList   string `bson:"task_list_name,omitempty"`
+	ServerID   string `bson:"server_id"`
+	Attempts   int    `bson:"attempts,omitempty"`
+
+	// Event is the AgentEvent kind: EventClaimed, or the outcome such as
+	// EventCompleted, EventFailed or EventReleased.
+	Event  string `bson:"event"`
+	Reason string `bson:"reason,omitempty"`
+
+	// Time is when the event happened, in milliseconds since the epoch.
+	Time int64 `bson:"time"`
+
+	// DurationMs is the time from the claim to an outcome; zero for claims.
+	DurationMs int64 `bson:"duration_ms,omitempty"`
+}
+
+// WriteAudit appends record to AuditCollection; it does nothing if
+// AuditCollection is empty.
+func (m *MongoOps) WriteAudit(ctx context.Context, record AuditRecord) error {
+	if m.AuditCollection == "" {
+		return nil
+	}
+	// Not retried, as a retry could append the record twice; see retry
+	_, err := m.collection(m.AuditCollection).InsertOne(ctx, record)
+	return err
+}
+
+// audit writes the audit record for an event about task, if auditing is
+// enabled. Failures are logged: the audit trail never blocks processing.
+func (p *AgentPoller) audit(kind string, task *TaskDocument, reason string) {
+	if p.cfg.AuditCollection == "" {
+		return
+	}
+	writer, ok := p.ops.(auditWriter)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	record := AuditRecord{
+		TaskID:     task.UUID,
+		StepID:     task.StepID,
+		WorkflowID: task.WorkflowID,
+		Facet:      task.Name,
+		TaskList:   task.TaskListName,
+		ServerID:   p.serverID,
+		Attempts:   task.Attempts,
+		Event:      kind,
+		Reason:     reason,
+		Time:       now.UnixNano() / int64(time.Millisecond),
+	}
+	if kind == EventClaimed {
+		p.auditClaims.Store(task.UUID, now)
+	} else if claimed, ok := p.auditClaims.Load(task.UUID); ok {
+		// Every other event ends this agent's handling of the task
+		p.auditClaims.Delete(task.UUID)
+		record.DurationMs = now.Sub(claimed.(time.Time)).Milliseconds()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	if err := writer.WriteAudit(ctx, record); err != nil {
+		log.Printf("Failed to write audit record for task %s: %v", task.UUID, err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// CancelReasonField is the task field read for the reason a task was
+// canceled externally. When the task has no such field, the same key in
+// its data is used instead.
+const CancelReasonField = "cancel_reason"
+
+type cancelReasonKey struct{}
+
+// cancelReason records why a handler context was canceled externally.
+type cancelReason struct {
+	mu       sync.Mutex
+	reason   string
+	canceled bool
+}
+
+func (c *cancelReason) set(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reason = reason
+	c.canceled = true
+}
+
+func (c *cancelReason) get() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason, c.canceled
+}
+
+// CancelReasonFromContext reports whether ctx, a handler context, was
+// canceled because its task was moved to canceled in the database, and
+// the reason recorded on the task ("" if none). It returns false for a
+// context canceled for any other reason, such as shutdown. See
+// Config.CancelCheckInterval.
+func CancelReasonFromContext(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(cancelReasonKey{}).(*cancelReason)
+	if !ok || ctx.Err() == nil {
+		return "", false
+	}
+	return c.get()
+}
+
+// cancelWatchLoop periodically cancels in-flight tasks that were canceled
+// in the database.
+func (p *AgentPoller) cancelWatchLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.CancelCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkCanceled(ctx)
+		}
+	}
+}
+
+// checkCanceled looks up the in-flight tasks and cancels the handler
+// context of each one canceled in the database, recording its reason.
+func (p *AgentPoller) checkCanceled(ctx context.Context) {
+	p.inFlightMu.Lock()
+	uuids := make([]string, 0, len(p.inFlightTasks))
+	for id := range p.inFlightTasks {
+		uuids = append(uuids, id)
+	}
+	p.inFlightMu.Unlock()
+	if len(uuids) == 0 {
+		return
+	}
+
+	canceled, err := p.ops.CanceledTasks(ctx, uuids)
+	if err != nil {
+		log.Printf("Error checking for canceled tasks: %v", err)
+		return
+	}
+	for id, reason := range canceled {
+		p.inFlightMu.Lock()
+		t := p.inFlightTasks[id]
+		p.inFlightMu.Unlock()
+		if t == nil {
+			continue // finished meanwhile
+		}
+		log.Printf("Task %s canceled externally (reason: %q), canceling its handler", id, reason)
+		t.reason.set(reason)
+		t.cancel()
+	}
+}
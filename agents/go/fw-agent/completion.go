@@ -0,0 +1,163 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// CompletionKey is the reserved result key under which a handler may return
+// a Completion (or *Completion) to control how the task is finished. The key
+// is removed from the result before returns are written to the step.
+const CompletionKey = "_completion"
+
+// NextTaskListKey is the reserved result key under which a handler may
+// return a string naming the task list the resume task is inserted on,
+// e.g. to hand the next step to a different pool. The key is removed from
+// the result before returns are written to the step, whatever its value;
+// a value that is not a non-empty string is ignored. A Completion with a
+// TaskList takes precedence over it.
+const NextTaskListKey = "__next_task_list__"
+
+// Completion lets a handler decide, per task, whether the workflow continues.
+//
+// When a handler's result carries a Completion, Resume replaces the default
+// decision (resume unless the handler was registered with RegisterTerminal):
+//
+//   - Resume true inserts an fw:resume task, on TaskList if set, otherwise on
+//     the originating task's list.
+//   - Resume false finalizes the step as Completed without a resume task,
+//     exactly as for a terminal facet.
+type Completion struct {
+	Resume   bool
+	TaskList string
+}
+
+// takeCompletion removes and returns the Completion carried in result, or
+// nil if the handler did not return one.
+func takeCompletion(result map[string]interface{}) *Completion {
+	v, ok := result[CompletionKey]
+	if !ok {
+		return nil
+	}
+	delete(result, CompletionKey)
+
+	switch c := v.(type) {
+	case Completion:
+		return &c
+	case *Completion:
+		return c
+	}
+	return nil
+}
+
+// takeNextTaskList removes NextTaskListKey from result and returns its
+// value, or "" if the handler did not set a usable one.
+func takeNextTaskList(result map[string]interface{}) string {
+	v, ok := result[NextTaskListKey]
+	if !ok {
+		return ""
+	}
+	delete(result, NextTaskListKey)
+	name, _ := v.(string)
+	return name
+}
+
+// retryWithBackoff runs op and, while it fails with any error, up to
+// retries more times, waiting backoff before the first retry and doubling
+// it after each; what names the operation in the log. It returns op's last
+// error, early if ctx ends during a wait.
+//
+// This is the outer of two retry layers. MongoOps.retry already retries
+// transient errors of reads and idempotent writes (MongoRetries times,
+// backing off from MongoRetryBackoff), so an op such as MarkTaskCompleted
+// makes up to (MongoRetries+1)*(retries+1) attempts, the outer waits
+// riding out failures longer than the inner ones, e.g. an election. Claims
+// and inserts such as InsertResumeTask are not retried by MongoOps, so
+// for them this layer alone makes retries+1 attempts.
+func retryWithBackoff(ctx context.Context, retries int, backoff time.Duration, what string, op func() error) error {
+	err := op()
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		log.Printf("Failed to %s, retrying in %v: %v", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// completeTask marks task completed after its side effects succeeded,
+// retrying per cfg.CompletionRetries. If that still fails the workflow has
+// advanced but the task is left running, so it is flagged and reported
+// rather than failed.
+func (p *AgentPoller) completeTask(ctx context.Context, task *TaskDocument) {
+	err := retryWithBackoff(ctx, p.cfg.CompletionRetries, p.cfg.CompletionRetryBackoff, "mark task completed", func() error {
+		return p.ops.MarkTaskCompleted(ctx, task)
+	})
+	if err == nil {
+		return
+	}
+
+	log.Printf("Task %s finished but could not be marked completed: %v", task.UUID, err)
+	p.recordEvent(EventCompletionFailed, task, err.Error())
+	if ferr := p.ops.FlagCompletionFailed(ctx, task, err.Error()); ferr != nil {
+		log.Printf("Failed to flag task %s: %v", task.UUID, ferr)
+	}
+
+	p.mu.RLock()
+	hook := p.completionFailed
+	p.mu.RUnlock()
+	if hook != nil {
+		hook(task, err)
+	}
+}
+
+// insertResume inserts task's resume task on taskList, retrying per
+// cfg.ResumeInsertRetries, and reports whether it was inserted. The step's
+// returns are already written by then, so failing the task would invite a
+// second run; if every attempt fails the task is set to resume_pending
+// instead, recording the list, and reported.
+//
+// A retry after a lost reply may find the resume already inserted; with a
+// unique (name, step_id) index on tasks InsertResumeTask treats that as
+// success, without one it may insert a second resume task.
+func (p *AgentPoller) insertResume(ctx context.Context, task *TaskDocument, taskList string) bool {
+	err := retryWithBackoff(ctx, p.cfg.ResumeInsertRetries, p.cfg.ResumeInsertRetryBackoff, "insert resume task", func() error {
+		return p.ops.InsertResumeTask(ctx, task.StepID, task.WorkflowID, taskList, task.Name)
+	})
+	if err == nil {
+		return true
+	}
+
+	log.Printf("Task %s returns written but its resume task could not be inserted: %v", task.UUID, err)
+	p.recordEvent(EventResumePending, task, err.Error())
+	if merr := p.ops.MarkTaskResumePending(ctx, task, taskList, err.Error()); merr != nil {
+		log.Printf("Failed to mark task %s resume_pending: %v", task.UUID, merr)
+	}
+
+	p.mu.RLock()
+	hook := p.resumePending
+	p.mu.RUnlock()
+	if hook != nil {
+		hook(task, err)
+	}
+	return false
+}
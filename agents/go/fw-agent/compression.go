@@ -0,0 +1,139 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Compressed param and return values are stored in place of the value as
+// a marker document:
+//
+//	{"_afl_compressed": "gzip+json", "data": BinData(0, <gzip of the JSON encoding>)}
+//
+// The attribute's type_hint describes the original value. Readers on any
+// side decompress with gzip and parse the JSON; in Python:
+//
+//	json.loads(gzip.decompress(value["data"]))
+//
+// Because the payload is JSON, BSON-specific types (dates, ObjectIDs,
+// int64 precision beyond 2^53) do not survive compression.
+const (
+	CompressedMarkerKey = "_afl_compressed"
+	CompressionGzipJSON = "gzip+json"
+)
+
+// compressValue returns v as a compressed marker document if its JSON
+// encoding is larger than m.CompressThreshold, and v unchanged otherwise,
+// including when compression is disabled or v cannot be encoded as JSON.
+func (m *MongoOps) compressValue(v interface{}) interface{} {
+	if m.CompressThreshold <= 0 {
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil || len(data) <= m.CompressThreshold {
+		return v
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return v
+	}
+	if err := zw.Close(); err != nil {
+		return v
+	}
+	return bson.D{
+		{Key: CompressedMarkerKey, Value: CompressionGzipJSON},
+		{Key: "data", Value: primitive.Binary{Data: buf.Bytes()}},
+	}
+}
+
+// decompressValue returns the original value of a compressed marker
+// document, and any other v unchanged. Decompression does not depend on
+// MongoOps.CompressThreshold, so values written by other agents are
+// always readable.
+func decompressValue(v interface{}) (interface{}, error) {
+	var format, payload interface{}
+	switch doc := v.(type) {
+	case primitive.D:
+		for _, e := range doc {
+			switch e.Key {
+			case CompressedMarkerKey:
+				format = e.Value
+			case "data":
+				payload = e.Value
+			}
+		}
+	case primitive.M:
+		format, payload = doc[CompressedMarkerKey], doc["data"]
+	case map[string]interface{}:
+		format, payload = doc[CompressedMarkerKey], doc["data"]
+	default:
+		return v, nil
+	}
+	if format == nil {
+		return v, nil
+	}
+	if format != CompressionGzipJSON {
+		return nil, fmt.Errorf("unsupported compression %v", format)
+	}
+
+	var data []byte
+	switch b := payload.(type) {
+	case primitive.Binary:
+		data = b.Data
+	case []byte:
+		data = b
+	default:
+		return nil, fmt.Errorf("compressed value has no binary data")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing value: %w", err)
+	}
+	defer zr.Close()
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing value: %w", err)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("decoding compressed value: %w", err)
+	}
+	return value, nil
+}
+
+// decompressAttributes returns the values of attrs, decompressed.
+func decompressAttributes(attrs map[string]StepAttribute) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(attrs))
+	for name, attr := range attrs {
+		value, err := decompressValue(attr.Value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
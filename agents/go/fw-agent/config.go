@@ -20,11 +20,20 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // Config holds the configuration for an AgentPoller.
 type Config struct {
+	// ConfigPath is the file the config was loaded from, set by
+	// LoadConfig. RunAgent re-reads it on SIGHUP.
+	ConfigPath string
+
 	// ServiceName is the service identifier for server registration.
 	ServiceName string
 
@@ -37,22 +46,399 @@ type Config struct {
 	// TaskList is the task list name for routing.
 	TaskList string
 
+	// TaskLists names additional task lists served alongside TaskList.
+	// Each poll cycle tries the lists in rotating order.
+	TaskLists []string
+
+	// TaskListConcurrency caps how many tasks from a given task list may be
+	// processed at once. Lists without a positive entry are limited only by
+	// MaxConcurrent, which also bounds the total across all lists.
+	TaskListConcurrency map[string]int
+
+	// AcceptedDataTypes, if non-empty, limits claiming to tasks whose
+	// data_type is listed.
+	AcceptedDataTypes []string
+
+	// AllowedTaskLists, if non-empty, are the only task lists the agent
+	// may claim from, and it never claims from DeniedTaskLists. Both are
+	// enforced in the claim filter on top of TaskList and TaskLists, as a
+	// guard against misconfiguration in shared clusters.
+	AllowedTaskLists []string
+	DeniedTaskLists  []string
+
+	// ClaimableStates lists the task states the agent claims from, for
+	// engines that park retryable or scheduled tasks outside pending, or a
+	// retry agent that picks failed tasks back up. Empty means pending
+	// only. TaskStateCanceled, TaskStateRunning and TaskStateResumePending
+	// are never claimed, even if listed.
+	ClaimableStates []string
+
+	// ResumeTaskName is the name of the system task inserted to resume a
+	// step after its handler completes. Defaults to ResumeTaskName.
+	ResumeTaskName string
+
+	// Namespace, if set, scopes the agent to "<Namespace>.<facet>" task
+	// names: handlers registered with an unqualified name are registered
+	// under the namespace, and tasks outside it are never claimed.
+	Namespace string
+
+	// RunnerID, if set, enables directed dispatch: only tasks whose
+	// runner_id is this id (or, with AcceptUnassigned, empty) are claimed.
+	// Empty leaves runner_id unconstrained, so tasks the runtime stamped
+	// with a workflow runner's id are still claimed; AgentPoller.RunnerID
+	// then reports the generated server id.
+	RunnerID string
+
+	// AcceptUnassigned also claims tasks with no runner_id when RunnerID is
+	// set. Disable it for agents that should only take work explicitly
+	// directed at them.
+	AcceptUnassigned bool
+
 	// PollInterval is the polling interval.
 	PollInterval time.Duration
 
+	// AdaptivePolling, when true, polls again immediately after a cycle that
+	// claimed a task and only waits PollInterval once a cycle claims nothing.
+	// This drains bursts quickly while keeping idle load at the base rate.
+	AdaptivePolling bool
+
+	// IdleBackoffAfter, if positive, is how many consecutive cycles must
+	// claim nothing before the poll interval starts doubling, up to
+	// MaxPollInterval. The interval returns to PollInterval as soon as a
+	// task is claimed.
+	IdleBackoffAfter int
+
+	// MaxPollInterval caps the idle backoff; see IdleBackoffAfter. It has
+	// no effect unless greater than PollInterval.
+	MaxPollInterval time.Duration
+
+	// ClaimUnmatched claims tasks of any name (within Namespace, if set)
+	// for the RegisterDefault handler, instead of only registered names.
+	// It has no effect without a default handler.
+	ClaimUnmatched bool
+
+	// RecoverPollPanics recovers a panic in a poll cycle, logs it and
+	// carries on polling, counting it in Stats.PollPanics. Without it a
+	// panic ends the process. Enabled by default.
+	RecoverPollPanics bool
+
+	// ReleaseUnregistered returns a claimed task to pending, instead of
+	// failing it, when its facet was unregistered between the claim and
+	// dispatch, so an agent that still handles it can take it. Enabled by
+	// default.
+	ReleaseUnregistered bool
+
+	// RequireWritableStep fails a task whose handler succeeded when its
+	// step was removed or moved on meanwhile, so that its returns cannot be
+	// written, instead of completing it and inserting a resume task for the
+	// step.
+	RequireWritableStep bool
+
+	// FullPoolPolicy is what the poll loop does when MaxConcurrent handlers
+	// are already running; see FullPoolPolicy. Empty means FullPoolDrop.
+	FullPoolPolicy FullPoolPolicy
+
+	// FullPoolWait bounds how long FullPoolBlock waits for a slot before
+	// releasing the claimed task. Zero means PollInterval.
+	FullPoolWait time.Duration
+
+	// CheckLeafSteps reads the step document after a handler succeeds and,
+	// if the engine marked it "leaf": true, completes the step as a
+	// RegisterTerminal handler would instead of inserting a resume task.
+	// A handler's own completion control takes precedence.
+	CheckLeafSteps bool
+
+	// WatchMode follows the tasks collection with a change stream and
+	// claims as soon as a claimable task appears, instead of at the next
+	// poll. Polling continues as a fallback. Needs a replica set or sharded
+	// cluster; a failed stream is reopened where it left off.
+	WatchMode bool
+
+	// MissingStepPolicy handles claimed tasks without a step_id; see
+	// MissingStepPolicy. Empty means MissingStepFail.
+	MissingStepPolicy MissingStepPolicy
+
+	// MaxTasksBeforeExit, if positive, makes Start stop claiming once this
+	// many tasks have completed, failed or been ignored (tasks released,
+	// requeued or canceled do not count), then deregister and return, e.g.
+	// for a canary worker that handles a fixed sample. No more tasks are
+	// claimed than the budget has left after those in flight.
+	MaxTasksBeforeExit int
+
+	// StrictSerial processes each claimed task to completion on the poll
+	// goroutine before claiming the next, so tasks run one at a time in
+	// claim order regardless of MaxConcurrent.
+	StrictSerial bool
+
 	// MaxConcurrent is the maximum number of concurrent event handlers.
+	// FullPoolPolicy decides what happens to claims while all are busy.
 	MaxConcurrent int
 
+	// MaxReturnBytes, if positive, fails a task whose handler result
+	// encodes to more BSON bytes than this, instead of writing it.
+	MaxReturnBytes int
+
+	// AdvanceStepState, if set, is the state the agent moves a step to
+	// (from EVENT_TRANSMIT) after writing its returns and before inserting
+	// the resume task, e.g. StepStateCompleted, for deployments where the
+	// agent owns the step transition. Empty leaves the step to the runner.
+	AdvanceStepState string
+
+	// CapturePanicStack records the goroutine dump of a recovered handler
+	// panic: it is logged and stored, truncated to PanicStackLimit bytes,
+	// as error.stack on the failed task.
+	CapturePanicStack bool
+
+	// PanicStackLimit bounds the captured panic stack in bytes.
+	PanicStackLimit int
+
+	// EventBufferSize is how many recent decisions (claims, releases,
+	// completions, failures, ...) RecentEvents keeps. Zero disables it.
+	EventBufferSize int
+
+	// SampleBufferSize is how many recent handler invocations, with their
+	// params and result, LastSamples keeps for debugging; see
+	// SetSampleRedactor. Zero disables capture.
+	SampleBufferSize int
+
+	// LogCompletions logs a summary of each successfully completed task
+	// through the poller's Logger: facet, duration, and the names (never
+	// the values) of its params and returns.
+	LogCompletions bool
+
+	// RequeueOnShutdown makes Stop hand in-flight tasks back to pending
+	// (clearing runner_id) and cancel their handler contexts, instead of
+	// waiting for them to finish.
+	RequeueOnShutdown bool
+
+	// RegisterOneShot makes PollOnce and PollN register the server on first
+	// use, for Job-style runs that never call Start; Close deregisters it.
+	RegisterOneShot bool
+
+	// StepLockTTL, if positive, makes the poller take a step-scoped lock in
+	// the locks collection before processing a task, so that two agents
+	// never process tasks for the same step concurrently. The lock is
+	// renewed at a third of its TTL while the handler runs, so the TTL only
+	// bounds how long a crashed holder can block the step; it should exceed
+	// a few renewal round trips. A task whose step another agent holds is
+	// deferred by PollInterval (via run_at). Zero disables the DB lock;
+	// duplicate steps are still detected within a single agent.
+	StepLockTTL time.Duration
+
+	// SerializePerWorkflow makes the poller take a workflow-scoped lock in
+	// the locks collection before processing a task, so that no two agents
+	// (or goroutines) run steps of the same workflow at once. Claims skip
+	// workflows this agent is processing, and a task whose workflow another
+	// agent holds is deferred by PollInterval (via run_at) and picked up by
+	// a later poll.
+	SerializePerWorkflow bool
+
+	// WorkflowLockTTL is how long a workflow lock lives without renewal. It
+	// is renewed at a third of the TTL while the handler runs, so it bounds
+	// how long a crashed agent can block its workflows, not how long a
+	// handler may run.
+	WorkflowLockTTL time.Duration
+
 	// HeartbeatInterval is the heartbeat interval.
 	HeartbeatInterval time.Duration
 
+	// QueueDepthInterval is how often the number of pending tasks for this
+	// agent's handlers is sampled into Stats().QueueDepth. Zero disables
+	// sampling.
+	QueueDepthInterval time.Duration
+
+	// ReclaimStaleAfter, if positive, makes the agent renew the lease (the
+	// updated time) of each task it processes and, at this interval, reset
+	// running tasks for its handlers whose lease is older than this back to
+	// pending. Zero disables both.
+	ReclaimStaleAfter time.Duration
+
+	// CancelCheckInterval, if positive, is how often the agent looks up the
+	// tasks it is processing and cancels the handler context of any that
+	// was moved to canceled in the database; see CancelReasonFromContext.
+	// Zero disables the check.
+	CancelCheckInterval time.Duration
+
+	// EnableResumeSweeper makes the agent, every ResumeSweepInterval, insert
+	// the missing resume task of steps its handlers finished: tasks left
+	// resume_pending, and completed tasks whose step still waits in
+	// EVENT_TRANSMIT with no resume task, e.g. after the resume was lost.
+	EnableResumeSweeper bool
+	ResumeSweepInterval time.Duration
+
+	// ResumeSweepLimit caps how many finished tasks a sweep examines per
+	// task list, resume_pending ones first, then the most recently
+	// completed. Zero examines all of them.
+	ResumeSweepLimit int
+
+	// ReclaimGracePeriod is how long a reclaim waits after finding stale
+	// tasks before re-checking their lease and resetting them, giving a
+	// slow but live agent time to renew. Zero resets them immediately.
+	ReclaimGracePeriod time.Duration
+
+	// RegistrationTimeout bounds each register, deregister and heartbeat
+	// call on the servers collection. Zero means no internal timeout.
+	RegistrationTimeout time.Duration
+
+	// MinRemainingTime stops PollOnce, PollN and the poll loop from claiming
+	// once the context's deadline is closer than this, for agents running
+	// under a fixed time budget. It has no effect without a deadline.
+	MinRemainingTime time.Duration
+
+	// FacetEstimates optionally gives the expected run time of facets, by
+	// registered name. Under a context deadline a facet is not claimed
+	// when its estimate exceeds the time remaining.
+	FacetEstimates map[string]time.Duration
+
+	// PressureWindow is how many consecutive queue-depth samples must exceed
+	// PressureThreshold before Pressure reports ScaleOut. Zero disables it.
+	PressureWindow int
+
+	// PressureThreshold is the saturation ratio, (in-flight + queue depth)
+	// / MaxConcurrent, above which a sample counts toward PressureWindow.
+	PressureThreshold float64
+
+	// HeartbeatRetries is the number of extra attempts made when a heartbeat
+	// fails, before waiting for the next scheduled tick. Zero disables retries.
+	HeartbeatRetries int
+
+	// HeartbeatRetryBackoff is the base delay before the first heartbeat retry.
+	// Each further retry doubles it, with jitter, up to HeartbeatRetryMaxBackoff.
+	HeartbeatRetryBackoff time.Duration
+
+	// HeartbeatRetryMaxBackoff caps the delay between heartbeat retries.
+	// Zero caps it at HeartbeatInterval, so that a retry never waits past
+	// the next scheduled heartbeat.
+	HeartbeatRetryMaxBackoff time.Duration
+
+	// AdaptiveHeartbeat stretches the heartbeat interval with the agent's
+	// load (the share of MaxConcurrent slots in use), up to twice
+	// HeartbeatInterval but never beyond a third of ServerStaleAfter, and
+	// records the load in each ping.
+	AdaptiveHeartbeat bool
+
+	// ServerStaleAfter is how long without a ping before the engine treats
+	// a server as dead. It bounds AdaptiveHeartbeat; zero means unknown.
+	ServerStaleAfter time.Duration
+
+	// FailoverForGroup makes the agent a standby for that server group: it
+	// claims nothing while any other server of the group has pinged within
+	// FailoverStaleAfter.
+	FailoverForGroup string
+
+	// FailoverStaleAfter is how old the group's latest ping must be before
+	// a standby takes over. Zero falls back to ServerStaleAfter, then to
+	// three heartbeat intervals.
+	FailoverStaleAfter time.Duration
+
 	// MongoURL is the MongoDB connection string.
 	MongoURL string
 
 	// Database is the MongoDB database name.
 	Database string
+
+	// ClaimIndexHint optionally names the tasks index to hint on claim.
+	ClaimIndexHint string
+
+	// AuditCollection, if set, is a collection that receives an
+	// append-only AuditRecord for each claim of a task and its outcome.
+	AuditCollection string
+
+	// WriteConcern is the write concern for all agent writes: "majority",
+	// a number of nodes such as "1", or a tag set name. Empty uses the
+	// connection string / server default.
+	WriteConcern string
+
+	// ReadConcern is the read concern level for all agent reads, e.g.
+	// "local" or "majority". Empty uses the server default.
+	ReadConcern string
+
+	// OrderField, if set, is the task timestamp field claims sort on,
+	// oldest first, e.g. "created"; see MongoOps.OrderField.
+	OrderField string
+
+	// TimestampUnit is how the deployment stores task created/updated
+	// times: TimestampMillis (default), TimestampSeconds or TimestampDate.
+	TimestampUnit TimestampUnit
+
+	// MaxTaskAge, if positive, skips tasks older than this when claiming.
+	MaxTaskAge time.Duration
+
+	// UseServerTime stamps and compares task, lock and log times using the
+	// MongoDB server's clock, measured on connect and on every heartbeat,
+	// instead of the local clock. Use it when agent hosts' clocks may be
+	// skewed against each other or the Python runner.
+	UseServerTime bool
+
+	// UseTransactions completes a task whose step needs no resume with its
+	// step update in one transaction, on replica sets and sharded clusters;
+	// see MongoOps.CompleteWithReturns. Standalone servers fall back to
+	// sequential writes.
+	UseTransactions bool
+
+	// UseSecondaryPrecheck makes each poll cycle first look for claimable
+	// work on a secondary (secondaryPreferred) and skip the claim, a write
+	// on the primary, when none is seen. A lagging secondary can delay
+	// pickup of new tasks by its replication lag.
+	UseSecondaryPrecheck bool
+
+	// CompressThreshold, if positive, stores step returns whose JSON
+	// encoding exceeds this many bytes gzip-compressed. Compressed params
+	// and returns are always decompressed on read.
+	CompressThreshold int
+
+	// ClaimFullDocument returns the whole task document on claim, including
+	// data and error. By default claims project only the fields the poller
+	// uses; routed handlers always get data.
+	ClaimFullDocument bool
+
+	// FieldMap renames task and step fields for non-standard schemas,
+	// e.g. {"state": "status", "uuid": "id"}. See FieldMap.
+	FieldMap FieldMap
+
+	// DebugCommands logs every MongoDB command started, succeeded or failed
+	// through the poller's Logger at debug level. Commands include full
+	// filters and documents, so this may log payload values.
+	DebugCommands bool
+
+	// SlowOpThreshold, if positive, logs claim, param read, return write
+	// and resume insert calls that take longer than this.
+	SlowOpThreshold time.Duration
+
+	// MongoRetries is how many times a Mongo read or idempotent write
+	// failing with a transient error is retried; MongoRetryBackoff is the
+	// initial delay, doubled per attempt. Claims and inserts are not
+	// retried here, only by the driver's retryable writes.
+	MongoRetries      int
+	MongoRetryBackoff time.Duration
+
+	// CompletionRetries is how many more times marking a task completed is
+	// attempted, for any error, once its returns and resume task are
+	// written; CompletionRetryBackoff is the initial delay, doubled per
+	// attempt. Each attempt is itself retried per MongoRetries. If every
+	// attempt fails the task is flagged completion_failed; see
+	// SetCompletionFailedHook.
+	CompletionRetries      int
+	CompletionRetryBackoff time.Duration
+
+	// ResumeInsertRetries is how many more times inserting a task's resume
+	// task is attempted, for any error, once its returns are written;
+	// ResumeInsertRetryBackoff is the initial delay, doubled per attempt.
+	// These are the only retries of the insert besides the driver's
+	// retryable writes. If every attempt fails the task is set to resume_pending rather than
+	// failed; see SetResumePendingHook.
+	ResumeInsertRetries      int
+	ResumeInsertRetryBackoff time.Duration
+
+	// RetryBackoff, with MaxAttempts set, retries tasks whose handler
+	// failed with a Retriable error after a delay instead of failing them.
+	RetryBackoff RetryBackoff
 }
 
+// DefaultHeartbeatRetryMaxBackoff caps heartbeat retries by default, and
+// when neither HeartbeatRetryMaxBackoff nor HeartbeatInterval is set.
+const DefaultHeartbeatRetryMaxBackoff = 2 * time.Second
+
 // DefaultConfig returns a Config with default values.
 func DefaultConfig() Config {
 	hostname, _ := os.Hostname()
@@ -61,29 +447,152 @@ func DefaultConfig() Config {
 	}
 
 	return Config{
-		ServiceName:       "fw-agent",
-		ServerGroup:       "default",
-		ServerName:        hostname,
-		TaskList:          "default",
-		PollInterval:      2 * time.Second,
-		MaxConcurrent:     5,
-		HeartbeatInterval: 10 * time.Second,
-		MongoURL:          "mongodb://localhost:27017",
-		Database:          "afl",
+		ServiceName:         "fw-agent",
+		ServerGroup:         "default",
+		ServerName:          hostname,
+		TaskList:            "default",
+		ResumeTaskName:      ResumeTaskName,
+		AcceptUnassigned:    true,
+		RecoverPollPanics:   true,
+		ReleaseUnregistered: true,
+		PollInterval:        2 * time.Second,
+		MaxConcurrent:       5,
+		HeartbeatInterval:   10 * time.Second,
+		MongoURL:            "mongodb://localhost:27017",
+		Database:            "afl",
+
+		RegistrationTimeout: 10 * time.Second,
+		WorkflowLockTTL:     5 * time.Minute,
+
+		PanicStackLimit: DefaultPanicStackLimit,
+
+		PressureWindow:    3,
+		PressureThreshold: 1.0,
+
+		HeartbeatRetries:         3,
+		HeartbeatRetryBackoff:    250 * time.Millisecond,
+		HeartbeatRetryMaxBackoff: DefaultHeartbeatRetryMaxBackoff,
+
+		MongoRetries:      DefaultMongoRetries,
+		MongoRetryBackoff: DefaultMongoRetryBackoff,
+
+		CompletionRetries:      2,
+		CompletionRetryBackoff: 200 * time.Millisecond,
+
+		ResumeInsertRetries:      2,
+		ResumeInsertRetryBackoff: 200 * time.Millisecond,
+
+		ResumeSweepInterval: time.Minute,
+		ResumeSweepLimit:    1000,
+
+		RetryBackoff: RetryBackoff{
+			Strategy: BackoffFullJitter,
+			Base:     time.Second,
+			Cap:      5 * time.Minute,
+		},
 	}
 }
 
 // mongoConfig represents the mongodb section of afl.config.json.
 type mongoConfig struct {
-	URL      string `json:"url"`
-	Database string `json:"database"`
+	URL             string `json:"url"`
+	Database        string `json:"database"`
+	ClaimIndexHint  string `json:"claimIndexHint"`
+	AuditCollection string `json:"auditCollection"`
+	WriteConcern    string `json:"writeConcern"`
+	ReadConcern     string `json:"readConcern"`
+
+	FieldMap          FieldMap `json:"fieldMap"`
+	OrderField        string   `json:"orderField"`
+	TimestampUnit     string   `json:"timestampUnit"`
+	MaxTaskAgeMs      *int     `json:"maxTaskAgeMs"`
+	ClaimFullDocument *bool    `json:"claimFullDocument"`
+	CompressThreshold *int     `json:"compressThreshold"`
+	UseServerTime     *bool    `json:"useServerTime"`
+	UseTransactions   *bool    `json:"useTransactions"`
+	SecondaryPrecheck *bool    `json:"secondaryPrecheck"`
+	DebugCommands     *bool    `json:"debugCommands"`
+	SlowOpThresholdMs *int     `json:"slowOpThresholdMs"`
+	Retries           *int     `json:"retries"`
+	RetryBackoffMs    *int     `json:"retryBackoffMs"`
 }
 
 // runnerConfig represents the runner section of afl.config.json.
 type runnerConfig struct {
-	PollIntervalMs    *int `json:"pollIntervalMs"`
-	MaxConcurrent     *int `json:"maxConcurrent"`
-	HeartbeatIntervalMs *int `json:"heartbeatIntervalMs"`
+	PollIntervalMs             *int                `json:"pollIntervalMs"`
+	MaxConcurrent              *int                `json:"maxConcurrent"`
+	HeartbeatIntervalMs        *int                `json:"heartbeatIntervalMs"`
+	AdaptivePolling            *bool               `json:"adaptivePolling"`
+	IdleBackoffAfter           *int                `json:"idleBackoffAfter"`
+	MaxPollIntervalMs          *int                `json:"maxPollIntervalMs"`
+	StrictSerial               *bool               `json:"strictSerial"`
+	MaxTasksBeforeExit         *int                `json:"maxTasksBeforeExit"`
+	CompletionRetries          *int                `json:"completionRetries"`
+	CompletionRetryBackoffMs   *int                `json:"completionRetryBackoffMs"`
+	ResumeInsertRetries        *int                `json:"resumeInsertRetries"`
+	ResumeInsertRetryBackoffMs *int                `json:"resumeInsertRetryBackoffMs"`
+	RetryBackoff               *retryBackoffConfig `json:"retryBackoff"`
+	ClaimUnmatched             *bool               `json:"claimUnmatched"`
+	RecoverPollPanics          *bool               `json:"recoverPollPanics"`
+	ReleaseUnregistered        *bool               `json:"releaseUnregistered"`
+	RequireWritableStep        *bool               `json:"requireWritableStep"`
+	WatchMode                  *bool               `json:"watchMode"`
+	CheckLeafSteps             *bool               `json:"checkLeafSteps"`
+	FullPoolPolicy             *string             `json:"fullPoolPolicy"`
+	FullPoolWaitMs             *int                `json:"fullPoolWaitMs"`
+	MissingStepPolicy          *string             `json:"missingStepPolicy"`
+	QueueDepthIntervalMs       *int                `json:"queueDepthIntervalMs"`
+	ReclaimStaleAfterMs        *int                `json:"reclaimStaleAfterMs"`
+	CancelCheckIntervalMs      *int                `json:"cancelCheckIntervalMs"`
+	EnableResumeSweeper        *bool               `json:"enableResumeSweeper"`
+	ResumeSweepIntervalMs      *int                `json:"resumeSweepIntervalMs"`
+	ResumeSweepLimit           *int                `json:"resumeSweepLimit"`
+	ReclaimGracePeriodMs       *int                `json:"reclaimGracePeriodMs"`
+	RunnerID                   *string             `json:"runnerId"`
+	Namespace                  *string             `json:"namespace"`
+	ResumeTaskName             *string             `json:"resumeTaskName"`
+	AcceptedDataTypes          []string            `json:"acceptedDataTypes"`
+	AllowedTaskLists           []string            `json:"allowedTaskLists"`
+	DeniedTaskLists            []string            `json:"deniedTaskLists"`
+	ClaimableStates            []string            `json:"claimableStates"`
+	TaskLists                  []string            `json:"taskLists"`
+	TaskListConcurrency        map[string]int      `json:"taskListConcurrency"`
+	RequeueOnShutdown          *bool               `json:"requeueOnShutdown"`
+	RegisterOneShot            *bool               `json:"registerOneShot"`
+	LogCompletions             *bool               `json:"logCompletions"`
+	EventBufferSize            *int                `json:"eventBufferSize"`
+	SampleBufferSize           *int                `json:"sampleBufferSize"`
+	AdvanceStepState           *string             `json:"advanceStepState"`
+	CapturePanicStack          *bool               `json:"capturePanicStack"`
+	PanicStackLimit            *int                `json:"panicStackLimit"`
+	MaxReturnBytes             *int                `json:"maxReturnBytes"`
+	AcceptUnassigned           *bool               `json:"acceptUnassigned"`
+
+	SerializePerWorkflow *bool `json:"serializePerWorkflow"`
+	WorkflowLockTTLMs    *int  `json:"workflowLockTtlMs"`
+
+	MinRemainingMs   *int           `json:"minRemainingMs"`
+	FacetEstimatesMs map[string]int `json:"facetEstimatesMs"`
+
+	PressureWindow    *int     `json:"pressureWindow"`
+	PressureThreshold *float64 `json:"pressureThreshold"`
+
+	RegistrationTimeoutMs      *int    `json:"registrationTimeoutMs"`
+	HeartbeatRetries           *int    `json:"heartbeatRetries"`
+	HeartbeatRetryBackoffMs    *int    `json:"heartbeatRetryBackoffMs"`
+	HeartbeatRetryMaxBackoffMs *int    `json:"heartbeatRetryMaxBackoffMs"`
+	AdaptiveHeartbeat          *bool   `json:"adaptiveHeartbeat"`
+	ServerStaleAfterMs         *int    `json:"serverStaleAfterMs"`
+	FailoverForGroup           *string `json:"failoverForGroup"`
+	FailoverStaleAfterMs       *int    `json:"failoverStaleAfterMs"`
+}
+
+// retryBackoffConfig represents the runner's retryBackoff object.
+type retryBackoffConfig struct {
+	Strategy    string `json:"strategy"`
+	BaseMs      *int   `json:"baseMs"`
+	CapMs       *int   `json:"capMs"`
+	MaxAttempts *int   `json:"maxAttempts"`
 }
 
 // aflConfig represents the structure of afl.config.json.
@@ -107,12 +616,87 @@ func LoadConfig(path string) (Config, error) {
 		return cfg, err
 	}
 
+	applyFileConfig(&cfg, fileCfg)
+	cfg.ConfigPath = path
+
+	// AFL_ENV overlay
+	if envName := os.Getenv("AFL_ENV"); envName != "" {
+		dir := filepath.Dir(path)
+		overlayPath := filepath.Join(dir, "afl.config."+envName+".json")
+		if overlayData, err := ioutil.ReadFile(overlayPath); err == nil {
+			var overlay aflConfig
+			if json.Unmarshal(overlayData, &overlay) == nil {
+				applyFileConfig(&cfg, overlay)
+			}
+		}
+	}
+
+	// Override with environment variables if set
+	applyEnvOverrides(&cfg)
+
+	return cfg, nil
+}
+
+// applyFileConfig copies the fields present in a parsed afl.config.json
+// (or environment overlay) onto cfg.
+func applyFileConfig(cfg *Config, fileCfg aflConfig) {
 	if fileCfg.MongoDB.URL != "" {
 		cfg.MongoURL = fileCfg.MongoDB.URL
 	}
 	if fileCfg.MongoDB.Database != "" {
 		cfg.Database = fileCfg.MongoDB.Database
 	}
+	if fileCfg.MongoDB.ClaimIndexHint != "" {
+		cfg.ClaimIndexHint = fileCfg.MongoDB.ClaimIndexHint
+	}
+	if fileCfg.MongoDB.AuditCollection != "" {
+		cfg.AuditCollection = fileCfg.MongoDB.AuditCollection
+	}
+	if fileCfg.MongoDB.WriteConcern != "" {
+		cfg.WriteConcern = fileCfg.MongoDB.WriteConcern
+	}
+	if fileCfg.MongoDB.ReadConcern != "" {
+		cfg.ReadConcern = fileCfg.MongoDB.ReadConcern
+	}
+	if len(fileCfg.MongoDB.FieldMap) > 0 {
+		cfg.FieldMap = fileCfg.MongoDB.FieldMap
+	}
+	if fileCfg.MongoDB.OrderField != "" {
+		cfg.OrderField = fileCfg.MongoDB.OrderField
+	}
+	if fileCfg.MongoDB.TimestampUnit != "" {
+		cfg.TimestampUnit = TimestampUnit(fileCfg.MongoDB.TimestampUnit)
+	}
+	if fileCfg.MongoDB.MaxTaskAgeMs != nil {
+		cfg.MaxTaskAge = time.Duration(*fileCfg.MongoDB.MaxTaskAgeMs) * time.Millisecond
+	}
+	if fileCfg.MongoDB.SecondaryPrecheck != nil {
+		cfg.UseSecondaryPrecheck = *fileCfg.MongoDB.SecondaryPrecheck
+	}
+	if fileCfg.MongoDB.UseServerTime != nil {
+		cfg.UseServerTime = *fileCfg.MongoDB.UseServerTime
+	}
+	if fileCfg.MongoDB.UseTransactions != nil {
+		cfg.UseTransactions = *fileCfg.MongoDB.UseTransactions
+	}
+	if fileCfg.MongoDB.ClaimFullDocument != nil {
+		cfg.ClaimFullDocument = *fileCfg.MongoDB.ClaimFullDocument
+	}
+	if fileCfg.MongoDB.CompressThreshold != nil {
+		cfg.CompressThreshold = *fileCfg.MongoDB.CompressThreshold
+	}
+	if fileCfg.MongoDB.DebugCommands != nil {
+		cfg.DebugCommands = *fileCfg.MongoDB.DebugCommands
+	}
+	if fileCfg.MongoDB.SlowOpThresholdMs != nil {
+		cfg.SlowOpThreshold = time.Duration(*fileCfg.MongoDB.SlowOpThresholdMs) * time.Millisecond
+	}
+	if fileCfg.MongoDB.Retries != nil {
+		cfg.MongoRetries = *fileCfg.MongoDB.Retries
+	}
+	if fileCfg.MongoDB.RetryBackoffMs != nil {
+		cfg.MongoRetryBackoff = time.Duration(*fileCfg.MongoDB.RetryBackoffMs) * time.Millisecond
+	}
 
 	// Runner section
 	if fileCfg.Runner.PollIntervalMs != nil {
@@ -124,37 +708,197 @@ func LoadConfig(path string) (Config, error) {
 	if fileCfg.Runner.HeartbeatIntervalMs != nil {
 		cfg.HeartbeatInterval = time.Duration(*fileCfg.Runner.HeartbeatIntervalMs) * time.Millisecond
 	}
-
-	// AFL_ENV overlay
-	if envName := os.Getenv("AFL_ENV"); envName != "" {
-		dir := filepath.Dir(path)
-		overlayPath := filepath.Join(dir, "afl.config."+envName+".json")
-		if overlayData, err := ioutil.ReadFile(overlayPath); err == nil {
-			var overlay aflConfig
-			if json.Unmarshal(overlayData, &overlay) == nil {
-				if overlay.MongoDB.URL != "" {
-					cfg.MongoURL = overlay.MongoDB.URL
-				}
-				if overlay.MongoDB.Database != "" {
-					cfg.Database = overlay.MongoDB.Database
-				}
-				if overlay.Runner.PollIntervalMs != nil {
-					cfg.PollInterval = time.Duration(*overlay.Runner.PollIntervalMs) * time.Millisecond
-				}
-				if overlay.Runner.MaxConcurrent != nil {
-					cfg.MaxConcurrent = *overlay.Runner.MaxConcurrent
-				}
-				if overlay.Runner.HeartbeatIntervalMs != nil {
-					cfg.HeartbeatInterval = time.Duration(*overlay.Runner.HeartbeatIntervalMs) * time.Millisecond
-				}
-			}
+	if fileCfg.Runner.AdaptivePolling != nil {
+		cfg.AdaptivePolling = *fileCfg.Runner.AdaptivePolling
+	}
+	if fileCfg.Runner.IdleBackoffAfter != nil {
+		cfg.IdleBackoffAfter = *fileCfg.Runner.IdleBackoffAfter
+	}
+	if fileCfg.Runner.MaxPollIntervalMs != nil {
+		cfg.MaxPollInterval = time.Duration(*fileCfg.Runner.MaxPollIntervalMs) * time.Millisecond
+	}
+	if fileCfg.Runner.StrictSerial != nil {
+		cfg.StrictSerial = *fileCfg.Runner.StrictSerial
+	}
+	if fileCfg.Runner.RecoverPollPanics != nil {
+		cfg.RecoverPollPanics = *fileCfg.Runner.RecoverPollPanics
+	}
+	if fileCfg.Runner.ReleaseUnregistered != nil {
+		cfg.ReleaseUnregistered = *fileCfg.Runner.ReleaseUnregistered
+	}
+	if fileCfg.Runner.RequireWritableStep != nil {
+		cfg.RequireWritableStep = *fileCfg.Runner.RequireWritableStep
+	}
+	if fileCfg.Runner.WatchMode != nil {
+		cfg.WatchMode = *fileCfg.Runner.WatchMode
+	}
+	if fileCfg.Runner.CheckLeafSteps != nil {
+		cfg.CheckLeafSteps = *fileCfg.Runner.CheckLeafSteps
+	}
+	if fileCfg.Runner.FullPoolPolicy != nil {
+		cfg.FullPoolPolicy = FullPoolPolicy(*fileCfg.Runner.FullPoolPolicy)
+	}
+	if fileCfg.Runner.FullPoolWaitMs != nil {
+		cfg.FullPoolWait = time.Duration(*fileCfg.Runner.FullPoolWaitMs) * time.Millisecond
+	}
+	if fileCfg.Runner.MissingStepPolicy != nil {
+		cfg.MissingStepPolicy = MissingStepPolicy(*fileCfg.Runner.MissingStepPolicy)
+	}
+	if fileCfg.Runner.ClaimUnmatched != nil {
+		cfg.ClaimUnmatched = *fileCfg.Runner.ClaimUnmatched
+	}
+	if fileCfg.Runner.CompletionRetries != nil {
+		cfg.CompletionRetries = *fileCfg.Runner.CompletionRetries
+	}
+	if fileCfg.Runner.CompletionRetryBackoffMs != nil {
+		cfg.CompletionRetryBackoff = time.Duration(*fileCfg.Runner.CompletionRetryBackoffMs) * time.Millisecond
+	}
+	if fileCfg.Runner.ResumeInsertRetries != nil {
+		cfg.ResumeInsertRetries = *fileCfg.Runner.ResumeInsertRetries
+	}
+	if fileCfg.Runner.ResumeInsertRetryBackoffMs != nil {
+		cfg.ResumeInsertRetryBackoff = time.Duration(*fileCfg.Runner.ResumeInsertRetryBackoffMs) * time.Millisecond
+	}
+	if rb := fileCfg.Runner.RetryBackoff; rb != nil {
+		if rb.Strategy != "" {
+			cfg.RetryBackoff.Strategy = BackoffStrategy(rb.Strategy)
+		}
+		if rb.BaseMs != nil {
+			cfg.RetryBackoff.Base = time.Duration(*rb.BaseMs) * time.Millisecond
+		}
+		if rb.CapMs != nil {
+			cfg.RetryBackoff.Cap = time.Duration(*rb.CapMs) * time.Millisecond
+		}
+		if rb.MaxAttempts != nil {
+			cfg.RetryBackoff.MaxAttempts = *rb.MaxAttempts
 		}
 	}
-
-	// Override with environment variables if set
-	applyEnvOverrides(&cfg)
-
-	return cfg, nil
+	if fileCfg.Runner.MaxTasksBeforeExit != nil {
+		cfg.MaxTasksBeforeExit = *fileCfg.Runner.MaxTasksBeforeExit
+	}
+	if fileCfg.Runner.ReclaimStaleAfterMs != nil {
+		cfg.ReclaimStaleAfter = time.Duration(*fileCfg.Runner.ReclaimStaleAfterMs) * time.Millisecond
+	}
+	if fileCfg.Runner.CancelCheckIntervalMs != nil {
+		cfg.CancelCheckInterval = time.Duration(*fileCfg.Runner.CancelCheckIntervalMs) * time.Millisecond
+	}
+	if fileCfg.Runner.EnableResumeSweeper != nil {
+		cfg.EnableResumeSweeper = *fileCfg.Runner.EnableResumeSweeper
+	}
+	if fileCfg.Runner.ResumeSweepIntervalMs != nil {
+		cfg.ResumeSweepInterval = time.Duration(*fileCfg.Runner.ResumeSweepIntervalMs) * time.Millisecond
+	}
+	if fileCfg.Runner.ResumeSweepLimit != nil {
+		cfg.ResumeSweepLimit = *fileCfg.Runner.ResumeSweepLimit
+	}
+	if fileCfg.Runner.ReclaimGracePeriodMs != nil {
+		cfg.ReclaimGracePeriod = time.Duration(*fileCfg.Runner.ReclaimGracePeriodMs) * time.Millisecond
+	}
+	if fileCfg.Runner.QueueDepthIntervalMs != nil {
+		cfg.QueueDepthInterval = time.Duration(*fileCfg.Runner.QueueDepthIntervalMs) * time.Millisecond
+	}
+	if fileCfg.Runner.RunnerID != nil {
+		cfg.RunnerID = *fileCfg.Runner.RunnerID
+	}
+	if len(fileCfg.Runner.AcceptedDataTypes) > 0 {
+		cfg.AcceptedDataTypes = fileCfg.Runner.AcceptedDataTypes
+	}
+	if len(fileCfg.Runner.AllowedTaskLists) > 0 {
+		cfg.AllowedTaskLists = fileCfg.Runner.AllowedTaskLists
+	}
+	if len(fileCfg.Runner.DeniedTaskLists) > 0 {
+		cfg.DeniedTaskLists = fileCfg.Runner.DeniedTaskLists
+	}
+	if len(fileCfg.Runner.ClaimableStates) > 0 {
+		cfg.ClaimableStates = fileCfg.Runner.ClaimableStates
+	}
+	if len(fileCfg.Runner.TaskLists) > 0 {
+		cfg.TaskLists = fileCfg.Runner.TaskLists
+	}
+	if len(fileCfg.Runner.TaskListConcurrency) > 0 {
+		cfg.TaskListConcurrency = fileCfg.Runner.TaskListConcurrency
+	}
+	if fileCfg.Runner.ResumeTaskName != nil {
+		cfg.ResumeTaskName = *fileCfg.Runner.ResumeTaskName
+	}
+	if fileCfg.Runner.Namespace != nil {
+		cfg.Namespace = *fileCfg.Runner.Namespace
+	}
+	if fileCfg.Runner.MaxReturnBytes != nil {
+		cfg.MaxReturnBytes = *fileCfg.Runner.MaxReturnBytes
+	}
+	if fileCfg.Runner.CapturePanicStack != nil {
+		cfg.CapturePanicStack = *fileCfg.Runner.CapturePanicStack
+	}
+	if fileCfg.Runner.PanicStackLimit != nil {
+		cfg.PanicStackLimit = *fileCfg.Runner.PanicStackLimit
+	}
+	if fileCfg.Runner.AdvanceStepState != nil {
+		cfg.AdvanceStepState = *fileCfg.Runner.AdvanceStepState
+	}
+	if fileCfg.Runner.EventBufferSize != nil {
+		cfg.EventBufferSize = *fileCfg.Runner.EventBufferSize
+	}
+	if fileCfg.Runner.SampleBufferSize != nil {
+		cfg.SampleBufferSize = *fileCfg.Runner.SampleBufferSize
+	}
+	if fileCfg.Runner.LogCompletions != nil {
+		cfg.LogCompletions = *fileCfg.Runner.LogCompletions
+	}
+	if fileCfg.Runner.RegisterOneShot != nil {
+		cfg.RegisterOneShot = *fileCfg.Runner.RegisterOneShot
+	}
+	if fileCfg.Runner.RequeueOnShutdown != nil {
+		cfg.RequeueOnShutdown = *fileCfg.Runner.RequeueOnShutdown
+	}
+	if fileCfg.Runner.AcceptUnassigned != nil {
+		cfg.AcceptUnassigned = *fileCfg.Runner.AcceptUnassigned
+	}
+	if fileCfg.Runner.SerializePerWorkflow != nil {
+		cfg.SerializePerWorkflow = *fileCfg.Runner.SerializePerWorkflow
+	}
+	if fileCfg.Runner.WorkflowLockTTLMs != nil {
+		cfg.WorkflowLockTTL = time.Duration(*fileCfg.Runner.WorkflowLockTTLMs) * time.Millisecond
+	}
+	if fileCfg.Runner.MinRemainingMs != nil {
+		cfg.MinRemainingTime = time.Duration(*fileCfg.Runner.MinRemainingMs) * time.Millisecond
+	}
+	if len(fileCfg.Runner.FacetEstimatesMs) > 0 {
+		cfg.FacetEstimates = make(map[string]time.Duration, len(fileCfg.Runner.FacetEstimatesMs))
+		for facet, ms := range fileCfg.Runner.FacetEstimatesMs {
+			cfg.FacetEstimates[facet] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if fileCfg.Runner.PressureWindow != nil {
+		cfg.PressureWindow = *fileCfg.Runner.PressureWindow
+	}
+	if fileCfg.Runner.PressureThreshold != nil {
+		cfg.PressureThreshold = *fileCfg.Runner.PressureThreshold
+	}
+	if fileCfg.Runner.RegistrationTimeoutMs != nil {
+		cfg.RegistrationTimeout = time.Duration(*fileCfg.Runner.RegistrationTimeoutMs) * time.Millisecond
+	}
+	if fileCfg.Runner.HeartbeatRetries != nil {
+		cfg.HeartbeatRetries = *fileCfg.Runner.HeartbeatRetries
+	}
+	if fileCfg.Runner.HeartbeatRetryBackoffMs != nil {
+		cfg.HeartbeatRetryBackoff = time.Duration(*fileCfg.Runner.HeartbeatRetryBackoffMs) * time.Millisecond
+	}
+	if fileCfg.Runner.HeartbeatRetryMaxBackoffMs != nil {
+		cfg.HeartbeatRetryMaxBackoff = time.Duration(*fileCfg.Runner.HeartbeatRetryMaxBackoffMs) * time.Millisecond
+	}
+	if fileCfg.Runner.AdaptiveHeartbeat != nil {
+		cfg.AdaptiveHeartbeat = *fileCfg.Runner.AdaptiveHeartbeat
+	}
+	if fileCfg.Runner.ServerStaleAfterMs != nil {
+		cfg.ServerStaleAfter = time.Duration(*fileCfg.Runner.ServerStaleAfterMs) * time.Millisecond
+	}
+	if fileCfg.Runner.FailoverForGroup != nil {
+		cfg.FailoverForGroup = *fileCfg.Runner.FailoverForGroup
+	}
+	if fileCfg.Runner.FailoverStaleAfterMs != nil {
+		cfg.FailoverStaleAfter = time.Duration(*fileCfg.Runner.FailoverStaleAfterMs) * time.Millisecond
+	}
 }
 
 // ResolveConfig resolves configuration using the standard search order:
@@ -214,11 +958,52 @@ func applyEnvOverrides(cfg *Config) {
 	if db := os.Getenv("AFL_MONGODB_DATABASE"); db != "" {
 		cfg.Database = db
 	}
+	if wc := os.Getenv("AFL_MONGODB_WRITE_CONCERN"); wc != "" {
+		cfg.WriteConcern = wc
+	}
+	if rc := os.Getenv("AFL_MONGODB_READ_CONCERN"); rc != "" {
+		cfg.ReadConcern = rc
+	}
 	if v := os.Getenv("AFL_POLL_INTERVAL_MS"); v != "" {
 		if ms, err := strconv.Atoi(v); err == nil {
 			cfg.PollInterval = time.Duration(ms) * time.Millisecond
 		}
 	}
+	if v := os.Getenv("AFL_MAX_TASKS_BEFORE_EXIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxTasksBeforeExit = n
+		}
+	}
+	if v := os.Getenv("AFL_IDLE_BACKOFF_AFTER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.IdleBackoffAfter = n
+		}
+	}
+	if v := os.Getenv("AFL_MAX_POLL_INTERVAL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.MaxPollInterval = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_CANCEL_CHECK_INTERVAL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.CancelCheckInterval = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_ENABLE_RESUME_SWEEPER"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.EnableResumeSweeper = b
+		}
+	}
+	if v := os.Getenv("AFL_RESUME_SWEEP_INTERVAL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.ResumeSweepInterval = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_RESUME_SWEEP_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ResumeSweepLimit = n
+		}
+	}
 	if v := os.Getenv("AFL_MAX_CONCURRENT"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
 			cfg.MaxConcurrent = n
@@ -229,4 +1014,184 @@ func applyEnvOverrides(cfg *Config) {
 			cfg.HeartbeatInterval = time.Duration(ms) * time.Millisecond
 		}
 	}
+	if v := os.Getenv("AFL_RUNNER_ID"); v != "" {
+		cfg.RunnerID = v
+	}
+	if v := os.Getenv("AFL_ACCEPTED_DATA_TYPES"); v != "" {
+		cfg.AcceptedDataTypes = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AFL_ALLOWED_TASK_LISTS"); v != "" {
+		cfg.AllowedTaskLists = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AFL_DENIED_TASK_LISTS"); v != "" {
+		cfg.DeniedTaskLists = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AFL_CLAIMABLE_STATES"); v != "" {
+		cfg.ClaimableStates = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AFL_TASK_LISTS"); v != "" {
+		cfg.TaskLists = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AFL_RESUME_TASK_NAME"); v != "" {
+		cfg.ResumeTaskName = v
+	}
+	if v := os.Getenv("AFL_NAMESPACE"); v != "" {
+		cfg.Namespace = v
+	}
+	if v := os.Getenv("AFL_LOG_COMPLETIONS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.LogCompletions = b
+		}
+	}
+	if v := os.Getenv("AFL_CAPTURE_PANIC_STACK"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.CapturePanicStack = b
+		}
+	}
+	if v := os.Getenv("AFL_HEARTBEAT_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.HeartbeatRetries = n
+		}
+	}
+	if v := os.Getenv("AFL_HEARTBEAT_RETRY_BACKOFF_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.HeartbeatRetryBackoff = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_HEARTBEAT_RETRY_MAX_BACKOFF_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.HeartbeatRetryMaxBackoff = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_TIMESTAMP_UNIT"); v != "" {
+		cfg.TimestampUnit = TimestampUnit(v)
+	}
+	if v := os.Getenv("AFL_ADAPTIVE_HEARTBEAT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.AdaptiveHeartbeat = b
+		}
+	}
+	if v := os.Getenv("AFL_SERVER_STALE_AFTER_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.ServerStaleAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_FAILOVER_FOR_GROUP"); v != "" {
+		cfg.FailoverForGroup = v
+	}
+	if v := os.Getenv("AFL_FAILOVER_STALE_AFTER_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.FailoverStaleAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_MISSING_STEP_POLICY"); v != "" {
+		cfg.MissingStepPolicy = MissingStepPolicy(v)
+	}
+	if v := os.Getenv("AFL_REQUIRE_WRITABLE_STEP"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.RequireWritableStep = b
+		}
+	}
+	if v := os.Getenv("AFL_WATCH_MODE"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.WatchMode = b
+		}
+	}
+	if v := os.Getenv("AFL_CHECK_LEAF_STEPS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.CheckLeafSteps = b
+		}
+	}
+	if v := os.Getenv("AFL_FULL_POOL_POLICY"); v != "" {
+		cfg.FullPoolPolicy = FullPoolPolicy(v)
+	}
+	if v := os.Getenv("AFL_FULL_POOL_WAIT_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.FullPoolWait = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_SECONDARY_PRECHECK"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.UseSecondaryPrecheck = b
+		}
+	}
+	if v := os.Getenv("AFL_USE_SERVER_TIME"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.UseServerTime = b
+		}
+	}
+	if v := os.Getenv("AFL_USE_TRANSACTIONS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.UseTransactions = b
+		}
+	}
+	if v := os.Getenv("AFL_RETRY_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.RetryBackoff.MaxAttempts = n
+		}
+	}
+	if v := os.Getenv("AFL_RETRY_BACKOFF"); v != "" {
+		cfg.RetryBackoff.Strategy = BackoffStrategy(v)
+	}
+	if v := os.Getenv("AFL_RETRY_BACKOFF_BASE_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.RetryBackoff.Base = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_RETRY_BACKOFF_CAP_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.RetryBackoff.Cap = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("AFL_AUDIT_COLLECTION"); v != "" {
+		cfg.AuditCollection = v
+	}
+	if v := os.Getenv("AFL_COMPRESS_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.CompressThreshold = n
+		}
+	}
+	if v := os.Getenv("AFL_CLAIM_FULL_DOCUMENT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.ClaimFullDocument = b
+		}
+	}
+	if v := os.Getenv("AFL_MONGODB_DEBUG_COMMANDS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.DebugCommands = b
+		}
+	}
+	if v := os.Getenv("AFL_SLOW_OP_THRESHOLD_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			cfg.SlowOpThreshold = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// databaseOptions returns the database options implied by the configured
+// read and write concerns.
+func (c Config) databaseOptions() *options.DatabaseOptions {
+	opts := options.Database()
+	if wc := parseWriteConcern(c.WriteConcern); wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+	if c.ReadConcern != "" {
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: c.ReadConcern})
+	}
+	return opts
+}
+
+// parseWriteConcern converts a write concern string ("majority", a node
+// count, or a tag set name) into a WriteConcern, or nil if s is empty.
+func parseWriteConcern(s string) *writeconcern.WriteConcern {
+	switch {
+	case s == "":
+		return nil
+	case s == "majority":
+		return writeconcern.Majority()
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return &writeconcern.WriteConcern{W: n}
+	}
+	return writeconcern.Custom(s)
 }
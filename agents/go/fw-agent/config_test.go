@@ -0,0 +1,117 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// writeConfigFile writes an afl.config.json into a temp dir and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fwagent-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "afl.config.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigConcerns(t *testing.T) {
+	path := writeConfigFile(t, `{"mongodb": {"writeConcern": "majority", "readConcern": "majority"}}`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.WriteConcern != "majority" || cfg.ReadConcern != "majority" {
+		t.Errorf("Expected majority concerns, got write=%q read=%q", cfg.WriteConcern, cfg.ReadConcern)
+	}
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	if parseWriteConcern("") != nil {
+		t.Error("Expected nil write concern for empty string")
+	}
+	if w := parseWriteConcern("majority").W; w != "majority" {
+		t.Errorf("Expected w=majority, got %v", w)
+	}
+	if w := parseWriteConcern("2").W; w != 2 {
+		t.Errorf("Expected w=2, got %v", w)
+	}
+	if w := parseWriteConcern("dc-east").W; w != "dc-east" {
+		t.Errorf("Expected tag set w=dc-east, got %v", w)
+	}
+}
+
+func TestConcernsAppliedToOperations(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("claim and read", func(mt *mtest.T) {
+		cfg := DefaultConfig()
+		// mtest clients default to w:majority, so use a distinct value
+		cfg.WriteConcern = "1"
+		cfg.ReadConcern = "majority"
+		ops := NewMongoOps(mt.Client.Database("afl", cfg.databaseOptions()))
+
+		mt.AddMockResponses(
+			claimedTaskResponse(bson.D{{Key: "uuid", Value: "t1"}}),
+			mtest.CreateCursorResponse(0, "afl.steps", mtest.FirstBatch, bson.D{{Key: "uuid", Value: "s1"}}),
+		)
+
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		claim := mt.GetStartedEvent().Command
+		if w := claim.Lookup("writeConcern", "w").Int32(); w != 1 {
+			mt.Errorf("Expected claim writeConcern w=1, got %d", w)
+		}
+
+		if _, err := ops.ReadStepParams(context.Background(), "s1"); err != nil {
+			mt.Fatalf("ReadStepParams: %v", err)
+		}
+		read := mt.GetStartedEvent().Command
+		if level := read.Lookup("readConcern", "level").StringValue(); level != "majority" {
+			mt.Errorf("Expected readConcern majority, got %q", level)
+		}
+	})
+}
+
+func TestLoadConfigResumeTaskName(t *testing.T) {
+	if got := DefaultConfig().ResumeTaskName; got != ResumeTaskName {
+		t.Errorf("Expected default %s, got %s", ResumeTaskName, got)
+	}
+
+	path := writeConfigFile(t, `{"runner": {"resumeTaskName": "afl:resume:v2"}}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.ResumeTaskName != "afl:resume:v2" {
+		t.Errorf("Expected afl:resume:v2, got %s", cfg.ResumeTaskName)
+	}
+}
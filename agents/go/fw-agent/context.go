@@ -0,0 +1,140 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ContextParam is the params key under which processTask injects the
+// per-task context.Context. Use HandlerContext to retrieve it.
+const ContextParam = "_context"
+
+type taskContextKey struct{}
+
+type returnsWriterKey struct{}
+
+// ReturnsWriter persists individual returns on the task's step while the
+// handler is still running, so partial results are visible to the workflow
+// before completion. Each Write is a WriteStepReturns of one return.
+//
+// The handler's final result is written afterwards with the same $set
+// semantics: a name present in both overwrites the partial value, and
+// partial returns absent from the final result stay on the step. A Write
+// after the handler has returned is rejected.
+type ReturnsWriter interface {
+	Write(name string, value interface{}) error
+}
+
+// HandlerContext returns the context injected into a handler's params, or
+// context.Background() if none is present (e.g. when a handler is called
+// directly in a test).
+func HandlerContext(params map[string]interface{}) context.Context {
+	if ctx, ok := params[ContextParam].(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// TaskFromContext returns the task that is being processed. The returned
+// document is a copy: mutating it has no effect on the task in MongoDB or
+// on the poller.
+func TaskFromContext(ctx context.Context) (*TaskDocument, bool) {
+	task, ok := ctx.Value(taskContextKey{}).(*TaskDocument)
+	return task, ok
+}
+
+// ReturnsWriterFromContext returns the ReturnsWriter for the step being
+// processed.
+func ReturnsWriterFromContext(ctx context.Context) (ReturnsWriter, bool) {
+	w, ok := ctx.Value(returnsWriterKey{}).(ReturnsWriter)
+	return w, ok
+}
+
+// withReturnsWriter returns a child context carrying w.
+func withReturnsWriter(ctx context.Context, w ReturnsWriter) context.Context {
+	return context.WithValue(ctx, returnsWriterKey{}, w)
+}
+
+// detachedContext carries its parent's values but none of its
+// cancellation or deadline; see detachContext.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// detachContext returns a context for processing a claimed task: the end
+// of the poll loop's ctx must not cut a handler or its completion writes
+// short, so a drain can finish them. Only requeueing or an external cancel
+// cancels a task; see trackTask.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+// withTask returns a child context carrying a copy of task.
+func withTask(ctx context.Context, task *TaskDocument) context.Context {
+	taskCopy := *task
+	taskCopy.Data = copyMap(task.Data)
+	taskCopy.Error = copyMap(task.Error)
+	return context.WithValue(ctx, taskContextKey{}, &taskCopy)
+}
+
+// copyMap returns a shallow copy of m, preserving nil.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// errWriterClosed is returned by a ReturnsWriter used after its handler
+// returned.
+var errWriterClosed = errors.New("returns writer used after handler returned")
+
+// stepReturnsWriter is the ReturnsWriter injected by processTask.
+type stepReturnsWriter struct {
+	ops    taskStore
+	ctx    context.Context
+	stepID string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (w *stepReturnsWriter) Write(name string, value interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWriterClosed
+	}
+	return w.ops.WriteStepReturns(w.ctx, w.stepID, map[string]interface{}{name: value})
+}
+
+func (w *stepReturnsWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
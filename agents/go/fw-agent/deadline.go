@@ -0,0 +1,47 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"time"
+)
+
+// withinDeadline drops from names the facets that cannot finish before
+// ctx's deadline: all of them once less than Config.MinRemainingTime is
+// left, otherwise those whose Config.FacetEstimates entry exceeds the time
+// left. Without a deadline names is returned unchanged.
+func (p *AgentPoller) withinDeadline(ctx context.Context, names []string) []string {
+	deadline, ok := ctx.Deadline()
+	if !ok || len(names) == 0 {
+		return names
+	}
+	remaining := time.Until(deadline)
+	if remaining < p.cfg.MinRemainingTime || remaining <= 0 {
+		return nil
+	}
+	if len(p.cfg.FacetEstimates) == 0 {
+		return names
+	}
+
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		if estimate, ok := p.cfg.FacetEstimates[name]; ok && estimate > remaining {
+			continue
+		}
+		kept = append(kept, name)
+	}
+	return kept
+}
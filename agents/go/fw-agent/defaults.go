@@ -0,0 +1,112 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// RegisterWithDefaults registers a handler like Register, with params that
+// are filled in for every task of the facet whose step lacks them, such as
+// an endpoint URL or a timeout.
+//
+// The step's params win: a default only applies to a key the step does not
+// have, even if the step's value is null. Where both the step and the
+// defaults hold a document (a map[string]interface{} in defaults), the two
+// are merged key by key the same way, at any depth. Arrays are not merged.
+// defaults is copied, and each task gets its own copy of the defaults it
+// uses.
+func (p *AgentPoller) RegisterWithDefaults(facetName string, handler Handler, defaults map[string]interface{}) {
+	p.Register(facetName, handler)
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paramDefaults[facetName] = copyDefaultDoc(defaults)
+}
+
+// applyParamDefaults merges the defaults registered for facet into params.
+func (p *AgentPoller) applyParamDefaults(facet string, params map[string]interface{}) {
+	p.mu.RLock()
+	defaults := p.paramDefaults[facet]
+	p.mu.RUnlock()
+	mergeDefaults(params, defaults)
+}
+
+// mergeDefaults adds the defaults for keys doc lacks, and merges nested
+// documents present in both.
+func mergeDefaults(doc, defaults map[string]interface{}) {
+	for key, def := range defaults {
+		if value, ok := doc[key]; ok {
+			doc[key] = mergeDefaultValue(value, def)
+		} else {
+			doc[key] = copyDefault(def)
+		}
+	}
+}
+
+// mergeDefaultValue merges def into value when both are documents, and
+// otherwise returns value.
+func mergeDefaultValue(value, def interface{}) interface{} {
+	defDoc, ok := def.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	switch doc := value.(type) {
+	case map[string]interface{}:
+		mergeDefaults(doc, defDoc)
+	case primitive.M:
+		mergeDefaults(doc, defDoc)
+	case primitive.D:
+		// Keep the step's key order and append missing keys sorted
+		index := make(map[string]int, len(doc))
+		for i, e := range doc {
+			index[e.Key] = i
+		}
+		for _, key := range sortedKeys(defDoc) {
+			if i, ok := index[key]; ok {
+				doc[i].Value = mergeDefaultValue(doc[i].Value, defDoc[key])
+			} else {
+				doc = append(doc, primitive.E{Key: key, Value: copyDefault(defDoc[key])})
+			}
+		}
+		return doc
+	}
+	return value
+}
+
+// copyDefault deep-copies the documents and arrays of a default value so
+// that a handler modifying its params cannot change the defaults.
+func copyDefault(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyDefaultDoc(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = copyDefault(e)
+		}
+		return out
+	}
+	return v
+}
+
+func copyDefaultDoc(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = copyDefault(v)
+	}
+	return out
+}
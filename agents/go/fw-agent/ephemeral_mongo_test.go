@@ -0,0 +1,186 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ephemeralMongo is a throwaway MongoDB shared by the integration tests,
+// started on first use and stopped by TestMain.
+type ephemeralMongo struct {
+	url  string
+	stop func()
+}
+
+var (
+	ephemeralOnce sync.Once
+	ephemeral     *ephemeralMongo
+	ephemeralErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if ephemeral != nil {
+		ephemeral.stop()
+	}
+	os.Exit(code)
+}
+
+// testMongoURL returns the MongoDB the integration tests run against:
+// AFL_TEST_MONGODB_URL if set, otherwise an ephemeral server. That is a
+// mongod from AFL_TEST_MONGOD or the PATH, run on a free port with a
+// temporary dbpath, or failing that a container of AFL_TEST_MONGO_IMAGE
+// (mongo:7) run through docker.
+func testMongoURL(t *testing.T) string {
+	t.Helper()
+	if url := os.Getenv("AFL_TEST_MONGODB_URL"); url != "" {
+		return url
+	}
+	ephemeralOnce.Do(func() {
+		ephemeral, ephemeralErr = startMongod()
+		if errors.Is(ephemeralErr, exec.ErrNotFound) {
+			ephemeral, ephemeralErr = startMongoContainer()
+		}
+	})
+	if ephemeralErr != nil {
+		t.Fatalf("no MongoDB for integration tests (set AFL_TEST_MONGODB_URL, or put mongod or docker on the PATH): %v", ephemeralErr)
+	}
+	return ephemeral.url
+}
+
+// startMongod runs a standalone mongod on a free local port.
+func startMongod() (*ephemeralMongo, error) {
+	path := os.Getenv("AFL_TEST_MONGOD")
+	if path == "" {
+		var err error
+		if path, err = exec.LookPath("mongod"); err != nil {
+			return nil, err
+		}
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "afl-mongod")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, "--dbpath", dir, "--port", fmt.Sprint(port), "--bind_ip", "127.0.0.1", "--quiet")
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	url := fmt.Sprintf("mongodb://127.0.0.1:%d", port)
+	if err := waitForMongo(url, 30*time.Second); err != nil {
+		stop()
+		return nil, fmt.Errorf("mongod: %w", err)
+	}
+	return &ephemeralMongo{url: url, stop: stop}, nil
+}
+
+// startMongoContainer runs a MongoDB container with its port published on
+// a free local port.
+func startMongoContainer() (*ephemeralMongo, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, err
+	}
+	image := os.Getenv("AFL_TEST_MONGO_IMAGE")
+	if image == "" {
+		image = "mongo:7"
+	}
+
+	out, err := exec.Command(docker, "run", "-d", "--rm", "-p", "127.0.0.1::27017", image).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker run %s: %w", image, err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() {
+		exec.Command(docker, "rm", "-f", id).Run()
+	}
+
+	out, err = exec.Command(docker, "port", id, "27017/tcp").Output()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("docker port: %w", err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+
+	url := "mongodb://" + addr
+	if err := waitForMongo(url, time.Minute); err != nil {
+		stop()
+		return nil, fmt.Errorf("container %s: %w", image, err)
+	}
+	return &ephemeralMongo{url: url, stop: stop}, nil
+}
+
+// freePort returns a local TCP port that was free a moment ago.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitForMongo pings url until it answers or timeout passes.
+func waitForMongo(url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	for {
+		err = client.Ping(ctx, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %v: %w", timeout, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
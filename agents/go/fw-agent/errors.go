@@ -0,0 +1,113 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "errors"
+
+// Error types recorded in ErrorInfo.Type.
+const (
+	// ErrorTypeError is an unclassified handler error.
+	ErrorTypeError = "error"
+
+	// ErrorTypePermanent is a handler error wrapped with Permanent.
+	ErrorTypePermanent = "permanent"
+
+	// ErrorTypeRetriable is a handler error wrapped with Retriable.
+	ErrorTypeRetriable = "retriable"
+
+	// ErrorTypePanic is a recovered handler panic.
+	ErrorTypePanic = "panic"
+
+	// ErrorTypeFramework is a failure raised by the agent rather than the
+	// handler, e.g. no handler registered or unreadable params.
+	ErrorTypeFramework = "framework"
+)
+
+// ErrorInfo is the structured error written to a failed task's error
+// field. Message is always present, so readers of the old {message} shape
+// keep working.
+type ErrorInfo struct {
+	Message   string `bson:"message"`
+	Type      string `bson:"type"`
+	Retriable bool   `bson:"retriable"`
+	Attempts  int    `bson:"attempts"`
+	Timestamp int64  `bson:"timestamp"`
+	Stack     string `bson:"stack,omitempty"`
+}
+
+// PermanentError marks a handler error that will not succeed on retry.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the wrapped error.
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// RetriableError marks a handler error that may succeed on retry, e.g. a
+// downstream outage.
+type RetriableError struct {
+	Err error
+}
+
+func (e *RetriableError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the wrapped error.
+func (e *RetriableError) Unwrap() error { return e.Err }
+
+// Permanent wraps err as a *PermanentError.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Retriable wraps err as a *RetriableError.
+func Retriable(err error) error {
+	return &RetriableError{Err: err}
+}
+
+// newErrorInfo describes a handler error for task. A nil err describes a
+// framework failure with message msg.
+func newErrorInfo(task *TaskDocument, err error, msg string) ErrorInfo {
+	info := ErrorInfo{
+		Message:   msg,
+		Type:      ErrorTypeFramework,
+		Attempts:  task.Attempts,
+		Timestamp: NowMillis(),
+	}
+	if err == nil {
+		return info
+	}
+
+	info.Message = err.Error()
+	var (
+		perr *PanicError
+		rerr *RetriableError
+		serr *PermanentError
+	)
+	switch {
+	case errors.As(err, &perr):
+		info.Type = ErrorTypePanic
+		info.Stack = perr.Stack
+	case errors.As(err, &rerr):
+		info.Type = ErrorTypeRetriable
+		info.Retriable = true
+	case errors.As(err, &serr):
+		info.Type = ErrorTypePermanent
+	default:
+		info.Type = ErrorTypeError
+	}
+	return info
+}
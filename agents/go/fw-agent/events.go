@@ -0,0 +1,133 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of AgentEvent.
+const (
+	EventClaimed   = "claimed"
+	EventReleased  = "released"
+	EventSkipped   = "skipped"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventIgnored   = "ignored"
+	EventCanceled  = "canceled"
+	EventRequeued  = "requeued"
+	EventRetried   = "retried"
+
+	// EventCompletionFailed means the task's work was done (returns written,
+	// resume inserted) but it could not be marked completed.
+	EventCompletionFailed = "completion_failed"
+
+	// EventResumePending means the task's returns were written but its
+	// resume task could not be inserted.
+	EventResumePending = "resume_pending"
+)
+
+// AgentEvent is one decision the poller made about a task.
+type AgentEvent struct {
+	Time       time.Time
+	Kind       string
+	TaskID     string
+	StepID     string
+	WorkflowID string
+	Facet      string
+
+	// Reason explains releases, skips and failures; empty otherwise.
+	Reason string
+}
+
+// eventRing is a fixed-size, thread-safe buffer of the most recent events.
+type eventRing struct {
+	mu     sync.Mutex
+	events []AgentEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		return nil
+	}
+	return &eventRing{events: make([]AgentEvent, size)}
+}
+
+func (r *eventRing) add(e AgentEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to n of the most recent events, oldest first.
+func (r *eventRing) last(n int) []AgentEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := r.next
+	if r.full {
+		size = len(r.events)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+
+	out := make([]AgentEvent, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.events)
+	}
+	for i := range out {
+		out[i] = r.events[(start+i)%len(r.events)]
+	}
+	return out
+}
+
+// RecentEvents returns up to n of the poller's most recent decisions, oldest
+// first; n <= 0 returns everything buffered. It returns nil unless
+// Config.EventBufferSize is positive.
+func (p *AgentPoller) RecentEvents(n int) []AgentEvent {
+	if p.events == nil {
+		return nil
+	}
+	return p.events.last(n)
+}
+
+// recordEvent appends a decision about task to the event buffer, if
+// enabled, and to the audit trail.
+func (p *AgentPoller) recordEvent(kind string, task *TaskDocument, reason string) {
+	// Metrics counts every decision, even with the ring disabled
+	p.counters.count(kind)
+	p.audit(kind, task, reason)
+	if p.events == nil {
+		return
+	}
+	p.events.add(AgentEvent{
+		Time:       time.Now(),
+		Kind:       kind,
+		TaskID:     task.UUID,
+		StepID:     task.StepID,
+		WorkflowID: task.WorkflowID,
+		Facet:      task.Name,
+		Reason:     reason,
+	})
+}
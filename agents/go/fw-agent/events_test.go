@@ -0,0 +1,101 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecentEventsInOrder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EventBufferSize = 16
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	poller.Register("ns.Ok", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	poller.Register("ns.Bad", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("boom")
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addStep("step-2", map[string]interface{}{})
+	ctx := context.Background()
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Ok", StepID: "step-1", TaskListName: "default"})
+	if err := poller.PollOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Bad", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	events := poller.RecentEvents(0)
+	want := []struct{ kind, task string }{
+		{EventClaimed, "task-1"},
+		{EventCompleted, "task-1"},
+		{EventClaimed, "task-2"},
+		{EventFailed, "task-2"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Kind != w.kind || events[i].TaskID != w.task {
+			t.Errorf("event %d: expected %s %s, got %s %s", i, w.kind, w.task, events[i].Kind, events[i].TaskID)
+		}
+		if i > 0 && events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("event %d is older than its predecessor", i)
+		}
+	}
+	if events[3].Reason != "boom" || events[3].Facet != "ns.Bad" {
+		t.Errorf("Expected failure reason and facet, got %+v", events[3])
+	}
+
+	if last := poller.RecentEvents(1); len(last) != 1 || last[0].Kind != EventFailed {
+		t.Errorf("Expected the most recent event only, got %+v", last)
+	}
+}
+
+func TestRecentEventsRingWraps(t *testing.T) {
+	r := newEventRing(3)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		r.add(AgentEvent{TaskID: id})
+	}
+
+	got := r.last(0)
+	if len(got) != 3 || got[0].TaskID != "c" || got[1].TaskID != "d" || got[2].TaskID != "e" {
+		t.Errorf("Expected [c d e], got %+v", got)
+	}
+	if got := r.last(2); len(got) != 2 || got[0].TaskID != "d" || got[1].TaskID != "e" {
+		t.Errorf("Expected [d e], got %+v", got)
+	}
+}
+
+func TestRecentEventsDisabledByDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Ok", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	runSingle(t, poller, store, "ns.Ok")
+
+	if events := poller.RecentEvents(10); events != nil {
+		t.Errorf("Expected no events when the buffer is disabled, got %+v", events)
+	}
+}
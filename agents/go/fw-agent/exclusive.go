@@ -0,0 +1,55 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "sync/atomic"
+
+// ExclusiveKey is the reserved task data key asking for a task to run by
+// itself on its agent. A task whose data holds ExclusiveKey: true starts
+// only once every other task in flight on the agent has finished, and the
+// agent claims nothing more until it is done. Other agents are unaffected.
+//
+// Tasks claimed just before an exclusive task was dispatched wait for it
+// to finish before starting. An exclusive task holds nothing the tasks it
+// waits for need, so it cannot deadlock, but a handler that never returns
+// keeps it waiting as it would keep Stop waiting.
+const ExclusiveKey = "_exclusive"
+
+// isExclusive reports whether task asks to run alone; see ExclusiveKey.
+func isExclusive(task *TaskDocument) bool {
+	exclusive, _ := task.Data[ExclusiveKey].(bool)
+	return exclusive
+}
+
+// enterExclusive blocks until task may run, alongside others or, for an
+// exclusive task, alone, and returns the func that ends its turn.
+func (p *AgentPoller) enterExclusive(task *TaskDocument) (leave func()) {
+	if !isExclusive(task) {
+		p.exclusive.RLock()
+		return p.exclusive.RUnlock
+	}
+	atomic.AddInt32(&p.exclusiveWaiting, 1)
+	p.exclusive.Lock()
+	return func() {
+		p.exclusive.Unlock()
+		atomic.AddInt32(&p.exclusiveWaiting, -1)
+	}
+}
+
+// exclusivePending reports whether an exclusive task is waiting or
+// running, during which nothing is claimed.
+func (p *AgentPoller) exclusivePending() bool {
+	return atomic.LoadInt32(&p.exclusiveWaiting) > 0
+}
@@ -0,0 +1,65 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// standingBy reports whether the agent must not claim because it is a
+// standby (Config.FailoverForGroup) for a group that is still alive. A
+// failed liveness check also keeps it standing by.
+func (p *AgentPoller) standingBy(ctx context.Context) bool {
+	group := p.cfg.FailoverForGroup
+	if group == "" {
+		return false
+	}
+	monitor, ok := p.registration.(groupMonitor)
+	if !ok {
+		return false
+	}
+
+	alive, err := monitor.GroupAlive(ctx, group, p.serverID, p.failoverStaleAfter())
+	if err != nil {
+		log.Printf("Failed to check server group %s: %v", group, err)
+		return true
+	}
+	active := int32(0)
+	if !alive {
+		active = 1
+	}
+	if atomic.SwapInt32(&p.failoverActive, active) != active {
+		if alive {
+			log.Printf("Server group %s is alive again, standing by", group)
+		} else {
+			log.Printf("Server group %s is stale, taking over its tasks", group)
+		}
+	}
+	return alive
+}
+
+// failoverStaleAfter returns the ping age at which a standby takes over.
+func (p *AgentPoller) failoverStaleAfter() time.Duration {
+	if p.cfg.FailoverStaleAfter > 0 {
+		return p.cfg.FailoverStaleAfter
+	}
+	if p.cfg.ServerStaleAfter > 0 {
+		return p.cfg.ServerStaleAfter
+	}
+	return 3 * p.baseHeartbeatInterval()
+}
@@ -0,0 +1,160 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FieldMap renames top-level fields of task and step documents for schemas
+// that differ from the standard one, mapping the canonical name (the bson
+// tag on TaskDocument or StepDocument, e.g. "state", "uuid", "attributes")
+// to the name stored in MongoDB, e.g. {"state": "status", "uuid": "id"}.
+//
+// Only the first segment of a dotted path is mapped, so mapping
+// "attributes" also moves "attributes.params.x". Fields nested below the
+// top level keep their canonical names. Locks, step logs and server
+// documents are never remapped.
+type FieldMap map[string]string
+
+// path maps the first segment of a canonical field path.
+func (m *MongoOps) path(p string) string {
+	if len(m.FieldMap) == 0 {
+		return p
+	}
+	head, rest := p, ""
+	if i := strings.IndexByte(p, '.'); i >= 0 {
+		head, rest = p[:i], p[i:]
+	}
+	if mapped, ok := m.FieldMap[head]; ok {
+		return mapped + rest
+	}
+	return p
+}
+
+// mapDoc returns a filter, update or projection with its field paths
+// mapped. Operator keys such as "$set" are kept and their documents mapped
+// in turn; the values of field keys are left untouched.
+func (m *MongoOps) mapDoc(doc bson.M) bson.M {
+	if len(m.FieldMap) == 0 {
+		return doc
+	}
+	out := make(bson.M, len(doc))
+	for k, v := range doc {
+		if strings.HasPrefix(k, "$") {
+			if inner, ok := v.(bson.M); ok {
+				v = m.mapDoc(inner)
+			}
+			out[k] = v
+			continue
+		}
+		out[m.path(k)] = v
+	}
+	return out
+}
+
+// decode decodes a single result into out, renaming mapped fields back to
+// their canonical names and converting timestamps to milliseconds first.
+func (m *MongoOps) decode(res *mongo.SingleResult, out interface{}) error {
+	if len(m.FieldMap) == 0 && m.storesMillis() {
+		return res.Decode(out)
+	}
+	raw, err := res.Raw()
+	if err != nil {
+		return err
+	}
+	return m.decodeRaw(raw, out)
+}
+
+// decodeRaw decodes a raw document, such as a cursor's current one, into
+// out, renaming mapped fields back to their canonical names and converting
+// timestamps to milliseconds first.
+func (m *MongoOps) decodeRaw(raw bson.Raw, out interface{}) error {
+	var (
+		data = []byte(raw)
+		err  error
+	)
+	if len(m.FieldMap) > 0 {
+		reverse := make(map[string]string, len(m.FieldMap))
+		for canonical, mapped := range m.FieldMap {
+			reverse[mapped] = canonical
+		}
+		if data, err = m.renameFields(data, reverse); err != nil {
+			return err
+		}
+	}
+	if !m.storesMillis() {
+		if data, err = m.convertTimestamps(data, false); err != nil {
+			return err
+		}
+	}
+	if m.Registry != nil {
+		return bson.UnmarshalWithRegistry(m.Registry, data, out)
+	}
+	return bson.Unmarshal(data, out)
+}
+
+// encode marshals doc for insertion with its timestamps converted to the
+// stored unit and its canonical fields renamed.
+func (m *MongoOps) encode(doc interface{}) (interface{}, error) {
+	if len(m.FieldMap) == 0 && m.storesMillis() {
+		return doc, nil
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if m.Registry != nil {
+		data, err = bson.MarshalWithRegistry(m.Registry, doc)
+	} else {
+		data, err = bson.Marshal(doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !m.storesMillis() {
+		if data, err = m.convertTimestamps(data, true); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.FieldMap) == 0 {
+		return bson.Raw(data), nil
+	}
+	renamed, err := m.renameFields(data, m.FieldMap)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(renamed), nil
+}
+
+// renameFields re-encodes a document with its top-level keys renamed.
+func (m *MongoOps) renameFields(raw bson.Raw, names map[string]string) ([]byte, error) {
+	elems, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	renamed := make(bson.D, 0, len(elems))
+	for _, e := range elems {
+		key := e.Key()
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		renamed = append(renamed, bson.E{Key: key, Value: e.Value()})
+	}
+	return bson.Marshal(renamed)
+}
@@ -0,0 +1,144 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FullPoolPolicy is what the poll loop does when all MaxConcurrent slots
+// are busy.
+type FullPoolPolicy string
+
+const (
+	// FullPoolDrop claims regardless and, if no slot is free for the
+	// claimed task, releases it back to pending for the next cycle or
+	// another agent. It is the default.
+	FullPoolDrop FullPoolPolicy = "drop"
+
+	// FullPoolBlock keeps the claimed task and waits up to
+	// Config.FullPoolWait for a slot before releasing it, favoring the
+	// latency of tasks already claimed over spreading work across agents.
+	FullPoolBlock FullPoolPolicy = "block"
+
+	// FullPoolSkipClaim claims nothing while the pool is full, leaving
+	// pending tasks to agents with capacity.
+	FullPoolSkipClaim FullPoolPolicy = "skip-claim"
+)
+
+// slotPool bounds the number of concurrent handlers. Unlike a buffered
+// channel its limit can change while slots are taken; see ReloadConfig.
+type slotPool struct {
+	mu    sync.Mutex
+	used  int
+	limit int
+
+	// freed is signaled, without blocking, whenever a slot may have
+	// become free.
+	freed chan struct{}
+}
+
+func newSlotPool(limit int) *slotPool {
+	return &slotPool{limit: limit, freed: make(chan struct{}, 1)}
+}
+
+// tryAcquire takes a slot if one is free.
+func (s *slotPool) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used >= s.limit {
+		return false
+	}
+	s.used++
+	return true
+}
+
+// take takes a slot whether or not one is free.
+func (s *slotPool) take() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used++
+}
+
+// release gives back a slot taken with tryAcquire or take.
+func (s *slotPool) release() {
+	s.mu.Lock()
+	s.used--
+	s.mu.Unlock()
+	s.signal()
+}
+
+// setLimit changes the limit. Slots taken above a lowered limit stay
+// taken until released.
+func (s *slotPool) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+	s.signal()
+}
+
+// usage returns the slots taken and the limit.
+func (s *slotPool) usage() (used, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used, s.limit
+}
+
+func (s *slotPool) signal() {
+	select {
+	case s.freed <- struct{}{}:
+	default:
+	}
+}
+
+// poolFull reports whether every MaxConcurrent slot is taken.
+func (p *AgentPoller) poolFull() bool {
+	used, limit := p.slots.usage()
+	return used >= limit
+}
+
+// acquireSlot takes a MaxConcurrent slot for a claimed task according to
+// Config.FullPoolPolicy, reporting whether it got one.
+func (p *AgentPoller) acquireSlot(ctx context.Context) bool {
+	if p.slots.tryAcquire() {
+		return true
+	}
+	if p.cfg.FullPoolPolicy != FullPoolBlock {
+		return false
+	}
+
+	wait := p.cfg.FullPoolWait
+	if wait <= 0 {
+		wait = p.pollInterval()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.slots.freed:
+			if p.slots.tryAcquire() {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-p.stopCh:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "sort"
+
+// ReloadHandlers swaps in a new generation of handlers for plugin-style
+// agents that reload their business logic. handlers replaces every plain
+// registration, as if each were registered with Register; names it lacks
+// are unregistered. Routes and the RegisterDefault handler are kept.
+//
+// Tasks dispatched before the reload keep running the handler of the
+// generation they started with, while new claims use the new one. Once the
+// last task of an older generation finishes, the generation is retired and
+// the func set with SetGenerationRetiredFunc is called, after which its code
+// may be unloaded. ReloadHandlers returns the new generation.
+func (p *AgentPoller) ReloadHandlers(handlers map[string]Handler) uint64 {
+	qualified := make(map[string]Handler, len(handlers))
+	for name, handler := range handlers {
+		qualified[p.qualify(name)] = handler
+	}
+
+	p.mu.Lock()
+	for name := range p.handlers {
+		if _, ok := qualified[name]; !ok {
+			delete(p.handlers, name)
+			delete(p.terminal, name)
+			delete(p.priority, name)
+			delete(p.meta, name)
+			delete(p.paramDefaults, name)
+		}
+	}
+	for name, handler := range qualified {
+		p.handlers[name] = handler
+		delete(p.terminal, name)
+		delete(p.priority, name)
+		delete(p.meta, name)
+		delete(p.paramDefaults, name)
+	}
+	old := p.generation
+	p.generation++
+	current := p.generation
+	var retired func(generation uint64)
+	if p.genInFlight[old] == 0 {
+		retired = p.generationRetired
+	}
+	p.handlersChanged()
+	p.mu.Unlock()
+
+	if retired != nil {
+		retired(old)
+	}
+	return current
+}
+
+// SetGenerationRetiredFunc sets a func called with each handler generation
+// replaced by ReloadHandlers once no task is running its handlers any more.
+// It is called at most once per generation, outside any poller lock.
+func (p *AgentPoller) SetGenerationRetiredFunc(fn func(generation uint64)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generationRetired = fn
+}
+
+// HandlerGeneration returns the current handler generation: zero until the
+// first ReloadHandlers, which increments it.
+func (p *AgentPoller) HandlerGeneration() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.generation
+}
+
+// LiveGenerations returns, in ascending order, the current handler
+// generation and every older one that still has tasks in flight.
+func (p *AgentPoller) LiveGenerations() []uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	live := []uint64{p.generation}
+	for generation := range p.genInFlight {
+		if generation != p.generation {
+			live = append(live, generation)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+	return live
+}
+
+// acquireHandler resolves the handler for task as resolveHandler does and
+// pins the current generation until release is called, so a reload cannot
+// retire it while the task runs. release must be called exactly once.
+func (p *AgentPoller) acquireHandler(task *TaskDocument) (facet string, handler Handler, release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	facet, handler = p.resolveHandlerLocked(task)
+	if handler == nil {
+		return facet, nil, func() {}
+	}
+	generation := p.generation
+	p.genInFlight[generation]++
+	return facet, handler, func() { p.releaseGeneration(generation) }
+}
+
+// releaseGeneration unpins generation, retiring it if it was replaced and
+// this was its last task.
+func (p *AgentPoller) releaseGeneration(generation uint64) {
+	p.mu.Lock()
+	p.genInFlight[generation]--
+	var retired func(generation uint64)
+	if p.genInFlight[generation] <= 0 {
+		delete(p.genInFlight, generation)
+		if generation != p.generation {
+			retired = p.generationRetired
+		}
+	}
+	p.mu.Unlock()
+
+	if retired != nil {
+		retired(generation)
+	}
+}
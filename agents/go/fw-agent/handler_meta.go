@@ -0,0 +1,116 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// HandlerMeta describes a handler for discovery tools. It is published in
+// the servers document's handlers list; see RegisterWithMeta.
+type HandlerMeta struct {
+	Description string `bson:"description,omitempty"`
+	Version     string `bson:"version,omitempty"`
+
+	// Params and Returns summarize the handler's inputs and outputs as
+	// attribute name to type, e.g. {"address": "String"}.
+	Params  map[string]string `bson:"params,omitempty"`
+	Returns map[string]string `bson:"returns,omitempty"`
+}
+
+// HandlerEntry is one element of ServerDocument.Handlers. A handler
+// without metadata is stored as a bare name string, as it always has been;
+// one with metadata as a {name, description, ...} document.
+type HandlerEntry struct {
+	Name string
+	Meta *HandlerMeta
+}
+
+// handlerEntryDoc is the document form of a HandlerEntry.
+type handlerEntryDoc struct {
+	Name        string `bson:"name"`
+	HandlerMeta `bson:",inline"`
+}
+
+// MarshalBSONValue writes the entry as a string or a document.
+func (e HandlerEntry) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if e.Meta == nil {
+		return bsontype.String, bsoncore.AppendString(nil, e.Name), nil
+	}
+	data, err := bson.Marshal(handlerEntryDoc{Name: e.Name, HandlerMeta: *e.Meta})
+	return bsontype.EmbeddedDocument, data, err
+}
+
+// UnmarshalBSONValue reads either form written by MarshalBSONValue.
+func (e *HandlerEntry) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bsontype.String:
+		name, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return fmt.Errorf("invalid handler name")
+		}
+		*e = HandlerEntry{Name: name}
+		return nil
+	case bsontype.EmbeddedDocument:
+		var doc handlerEntryDoc
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		*e = HandlerEntry{Name: doc.Name, Meta: &doc.HandlerMeta}
+		return nil
+	}
+	return fmt.Errorf("cannot decode %v into a handler entry", t)
+}
+
+// RegisterWithMeta registers a handler like Register and publishes meta
+// for it in the servers document on the next registration.
+func (p *AgentPoller) RegisterWithMeta(facetName string, handler Handler, meta HandlerMeta) {
+	p.Register(facetName, handler)
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta[facetName] = meta
+	p.handlersChanged()
+}
+
+// handlerMeta returns the metadata registered for name, if any.
+func (p *AgentPoller) handlerMeta(name string) (HandlerMeta, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	meta, ok := p.meta[name]
+	return meta, ok
+}
+
+// handlerEntries pairs handler names with their metadata, if any.
+func handlerEntries(names []string, lookup func(string) (HandlerMeta, bool)) []HandlerEntry {
+	if names == nil {
+		return nil
+	}
+	entries := make([]HandlerEntry, len(names))
+	for i, name := range names {
+		entries[i].Name = name
+		if lookup == nil {
+			continue
+		}
+		if meta, ok := lookup(name); ok {
+			entries[i].Meta = &meta
+		}
+	}
+	return entries
+}
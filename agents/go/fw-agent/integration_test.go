@@ -0,0 +1,472 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Integration tests run the poller against a real MongoDB:
+//
+//	go test -tags integration ./...
+//
+// starts an ephemeral server (see testMongoURL), unless
+// AFL_TEST_MONGODB_URL points at one. Each test uses its own throwaway
+// database.
+
+// integrationEnv is a scratch database plus a poller configured for it.
+type integrationEnv struct {
+	url    string
+	db     *mongo.Database
+	poller *AgentPoller
+}
+
+func newIntegrationEnv(t *testing.T) *integrationEnv {
+	t.Helper()
+	url := testMongoURL(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("ping %s: %v", url, err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MongoURL = url
+	cfg.Database = "afl_it_" + strings.Replace(uuid.New().String()[:8], "-", "", -1)
+	db := client.Database(cfg.Database)
+	poller := NewAgentPoller(cfg)
+
+	t.Cleanup(func() {
+		ctx := context.Background()
+		poller.Close(ctx)
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return &integrationEnv{url: url, db: db, poller: poller}
+}
+
+// seedStep inserts a step in state with the given param values.
+func (e *integrationEnv) seedStep(t *testing.T, stepID, state string, params map[string]interface{}) {
+	t.Helper()
+	attrs := bson.M{}
+	for name, value := range params {
+		attrs[name] = bson.M{"name": name, "value": value}
+	}
+	step := bson.M{
+		"uuid":        stepID,
+		"workflow_id": "wf-1",
+		"state":       state,
+		"attributes":  bson.M{"params": attrs},
+	}
+	if _, err := e.db.Collection(CollectionSteps).InsertOne(context.Background(), step); err != nil {
+		t.Fatalf("seed step: %v", err)
+	}
+}
+
+// seedTask inserts a task for facet on the default task list.
+func (e *integrationEnv) seedTask(t *testing.T, taskID, facet, stepID, state string, updated int64) {
+	t.Helper()
+	task := TaskDocument{
+		UUID:         taskID,
+		Name:         facet,
+		WorkflowID:   "wf-1",
+		StepID:       stepID,
+		State:        state,
+		Created:      updated,
+		Updated:      updated,
+		TaskListName: "default",
+	}
+	if _, err := e.db.Collection(CollectionTasks).InsertOne(context.Background(), task); err != nil {
+		t.Fatalf("seed task: %v", err)
+	}
+}
+
+func (e *integrationEnv) task(t *testing.T, filter bson.M) TaskDocument {
+	t.Helper()
+	var task TaskDocument
+	if err := e.db.Collection(CollectionTasks).FindOne(context.Background(), filter).Decode(&task); err != nil {
+		t.Fatalf("find task %v: %v", filter, err)
+	}
+	return task
+}
+
+func (e *integrationEnv) step(t *testing.T, stepID string) StepDocument {
+	t.Helper()
+	var step StepDocument
+	if err := e.db.Collection(CollectionSteps).FindOne(context.Background(), bson.M{"uuid": stepID}).Decode(&step); err != nil {
+		t.Fatalf("find step %s: %v", stepID, err)
+	}
+	return step
+}
+
+func (e *integrationEnv) pollOnce(t *testing.T) {
+	t.Helper()
+	if err := e.poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+}
+
+func doubleHandler(params map[string]interface{}) (map[string]interface{}, error) {
+	var n int64
+	switch v := params["n"].(type) {
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case float64:
+		n = int64(v)
+	}
+	return map[string]interface{}{"doubled": n * 2}, nil
+}
+
+func TestIntegrationHappyPath(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	env.seedStep(t, "step-1", StepStateEventTransmit, map[string]interface{}{"n": int32(21)})
+	env.seedTask(t, "task-1", "ns.Double", "step-1", TaskStatePending, NowMillis())
+
+	env.pollOnce(t)
+
+	task := env.task(t, bson.M{"uuid": "task-1"})
+	if task.State != TaskStateCompleted {
+		t.Fatalf("Expected task completed, got %s", task.State)
+	}
+	if task.Attempts != 1 {
+		t.Errorf("Expected one claim attempt, got %d", task.Attempts)
+	}
+	step := env.step(t, "step-1")
+	if got := step.Attributes.Returns["doubled"].Value; got != int64(42) {
+		t.Errorf("Expected returns.doubled 42, got %v (%T)", got, got)
+	}
+
+	resume := env.task(t, bson.M{"step_id": "step-1", "name": ResumeTaskName + ":ns.Double"})
+	if resume.State != TaskStatePending || resume.TaskListName != "default" || resume.WorkflowID != "wf-1" {
+		t.Errorf("Unexpected resume task %+v", resume)
+	}
+
+	// The resume task is for the Python runner and is never claimed here
+	env.pollOnce(t)
+	if got := env.task(t, bson.M{"uuid": resume.UUID}).State; got != TaskStatePending {
+		t.Errorf("Expected resume task left pending, got %s", got)
+	}
+}
+
+func TestIntegrationNoHandler(t *testing.T) {
+	env := newIntegrationEnv(t)
+	// Claimable through the routed facet, but no route matches the task's
+	// data and there is no default handler
+	env.poller.RegisterRouted("ns.Route", "region", "eu", doubleHandler)
+	env.seedStep(t, "step-1", StepStateEventTransmit, nil)
+	env.seedTask(t, "task-1", "ns.Route", "step-1", TaskStatePending, NowMillis())
+	if _, err := env.db.Collection(CollectionTasks).UpdateOne(context.Background(),
+		bson.M{"uuid": "task-1"}, bson.M{"$set": bson.M{"data": bson.M{"region": "us"}}}); err != nil {
+		t.Fatalf("set data: %v", err)
+	}
+
+	env.pollOnce(t)
+
+	task := env.task(t, bson.M{"uuid": "task-1"})
+	if task.State != TaskStateFailed {
+		t.Fatalf("Expected task failed, got %s", task.State)
+	}
+	if task.Error["type"] != ErrorTypeFramework || task.Error["message"] != "no handler registered" {
+		t.Errorf("Unexpected error %v", task.Error)
+	}
+	if n, _ := env.db.Collection(CollectionTasks).CountDocuments(context.Background(), bson.M{"step_id": "step-1"}); n != 1 {
+		t.Errorf("Expected no resume task, found %d tasks for the step", n)
+	}
+}
+
+func TestIntegrationWrongStepState(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	env.seedStep(t, "step-1", StepStateCompleted, map[string]interface{}{"n": int32(1)})
+	env.seedTask(t, "task-1", "ns.Double", "step-1", TaskStatePending, NowMillis())
+
+	env.pollOnce(t)
+
+	// Writes are filtered on EVENT_TRANSMIT: a step that has moved on
+	// keeps its state and gains no returns.
+	step := env.step(t, "step-1")
+	if step.State != StepStateCompleted {
+		t.Errorf("Expected step state untouched, got %s", step.State)
+	}
+	if len(step.Attributes.Returns) != 0 {
+		t.Errorf("Expected no returns written, got %v", step.Attributes.Returns)
+	}
+}
+
+func TestIntegrationReclaim(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	env.seedStep(t, "step-1", StepStateEventTransmit, map[string]interface{}{"n": int32(2)})
+	env.seedTask(t, "task-1", "ns.Double", "step-1", TaskStateRunning, NowMillis()-time.Hour.Milliseconds())
+
+	ops := NewMongoOps(env.db)
+	n, err := ops.ReclaimStaleTasks(context.Background(), []string{"ns.Double"}, "default", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("ReclaimStaleTasks: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected one task reclaimed, got %d", n)
+	}
+
+	env.pollOnce(t)
+
+	if got := env.task(t, bson.M{"uuid": "task-1"}).State; got != TaskStateCompleted {
+		t.Errorf("Expected reclaimed task completed, got %s", got)
+	}
+	if got := env.step(t, "step-1").Attributes.Returns["doubled"].Value; got != int64(4) {
+		t.Errorf("Expected returns.doubled 4, got %v", got)
+	}
+}
+
+func TestIntegrationUseServerTime(t *testing.T) {
+	env := newIntegrationEnv(t)
+	ops := NewMongoOps(env.db)
+	ops.UseServerTime = true
+	if err := ops.SyncServerTime(context.Background()); err != nil {
+		t.Fatalf("SyncServerTime: %v", err)
+	}
+	// Pretend the local clock runs an hour behind the server
+	ops.clockOffset += time.Hour.Milliseconds()
+	skewed := ops.nowMillis()
+	ops.clockOffset -= time.Hour.Milliseconds()
+
+	var reply struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	if err := env.db.RunCommand(context.Background(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply); err != nil {
+		t.Fatalf("isMaster: %v", err)
+	}
+	if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", "ns.F"); err != nil {
+		t.Fatalf("InsertResumeTask: %v", err)
+	}
+
+	created := env.task(t, bson.M{"step_id": "step-1"}).Created
+	server := reply.LocalTime.UnixNano() / int64(time.Millisecond)
+	if d := created - server; d < -2000 || d > 2000 {
+		t.Errorf("Expected created %d near server time %d", created, server)
+	}
+	if skewed-created < time.Hour.Milliseconds()-2000 {
+		t.Errorf("Expected the offset to drive created, got %d vs skewed %d", created, skewed)
+	}
+}
+
+func TestIntegrationClaimFilterFunc(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	open := "step-a"
+	env.poller.SetClaimFilterFunc(func(base bson.M) bson.M {
+		base["step_id"] = open
+		return base
+	})
+	for _, stepID := range []string{"step-a", "step-b"} {
+		env.seedStep(t, stepID, StepStateEventTransmit, map[string]interface{}{"n": int32(1)})
+		env.seedTask(t, "task-"+stepID, "ns.Double", stepID, TaskStatePending, NowMillis())
+	}
+
+	env.pollOnce(t)
+	if got := env.task(t, bson.M{"uuid": "task-step-b"}).State; got != TaskStatePending {
+		t.Fatalf("Expected task-step-b held back, got %s", got)
+	}
+	if got := env.task(t, bson.M{"uuid": "task-step-a"}).State; got != TaskStateCompleted {
+		t.Fatalf("Expected task-step-a completed, got %s", got)
+	}
+
+	open = "step-b"
+	env.pollOnce(t)
+	if got := env.task(t, bson.M{"uuid": "task-step-b"}).State; got != TaskStateCompleted {
+		t.Errorf("Expected task-step-b completed once the filter changed, got %s", got)
+	}
+}
+
+func TestIntegrationClaimIndexHint(t *testing.T) {
+	env := newIntegrationEnv(t)
+	ctx := context.Background()
+	tasks := env.db.Collection(CollectionTasks)
+	const hint = "claim_state_name_list_created"
+	_, err := tasks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "state", Value: 1}, {Key: "name", Value: 1}, {Key: "task_list_name", Value: 1}, {Key: "created", Value: 1}},
+			Options: options.Index().SetName(hint),
+		},
+		// A competing index the planner could otherwise pick
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetName("name_1")},
+	})
+	if err != nil {
+		t.Fatalf("create indexes: %v", err)
+	}
+	env.seedStep(t, "step-1", StepStateEventTransmit, map[string]interface{}{"n": int32(1)})
+	env.seedTask(t, "task-1", "ns.Double", "step-1", TaskStatePending, NowMillis())
+
+	// Capture the findAndModify ClaimTask actually sends
+	var mu sync.Mutex
+	var sent bson.Raw
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			if e.CommandName == "findAndModify" {
+				mu.Lock()
+				sent = append(bson.Raw(nil), e.Command...)
+				mu.Unlock()
+			}
+		},
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(env.url).SetMonitor(monitor))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	ops := NewMongoOps(client.Database(env.db.Name()))
+	ops.ClaimIndexHint = hint
+	task, err := ops.ClaimTask(ctx, []string{"ns.Double"}, "default")
+	if err != nil || task == nil || task.UUID != "task-1" {
+		t.Fatalf("Expected task-1 claimed with the hint, got %v, %v", task, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent == nil {
+		t.Fatal("ClaimTask sent no findAndModify")
+	}
+	if got, ok := sent.Lookup("hint").StringValueOK(); !ok || got != hint {
+		t.Fatalf("Expected ClaimTask to send hint %s, got %s", hint, sent.Lookup("hint"))
+	}
+
+	// Explain the captured command, minus the session and write fields
+	// explain does not accept
+	elems, err := sent.Elements()
+	if err != nil {
+		t.Fatalf("captured command: %v", err)
+	}
+	var cmd bson.D
+	for _, elem := range elems {
+		switch key := elem.Key(); {
+		case strings.HasPrefix(key, "$"), key == "lsid", key == "txnNumber", key == "writeConcern":
+		default:
+			cmd = append(cmd, bson.E{Key: key, Value: elem.Value()})
+		}
+	}
+	var explained bson.Raw
+	err = env.db.RunCommand(ctx, bson.D{
+		{Key: "explain", Value: cmd},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}).Decode(&explained)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	plan, err := explained.LookupErr("queryPlanner", "winningPlan")
+	if err != nil {
+		t.Fatalf("no winning plan in %s", explained)
+	}
+	if got := planIndexName(plan.Document()); got != hint {
+		t.Errorf("Expected the winning plan to use %s, got %q in %s", hint, got, plan)
+	}
+}
+
+// planIndexName returns the first indexName in an explain plan, searching
+// its stages depth first.
+func planIndexName(plan bson.Raw) string {
+	elems, err := plan.Elements()
+	if err != nil {
+		return ""
+	}
+	for _, elem := range elems {
+		if elem.Key() == "indexName" {
+			return elem.Value().StringValue()
+		}
+		if doc, ok := elem.Value().DocumentOK(); ok {
+			if name := planIndexName(doc); name != "" {
+				return name
+			}
+		}
+		if arr, ok := elem.Value().ArrayOK(); ok {
+			// inputStages
+			if name := planIndexName(bson.Raw(arr)); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func TestIntegrationWaitForTaskState(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	env.seedStep(t, "step-1", StepStateEventTransmit, map[string]interface{}{"n": int32(2)})
+	env.seedTask(t, "task-1", "ns.Double", "step-1", TaskStatePending, NowMillis())
+
+	ops := NewMongoOps(env.db)
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := ops.WaitForTaskState(short, "task-1", []string{TaskStateCompleted}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a timeout before the task is processed, got %v", err)
+	}
+
+	polled := make(chan error, 1)
+	go func() { polled <- env.poller.PollOnce(context.Background()) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	task, err := ops.WaitForTaskState(ctx, "task-1", []string{TaskStateCompleted, TaskStateFailed})
+	if err != nil {
+		t.Fatalf("WaitForTaskState: %v", err)
+	}
+	if task.State != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", task.State)
+	}
+	if err := <-polled; err != nil {
+		t.Errorf("PollOnce: %v", err)
+	}
+}
+
+func TestIntegrationSubmitTask(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.poller.Register("ns.Double", doubleHandler)
+	env.seedStep(t, "step-1", StepStateEventTransmit, map[string]interface{}{"n": int32(4)})
+
+	ops := NewMongoOps(env.db)
+	id, err := ops.SubmitTask(context.Background(), TaskSpec{Name: "ns.Double", StepID: "step-1", WorkflowID: "wf-1"})
+	if err != nil {
+		t.Fatalf("SubmitTask: %v", err)
+	}
+	if got := env.task(t, bson.M{"uuid": id}); got.State != TaskStatePending || got.Created == 0 {
+		t.Fatalf("Expected a pending task with created set, got %+v", got)
+	}
+
+	env.pollOnce(t)
+	if got := env.task(t, bson.M{"uuid": id}).State; got != TaskStateCompleted {
+		t.Errorf("Expected the submitted task claimed and completed, got %s", got)
+	}
+}
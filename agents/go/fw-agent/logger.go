@@ -0,0 +1,121 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Logger receives structured log events from the poller. Fields carry
+// machine-readable context; implementations typically forward them to a
+// structured logging library.
+type Logger interface {
+	Debug(msg string, fields map[string]interface{})
+	Info(msg string, fields map[string]interface{})
+}
+
+// stdLogger is the default Logger, writing to the standard log package as
+// "msg key=value ..." with keys sorted. Debug lines are prefixed "DEBUG".
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, fields map[string]interface{}) {
+	log.Print("DEBUG " + formatFields(msg, fields))
+}
+
+func (stdLogger) Info(msg string, fields map[string]interface{}) {
+	log.Print(formatFields(msg, fields))
+}
+
+// formatFields renders msg followed by key=value pairs in key order.
+func formatFields(msg string, fields map[string]interface{}) string {
+	keys := sortedKeys(fields)
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, msg)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// SetLogger replaces the Logger used for structured events such as
+// completion summaries. It must be called before Start or PollOnce.
+func (p *AgentPoller) SetLogger(l Logger) {
+	p.logger = l
+}
+
+// logCompletion emits a summary of a successfully completed task when
+// Config.LogCompletions is set. Only param and return names are included,
+// never their values, so sensitive payloads stay out of the logs.
+func (p *AgentPoller) logCompletion(task *TaskDocument, durationMs int64, paramKeys, returnKeys []string) {
+	if !p.cfg.LogCompletions {
+		return
+	}
+	p.logger.Info("Task completed", map[string]interface{}{
+		"facet":       task.Name,
+		"task_id":     task.UUID,
+		"step_id":     task.StepID,
+		"workflow_id": task.WorkflowID,
+		"duration_ms": durationMs,
+		"param_keys":  paramKeys,
+		"return_keys": returnKeys,
+	})
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// commandMonitor returns a driver command monitor that reports every
+// started, succeeded and failed command to logger at debug level.
+func commandMonitor(logger Logger) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			logger.Debug("Mongo command started", map[string]interface{}{
+				"command_name": evt.CommandName,
+				"request_id":   evt.RequestID,
+				"database":     evt.DatabaseName,
+				"command":      evt.Command.String(),
+			})
+		},
+		Succeeded: func(_ context.Context, evt *event.CommandSucceededEvent) {
+			logger.Debug("Mongo command succeeded", map[string]interface{}{
+				"command_name": evt.CommandName,
+				"request_id":   evt.RequestID,
+				"duration_ms":  evt.Duration.Milliseconds(),
+				"reply":        evt.Reply.String(),
+			})
+		},
+		Failed: func(_ context.Context, evt *event.CommandFailedEvent) {
+			logger.Debug("Mongo command failed", map[string]interface{}{
+				"command_name": evt.CommandName,
+				"request_id":   evt.RequestID,
+				"duration_ms":  evt.Duration.Milliseconds(),
+				"failure":      evt.Failure,
+			})
+		},
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"log"
+	"time"
+)
+
+// Operation names reported to an OpRecorder.
+const (
+	OpClaimTask        = "claim_task"
+	OpReadStepParams   = "read_step_params"
+	OpWriteStepReturns = "write_step_returns"
+	OpInsertResumeTask = "insert_resume_task"
+
+	OpCompleteWithReturns = "complete_with_returns"
+)
+
+// OpRecorder receives the duration and outcome of each instrumented
+// MongoOps call. Implementations typically feed a histogram labeled by op,
+// e.g. a Prometheus HistogramVec; they must be safe for concurrent use.
+type OpRecorder interface {
+	ObserveOp(op string, d time.Duration, err error)
+}
+
+// OpRecorderFunc adapts a function to the OpRecorder interface.
+type OpRecorderFunc func(op string, d time.Duration, err error)
+
+// ObserveOp calls f(op, d, err).
+func (f OpRecorderFunc) ObserveOp(op string, d time.Duration, err error) {
+	f(op, d, err)
+}
+
+// Gauge receives the latest value of a sampled measurement. Its method set
+// matches prometheus.Gauge, so one can be passed directly.
+type Gauge interface {
+	Set(v float64)
+}
+
+// GaugeFunc adapts a function to the Gauge interface.
+type GaugeFunc func(v float64)
+
+// Set calls f(v).
+func (f GaugeFunc) Set(v float64) {
+	f(v)
+}
+
+// observe reports the duration of op since start, with the error *errp, to
+// the Recorder and logs it if it exceeded SlowOpThreshold. Meant to be
+// deferred with named error results.
+func (m *MongoOps) observe(op string, start time.Time, errp *error) {
+	d := time.Since(start)
+	if m.Recorder != nil {
+		m.Recorder.ObserveOp(op, d, *errp)
+	}
+	if m.SlowOpThreshold > 0 && d > m.SlowOpThreshold {
+		log.Printf("Slow Mongo operation %s took %v (threshold %v)", op, d, m.SlowOpThreshold)
+	}
+}
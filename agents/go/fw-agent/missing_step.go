@@ -0,0 +1,103 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// MissingStepPolicy is how the poller handles a claimed task without a
+// step_id, which a malformed producer may insert.
+type MissingStepPolicy string
+
+const (
+	// MissingStepFail fails the task with "missing step_id". It is the
+	// default.
+	MissingStepFail MissingStepPolicy = "fail"
+
+	// MissingStepIgnore marks the task ignored.
+	MissingStepIgnore MissingStepPolicy = "ignore"
+
+	// MissingStepUseData runs the handler with the task's data as params,
+	// for execute-style tasks that carry their input themselves. There is
+	// no step to write returns to, so the handler's result is discarded
+	// and no resume task is inserted.
+	MissingStepUseData MissingStepPolicy = "data"
+)
+
+// processWithoutStep handles task, which has no step_id, according to
+// Config.MissingStepPolicy.
+func (p *AgentPoller) processWithoutStep(ctx context.Context, task *TaskDocument) {
+	switch p.cfg.MissingStepPolicy {
+	case MissingStepIgnore:
+		log.Printf("Task %s has no step_id, ignoring it", task.UUID)
+		p.recordEvent(EventIgnored, task, "missing step_id")
+		if err := p.ops.MarkTaskIgnored(ctx, task); err != nil {
+			log.Printf("Failed to mark task ignored: %v", err)
+		}
+	case MissingStepUseData:
+		p.processTaskData(ctx, task)
+	default:
+		log.Printf("Task %s has no step_id", task.UUID)
+		p.failTask(ctx, task, "missing step_id")
+	}
+}
+
+// processTaskData runs the handler for a task without a step on the
+// task's data.
+func (p *AgentPoller) processTaskData(ctx context.Context, task *TaskDocument) {
+	facet, handler, release := p.acquireHandler(task)
+	defer release()
+	if handler == nil {
+		log.Printf("No handler for task: %s", task.Name)
+		p.failTask(ctx, task, "no handler registered")
+		return
+	}
+	p.counters.facetStarted(facet)
+	defer p.counters.facetDone(facet)
+
+	params := copyMap(task.Data)
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	sampled := p.sampleInput(params)
+	params["_facet_name"] = task.Name
+	params[ContextParam] = withTask(ctx, task)
+
+	handlerStart := time.Now()
+	result, err := p.invokeHandler(task, handler, params)
+	p.counters.observeHandler(time.Since(handlerStart))
+	p.recordSample(task, sampled, result, err, time.Since(handlerStart))
+	detail, discard := p.discardReason(ctx, task)
+	switch {
+	case discard:
+		log.Printf("Task %s canceled during processing, discarding result", task.UUID)
+		p.recordEvent(EventCanceled, task, detail)
+	case errors.Is(err, ErrIgnoreTask):
+		p.recordEvent(EventIgnored, task, err.Error())
+		if err := p.ops.MarkTaskIgnored(ctx, task); err != nil {
+			log.Printf("Failed to mark task ignored: %v", err)
+		}
+	case err != nil:
+		log.Printf("Handler error for %s: %v", task.Name, err)
+		p.failTaskErr(ctx, task, err)
+	default:
+		p.recordEvent(EventCompleted, task, "")
+		p.completeTask(ctx, task)
+	}
+}
@@ -28,9 +28,20 @@ type TaskDocument struct {
 	Created      int64                  `bson:"created"`
 	Updated      int64                  `bson:"updated"`
 	Error        map[string]interface{} `bson:"error,omitempty"`
+	Attempts     int                    `bson:"attempts,omitempty"`
 	TaskListName string                 `bson:"task_list_name"`
 	DataType     string                 `bson:"data_type,omitempty"`
 	Data         map[string]interface{} `bson:"data,omitempty"`
+
+	// Reexecute marks a task that re-runs its step's handler after the
+	// params were edited: the params are read afresh as always, and the
+	// handler's result replaces the step's returns instead of merging
+	// into them. The step must be back in EVENT_TRANSMIT.
+	Reexecute bool `bson:"reexecute,omitempty"`
+
+	// ResumeTaskList is the task list the resume task of a resume_pending
+	// task belongs on.
+	ResumeTaskList string `bson:"resume_task_list,omitempty"`
 }
 
 // StepAttribute represents a parameter or return value attribute.
@@ -57,25 +68,39 @@ type StepDocument struct {
 	BlockID     string         `bson:"block_id"`
 	FacetName   string         `bson:"facet_name,omitempty"`
 	Attributes  StepAttributes `bson:"attributes,omitempty"`
+
+	// Leaf marks a step without successors; see Config.CheckLeafSteps.
+	Leaf bool `bson:"leaf,omitempty"`
 }
 
 // ServerDocument represents a server in the servers collection.
 type ServerDocument struct {
-	UUID        string   `bson:"uuid"`
-	ServerGroup string   `bson:"server_group"`
-	ServiceName string   `bson:"service_name"`
-	ServerName  string   `bson:"server_name"`
-	ServerIPs   []string `bson:"server_ips"`
-	StartTime   int64    `bson:"start_time"`
-	PingTime    int64    `bson:"ping_time"`
-	Topics      []string `bson:"topics"`
-	Handlers    []string `bson:"handlers"`
+	UUID        string         `bson:"uuid"`
+	ServerGroup string         `bson:"server_group"`
+	ServiceName string         `bson:"service_name"`
+	ServerName  string         `bson:"server_name"`
+	ServerIPs   []string       `bson:"server_ips"`
+	StartTime   int64          `bson:"start_time"`
+	PingTime    int64          `bson:"ping_time"`
+	Load        float64        `bson:"load,omitempty"`
+	Topics      []string       `bson:"topics"`
+	Handlers    []HandlerEntry `bson:"handlers"`
 	Handled     []struct {
 		Handler    string `bson:"handler"`
 		Handled    int    `bson:"handled"`
 		NotHandled int    `bson:"not_handled"`
 	} `bson:"handled"`
 	State string `bson:"state"`
+
+	// Lifecycle fields carried forward across restarts of the same logical
+	// server (same server_group, service_name and server_name).
+	RestartCount      int   `bson:"restart_count"`
+	PreviousStartTime int64 `bson:"previous_start_time,omitempty"`
+	TotalUptimeMs     int64 `bson:"total_uptime_ms"`
+
+	// Extra holds integrator-defined fields, written inline alongside the
+	// standard ones (see ServerRegistration.RegisterHook).
+	Extra map[string]interface{} `bson:",inline"`
 }
 
 // NowMillis returns the current time in milliseconds since Unix epoch.
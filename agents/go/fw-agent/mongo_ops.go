@@ -16,47 +16,297 @@ package fwagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// ErrStepNotWritable is returned (wrapped) by ReadStepParams and
+// CompleteWithReturns, and with MongoOps.RequireStepMatch by
+// WriteStepReturns and ReplaceStepReturns, when the step is no longer in
+// EVENT_TRANSMIT, e.g. already completed or removed.
+var ErrStepNotWritable = errors.New("step is not awaiting returns")
+
+// ErrTaskNotCompleted is returned (wrapped) by CompleteWithReturns when the
+// step was written and completed but the task could not be marked
+// completed; only MarkTaskCompleted is left to retry.
+var ErrTaskNotCompleted = errors.New("step completed but task not marked completed")
+
+// ErrUndecodableTask is returned (wrapped) by ClaimTask when the claimed
+// document cannot be decoded into a TaskDocument. The document is marked
+// failed, so it neither stays running nor is claimed again.
+var ErrUndecodableTask = errors.New("claimed task could not be decoded")
+
+// ErrLockHeld is returned by AcquireLock when another holder has a live lock.
+var ErrLockHeld = errors.New("lock held by another owner")
+
+// ErrLockNotHeld is returned by ReleaseLock and RenewLock when the token no longer holds
+// the lock.
+var ErrLockNotHeld = errors.New("lock not held")
+
+// ErrNotFound is matched, via errors.Is, by every NotFoundError.
+var ErrNotFound = errors.New("not found")
+
+// NotFoundError is returned by GetTask and GetStep when no document has the
+// requested uuid.
+type NotFoundError struct {
+	Kind string // "task" or "step"
+	UUID string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.UUID)
+}
+
+// Is reports whether target is ErrNotFound.
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
 // MongoOps provides MongoDB operations for the AFL agent protocol.
 type MongoOps struct {
+	// clockOffset is the server clock minus the local clock in
+	// milliseconds, accessed atomically; see SyncServerTime. It is first
+	// to keep it 64-bit aligned.
+	clockOffset int64
+
 	db *mongo.Database
+
+	// ClaimIndexHint, if set, names the tasks index ClaimTask forces the
+	// planner to use, e.g. the compound (state, name, task_list_name, created)
+	// index.
+	ClaimIndexHint string
+
+	// RunnerID, if set, restricts ClaimTask to tasks directed at this runner
+	// via runner_id. Tasks directed at other runners are never claimed.
+	RunnerID string
+
+	// AcceptUnassigned lets ClaimTask also claim tasks with an empty or
+	// missing runner_id when RunnerID is set.
+	AcceptUnassigned bool
+
+	// AcceptedDataTypes, if non-empty, restricts ClaimTask to tasks whose
+	// data_type is listed, e.g. to keep resume tasks for the Python runner
+	// away from this agent.
+	AcceptedDataTypes []string
+
+	// BusyWorkflows, if set, returns the workflows whose tasks claims skip
+	// because this agent is already processing one of their steps; see
+	// Config.SerializePerWorkflow.
+	BusyWorkflows func() []string
+
+	// BusySteps, if set, returns the steps whose tasks claims skip because
+	// this agent is already processing a task for them.
+	BusySteps func() []string
+
+	// AllowedTaskLists, if non-empty, are the only task lists ClaimTask,
+	// CountPending and HasPending match, and DeniedTaskLists are never
+	// matched, whatever list the caller or ClaimFilterFunc asks for.
+	AllowedTaskLists []string
+	DeniedTaskLists  []string
+
+	// ClaimableStates lists the task states ClaimTask picks up, e.g. a
+	// retry or scheduled state used by the engine alongside pending. A
+	// claimed task moves to running whatever its state was. Empty means
+	// pending only. The unclaimableStates (canceled, running and
+	// resume_pending) are never claimed, even if listed; a list of nothing
+	// else claims nothing.
+	ClaimableStates []string
+
+	// Registry, if set, is the BSON codec registry used for every collection
+	// MongoOps reads and writes, so that custom-encoded param and return
+	// types round-trip as intended.
+	Registry *bsoncodec.Registry
+
+	// Recorder, if set, receives the duration of ClaimTask, ReadStepParams,
+	// WriteStepReturns and InsertResumeTask calls.
+	Recorder OpRecorder
+
+	// SlowOpThreshold, if positive, logs instrumented calls that take
+	// longer than this.
+	SlowOpThreshold time.Duration
+
+	// ResumeTaskName overrides the name of inserted resume tasks. Empty
+	// uses ResumeTaskName.
+	ResumeTaskName string
+
+	// UseServerTime makes timestamps written and compared by MongoOps
+	// follow the MongoDB server's clock rather than the local one, so
+	// ordering stays consistent across hosts with skewed clocks. The
+	// offset is measured by SyncServerTime.
+	UseServerTime bool
+
+	// AuditCollection, if set, is the collection WriteAudit appends to.
+	AuditCollection string
+
+	// RespectRunAt makes claims skip tasks whose run_at, as set by
+	// RetryTask or DeferTask, is in the future.
+	RespectRunAt bool
+
+	// RequireStepMatch makes WriteStepReturns and ReplaceStepReturns fail
+	// with ErrStepNotWritable when the step is no longer awaiting returns,
+	// instead of silently writing nothing.
+	RequireStepMatch bool
+
+	// ClaimFilterFunc, if set, is called on every claim (and pending
+	// count) with the standard filter and returns the filter to use, to
+	// add constraints that change at runtime. See claimQuery.
+	ClaimFilterFunc ClaimFilterFunc
+
+	// CompressThreshold, if positive, stores param and return values whose
+	// JSON encoding is larger than this many bytes gzip-compressed; see
+	// CompressedMarkerKey. Compressed values are decompressed on read
+	// whatever the threshold.
+	CompressThreshold int
+
+	// UseTransactions makes CompleteWithReturns write the step and task in
+	// one transaction where the deployment supports it.
+	UseTransactions bool
+
+	// OrderField, if set, is the task timestamp field ClaimTask sorts on,
+	// claiming the oldest task first, e.g. "created". Empty claims in
+	// natural order.
+	OrderField string
+
+	// TimestampUnit is how task created/updated times are stored. Writes
+	// use it, filters convert to it, and TaskDocument.Created/Updated are
+	// always decoded to milliseconds. Empty means TimestampMillis.
+	TimestampUnit TimestampUnit
+
+	// MaxTaskAge, if positive, stops ClaimTask from claiming tasks whose
+	// OrderField (created by default) is older than this.
+	MaxTaskAge time.Duration
+
+	// FullTaskDocument makes ClaimTask return every task field. Otherwise
+	// it projects claimFields, leaving Error unset and Data holding no more
+	// than ExclusiveKey.
+	FullTaskDocument bool
+
+	// FieldMap, if set, renames task and step fields for non-standard
+	// schemas; see FieldMap.
+	FieldMap FieldMap
+
+	// MaxRetries is how many times an operation failing with a transient
+	// error (see isTransient) is retried. Zero disables retries. Locks are
+	// never retried, since a lost acquire reply cannot be told apart from
+	// contention.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry; it doubles on each
+	// further attempt.
+	RetryBackoff time.Duration
 }
 
+// Default retry policy applied by NewMongoOps.
+const (
+	DefaultMongoRetries      = 2
+	DefaultMongoRetryBackoff = 100 * time.Millisecond
+)
+
 // NewMongoOps creates a new MongoOps instance.
 func NewMongoOps(db *mongo.Database) *MongoOps {
-	return &MongoOps{db: db}
+	return &MongoOps{
+		db:           db,
+		MaxRetries:   DefaultMongoRetries,
+		RetryBackoff: DefaultMongoRetryBackoff,
+	}
 }
 
-// ClaimTask atomically claims a pending task for processing.
-// Returns nil if no task is available.
-func (m *MongoOps) ClaimTask(ctx context.Context, taskNames []string, taskList string) (*TaskDocument, error) {
-	collection := m.db.Collection(CollectionTasks)
+// collection returns the named collection, applying Registry if set.
+func (m *MongoOps) collection(name string) *mongo.Collection {
+	if m.Registry != nil {
+		return m.db.Collection(name, options.Collection().SetRegistry(m.Registry))
+	}
+	return m.db.Collection(name)
+}
 
-	filter := bson.M{
-		"state":          TaskStatePending,
-		"name":           bson.M{"$in": taskNames},
-		"task_list_name": taskList,
+// retry runs op, retrying it up to MaxRetries times with exponential
+// backoff while it fails with a transient error. Other errors, and ctx
+// ending during a backoff, return immediately.
+//
+// A network error does not tell whether a write was applied, so op must be
+// a read or an idempotent write, such as a $set. Claims ($inc, and a
+// findAndModify that would pick another task) and inserts are left to the
+// driver's retryable writes, which the server deduplicates, as are locks.
+func (m *MongoOps) retry(ctx context.Context, op func() error) error {
+	backoff := m.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= m.MaxRetries || !isTransient(err) {
+			return err
+		}
+
+		log.Printf("Transient Mongo error (attempt %d/%d), retrying in %v: %v",
+			attempt+1, m.MaxRetries+1, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
 	}
+}
+
+// isTransient reports whether err is a network error or carries a driver
+// error label marking it safe to retry, e.g. after a primary stepdown.
+func isTransient(err error) bool {
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if errors.As(err, &se) {
+		return se.HasErrorLabel("TransientTransactionError") ||
+			se.HasErrorLabel("RetryableWriteError")
+	}
+	return false
+}
+
+// ClaimTask atomically claims a pending task for processing, counting an
+// attempt; ReleaseTask, DeferTask and RequeueTask take it back, so that
+// attempts only counts claims a handler ran for.
+// Returns nil if no task is available.
+func (m *MongoOps) ClaimTask(ctx context.Context, taskNames []string, taskList string) (_ *TaskDocument, err error) {
+	defer m.observe(OpClaimTask, time.Now(), &err)
+
+	collection := m.collection(CollectionTasks)
+
+	filter := m.claimQuery(taskNames, taskList)
 
 	update := bson.M{
 		"$set": bson.M{
 			"state":   TaskStateRunning,
-			"updated": NowMillis(),
+			"updated": m.now(),
 		},
+		"$inc": bson.M{"attempts": 1},
 	}
 
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if m.ClaimIndexHint != "" {
+		opts.SetHint(m.ClaimIndexHint)
+	}
+	if m.OrderField != "" {
+		// Oldest first; any one unit sorts chronologically
+		opts.SetSort(m.mapDoc(bson.M{m.OrderField: 1}))
+	}
+	if !m.FullTaskDocument {
+		opts.SetProjection(m.mapDoc(claimProjection()))
+	}
 
-	var task TaskDocument
-	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&task)
+	// Not retried: if a claim applied but its reply was lost, a retry would
+	// claim a second task and strand the first; see retry
+	raw, err := collection.FindOneAndUpdate(ctx, m.mapDoc(filter), m.mapDoc(update), opts).Raw()
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
@@ -64,22 +314,373 @@ func (m *MongoOps) ClaimTask(ctx context.Context, taskNames []string, taskList s
 		return nil, err
 	}
 
+	var task TaskDocument
+	if err := m.decodeRaw(raw, &task); err != nil {
+		return nil, m.failUndecodable(ctx, raw, err)
+	}
 	return &task, nil
 }
 
-// ReadStepParams reads the params attribute from a step.
-func (m *MongoOps) ReadStepParams(ctx context.Context, stepID string) (map[string]interface{}, error) {
-	collection := m.db.Collection(CollectionSteps)
+// failUndecodable marks a claimed task that failed to decode as failed,
+// by _id since its fields cannot be trusted, and returns the error to
+// report for the claim.
+func (m *MongoOps) failUndecodable(ctx context.Context, raw bson.Raw, decodeErr error) error {
+	claimErr := fmt.Errorf("%w: %v", ErrUndecodableTask, decodeErr)
+	id, err := raw.LookupErr("_id")
+	if err != nil {
+		return claimErr
+	}
+
+	info := ErrorInfo{
+		Message:   "decode error: " + decodeErr.Error(),
+		Type:      ErrorTypeFramework,
+		Timestamp: m.nowMillis(),
+	}
+	filter := bson.M{"_id": id, "state": TaskStateRunning}
+	update := bson.M{"$set": bson.M{
+		"state":   TaskStateFailed,
+		"updated": m.now(),
+		"error":   info,
+	}}
+	err = m.retry(ctx, func() error {
+		_, err := m.collection(CollectionTasks).UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w; marking it failed: %v", claimErr, err)
+	}
+	return claimErr
+}
+
+// claimFields are the task fields ClaimTask fetches by default: identity,
+// routing, the ownership and state fields later conditional writes (lease
+// renewal, reclaim) compare against, and the data keys dispatch honors.
+var claimFields = []string{
+	"uuid", "name", "runner_id", "workflow_id", "flow_id", "step_id",
+	"state", "created", "updated", "attempts", "task_list_name", "data_type",
+	"reexecute", "data." + ExclusiveKey,
+}
+
+func claimProjection() bson.M {
+	projection := make(bson.M, len(claimFields))
+	for _, field := range claimFields {
+		projection[field] = 1
+	}
+	return projection
+}
+
+// CountPending returns how many tasks ClaimTask could currently claim for
+// the given names and task list.
+func (m *MongoOps) CountPending(ctx context.Context, taskNames []string, taskList string) (int64, error) {
+	collection := m.collection(CollectionTasks)
+	filter := m.mapDoc(m.claimQuery(taskNames, taskList))
+
+	var n int64
+	err := m.retry(ctx, func() error {
+		var err error
+		n, err = collection.CountDocuments(ctx, filter)
+		return err
+	})
+	return n, err
+}
+
+// HasPending reports whether a task ClaimTask could claim appears to
+// exist, reading from a secondary when one is available. The answer may be
+// stale, so it is only a hint for whether a claim is worth attempting.
+func (m *MongoOps) HasPending(ctx context.Context, taskNames []string, taskList string) (bool, error) {
+	opts := options.Collection().SetReadPreference(readpref.SecondaryPreferred())
+	if m.Registry != nil {
+		opts.SetRegistry(m.Registry)
+	}
+	collection := m.db.Collection(CollectionTasks, opts)
+
+	find := options.FindOne().SetProjection(bson.M{"_id": 1})
+	filter := m.mapDoc(m.claimQuery(taskNames, taskList))
+	var found bool
+	err := m.retry(ctx, func() error {
+		err := collection.FindOne(ctx, filter, find).Err()
+		found = err == nil
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	})
+	return found, err
+}
+
+// claimState is the claim filter's state condition: an equality for a
+// single state, so the claim index serves it as before, otherwise $in.
+func (m *MongoOps) claimState() interface{} {
+	if len(m.ClaimableStates) == 0 {
+		return TaskStatePending
+	}
+	states := claimableStates(m.ClaimableStates)
+	if len(states) == 1 {
+		return states[0]
+	}
+	return bson.M{"$in": states}
+}
+
+// unclaimableStates are never claimed, whatever the configuration says: a
+// canceled task must never run again, and running and resume_pending tasks
+// belong to the agent processing them.
+var unclaimableStates = []string{TaskStateCanceled, TaskStateRunning, TaskStateResumePending}
+
+// claimableStates returns states without unclaimableStates.
+func claimableStates(states []string) []string {
+	allowed := make([]string, 0, len(states))
+	for _, state := range states {
+		if !containsString(unclaimableStates, state) {
+			allowed = append(allowed, state)
+		}
+	}
+	return allowed
+}
+
+// ClaimFilterFunc augments the claim filter, e.g. to honor a feature flag,
+// time-of-day rules or tenant quotas. It receives a copy of the standard
+// filter and returns the filter to use; returning nil keeps the standard
+// one. The state, name, task list and runner constraints are re-applied
+// afterwards, so it can narrow the claim but not widen it past them.
+type ClaimFilterFunc func(base bson.M) bson.M
+
+// mandatoryClaimKeys are the claim filter fields ClaimFilterFunc cannot
+// override.
+var mandatoryClaimKeys = []string{"state", "name", "task_list_name", "runner_id"}
+
+// claimQuery is claimFilter passed through ClaimFilterFunc, if set.
+func (m *MongoOps) claimQuery(taskNames []string, taskList string) bson.M {
+	base := m.claimFilter(taskNames, taskList)
+	if m.ClaimFilterFunc == nil {
+		return base
+	}
+
+	in := make(bson.M, len(base))
+	for k, v := range base {
+		in[k] = v
+	}
+	filter := m.ClaimFilterFunc(in)
+	if filter == nil {
+		return base
+	}
+	for _, key := range mandatoryClaimKeys {
+		if v, ok := base[key]; ok {
+			filter[key] = v
+		} else {
+			delete(filter, key)
+		}
+	}
+	return filter
+}
+
+// taskListPermitted reports whether AllowedTaskLists and DeniedTaskLists
+// let the agent claim from list.
+func (m *MongoOps) taskListPermitted(list string) bool {
+	if containsString(m.DeniedTaskLists, list) {
+		return false
+	}
+	return len(m.AllowedTaskLists) == 0 || containsString(m.AllowedTaskLists, list)
+}
+
+// claimFilter builds the ClaimTask query for the given names and task list.
+// Resume task names are always dropped, whatever handlers are registered, so
+// the agent never claims work meant for the Python RunnerService.
+func (m *MongoOps) claimFilter(taskNames []string, taskList string) bson.M {
+	claimable := make([]string, 0, len(taskNames))
+	var patterns []string
+	for _, name := range taskNames {
+		if prefix, ok := patternPrefix(name); ok {
+			patterns = append(patterns, prefix)
+		} else if !m.isResumeTaskName(name) {
+			claimable = append(claimable, name)
+		}
+	}
+
+	filter := bson.M{
+		"state":          m.claimState(),
+		"name":           bson.M{"$in": claimable},
+		"task_list_name": taskList,
+	}
+	if !m.taskListPermitted(taskList) {
+		// Matches no task; task_list_name is mandatory, so a claim filter
+		// hook cannot widen it again
+		filter["task_list_name"] = bson.M{"$in": bson.A{}}
+	}
+
+	if len(patterns) > 0 {
+		// Prefix patterns match by anchored regex; resume tasks stay
+		// excluded even when a pattern would cover them
+		in := make(bson.A, 0, len(claimable)+len(patterns))
+		for _, name := range claimable {
+			in = append(in, name)
+		}
+		for _, prefix := range patterns {
+			in = append(in, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)})
+		}
+		filter["name"] = bson.M{"$in": in, "$not": m.resumeNameRegex()}
+	}
+
+	if m.RunnerID != "" {
+		if m.AcceptUnassigned {
+			// nil matches both a null and a missing runner_id
+			filter["runner_id"] = bson.M{"$in": bson.A{m.RunnerID, "", nil}}
+		} else {
+			filter["runner_id"] = m.RunnerID
+		}
+	}
+
+	if len(m.AcceptedDataTypes) > 0 {
+		filter["data_type"] = bson.M{"$in": m.AcceptedDataTypes}
+	}
+
+	if m.BusyWorkflows != nil {
+		if busy := m.BusyWorkflows(); len(busy) > 0 {
+			filter["workflow_id"] = bson.M{"$nin": busy}
+		}
+	}
+	if m.BusySteps != nil {
+		if busy := m.BusySteps(); len(busy) > 0 {
+			filter["step_id"] = bson.M{"$nin": busy}
+		}
+	}
+
+	if m.RespectRunAt {
+		// Also matches tasks without a run_at
+		filter["run_at"] = bson.M{"$not": bson.M{"$gt": m.timestamp(m.nowMillis())}}
+	}
+
+	if m.MaxTaskAge > 0 {
+		field := m.OrderField
+		if field == "" {
+			field = "created"
+		}
+		filter[field] = bson.M{"$gte": m.timestamp(m.nowMillis() - m.MaxTaskAge.Milliseconds())}
+	}
+
+	return filter
+}
+
+// GetTask returns the task with the given uuid, or a *NotFoundError.
+func (m *MongoOps) GetTask(ctx context.Context, taskID string) (*TaskDocument, error) {
+	collection := m.collection(CollectionTasks)
+
+	var task TaskDocument
+	err := m.retry(ctx, func() error {
+		return m.decode(collection.FindOne(ctx, m.mapDoc(bson.M{"uuid": taskID})), &task)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, &NotFoundError{Kind: "task", UUID: taskID}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// GetStep returns the step with the given uuid, or a *NotFoundError.
+func (m *MongoOps) GetStep(ctx context.Context, stepID string) (*StepDocument, error) {
+	collection := m.collection(CollectionSteps)
+
+	var step StepDocument
+	err := m.retry(ctx, func() error {
+		return m.decode(collection.FindOne(ctx, m.mapDoc(bson.M{"uuid": stepID})), &step)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, &NotFoundError{Kind: "step", UUID: stepID}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &step, nil
+}
+
+// isResumeTaskName reports whether name is a resume task name: the base
+// name (ResumeTaskName or its override) alone or with a ":<facet>" suffix.
+// resumeNameRegex matches every name isResumeTaskName accepts.
+func (m *MongoOps) resumeNameRegex() primitive.Regex {
+	bases := []string{regexp.QuoteMeta(ResumeTaskName)}
+	if m.ResumeTaskName != "" && m.ResumeTaskName != ResumeTaskName {
+		bases = append(bases, regexp.QuoteMeta(m.ResumeTaskName))
+	}
+	return primitive.Regex{Pattern: "^(" + strings.Join(bases, "|") + ")(:|$)"}
+}
+
+func (m *MongoOps) isResumeTaskName(name string) bool {
+	for _, base := range []string{ResumeTaskName, m.ResumeTaskName} {
+		if base != "" && (name == base || strings.HasPrefix(name, base+":")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadStepParams reads the params attribute from a step. If the step has
+// left EVENT_TRANSMIT, e.g. because a duplicate task already completed it,
+// the error wraps ErrStepNotWritable.
+func (m *MongoOps) ReadStepParams(ctx context.Context, stepID string) (_ map[string]interface{}, err error) {
+	defer m.observe(OpReadStepParams, time.Now(), &err)
+
+	collection := m.collection(CollectionSteps)
+
+	var step StepDocument
+	err = m.retry(ctx, func() error {
+		return m.decode(collection.FindOne(ctx, m.mapDoc(bson.M{"uuid": stepID})), &step)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if step.State != "" && step.State != StepStateEventTransmit {
+		return nil, fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+
+	return decompressAttributes(step.Attributes.Params)
+}
+
+// StepNeedsResume reports whether the step's handler should be followed by
+// a resume task: true unless the step document is marked "leaf": true,
+// as the engine does for steps without successors.
+func (m *MongoOps) StepNeedsResume(ctx context.Context, stepID string) (bool, error) {
+	opts := options.FindOne().SetProjection(m.mapDoc(bson.M{"_id": 0, "leaf": 1}))
 
 	var step StepDocument
-	err := collection.FindOne(ctx, bson.M{"uuid": stepID}).Decode(&step)
+	err := m.retry(ctx, func() error {
+		return m.decode(m.collection(CollectionSteps).FindOne(ctx, m.mapDoc(bson.M{"uuid": stepID}), opts), &step)
+	})
+	if err != nil {
+		return false, err
+	}
+	return !step.Leaf, nil
+}
+
+// ReadStepParamNames reads only the named params from a step, using a
+// projection so that large params the caller does not need are never
+// transferred. Names missing from the step are absent from the result.
+func (m *MongoOps) ReadStepParamNames(ctx context.Context, stepID string, names []string) (map[string]interface{}, error) {
+	collection := m.collection(CollectionSteps)
+
+	projection := bson.M{"_id": 0}
+	for _, name := range names {
+		projection["attributes.params."+name] = 1
+	}
+	opts := options.FindOne().SetProjection(m.mapDoc(projection))
+
+	var step StepDocument
+	err := m.retry(ctx, func() error {
+		return m.decode(collection.FindOne(ctx, m.mapDoc(bson.M{"uuid": stepID}), opts), &step)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result := make(map[string]interface{})
-	for name, attr := range step.Attributes.Params {
-		result[name] = attr.Value
+	result := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if attr, ok := step.Attributes.Params[name]; ok {
+			value, err := decompressValue(attr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: %w", name, err)
+			}
+			result[name] = value
+		}
 	}
 
 	return result, nil
@@ -106,19 +707,22 @@ func (m *MongoOps) FetchStep(ctx context.Context, ref map[string]interface{}) (m
 		return nil, fmt.Errorf("fetch_step: ref missing 'step_id'")
 	}
 
-	collection := m.db.Collection(CollectionSteps)
+	collection := m.collection(CollectionSteps)
 	var step StepDocument
-	if err := collection.FindOne(ctx, bson.M{"uuid": stepID}).Decode(&step); err != nil {
+	err := m.retry(ctx, func() error {
+		return m.decode(collection.FindOne(ctx, m.mapDoc(bson.M{"uuid": stepID})), &step)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	params := make(map[string]interface{}, len(step.Attributes.Params))
-	for name, attr := range step.Attributes.Params {
-		params[name] = attr.Value
+	params, err := decompressAttributes(step.Attributes.Params)
+	if err != nil {
+		return nil, err
 	}
-	returns := make(map[string]interface{}, len(step.Attributes.Returns))
-	for name, attr := range step.Attributes.Returns {
-		returns[name] = attr.Value
+	returns, err := decompressAttributes(step.Attributes.Returns)
+	if err != nil {
+		return nil, err
 	}
 	return map[string]interface{}{
 		"step_id":     step.UUID,
@@ -130,93 +734,760 @@ func (m *MongoOps) FetchStep(ctx context.Context, ref map[string]interface{}) (m
 }
 
 // WriteStepReturns writes return attributes to a step.
-func (m *MongoOps) WriteStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) error {
-	collection := m.db.Collection(CollectionSteps)
+func (m *MongoOps) WriteStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) (err error) {
+	defer m.observe(OpWriteStepReturns, time.Now(), &err)
+
+	collection := m.collection(CollectionSteps)
+
+	setFields := m.returnsFields(returns)
+
+	filter := bson.M{
+		"uuid":  stepID,
+		"state": StepStateEventTransmit,
+	}
+
+	update := bson.M{"$set": setFields}
+
+	return m.retry(ctx, func() error {
+		if len(setFields) == 0 {
+			// Nothing to write, but the step must still be there
+			return m.checkStepMatch(ctx, stepID, filter)
+		}
+		res, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		if err != nil {
+			return err
+		}
+		return m.stepMatched(stepID, res.MatchedCount)
+	})
+}
+
+// ReplaceStepReturns writes returns to a step like WriteStepReturns, but
+// replaces the step's returns as a whole, so returns of an earlier run
+// that are absent from returns are removed. It is used for Reexecute tasks.
+func (m *MongoOps) ReplaceStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) (err error) {
+	defer m.observe(OpWriteStepReturns, time.Now(), &err)
+
+	collection := m.collection(CollectionSteps)
 
-	// Build the $set update for each return field
+	attrs := make(map[string]StepAttribute, len(returns))
+	for name, value := range returns {
+		attrs[name] = m.attribute(name, value)
+	}
+
+	filter := bson.M{
+		"uuid":  stepID,
+		"state": StepStateEventTransmit,
+	}
+
+	update := bson.M{"$set": bson.M{"attributes.returns": attrs}}
+
+	return m.retry(ctx, func() error {
+		res, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		if err != nil {
+			return err
+		}
+		return m.stepMatched(stepID, res.MatchedCount)
+	})
+}
+
+// stepMatched returns ErrStepNotWritable if RequireStepMatch is set and a
+// returns write matched no step.
+func (m *MongoOps) stepMatched(stepID string, matched int64) error {
+	if m.RequireStepMatch && matched == 0 {
+		return fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+	return nil
+}
+
+// checkStepMatch is stepMatched for a write with no fields: it counts the
+// steps the write would have matched.
+func (m *MongoOps) checkStepMatch(ctx context.Context, stepID string, filter bson.M) error {
+	if !m.RequireStepMatch {
+		return nil
+	}
+	n, err := m.collection(CollectionSteps).CountDocuments(ctx, m.mapDoc(filter), options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	return m.stepMatched(stepID, n)
+}
+
+// returnsFields builds the $set fields writing each return attribute.
+func (m *MongoOps) returnsFields(returns map[string]interface{}) bson.M {
 	setFields := bson.M{}
 	for name, value := range returns {
-		setFields["attributes.returns."+name] = StepAttribute{
-			Name:     name,
-			Value:    value,
-			TypeHint: inferTypeHint(value),
+		setFields["attributes.returns."+name] = m.attribute(name, value)
+	}
+	return setFields
+}
+
+// attribute builds the stored attribute for a value, compressed if it
+// exceeds CompressThreshold.
+func (m *MongoOps) attribute(name string, value interface{}) StepAttribute {
+	return StepAttribute{
+		Name:     name,
+		Value:    m.compressValue(value),
+		TypeHint: inferTypeHint(value),
+	}
+}
+
+// CompleteWithReturns finishes a task whose step needs no resume: it writes
+// returns to the step and moves it to StepStateCompleted in a single
+// update, then marks the task completed. That is two round trips instead
+// of the three of WriteStepReturns, MarkStepCompleted and
+// MarkTaskCompleted.
+//
+// With UseTransactions both writes run in one transaction; if the
+// deployment does not support transactions (a standalone server) they run
+// sequentially instead, and a failure to mark the task completed wraps
+// ErrTaskNotCompleted. If the step is not in EVENT_TRANSMIT nothing is
+// written and the error wraps ErrStepNotWritable, unless the step was
+// completed by this task, e.g. by an attempt whose reply was lost.
+func (m *MongoOps) CompleteWithReturns(ctx context.Context, task *TaskDocument, stepID string, returns map[string]interface{}) (err error) {
+	defer m.observe(OpCompleteWithReturns, time.Now(), &err)
+
+	if m.UseTransactions {
+		err = m.completeInTransaction(ctx, task, stepID, returns)
+		if !isTransactionsUnsupported(err) {
+			return err
 		}
 	}
 
+	if err := m.retry(ctx, func() error {
+		return m.completeStep(ctx, task, stepID, returns)
+	}); err != nil {
+		return err
+	}
+	if err := m.MarkTaskCompleted(ctx, task); err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskNotCompleted, err)
+	}
+	return nil
+}
+
+// completeInTransaction runs the CompleteWithReturns writes in a
+// transaction, which the driver retries as a whole on transient errors.
+func (m *MongoOps) completeInTransaction(ctx context.Context, task *TaskDocument, stepID string, returns map[string]interface{}) error {
+	session, err := m.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := m.completeStep(sc, task, stepID, returns); err != nil {
+			return nil, err
+		}
+		update := bson.M{
+			"$set": bson.M{
+				"state":   TaskStateCompleted,
+				"updated": m.now(),
+			},
+		}
+		_, err := m.collection(CollectionTasks).UpdateOne(sc, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return nil, err
+	})
+	return err
+}
+
+// completeStep writes returns and completes a step still in EVENT_TRANSMIT,
+// recording task as the one that completed it. A step this task already
+// completed counts as success, so retrying after a lost reply is safe.
+func (m *MongoOps) completeStep(ctx context.Context, task *TaskDocument, stepID string, returns map[string]interface{}) error {
+	setFields := m.returnsFields(returns)
+	setFields["state"] = StepStateCompleted
+	setFields["completed_by_task"] = task.UUID
+
 	filter := bson.M{
 		"uuid":  stepID,
 		"state": StepStateEventTransmit,
 	}
 
-	update := bson.M{"$set": setFields}
+	steps := m.collection(CollectionSteps)
+	res, err := steps.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(bson.M{"$set": setFields}))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
 
-	_, err := collection.UpdateOne(ctx, filter, update)
-	return err
+	done := bson.M{
+		"uuid":              stepID,
+		"state":             StepStateCompleted,
+		"completed_by_task": task.UUID,
+	}
+	n, err := steps.CountDocuments(ctx, m.mapDoc(done), options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+	return nil
+}
+
+// isTransactionsUnsupported reports whether err is the server rejecting a
+// transaction because it is not a replica set member or mongos.
+func isTransactionsUnsupported(err error) bool {
+	var ce mongo.CommandError
+	return errors.As(err, &ce) && ce.Code == 20 // IllegalOperation
 }
 
 // UpdateStepReturns merges partial return attributes into a step.
 // Unlike WriteStepReturns, this does NOT require the step to be in EVENT_TRANSMIT state,
 // allowing handlers to stream partial results during execution.
 func (m *MongoOps) UpdateStepReturns(ctx context.Context, stepID string, partial map[string]interface{}) error {
-	collection := m.db.Collection(CollectionSteps)
+	collection := m.collection(CollectionSteps)
 
-	setFields := bson.M{}
-	for name, value := range partial {
-		setFields["attributes.returns."+name] = StepAttribute{
-			Name:     name,
-			Value:    value,
-			TypeHint: inferTypeHint(value),
-		}
-	}
+	setFields := m.returnsFields(partial)
 
 	filter := bson.M{"uuid": stepID}
 	update := bson.M{"$set": setFields}
 
-	_, err := collection.UpdateOne(ctx, filter, update)
-	return err
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+}
+
+// MarkStepCompleted moves a step from EVENT_TRANSMIT to Completed.
+// Used for terminal facets, where no fw:resume task is inserted and the
+// agent is therefore responsible for finalizing the step itself.
+func (m *MongoOps) MarkStepCompleted(ctx context.Context, stepID string) error {
+	return m.AdvanceStepState(ctx, stepID, StepStateCompleted)
+}
+
+// AdvanceStepState moves a step from EVENT_TRANSMIT to state. A step that
+// has already left EVENT_TRANSMIT is left unchanged.
+func (m *MongoOps) AdvanceStepState(ctx context.Context, stepID, state string) error {
+	collection := m.collection(CollectionSteps)
+
+	filter := bson.M{
+		"uuid":  stepID,
+		"state": StepStateEventTransmit,
+	}
+
+	update := bson.M{"$set": bson.M{"state": state}}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
 }
 
 // MarkTaskCompleted marks a task as completed.
 func (m *MongoOps) MarkTaskCompleted(ctx context.Context, task *TaskDocument) error {
-	collection := m.db.Collection(CollectionTasks)
+	collection := m.collection(CollectionTasks)
 
 	update := bson.M{
 		"$set": bson.M{
 			"state":   TaskStateCompleted,
-			"updated": NowMillis(),
+			"updated": m.now(),
 		},
 	}
 
-	_, err := collection.UpdateOne(ctx, bson.M{"uuid": task.UUID}, update)
-	return err
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return err
+	})
 }
 
-// MarkTaskFailed marks a task as failed with an error message.
+// FlagCompletionFailed records on a task whose work is done, but which
+// could not be marked completed, that its bookkeeping lags: it sets
+// completion_failed and completion_error, leaving the state alone.
+func (m *MongoOps) FlagCompletionFailed(ctx context.Context, task *TaskDocument, errorMsg string) error {
+	collection := m.collection(CollectionTasks)
+
+	update := bson.M{
+		"$set": bson.M{
+			"completion_failed": true,
+			"completion_error":  errorMsg,
+			"updated":           m.now(),
+		},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return err
+	})
+}
+
+// MarkTaskFailed marks a task as failed with an error message, recorded as
+// a framework error.
 func (m *MongoOps) MarkTaskFailed(ctx context.Context, task *TaskDocument, errorMsg string) error {
-	collection := m.db.Collection(CollectionTasks)
+	return m.MarkTaskFailedInfo(ctx, task, newErrorInfo(task, nil, errorMsg))
+}
+
+// MarkTaskFailedWithStack marks a task as failed, also storing stack as
+// error.stack when it is non-empty.
+func (m *MongoOps) MarkTaskFailedWithStack(ctx context.Context, task *TaskDocument, errorMsg, stack string) error {
+	info := newErrorInfo(task, nil, errorMsg)
+	info.Stack = stack
+	return m.MarkTaskFailedInfo(ctx, task, info)
+}
+
+// MarkTaskFailedInfo marks a task as failed with info as its error field.
+func (m *MongoOps) MarkTaskFailedInfo(ctx context.Context, task *TaskDocument, info ErrorInfo) error {
+	collection := m.collection(CollectionTasks)
+
+	if m.UseServerTime {
+		info.Timestamp = m.nowMillis()
+	}
 
 	update := bson.M{
 		"$set": bson.M{
 			"state":   TaskStateFailed,
-			"updated": NowMillis(),
-			"error":   bson.M{"message": errorMsg},
+			"updated": m.now(),
+			"error":   info,
 		},
 	}
 
-	_, err := collection.UpdateOne(ctx, bson.M{"uuid": task.UUID}, update)
-	return err
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return err
+	})
+}
+
+// MarkTasksCompleted marks tasks completed in one bulk write and returns
+// how many were transitioned. Each update is guarded on its task still
+// being running, so a task that was reclaimed or already finished is left
+// alone.
+func (m *MongoOps) MarkTasksCompleted(ctx context.Context, tasks []*TaskDocument) (int, error) {
+	now := m.now()
+	return m.markTasks(ctx, tasks, func(task *TaskDocument) bson.M {
+		return bson.M{
+			"state":   TaskStateCompleted,
+			"updated": now,
+		}
+	})
+}
+
+// MarkTasksFailed marks tasks failed with errorMsg, recorded as a framework
+// error, in one bulk write and returns how many were transitioned. Like
+// MarkTasksCompleted, only tasks still running are updated.
+func (m *MongoOps) MarkTasksFailed(ctx context.Context, tasks []*TaskDocument, errorMsg string) (int, error) {
+	now := m.now()
+	return m.markTasks(ctx, tasks, func(task *TaskDocument) bson.M {
+		info := newErrorInfo(task, nil, errorMsg)
+		if m.UseServerTime {
+			info.Timestamp = m.nowMillis()
+		}
+		return bson.M{
+			"state":   TaskStateFailed,
+			"updated": now,
+			"error":   info,
+		}
+	})
+}
+
+// markTasks applies the $set built by set to each running task in tasks
+// with an unordered bulk write, and returns the number of tasks modified.
+func (m *MongoOps) markTasks(ctx context.Context, tasks []*TaskDocument, set func(*TaskDocument) bson.M) (int, error) {
+	if len(tasks) == 0 {
+		return 0, nil
+	}
+	collection := m.collection(CollectionTasks)
+
+	models := make([]mongo.WriteModel, 0, len(tasks))
+	for _, task := range tasks {
+		filter := bson.M{
+			"uuid":  task.UUID,
+			"state": TaskStateRunning,
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(m.mapDoc(filter)).
+			SetUpdate(m.mapDoc(bson.M{"$set": set(task)})))
+	}
+
+	// A retry skips the tasks a failed attempt already transitioned, since
+	// they no longer match, so the counts add up
+	var modified int64
+	err := m.retry(ctx, func() error {
+		res, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if res != nil {
+			modified += res.ModifiedCount
+		}
+		return err
+	})
+	return int(modified), err
+}
+
+// MarkTaskIgnored marks a task as ignored: the handler decided it does not
+// apply, which is neither a success nor a failure.
+func (m *MongoOps) MarkTaskIgnored(ctx context.Context, task *TaskDocument) error {
+	collection := m.collection(CollectionTasks)
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":   TaskStateIgnored,
+			"updated": m.now(),
+		},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return err
+	})
+}
+
+// MarkTaskResumePending records that task's returns were written but its
+// resume task could not be inserted: it sets the state to resume_pending,
+// with the task list the resume belongs on and the insert error.
+func (m *MongoOps) MarkTaskResumePending(ctx context.Context, task *TaskDocument, resumeTaskList, errorMsg string) error {
+	collection := m.collection(CollectionTasks)
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":            TaskStateResumePending,
+			"resume_task_list": resumeTaskList,
+			"resume_error":     errorMsg,
+			"updated":          m.now(),
+		},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(bson.M{"uuid": task.UUID}), m.mapDoc(update))
+		return err
+	})
+}
+
+// ReleaseTask returns a claimed task to pending so that it can be claimed
+// again, by this agent or another. Only a task still in running is reset.
+func (m *MongoOps) ReleaseTask(ctx context.Context, task *TaskDocument) error {
+	collection := m.collection(CollectionTasks)
+
+	filter := bson.M{
+		"uuid":  task.UUID,
+		"state": TaskStateRunning,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":   TaskStatePending,
+			"updated": m.now(),
+		},
+		"$inc": bson.M{"attempts": -1},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+}
+
+// DeferTask returns a running task to pending, to be claimed again once
+// delay has passed (see RespectRunAt). Used for tasks another agent holds a
+// lock for, so that they do not sit at the head of the queue meanwhile.
+func (m *MongoOps) DeferTask(ctx context.Context, task *TaskDocument, delay time.Duration) error {
+	collection := m.collection(CollectionTasks)
+
+	filter := bson.M{
+		"uuid":  task.UUID,
+		"state": TaskStateRunning,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":   TaskStatePending,
+			"updated": m.now(),
+			"run_at":  m.timestamp(m.nowMillis() + delay.Milliseconds()),
+		},
+		"$inc": bson.M{"attempts": -1},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+}
+
+// RenewTaskLease bumps a running task's updated time, its lease, so that
+// ReclaimStaleTasks leaves it alone while it is still being processed.
+func (m *MongoOps) RenewTaskLease(ctx context.Context, task *TaskDocument) error {
+	collection := m.collection(CollectionTasks)
+
+	filter := bson.M{
+		"uuid":  task.UUID,
+		"state": TaskStateRunning,
+	}
+
+	update := bson.M{"$set": bson.M{"updated": m.now()}}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+}
+
+// CanceledTasks returns, for each of uuids whose task is in state canceled,
+// its cancel reason: the task's cancel_reason, or data.cancel_reason if
+// that is absent, or "" if neither is a string.
+func (m *MongoOps) CanceledTasks(ctx context.Context, uuids []string) (map[string]string, error) {
+	collection := m.collection(CollectionTasks)
+
+	filter := bson.M{
+		"uuid":  bson.M{"$in": uuids},
+		"state": TaskStateCanceled,
+	}
+	projection := bson.M{
+		"_id":                       0,
+		"uuid":                      1,
+		CancelReasonField:           1,
+		"data." + CancelReasonField: 1,
+	}
+	opts := options.Find().SetProjection(m.mapDoc(projection))
+
+	canceled := make(map[string]string)
+	err := m.retry(ctx, func() error {
+		cursor, err := collection.Find(ctx, m.mapDoc(filter), opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var doc struct {
+				UUID   string                 `bson:"uuid"`
+				Reason interface{}            `bson:"cancel_reason"`
+				Data   map[string]interface{} `bson:"data"`
+			}
+			if err := m.decodeRaw(cursor.Current, &doc); err != nil {
+				return err
+			}
+			reason, ok := doc.Reason.(string)
+			if !ok {
+				reason, _ = doc.Data[CancelReasonField].(string)
+			}
+			canceled[doc.UUID] = reason
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return canceled, nil
+}
+
+// ReclaimStaleTasks resets running tasks for taskNames whose lease (updated
+// time) is older than staleAfter back to pending, and returns how many were
+// reset. With a positive grace it first waits that long, then resets each
+// candidate only if its lease is unchanged since it was found stale, so an
+// agent that was merely slow and renews in the meantime keeps its task.
+// As with claims, only tasks this agent could claim are considered, and a
+// reclaimed task keeps its runner_id, so a directed task stays directed.
+func (m *MongoOps) ReclaimStaleTasks(ctx context.Context, taskNames []string, taskList string, staleAfter, grace time.Duration) (int, error) {
+	collection := m.collection(CollectionTasks)
+
+	filter := m.claimFilter(taskNames, taskList)
+	filter["state"] = TaskStateRunning
+	filter["updated"] = bson.M{"$lt": m.timestamp(m.nowMillis() - staleAfter.Milliseconds())}
+
+	var stale []TaskDocument
+	err := m.retry(ctx, func() error {
+		stale = stale[:0]
+		cursor, err := collection.Find(ctx, m.mapDoc(filter))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var task TaskDocument
+			if err := m.decodeRaw(cursor.Current, &task); err != nil {
+				return err
+			}
+			stale = append(stale, task)
+		}
+		return cursor.Err()
+	})
+	if err != nil || len(stale) == 0 {
+		return 0, err
+	}
+
+	if grace > 0 {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(grace):
+		}
+	}
+
+	reclaimed := 0
+	for _, task := range stale {
+		// Matching the observed lease is the double-check: a renewal during
+		// the grace period moves updated and the reset no longer applies
+		recheck := bson.M{
+			"uuid":    task.UUID,
+			"state":   TaskStateRunning,
+			"updated": m.timestamp(task.Updated),
+		}
+		update := bson.M{
+			"$set": bson.M{
+				"state":   TaskStatePending,
+				"updated": m.now(),
+			},
+		}
+		var res *mongo.UpdateResult
+		err := m.retry(ctx, func() error {
+			var err error
+			res, err = collection.UpdateOne(ctx, m.mapDoc(recheck), m.mapDoc(update))
+			return err
+		})
+		if err != nil {
+			return reclaimed, err
+		}
+		if res.MatchedCount > 0 {
+			reclaimed++
+		}
+	}
+	return reclaimed, nil
+}
+
+// AcquireLock takes the named lock in the locks collection for ttl and
+// returns a token identifying this holder. A lock whose expires_at has passed
+// is considered abandoned and is taken over. Returns ErrLockHeld if another
+// holder has a live lock.
+//
+// The lock document is {_id: key, token, created, expires_at}. Acquisition
+// is a single upsert filtered on an expired lock: if no document exists it is
+// inserted, if an expired one exists it is overwritten, and if a live one
+// exists the upsert collides on _id and fails with a duplicate-key error.
+func (m *MongoOps) AcquireLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	collection := m.collection(CollectionLocks)
+
+	token := uuid.New().String()
+	now := m.nowMillis()
+
+	filter := bson.M{
+		"_id":        key,
+		"expires_at": bson.M{"$lte": now},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"token":      token,
+			"created":    now,
+			"expires_at": now + ttl.Milliseconds(),
+		},
+	}
+
+	opts := options.Update().SetUpsert(true)
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", ErrLockHeld
+	}
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ReleaseLock deletes the named lock if it is still held under token.
+// Returns ErrLockNotHeld if the lock expired and was taken over, or was
+// already released.
+func (m *MongoOps) ReleaseLock(ctx context.Context, key, token string) error {
+	collection := m.collection(CollectionLocks)
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": key, "token": token})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// RenewLock extends the named lock to expire ttl from now if it is still
+// held under token. Returns ErrLockNotHeld if the lock expired and was
+// taken over, or was released.
+func (m *MongoOps) RenewLock(ctx context.Context, key, token string, ttl time.Duration) error {
+	collection := m.collection(CollectionLocks)
+
+	update := bson.M{"$set": bson.M{"expires_at": m.nowMillis() + ttl.Milliseconds()}}
+
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": key, "token": token}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// RetryTask returns a running task to pending with its error recorded, to
+// be claimed again once delay has passed (see RespectRunAt). Unlike
+// RequeueTask it keeps the runner_id, so a directed task stays directed.
+func (m *MongoOps) RetryTask(ctx context.Context, task *TaskDocument, info ErrorInfo, delay time.Duration) error {
+	collection := m.collection(CollectionTasks)
+
+	if m.UseServerTime {
+		info.Timestamp = m.nowMillis()
+	}
+
+	filter := bson.M{
+		"uuid":  task.UUID,
+		"state": TaskStateRunning,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":   TaskStatePending,
+			"updated": m.now(),
+			"run_at":  m.timestamp(m.nowMillis() + delay.Milliseconds()),
+			"error":   info,
+		},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
+}
+
+// RequeueTask returns a running task to pending and clears its runner_id,
+// so that any agent can claim it immediately. Used when an agent hands back
+// its in-flight work on shutdown.
+func (m *MongoOps) RequeueTask(ctx context.Context, task *TaskDocument) error {
+	collection := m.collection(CollectionTasks)
+
+	filter := bson.M{
+		"uuid":  task.UUID,
+		"state": TaskStateRunning,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":     TaskStatePending,
+			"runner_id": "",
+			"updated":   m.now(),
+		},
+		"$inc": bson.M{"attempts": -1},
+	}
+
+	return m.retry(ctx, func() error {
+		_, err := collection.UpdateOne(ctx, m.mapDoc(filter), m.mapDoc(update))
+		return err
+	})
 }
 
 // InsertResumeTask creates an afl:resume task for the Python RunnerService.
 // If facetName is non-empty, the task name includes it for visibility (e.g. "fw:resume:ns.Facet").
-func (m *MongoOps) InsertResumeTask(ctx context.Context, stepID, workflowID, taskList, facetName string) error {
-	collection := m.db.Collection(CollectionTasks)
+// The base name is m.ResumeTaskName when set.
+// A duplicate-key error is treated as success, so the insert is idempotent
+// when the tasks collection has a unique index on (name, step_id).
+func (m *MongoOps) InsertResumeTask(ctx context.Context, stepID, workflowID, taskList, facetName string) (err error) {
+	defer m.observe(OpInsertResumeTask, time.Now(), &err)
 
-	resumeName := ResumeTaskName
+	collection := m.collection(CollectionTasks)
+
+	resumeName := m.ResumeTaskName
+	if resumeName == "" {
+		resumeName = ResumeTaskName
+	}
 	if facetName != "" {
-		resumeName = ResumeTaskName + ":" + facetName
+		resumeName += ":" + facetName
 	}
-	now := NowMillis()
+	now := m.nowMillis()
 	task := TaskDocument{
 		UUID:         uuid.New().String(),
 		Name:         resumeName,
@@ -235,16 +1506,168 @@ func (m *MongoOps) InsertResumeTask(ctx context.Context, stepID, workflowID, tas
 		},
 	}
 
-	_, err := collection.InsertOne(ctx, task)
+	// Not retried, as a retry could insert a second resume; see retry
+	doc, err := m.encode(task)
+	if err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// A unique (name, step_id) index already holds this resume, e.g.
+		// from a concurrent or retried insert; the step will be resumed.
+		return nil
+	}
 	return err
 }
 
+// unresumedBatchSize is how many steps FindUnresumedSteps checks per
+// query, keeping each $in well below the command size limit.
+const unresumedBatchSize = 200
+
+// FindUnresumedSteps returns the steps whose task for one of taskNames on
+// taskList finished without a resume task to follow: tasks left
+// resume_pending, and completed tasks whose step is still in EVENT_TRANSMIT
+// (a terminal facet's step is completed instead). Steps that have a resume
+// task, in any state, are left out. The resume task list is the recorded
+// one for resume_pending tasks, otherwise the task's own list.
+//
+// At most limit tasks are examined, resume_pending ones first, then the
+// most recently completed; a non-positive limit examines all of them. Their
+// steps and resume tasks are checked in batches, one query each.
+func (m *MongoOps) FindUnresumedSteps(ctx context.Context, taskNames []string, taskList string, limit int) ([]UnresumedStep, error) {
+	finished, err := m.findFinishedTasks(ctx, taskNames, taskList, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var unresumed []UnresumedStep
+	for start := 0; start < len(finished); start += unresumedBatchSize {
+		end := start + unresumedBatchSize
+		if end > len(finished) {
+			end = len(finished)
+		}
+		batch := finished[start:end]
+
+		stepIDs := make(bson.A, 0, len(batch))
+		for _, task := range batch {
+			stepIDs = append(stepIDs, task.StepID)
+		}
+		waiting, err := m.distinctStrings(ctx, CollectionSteps, "uuid", bson.M{
+			"uuid":  bson.M{"$in": stepIDs},
+			"state": StepStateEventTransmit,
+		})
+		if err != nil {
+			return unresumed, err
+		}
+		resumed, err := m.distinctStrings(ctx, CollectionTasks, "step_id", bson.M{
+			"step_id": bson.M{"$in": stepIDs},
+			"name":    m.resumeNameRegex(),
+		})
+		if err != nil {
+			return unresumed, err
+		}
+
+		for _, task := range batch {
+			pending := task.State == TaskStateResumePending
+			if resumed[task.StepID] || (!pending && !waiting[task.StepID]) {
+				continue
+			}
+			step := UnresumedStep{
+				StepID:        task.StepID,
+				WorkflowID:    task.WorkflowID,
+				FacetName:     task.Name,
+				TaskUUID:      task.UUID,
+				ResumePending: pending,
+				TaskList:      task.TaskListName,
+			}
+			if pending && task.ResumeTaskList != "" {
+				step.TaskList = task.ResumeTaskList
+			}
+			unresumed = append(unresumed, step)
+		}
+	}
+	return unresumed, nil
+}
+
+// findFinishedTasks returns up to limit resume_pending and completed tasks
+// for taskNames on taskList, resume_pending first and otherwise newest
+// first, with one task per step.
+func (m *MongoOps) findFinishedTasks(ctx context.Context, taskNames []string, taskList string, limit int) ([]TaskDocument, error) {
+	// Only the handler-name and list parts of the claim filter apply
+	claim := m.claimFilter(taskNames, taskList)
+
+	var finished []TaskDocument
+	seen := make(map[string]bool)
+	for _, state := range []string{TaskStateResumePending, TaskStateCompleted} {
+		filter := bson.M{
+			"name":           claim["name"],
+			"task_list_name": claim["task_list_name"],
+			"state":          state,
+		}
+		opts := options.Find().SetSort(m.mapDoc(bson.M{"updated": -1}))
+		if limit > 0 {
+			remaining := limit - len(finished)
+			if remaining <= 0 {
+				break
+			}
+			opts.SetLimit(int64(remaining))
+		}
+
+		var found []TaskDocument
+		err := m.retry(ctx, func() error {
+			found = found[:0]
+			cursor, err := m.collection(CollectionTasks).Find(ctx, m.mapDoc(filter), opts)
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(ctx)
+			for cursor.Next(ctx) {
+				var task TaskDocument
+				if err := m.decodeRaw(cursor.Current, &task); err != nil {
+					return err
+				}
+				found = append(found, task)
+			}
+			return cursor.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range found {
+			if !seen[task.StepID] {
+				seen[task.StepID] = true
+				finished = append(finished, task)
+			}
+		}
+	}
+	return finished, nil
+}
+
+// distinctStrings returns the set of string values of key over the
+// documents of collection matching filter.
+func (m *MongoOps) distinctStrings(ctx context.Context, collection, key string, filter bson.M) (map[string]bool, error) {
+	set := make(map[string]bool)
+	err := m.retry(ctx, func() error {
+		values, err := m.collection(collection).Distinct(ctx, m.path(key), m.mapDoc(filter))
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				set[s] = true
+			}
+		}
+		return nil
+	})
+	return set, err
+}
+
 // InsertStepLog inserts a step log entry for dashboard observability.
 // Best-effort: errors are logged but not returned.
 func (m *MongoOps) InsertStepLog(ctx context.Context, stepID, workflowID, runnerID, facetName, source, level, message string) {
-	collection := m.db.Collection(CollectionStepLogs)
+	collection := m.collection(CollectionStepLogs)
 
-	now := NowMillis()
+	now := m.nowMillis()
 	doc := bson.M{
 		"uuid":        uuid.New().String(),
 		"step_id":     stepID,
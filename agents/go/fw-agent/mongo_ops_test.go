@@ -0,0 +1,2483 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// claimedTaskResponse is a mock findAndModify reply returning one task.
+func claimedTaskResponse(task bson.D) bson.D {
+	return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: task}}
+}
+
+func TestClaimTaskNotRetriedOnTransientError(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	// An error isTransient accepts, but which the driver does not retry
+	// itself outside a transaction
+	mt.Run("claim is not repeated", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCommandErrorResponse(mtest.CommandError{
+				Code: 112, Name: "WriteConflict", Message: "write conflict",
+				Labels: []string{"TransientTransactionError"},
+			}),
+			claimedTaskResponse(bson.D{{Key: "uuid", Value: "t2"}}),
+		)
+
+		ops := NewMongoOps(mt.DB)
+		ops.MaxRetries = 2
+		ops.RetryBackoff = time.Millisecond
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err == nil {
+			mt.Fatalf("Expected the transient error returned, got task %+v", task)
+		}
+
+		mt.GetStartedEvent()
+		if ev := mt.GetStartedEvent(); ev != nil {
+			mt.Errorf("Expected a single claim attempt, got a second %s", ev.CommandName)
+		}
+	})
+}
+
+func TestClaimTaskIndexHint(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("hint applied when set", func(mt *mtest.T) {
+		mt.AddMockResponses(claimedTaskResponse(bson.D{{Key: "uuid", Value: "t1"}}))
+
+		ops := NewMongoOps(mt.DB)
+		ops.ClaimIndexHint = "state_name_task_list_created"
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+
+		hint, err := mt.GetStartedEvent().Command.LookupErr("hint")
+		if err != nil {
+			mt.Fatal("Expected hint in findAndModify command")
+		}
+		if hint.StringValue() != "state_name_task_list_created" {
+			mt.Errorf("Expected hint 'state_name_task_list_created', got %v", hint)
+		}
+	})
+
+	mt.Run("no hint by default", func(mt *mtest.T) {
+		mt.AddMockResponses(claimedTaskResponse(bson.D{{Key: "uuid", Value: "t1"}}))
+
+		ops := NewMongoOps(mt.DB)
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+
+		if _, err := mt.GetStartedEvent().Command.LookupErr("hint"); err == nil {
+			mt.Error("Expected no hint when ClaimIndexHint is empty")
+		}
+	})
+}
+
+func TestAcquireLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("free lock is acquired", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 1},
+			bson.E{Key: "upserted", Value: bson.A{bson.D{{Key: "index", Value: 0}, {Key: "_id", Value: "res:1"}}}},
+		))
+
+		ops := NewMongoOps(mt.DB)
+		token, err := ops.AcquireLock(context.Background(), "res:1", time.Minute)
+		if err != nil {
+			mt.Fatalf("AcquireLock: %v", err)
+		}
+		if token == "" {
+			mt.Error("Expected a non-empty token")
+		}
+
+		ev := mt.GetStartedEvent()
+		if ev.CommandName != "update" {
+			mt.Fatalf("Expected update command, got %s", ev.CommandName)
+		}
+		stmt := ev.Command.Lookup("updates").Array().Index(0).Value().Document()
+		if !stmt.Lookup("upsert").Boolean() {
+			mt.Error("Expected lock acquisition to upsert")
+		}
+		if _, err := stmt.LookupErr("q", "expires_at", "$lte"); err != nil {
+			mt.Error("Expected filter to only match an expired lock")
+		}
+	})
+
+	mt.Run("second acquire fails while held", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 11000, Message: "E11000 duplicate key error",
+		}))
+
+		ops := NewMongoOps(mt.DB)
+		token, err := ops.AcquireLock(context.Background(), "res:1", time.Minute)
+		if err != ErrLockHeld {
+			mt.Errorf("Expected ErrLockHeld, got %v", err)
+		}
+		if token != "" {
+			mt.Errorf("Expected no token on contention, got %q", token)
+		}
+	})
+
+	mt.Run("expired lock is reacquired", func(mt *mtest.T) {
+		// The expired document matches the filter and is overwritten in place
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 1},
+			bson.E{Key: "nModified", Value: 1},
+		))
+
+		ops := NewMongoOps(mt.DB)
+		token, err := ops.AcquireLock(context.Background(), "res:1", time.Minute)
+		if err != nil || token == "" {
+			mt.Fatalf("Expected takeover of expired lock, got token %q err %v", token, err)
+		}
+	})
+}
+
+func TestReleaseLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("holder releases", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.ReleaseLock(context.Background(), "res:1", "tok"); err != nil {
+			mt.Errorf("ReleaseLock: %v", err)
+		}
+		q := mt.GetStartedEvent().Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q")
+		if q.Document().Lookup("token").StringValue() != "tok" {
+			mt.Error("Expected release to be filtered by token")
+		}
+	})
+
+	mt.Run("stale token is rejected", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.ReleaseLock(context.Background(), "res:1", "old"); err != ErrLockNotHeld {
+			mt.Errorf("Expected ErrLockNotHeld, got %v", err)
+		}
+	})
+}
+
+func TestRenewLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("holder renews", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		before := NowMillis()
+		if err := ops.RenewLock(context.Background(), "res:1", "tok", time.Minute); err != nil {
+			mt.Fatalf("RenewLock: %v", err)
+		}
+		update := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document()
+		if update.Lookup("q", "token").StringValue() != "tok" {
+			mt.Error("Expected renewal to be filtered by token")
+		}
+		if exp := update.Lookup("u", "$set", "expires_at").Int64(); exp < before+time.Minute.Milliseconds() {
+			mt.Errorf("Expected expires_at a ttl from now, got %d", exp)
+		}
+	})
+
+	mt.Run("stale token is rejected", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.RenewLock(context.Background(), "res:1", "old", time.Minute); err != ErrLockNotHeld {
+			mt.Errorf("Expected ErrLockNotHeld, got %v", err)
+		}
+	})
+}
+
+func TestClaimFilterRunnerID(t *testing.T) {
+	names := []string{"ns.F"}
+
+	// No runner id: runner_id is not constrained
+	ops := &MongoOps{}
+	if _, ok := ops.claimFilter(names, "default")["runner_id"]; ok {
+		t.Error("Expected no runner_id constraint without RunnerID")
+	}
+
+	// Directed only: tasks for other runners and unassigned tasks are left alone
+	ops = &MongoOps{RunnerID: "runner-a"}
+	if got := ops.claimFilter(names, "default")["runner_id"]; got != "runner-a" {
+		t.Errorf("Expected runner_id 'runner-a', got %v", got)
+	}
+
+	// Directed plus unassigned
+	ops = &MongoOps{RunnerID: "runner-a", AcceptUnassigned: true}
+	in, ok := ops.claimFilter(names, "default")["runner_id"].(bson.M)
+	if !ok {
+		t.Fatal("Expected runner_id $in constraint")
+	}
+	accepted := in["$in"].(bson.A)
+	if len(accepted) != 3 || accepted[0] != "runner-a" || accepted[1] != "" || accepted[2] != nil {
+		t.Errorf("Expected [runner-a, \"\", nil], got %v", accepted)
+	}
+	for _, v := range accepted {
+		if v == "runner-b" {
+			t.Error("Tasks directed at other runners must not match")
+		}
+	}
+}
+
+func TestPollerRunnerIDDefaultsToServerID(t *testing.T) {
+	poller := NewAgentPoller(DefaultConfig())
+	if poller.RunnerID() != poller.serverID {
+		t.Errorf("Expected RunnerID to default to server id, got %q", poller.RunnerID())
+	}
+
+	cfg := DefaultConfig()
+	cfg.RunnerID = "gpu-1"
+	if got := NewAgentPoller(cfg).RunnerID(); got != "gpu-1" {
+		t.Errorf("Expected configured RunnerID 'gpu-1', got %q", got)
+	}
+}
+
+func TestDefaultConfigClaimsForeignRunnerTasks(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("runner_id unconstrained by default", func(mt *mtest.T) {
+		poller := NewAgentPoller(DefaultConfig())
+		poller.SetMongoClient(mt.Client)
+		if err := poller.connect(context.Background()); err != nil {
+			mt.Fatalf("connect: %v", err)
+		}
+
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "uuid", Value: "t1"},
+			{Key: "runner_id", Value: "workflow-runner-7"},
+		}))
+		task, err := poller.ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task == nil || task.UUID != "t1" {
+			mt.Fatalf("Expected the foreign runner's task claimed, got %+v", task)
+		}
+		if _, err := mt.GetStartedEvent().Command.LookupErr("query", "runner_id"); err == nil {
+			mt.Error("Expected no runner_id constraint with DefaultConfig")
+		}
+	})
+}
+
+func TestReadStepParamNames(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("projects requested params", func(mt *mtest.T) {
+		step := bson.D{{Key: "attributes", Value: bson.D{{Key: "params", Value: bson.D{
+			{Key: "region", Value: bson.D{{Key: "name", Value: "region"}, {Key: "value", Value: "eu"}}},
+			{Key: "blob", Value: bson.D{{Key: "name", Value: "blob"}, {Key: "value", Value: "large"}}},
+		}}}}}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, step))
+
+		ops := NewMongoOps(mt.DB)
+		params, err := ops.ReadStepParamNames(context.Background(), "step-1", []string{"region", "missing"})
+		if err != nil {
+			mt.Fatalf("ReadStepParamNames: %v", err)
+		}
+
+		if len(params) != 1 || params["region"] != "eu" {
+			mt.Errorf("Expected only {region: eu}, got %v", params)
+		}
+
+		projection := mt.GetStartedEvent().Command.Lookup("projection").Document()
+		if _, err := projection.LookupErr("attributes.params.region"); err != nil {
+			mt.Error("Expected projection on attributes.params.region")
+		}
+		if _, err := projection.LookupErr("attributes.params.blob"); err == nil {
+			mt.Error("Did not expect unrequested params in the projection")
+		}
+	})
+}
+
+func TestCountPending(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("counts with claim filter", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch,
+			bson.D{{Key: "n", Value: int32(7)}}))
+
+		ops := NewMongoOps(mt.DB)
+		n, err := ops.CountPending(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("CountPending: %v", err)
+		}
+		if n != 7 {
+			mt.Errorf("Expected 7 pending, got %d", n)
+		}
+
+		match := mt.GetStartedEvent().Command.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match").Document()
+		if match.Lookup("state").StringValue() != TaskStatePending {
+			mt.Error("Expected count restricted to pending tasks")
+		}
+	})
+}
+
+// updateStatement returns the first statement of the next started update
+// command.
+func updateStatement(mt *mtest.T) bson.Raw {
+	ev := mt.GetStartedEvent()
+	if ev == nil || ev.CommandName != "update" {
+		mt.Fatalf("Expected update command, got %v", ev)
+	}
+	return ev.Command.Lookup("updates").Array().Index(0).Value().Document()
+}
+
+func TestHandBackUndoesAttempt(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	handBacks := map[string]func(ops *MongoOps, task *TaskDocument) error{
+		"release": func(ops *MongoOps, task *TaskDocument) error {
+			return ops.ReleaseTask(context.Background(), task)
+		},
+		"defer": func(ops *MongoOps, task *TaskDocument) error {
+			return ops.DeferTask(context.Background(), task, time.Second)
+		},
+		"requeue": func(ops *MongoOps, task *TaskDocument) error {
+			return ops.RequeueTask(context.Background(), task)
+		},
+	}
+	for name, handBack := range handBacks {
+		handBack := handBack
+		mt.Run(name, func(mt *mtest.T) {
+			ops := NewMongoOps(mt.DB)
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+			if err := handBack(ops, &TaskDocument{UUID: "task-1", Attempts: 1}); err != nil {
+				mt.Fatalf("%s: %v", name, err)
+			}
+			if inc := updateStatement(mt).Lookup("u", "$inc", "attempts").Int32(); inc != -1 {
+				mt.Errorf("Expected the claim's attempt taken back, got $inc %d", inc)
+			}
+		})
+	}
+}
+
+func TestMarkTaskIgnored(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("sets ignored state", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.MarkTaskIgnored(context.Background(), &TaskDocument{UUID: "t1"}); err != nil {
+			mt.Fatalf("MarkTaskIgnored: %v", err)
+		}
+
+		stmt := updateStatement(mt)
+		if got := stmt.Lookup("u", "$set", "state").StringValue(); got != TaskStateIgnored {
+			mt.Errorf("Expected state %s, got %s", TaskStateIgnored, got)
+		}
+		if got := stmt.Lookup("q", "uuid").StringValue(); got != "t1" {
+			mt.Errorf("Expected filter on uuid t1, got %s", got)
+		}
+	})
+}
+
+func TestMarkTaskResumePending(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("sets resume_pending with the resume list", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.MarkTaskResumePending(context.Background(), &TaskDocument{UUID: "t1"}, "gpu", "not primary"); err != nil {
+			mt.Fatalf("MarkTaskResumePending: %v", err)
+		}
+
+		stmt := updateStatement(mt)
+		if got := stmt.Lookup("u", "$set", "state").StringValue(); got != TaskStateResumePending {
+			mt.Errorf("Expected state %s, got %s", TaskStateResumePending, got)
+		}
+		if got := stmt.Lookup("u", "$set", "resume_task_list").StringValue(); got != "gpu" {
+			mt.Errorf("Expected resume_task_list gpu, got %s", got)
+		}
+		if got := stmt.Lookup("u", "$set", "resume_error").StringValue(); got != "not primary" {
+			mt.Errorf("Expected resume_error, got %s", got)
+		}
+		if got := stmt.Lookup("q", "uuid").StringValue(); got != "t1" {
+			mt.Errorf("Expected filter on uuid t1, got %s", got)
+		}
+	})
+}
+
+// money is a domain type stored in MongoDB as a Decimal128 amount.
+type money struct {
+	Amount string
+}
+
+var moneyType = reflect.TypeOf(money{})
+
+func encodeMoney(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	d, err := primitive.ParseDecimal128(val.Interface().(money).Amount)
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(d)
+}
+
+func decodeMoney(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	d, err := vr.ReadDecimal128()
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(money{Amount: d.String()}))
+	return nil
+}
+
+func moneyRegistry() *bsoncodec.Registry {
+	reg := bson.NewRegistry()
+	reg.RegisterTypeEncoder(moneyType, bsoncodec.ValueEncoderFunc(encodeMoney))
+	reg.RegisterTypeDecoder(moneyType, bsoncodec.ValueDecoderFunc(decodeMoney))
+	reg.RegisterTypeMapEntry(bsontype.Decimal128, moneyType)
+	return reg
+}
+
+func TestDeclaredReturnTypesStoredAsBSONNumbers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("write", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		returns := map[string]interface{}{"count": float64(3), "ratio": 2}
+		types := map[string]string{"count": "Long", "ratio": "Double"}
+		if err := coerceReturns(returns, types); err != nil {
+			mt.Fatalf("coerceReturns: %v", err)
+		}
+		if err := ops.WriteStepReturns(context.Background(), "step-1", returns); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+
+		set := updateStatement(mt).Lookup("u", "$set").Document()
+		count := set.Lookup("attributes.returns.count")
+		if v := count.Document().Lookup("value"); v.Type != bsontype.Int64 || v.Int64() != 3 {
+			mt.Errorf("Expected count stored as Int64 3, got %v", v)
+		}
+		if hint := count.Document().Lookup("type_hint").StringValue(); hint != "Long" {
+			mt.Errorf("Expected count hinted Long, got %q", hint)
+		}
+		if v := set.Lookup("attributes.returns.ratio", "value"); v.Type != bsontype.Double {
+			mt.Errorf("Expected ratio stored as Double, got %v", v.Type)
+		}
+	})
+}
+
+func TestReplaceStepReturns(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("replaces the returns document", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.ReplaceStepReturns(context.Background(), "step-1", map[string]interface{}{"doubled": 10}); err != nil {
+			mt.Fatalf("ReplaceStepReturns: %v", err)
+		}
+
+		stmt := updateStatement(mt)
+		if got := stmt.Lookup("q", "state").StringValue(); got != StepStateEventTransmit {
+			mt.Errorf("Expected write guarded on EVENT_TRANSMIT, got %q", got)
+		}
+		returns := stmt.Lookup("u", "$set", "attributes.returns").Document()
+		elems, _ := returns.Elements()
+		if len(elems) != 1 || returns.Lookup("doubled", "value").AsInt64() != 10 {
+			mt.Errorf("Expected returns replaced by {doubled: 10}, got %s", returns)
+		}
+	})
+}
+
+func TestCompressedValuesRoundTrip(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("large compressed, small kept", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		ops.CompressThreshold = 256
+		large := map[string]interface{}{"text": strings.Repeat("lorem ipsum ", 100)}
+		returns := map[string]interface{}{"large": large, "small": "short"}
+		if err := ops.WriteStepReturns(context.Background(), "step-1", returns); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+
+		set := updateStatement(mt).Lookup("u", "$set").Document()
+		stored := set.Lookup("attributes.returns.large", "value")
+		if got := stored.Document().Lookup(CompressedMarkerKey).StringValue(); got != CompressionGzipJSON {
+			mt.Fatalf("Expected large value stored with the %s marker, got %s", CompressionGzipJSON, stored)
+		}
+		if _, data := stored.Document().Lookup("data").Binary(); len(data) >= 1200 {
+			mt.Errorf("Expected compressed data smaller than the value, got %d bytes", len(data))
+		}
+		if hint := set.Lookup("attributes.returns.large", "type_hint").StringValue(); hint != "Map" {
+			mt.Errorf("Expected the original type hint kept, got %q", hint)
+		}
+		if got := set.Lookup("attributes.returns.small", "value").StringValue(); got != "short" {
+			mt.Errorf("Expected small value stored as is, got %q", got)
+		}
+
+		// Read the stored values back as params
+		step := bson.D{{Key: "attributes", Value: bson.D{{Key: "params", Value: bson.D{
+			{Key: "large", Value: bson.D{{Key: "name", Value: "large"}, {Key: "value", Value: stored}}},
+			{Key: "small", Value: bson.D{{Key: "name", Value: "small"}, {Key: "value", Value: "short"}}},
+		}}}}}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, step))
+		params, err := ops.ReadStepParams(context.Background(), "step-1")
+		if err != nil {
+			mt.Fatalf("ReadStepParams: %v", err)
+		}
+		if !reflect.DeepEqual(params["large"], large) {
+			mt.Errorf("Expected the large value decompressed, got %v", params["large"])
+		}
+		if params["small"] != "short" {
+			mt.Errorf("Expected the small value unchanged, got %v", params["small"])
+		}
+	})
+
+	mt.Run("disabled by default", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		big := strings.Repeat("x", 4096)
+		if err := ops.WriteStepReturns(context.Background(), "step-1", map[string]interface{}{"big": big}); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+		if got := updateStatement(mt).Lookup("u", "$set", "attributes.returns.big", "value"); got.Type != bsontype.String {
+			mt.Errorf("Expected no compression without a threshold, got %v", got.Type)
+		}
+	})
+}
+
+func TestCustomRegistry(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("write encodes custom type", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ops := NewMongoOps(mt.DB)
+		ops.Registry = moneyRegistry()
+		returns := map[string]interface{}{"price": money{Amount: "12.34"}}
+		if err := ops.WriteStepReturns(context.Background(), "step-1", returns); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+
+		value := updateStatement(mt).Lookup("u", "$set", "attributes.returns.price", "value")
+		if value.Type != bsontype.Decimal128 {
+			mt.Errorf("Expected price stored as Decimal128, got %v", value.Type)
+		}
+	})
+
+	mt.Run("read decodes custom type", func(mt *mtest.T) {
+		d, _ := primitive.ParseDecimal128("99.95")
+		step := bson.D{{Key: "attributes", Value: bson.D{{Key: "params", Value: bson.D{
+			{Key: "price", Value: bson.D{{Key: "name", Value: "price"}, {Key: "value", Value: d}}},
+		}}}}}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, step))
+
+		ops := NewMongoOps(mt.DB)
+		ops.Registry = moneyRegistry()
+		params, err := ops.ReadStepParams(context.Background(), "step-1")
+		if err != nil {
+			mt.Fatalf("ReadStepParams: %v", err)
+		}
+		if got, ok := params["price"].(money); !ok || got.Amount != "99.95" {
+			mt.Errorf("Expected money{99.95}, got %#v", params["price"])
+		}
+	})
+}
+
+func TestInsertResumeTaskDuplicateKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("duplicate key is success", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 11000, Message: "E11000 duplicate key error collection: test.tasks index: name_1_step_id_1",
+		}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", "ns.F"); err != nil {
+			mt.Errorf("Expected duplicate resume insert to succeed, got %v", err)
+		}
+	})
+
+	mt.Run("other write errors propagate", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 121, Message: "Document failed validation",
+		}))
+
+		ops := NewMongoOps(mt.DB)
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", "ns.F"); err == nil {
+			mt.Error("Expected non-duplicate write error to be returned")
+		}
+	})
+}
+
+func TestFindUnresumedSteps(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	distinct := func(values ...interface{}) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "values", Value: append(bson.A{}, values...)})
+	}
+
+	mt.Run("finds finished tasks without a resume", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch,
+				bson.D{{Key: "uuid", Value: "t2"}, {Key: "name", Value: "ns.F"}, {Key: "step_id", Value: "s2"},
+					{Key: "state", Value: TaskStateResumePending}, {Key: "task_list_name", Value: "default"},
+					{Key: "resume_task_list", Value: "gpu"}}),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch,
+				bson.D{{Key: "uuid", Value: "t1"}, {Key: "name", Value: "ns.F"}, {Key: "step_id", Value: "s1"},
+					{Key: "workflow_id", Value: "wf-1"}, {Key: "state", Value: TaskStateCompleted}, {Key: "task_list_name", Value: "default"}},
+				bson.D{{Key: "uuid", Value: "t3"}, {Key: "name", Value: "ns.F"}, {Key: "step_id", Value: "s3"},
+					{Key: "state", Value: TaskStateCompleted}, {Key: "task_list_name", Value: "default"}}),
+			// s1 and s3 still wait; s3 was resumed
+			distinct("s1", "s3"),
+			distinct("s3"),
+		)
+
+		ops := NewMongoOps(mt.DB)
+		steps, err := ops.FindUnresumedSteps(context.Background(), []string{"ns.F"}, "default", 3)
+		if err != nil {
+			mt.Fatalf("FindUnresumedSteps: %v", err)
+		}
+
+		pendingFind := mt.GetStartedEvent()
+		if got := pendingFind.Command.Lookup("filter", "state").StringValue(); got != TaskStateResumePending {
+			mt.Errorf("Expected resume_pending tasks first, got %s", got)
+		}
+		if names, _ := pendingFind.Command.Lookup("filter", "name", "$in").Array().Values(); len(names) != 1 || names[0].StringValue() != "ns.F" {
+			mt.Errorf("Expected tasks scoped to the handlers, got %v", names)
+		}
+		if got := pendingFind.Command.Lookup("limit").AsInt64(); got != 3 {
+			mt.Errorf("Expected the limit applied, got %d", got)
+		}
+		completedFind := mt.GetStartedEvent()
+		if got := completedFind.Command.Lookup("filter", "state").StringValue(); got != TaskStateCompleted {
+			mt.Errorf("Expected completed tasks next, got %s", got)
+		}
+		if got := completedFind.Command.Lookup("limit").AsInt64(); got != 2 {
+			mt.Errorf("Expected the remaining limit applied, got %d", got)
+		}
+		if got := completedFind.Command.Lookup("sort", "updated").AsInt64(); got != -1 {
+			mt.Errorf("Expected newest first, got %d", got)
+		}
+		stepsCheck := mt.GetStartedEvent()
+		if got := stepsCheck.Command.Lookup("query", "state").StringValue(); got != StepStateEventTransmit {
+			mt.Errorf("Expected steps filtered on EVENT_TRANSMIT, got %s", got)
+		}
+		batch, _ := stepsCheck.Command.Lookup("query", "uuid", "$in").Array().Values()
+		if len(batch) != 3 {
+			mt.Errorf("Expected only the tasks' steps checked, got %v", batch)
+		}
+		if got := mt.GetStartedEvent().Command.Lookup("key").StringValue(); got != "step_id" {
+			mt.Errorf("Expected one resume lookup for the batch, got key %s", got)
+		}
+		if extra := mt.GetStartedEvent(); extra != nil {
+			mt.Errorf("Expected four queries, got a fifth: %s", extra.CommandName)
+		}
+
+		if len(steps) != 2 {
+			mt.Fatalf("Expected 2 unresumed steps, got %+v", steps)
+		}
+		if s := steps[0]; s.StepID != "s2" || !s.ResumePending || s.TaskList != "gpu" {
+			mt.Errorf("Unexpected resume_pending step: %+v", s)
+		}
+		if s := steps[1]; s.StepID != "s1" || s.TaskUUID != "t1" || s.WorkflowID != "wf-1" || s.TaskList != "default" || s.ResumePending {
+			mt.Errorf("Unexpected completed step: %+v", s)
+		}
+	})
+
+	mt.Run("checks steps in batches", func(mt *mtest.T) {
+		var completed []bson.D
+		for i := 0; i < unresumedBatchSize+1; i++ {
+			completed = append(completed, bson.D{{Key: "uuid", Value: fmt.Sprintf("t%d", i)}, {Key: "name", Value: "ns.F"},
+				{Key: "step_id", Value: fmt.Sprintf("s%d", i)}, {Key: "state", Value: TaskStateCompleted}})
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, completed...),
+			distinct("s0"), distinct(),
+			distinct(), distinct(),
+		)
+
+		ops := NewMongoOps(mt.DB)
+		steps, err := ops.FindUnresumedSteps(context.Background(), []string{"ns.F"}, "default", 0)
+		if err != nil {
+			mt.Fatalf("FindUnresumedSteps: %v", err)
+		}
+		if len(steps) != 1 || steps[0].StepID != "s0" {
+			mt.Errorf("Expected s0 unresumed, got %+v", steps)
+		}
+
+		if mt.GetStartedEvent().Command.Lookup("limit").Validate() == nil {
+			mt.Error("Expected no limit when none is set")
+		}
+		mt.GetStartedEvent()
+		var sizes []int
+		for ev := mt.GetStartedEvent(); ev != nil; ev = mt.GetStartedEvent() {
+			if ev.Command.Lookup("key").StringValue() == "uuid" {
+				ids, _ := ev.Command.Lookup("query", "uuid", "$in").Array().Values()
+				sizes = append(sizes, len(ids))
+			}
+		}
+		if len(sizes) != 2 || sizes[0] != unresumedBatchSize || sizes[1] != 1 {
+			mt.Errorf("Expected two step batches, got sizes %v", sizes)
+		}
+	})
+}
+
+// opRecord is one observation captured by a test OpRecorder.
+type opRecord struct {
+	op  string
+	err error
+}
+
+func TestOpRecorderCalledPerOp(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("records each instrumented op", func(mt *mtest.T) {
+		var recs []opRecord
+		ops := NewMongoOps(mt.DB)
+		ops.Recorder = OpRecorderFunc(func(op string, d time.Duration, err error) {
+			if d < 0 {
+				t.Errorf("negative duration for %s", op)
+			}
+			recs = append(recs, opRecord{op, err})
+		})
+		ctx := context.Background()
+
+		mt.AddMockResponses(claimedTaskResponse(bson.D{{Key: "uuid", Value: "task-1"}}))
+		if _, err := ops.ClaimTask(ctx, []string{"ns.Facet"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch,
+			bson.D{{Key: "uuid", Value: "step-1"}}))
+		if _, err := ops.ReadStepParams(ctx, "step-1"); err != nil {
+			mt.Fatalf("ReadStepParams: %v", err)
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		if err := ops.WriteStepReturns(ctx, "step-1", map[string]interface{}{"x": 1}); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 2, Message: "bad value",
+		}))
+		if err := ops.InsertResumeTask(ctx, "step-1", "wf-1", "default", "ns.Facet"); err == nil {
+			mt.Fatal("Expected InsertResumeTask error")
+		}
+
+		want := []string{OpClaimTask, OpReadStepParams, OpWriteStepReturns, OpInsertResumeTask}
+		if len(recs) != len(want) {
+			mt.Fatalf("Expected %d observations, got %+v", len(want), recs)
+		}
+		for i, op := range want {
+			if recs[i].op != op {
+				mt.Errorf("observation %d: expected %s, got %s", i, op, recs[i].op)
+			}
+		}
+		for _, r := range recs[:3] {
+			if r.err != nil {
+				mt.Errorf("%s: expected nil error, got %v", r.op, r.err)
+			}
+		}
+		if recs[3].err == nil {
+			mt.Error("Expected insert_resume_task error to be recorded")
+		}
+	})
+
+	mt.Run("uninstrumented op not recorded", func(mt *mtest.T) {
+		var count int
+		ops := NewMongoOps(mt.DB)
+		ops.Recorder = OpRecorderFunc(func(string, time.Duration, error) { count++ })
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		if err := ops.MarkStepCompleted(context.Background(), "step-1"); err != nil {
+			mt.Fatalf("MarkStepCompleted: %v", err)
+		}
+		if count != 0 {
+			mt.Errorf("Expected no observations, got %d", count)
+		}
+	})
+}
+
+// flakyOp returns an op failing with errs in order, then succeeding, and
+// a pointer to its call count.
+func flakyOp(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	stepdown := mongo.CommandError{Code: 189, Name: "PrimarySteppedDown", Labels: []string{"RetryableWriteError"}}
+	txn := mongo.CommandError{Code: 112, Name: "WriteConflict", Labels: []string{"TransientTransactionError"}}
+	ops := &MongoOps{MaxRetries: 2, RetryBackoff: time.Millisecond}
+
+	op, calls := flakyOp(stepdown, txn)
+	if err := ops.retry(context.Background(), op); err != nil {
+		t.Fatalf("Expected success after transient errors, got %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", *calls)
+	}
+
+	op, calls = flakyOp(stepdown, stepdown, stepdown)
+	if err := ops.retry(context.Background(), op); err == nil {
+		t.Error("Expected error once retries are exhausted")
+	}
+	if *calls != 3 {
+		t.Errorf("Expected MaxRetries+1 attempts, got %d", *calls)
+	}
+}
+
+func TestRetryNonTransientReturnsImmediately(t *testing.T) {
+	ops := &MongoOps{MaxRetries: 5, RetryBackoff: time.Millisecond}
+
+	for _, err := range []error{
+		mongo.ErrNoDocuments,
+		mongo.CommandError{Code: 2, Name: "BadValue"},
+		mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}},
+	} {
+		op, calls := flakyOp(err)
+		if got := ops.retry(context.Background(), op); got == nil {
+			t.Errorf("Expected %v returned, got nil", err)
+		}
+		if *calls != 1 {
+			t.Errorf("%v: expected a single attempt, got %d", err, *calls)
+		}
+	}
+}
+
+func TestRetryStopsOnContextDone(t *testing.T) {
+	ops := &MongoOps{MaxRetries: 5, RetryBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	op, calls := flakyOp(mongo.CommandError{Labels: []string{"RetryableWriteError"}})
+	if err := ops.retry(ctx, op); err == nil {
+		t.Error("Expected the transient error when ctx is done")
+	}
+	if *calls != 1 {
+		t.Errorf("Expected no retry after ctx done, got %d attempts", *calls)
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	ops := &MongoOps{}
+	op, calls := flakyOp(mongo.CommandError{Labels: []string{"RetryableWriteError"}})
+	if err := ops.retry(context.Background(), op); err == nil {
+		t.Error("Expected error with retries disabled")
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 attempt, got %d", *calls)
+	}
+}
+
+func TestGetTaskAndStep(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("found", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ctx := context.Background()
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, bson.D{
+			{Key: "uuid", Value: "task-1"},
+			{Key: "state", Value: TaskStateFailed},
+			{Key: "error", Value: bson.D{{Key: "message", Value: "boom"}}},
+		}))
+		task, err := ops.GetTask(ctx, "task-1")
+		if err != nil {
+			mt.Fatalf("GetTask: %v", err)
+		}
+		if task.UUID != "task-1" || task.State != TaskStateFailed || task.Error["message"] != "boom" {
+			mt.Errorf("Unexpected task %+v", task)
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{
+			{Key: "uuid", Value: "step-1"},
+			{Key: "state", Value: StepStateEventTransmit},
+			{Key: "attributes", Value: bson.D{{Key: "params", Value: bson.D{
+				{Key: "x", Value: bson.D{{Key: "name", Value: "x"}, {Key: "value", Value: int32(3)}}},
+			}}}},
+		}))
+		step, err := ops.GetStep(ctx, "step-1")
+		if err != nil {
+			mt.Fatalf("GetStep: %v", err)
+		}
+		if step.State != StepStateEventTransmit || step.Attributes.Params["x"].Value != int32(3) {
+			mt.Errorf("Unexpected step %+v", step)
+		}
+
+		for _, want := range []string{"tasks", "steps"} {
+			evt := mt.GetStartedEvent()
+			if got := evt.Command.Lookup("find").StringValue(); got != want {
+				mt.Errorf("Expected find on %s, got %s", want, got)
+			}
+		}
+	})
+
+	mt.Run("not found", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ctx := context.Background()
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch))
+		_, err := ops.GetTask(ctx, "missing")
+		var nf *NotFoundError
+		if !errors.As(err, &nf) || nf.Kind != "task" || nf.UUID != "missing" {
+			mt.Errorf("Expected task NotFoundError, got %v", err)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			mt.Error("Expected errors.Is(err, ErrNotFound)")
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch))
+		_, err = ops.GetStep(ctx, "missing")
+		if !errors.As(err, &nf) || nf.Kind != "step" {
+			mt.Errorf("Expected step NotFoundError, got %v", err)
+		}
+	})
+}
+
+func TestResumeTaskNameOverride(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("overridden", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.ResumeTaskName = "afl:resume:v2"
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", "ns.Facet"); err != nil {
+			mt.Fatalf("InsertResumeTask: %v", err)
+		}
+
+		doc := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		if got := doc.Lookup("name").StringValue(); got != "afl:resume:v2:ns.Facet" {
+			mt.Errorf("Expected afl:resume:v2:ns.Facet, got %s", got)
+		}
+	})
+
+	mt.Run("default", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", ""); err != nil {
+			mt.Fatalf("InsertResumeTask: %v", err)
+		}
+
+		doc := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		if got := doc.Lookup("name").StringValue(); got != ResumeTaskName {
+			mt.Errorf("Expected %s, got %s", ResumeTaskName, got)
+		}
+	})
+}
+
+func TestDebugCommandsMonitor(t *testing.T) {
+	if NewAgentPoller(DefaultConfig()).clientOptions().Monitor != nil {
+		t.Error("Command monitoring must be off by default")
+	}
+
+	cfg := DefaultConfig()
+	cfg.DebugCommands = true
+	poller := NewAgentPoller(cfg)
+	logger := &captureLogger{}
+	poller.SetLogger(logger)
+	monitor := poller.clientOptions().Monitor
+	if monitor == nil {
+		t.Fatal("Expected a command monitor with DebugCommands")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("claim events", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(claimedTaskResponse(bson.D{{Key: "uuid", Value: "t1"}}))
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.Facet"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+
+		// Replay the driver's events for the claim through the monitor
+		monitor.Started(context.Background(), mt.GetStartedEvent())
+		monitor.Succeeded(context.Background(), mt.GetSucceededEvent())
+	})
+
+	if len(logger.msgs) != 2 {
+		t.Fatalf("Expected started and succeeded events, got %v", logger.msgs)
+	}
+	if logger.msgs[0] != "Mongo command started" || logger.msgs[1] != "Mongo command succeeded" {
+		t.Errorf("Unexpected messages %v", logger.msgs)
+	}
+	started := logger.fields[0]
+	if started["command_name"] != "findAndModify" {
+		t.Errorf("Expected findAndModify, got %v", started["command_name"])
+	}
+	if cmd, _ := started["command"].(string); !strings.Contains(cmd, "ns.Facet") {
+		t.Errorf("Expected claim filter in logged command, got %s", cmd)
+	}
+}
+
+func TestFieldMapRemapsSchema(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("claim and complete", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.FieldMap = FieldMap{"uuid": "id", "state": "status", "attributes": "attrs"}
+		ctx := context.Background()
+
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "id", Value: "t1"},
+			{Key: "status", Value: TaskStateRunning},
+			{Key: "name", Value: "ns.Facet"},
+		}))
+		task, err := ops.ClaimTask(ctx, []string{"ns.Facet"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task.UUID != "t1" || task.State != TaskStateRunning || task.Name != "ns.Facet" {
+			mt.Errorf("Expected remapped fields decoded, got %+v", task)
+		}
+
+		claim := mt.GetStartedEvent().Command
+		if claim.Lookup("query", "status").StringValue() != TaskStatePending {
+			mt.Errorf("Expected claim filter on status, got %s", claim.Lookup("query"))
+		}
+		if _, err := claim.LookupErr("query", "state"); err == nil {
+			mt.Error("Canonical state must not appear in a remapped filter")
+		}
+		if claim.Lookup("update", "$set", "status").StringValue() != TaskStateRunning {
+			mt.Errorf("Expected $set on status, got %s", claim.Lookup("update"))
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		if err := ops.MarkTaskCompleted(ctx, task); err != nil {
+			mt.Fatalf("MarkTaskCompleted: %v", err)
+		}
+		stmt := updateStatement(mt)
+		if stmt.Lookup("q", "id").StringValue() != "t1" {
+			mt.Errorf("Expected filter on id, got %s", stmt.Lookup("q"))
+		}
+		if stmt.Lookup("u", "$set", "status").StringValue() != TaskStateCompleted {
+			mt.Errorf("Expected status completed, got %s", stmt.Lookup("u"))
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		if err := ops.WriteStepReturns(ctx, "s1", map[string]interface{}{"x": 1}); err != nil {
+			mt.Fatalf("WriteStepReturns: %v", err)
+		}
+		if _, err := updateStatement(mt).LookupErr("u", "$set", "attrs.returns.x"); err != nil {
+			mt.Errorf("Expected attrs.returns.x to be set: %v", err)
+		}
+	})
+
+	mt.Run("step read and resume insert", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.FieldMap = FieldMap{"uuid": "id", "state": "status", "attributes": "attrs"}
+		ctx := context.Background()
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{
+			{Key: "id", Value: "s1"},
+			{Key: "attrs", Value: bson.D{{Key: "params", Value: bson.D{
+				{Key: "x", Value: bson.D{{Key: "name", Value: "x"}, {Key: "value", Value: "v"}}},
+			}}}},
+		}))
+		params, err := ops.ReadStepParams(ctx, "s1")
+		if err != nil {
+			mt.Fatalf("ReadStepParams: %v", err)
+		}
+		if params["x"] != "v" {
+			mt.Errorf("Expected params read from remapped attributes, got %v", params)
+		}
+		if mt.GetStartedEvent().Command.Lookup("filter", "id").StringValue() != "s1" {
+			mt.Error("Expected step lookup by id")
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		if err := ops.InsertResumeTask(ctx, "s1", "wf-1", "default", "ns.Facet"); err != nil {
+			mt.Fatalf("InsertResumeTask: %v", err)
+		}
+		doc := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		if doc.Lookup("status").StringValue() != TaskStatePending || doc.Lookup("id").StringValue() == "" {
+			mt.Errorf("Expected resume task in remapped schema, got %s", doc)
+		}
+		if _, err := doc.LookupErr("uuid"); err == nil {
+			mt.Error("Canonical uuid must not be inserted")
+		}
+	})
+}
+
+func TestClaimableStates(t *testing.T) {
+	ops := &MongoOps{}
+	if got := ops.claimFilter([]string{"ns.F"}, "default")["state"]; got != TaskStatePending {
+		t.Errorf("Expected pending by default, got %v", got)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("claims from configured states", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.ClaimableStates = []string{TaskStatePending, "retry", "scheduled"}
+
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "uuid", Value: "task-1"}, {Key: "name", Value: "ns.F"}, {Key: "state", Value: TaskStateRunning},
+		}))
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task == nil || task.UUID != "task-1" {
+			mt.Fatalf("Expected task-1 claimed, got %+v", task)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		values, _ := cmd.Lookup("query", "state", "$in").Array().Values()
+		var states []string
+		for _, v := range values {
+			states = append(states, v.StringValue())
+		}
+		if got := strings.Join(states, ","); got != "pending,retry,scheduled" {
+			mt.Errorf("Expected state $in [pending retry scheduled], got %s", got)
+		}
+		if got := cmd.Lookup("update", "$set", "state").StringValue(); got != TaskStateRunning {
+			mt.Errorf("Expected claim to set running, got %q", got)
+		}
+	})
+}
+
+func TestInFlightStatesNeverClaimable(t *testing.T) {
+	for _, tc := range []struct {
+		states []string
+		want   interface{}
+	}{
+		{[]string{TaskStatePending, TaskStateRunning}, TaskStatePending},
+		{[]string{TaskStateResumePending, TaskStateFailed}, TaskStateFailed},
+		{[]string{TaskStatePending, TaskStateRunning, TaskStateResumePending, TaskStateFailed}, bson.M{"$in": []string{TaskStatePending, TaskStateFailed}}},
+	} {
+		ops := &MongoOps{ClaimableStates: tc.states}
+		if got := ops.claimFilter([]string{"ns.F"}, "default")["state"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("States %v: expected state condition %v, got %v", tc.states, tc.want, got)
+		}
+	}
+}
+
+func TestCanceledNeverClaimable(t *testing.T) {
+	for _, tc := range []struct {
+		states []string
+		want   interface{}
+	}{
+		{[]string{TaskStateFailed, TaskStateCanceled}, TaskStateFailed},
+		{[]string{TaskStateCanceled, TaskStatePending, TaskStateFailed}, bson.M{"$in": []string{TaskStatePending, TaskStateFailed}}},
+		{[]string{TaskStateCanceled}, bson.M{"$in": []string{}}},
+	} {
+		ops := &MongoOps{ClaimableStates: tc.states}
+		if got := ops.claimFilter([]string{"ns.F"}, "default")["state"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("States %v: expected state condition %v, got %v", tc.states, tc.want, got)
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("claim filter hook cannot reach canceled", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.ClaimableStates = []string{TaskStateFailed, TaskStateCanceled}
+		ops.ClaimFilterFunc = func(base bson.M) bson.M {
+			base["state"] = bson.M{"$in": bson.A{TaskStateCanceled}}
+			return base
+		}
+
+		mt.AddMockResponses(claimedTaskResponse(nil))
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if got := cmd.Lookup("query", "state").StringValue(); got != TaskStateFailed {
+			mt.Errorf("Expected the claim to match failed only, got %v", cmd.Lookup("query", "state"))
+		}
+	})
+}
+
+func TestDeniedTaskListsNeverClaimed(t *testing.T) {
+	ops := &MongoOps{AllowedTaskLists: []string{"default", "batch"}, DeniedTaskLists: []string{"batch"}}
+	for list, permitted := range map[string]bool{"default": true, "batch": false, "other": false} {
+		got := ops.claimFilter([]string{"ns.F"}, list)["task_list_name"]
+		if permitted && got != list {
+			t.Errorf("Expected %q claimable, got task_list_name %v", list, got)
+		}
+		if !permitted && !reflect.DeepEqual(got, bson.M{"$in": bson.A{}}) {
+			t.Errorf("Expected %q never matched, got task_list_name %v", list, got)
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("claim filter hook cannot reach a denied list", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.DeniedTaskLists = []string{"tenant-b"}
+		ops.ClaimFilterFunc = func(base bson.M) bson.M {
+			base["task_list_name"] = "tenant-b"
+			return base
+		}
+
+		mt.AddMockResponses(claimedTaskResponse(nil))
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "tenant-b"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		query := mt.GetStartedEvent().Command.Lookup("query")
+		if values, err := query.Document().Lookup("task_list_name", "$in").Array().Values(); err != nil || len(values) != 0 {
+			mt.Errorf("Expected the denied list matched by nothing, got %v", query)
+		}
+
+		mt.AddMockResponses(claimedTaskResponse(nil))
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "tenant-a"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		query = mt.GetStartedEvent().Command.Lookup("query")
+		if got := query.Document().Lookup("task_list_name").StringValue(); got != "tenant-a" {
+			mt.Errorf("Expected the permitted list claimed as requested, got %v", query)
+		}
+	})
+}
+
+func TestClaimFilterFunc(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("hook varies per cycle but keeps mandatory fields", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		tenants := []string{"a", "b"}
+		cycle := 0
+		ops.ClaimFilterFunc = func(base bson.M) bson.M {
+			base["data.tenant"] = tenants[cycle%len(tenants)]
+			cycle++
+			// Attempts to widen the claim are undone
+			base["state"] = TaskStateRunning
+			base["task_list_name"] = "other"
+			delete(base, "name")
+			return base
+		}
+
+		for i, tenant := range tenants {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+			if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+				mt.Fatalf("ClaimTask %d: %v", i, err)
+			}
+			query := mt.GetStartedEvent().Command.Lookup("query").Document()
+			if got := query.Lookup("data.tenant").StringValue(); got != tenant {
+				mt.Errorf("Cycle %d: expected tenant %q, got %q", i, tenant, got)
+			}
+			if got := query.Lookup("state").StringValue(); got != TaskStatePending {
+				mt.Errorf("Cycle %d: expected state pending restored, got %q", i, got)
+			}
+			if got := query.Lookup("task_list_name").StringValue(); got != "default" {
+				mt.Errorf("Cycle %d: expected task list restored, got %q", i, got)
+			}
+			if _, err := query.LookupErr("name"); err != nil {
+				mt.Errorf("Cycle %d: expected name constraint restored", i)
+			}
+		}
+	})
+
+	ops := &MongoOps{ClaimFilterFunc: func(bson.M) bson.M { return nil }}
+	if got := ops.claimQuery([]string{"ns.F"}, "default")["state"]; got != TaskStatePending {
+		t.Errorf("Expected a nil result to keep the standard filter, got state %v", got)
+	}
+}
+
+func TestClaimFilterAcceptedDataTypes(t *testing.T) {
+	ops := &MongoOps{}
+	if _, ok := ops.claimFilter([]string{"ns.F"}, "default")["data_type"]; ok {
+		t.Error("Expected no data_type constraint by default")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("unlisted data type not claimed", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.AcceptedDataTypes = []string{"event"}
+
+		// The server finds nothing matching, e.g. only a "resume" task exists
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task != nil {
+			mt.Errorf("Expected no task claimed, got %+v", task)
+		}
+
+		in := mt.GetStartedEvent().Command.Lookup("query", "data_type", "$in").Array()
+		values, _ := in.Values()
+		if len(values) != 1 || values[0].StringValue() != "event" {
+			mt.Errorf("Expected data_type $in [event], got %s", in)
+		}
+	})
+}
+
+func TestClaimFilterBusyWorkflows(t *testing.T) {
+	ops := &MongoOps{BusyWorkflows: func() []string { return nil }}
+	if _, ok := ops.claimFilter([]string{"ns.F"}, "default")["workflow_id"]; ok {
+		t.Error("Expected no workflow_id constraint without busy workflows")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("busy workflows skipped", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.BusyWorkflows = func() []string { return []string{"wf-1"} }
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+
+		nin := mt.GetStartedEvent().Command.Lookup("query", "workflow_id", "$nin").Array()
+		values, _ := nin.Values()
+		if len(values) != 1 || values[0].StringValue() != "wf-1" {
+			mt.Errorf("Expected workflow_id $nin [wf-1], got %s", nin)
+		}
+	})
+}
+
+func TestClaimFilterBusySteps(t *testing.T) {
+	ops := &MongoOps{BusySteps: func() []string { return []string{"step-1", "step-2"} }}
+	filter := ops.claimFilter([]string{"ns.F"}, "default")
+	nin, ok := filter["step_id"].(bson.M)["$nin"].([]string)
+	if !ok || len(nin) != 2 {
+		t.Errorf("Expected step_id $nin the busy steps, got %v", filter["step_id"])
+	}
+}
+
+func TestReadStepParamsStepNotAwaitingReturns(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("completed step", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{
+			{Key: "uuid", Value: "step-1"},
+			{Key: "state", Value: StepStateCompleted},
+		}))
+		if _, err := ops.ReadStepParams(context.Background(), "step-1"); !errors.Is(err, ErrStepNotWritable) {
+			mt.Errorf("Expected ErrStepNotWritable, got %v", err)
+		}
+	})
+}
+
+func TestDeferTask(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("run_at in the future", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		before := NowMillis()
+		if err := ops.DeferTask(context.Background(), &TaskDocument{UUID: "task-1"}, 2*time.Second); err != nil {
+			mt.Fatalf("DeferTask: %v", err)
+		}
+		update := updateStatement(mt)
+		set := update.Lookup("u", "$set").Document()
+		if got := set.Lookup("state").StringValue(); got != TaskStatePending {
+			mt.Errorf("Expected pending, got %q", got)
+		}
+		if runAt := set.Lookup("run_at").Int64(); runAt < before+2000 {
+			mt.Errorf("Expected run_at at least 2s ahead, got %d (now %d)", runAt, before)
+		}
+		if _, ok := set.Lookup("error").DocumentOK(); ok {
+			mt.Error("Expected a deferral to leave the error alone")
+		}
+	})
+}
+
+func TestClaimFilterExcludesResumeTasks(t *testing.T) {
+	ops := &MongoOps{ResumeTaskName: "afl:resume"}
+	names := []string{"ns.F", ResumeTaskName, ResumeTaskName + ":ns.F", "afl:resume", "afl:resume:ns.F", ExecuteTaskName}
+
+	got := ops.claimFilter(names, "default")["name"].(bson.M)["$in"].([]string)
+	if strings.Join(got, ",") != "ns.F,"+ExecuteTaskName {
+		t.Errorf("Expected only ns.F and an explicitly handled %s, got %v", ExecuteTaskName, got)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("resume handler never claims", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		task, err := ops.ClaimTask(context.Background(), []string{ResumeTaskName}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task != nil {
+			mt.Errorf("Expected nothing claimed, got %+v", task)
+		}
+
+		in := mt.GetStartedEvent().Command.Lookup("query", "name", "$in").Array()
+		if values, _ := in.Values(); len(values) != 0 {
+			mt.Errorf("Expected an empty name list, got %s", in)
+		}
+	})
+}
+
+func TestMarkTaskFailedWithStack(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("stores stack", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		task := &TaskDocument{UUID: "task-1"}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := ops.MarkTaskFailedWithStack(context.Background(), task, "handler panic: kaboom", "goroutine 1 [running]:"); err != nil {
+			mt.Fatalf("MarkTaskFailedWithStack: %v", err)
+		}
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := ops.MarkTaskFailed(context.Background(), task, "plain"); err != nil {
+			mt.Fatalf("MarkTaskFailed: %v", err)
+		}
+
+		errDoc := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set", "error").Document()
+		if got := errDoc.Lookup("stack").StringValue(); got != "goroutine 1 [running]:" {
+			mt.Errorf("Expected error.stack set, got %q", got)
+		}
+		errDoc = mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set", "error").Document()
+		if _, err := errDoc.LookupErr("stack"); err == nil {
+			mt.Error("Expected no error.stack without a stack")
+		}
+	})
+}
+
+func TestClaimFilterPrefixPatterns(t *testing.T) {
+	ops := &MongoOps{}
+	name := ops.claimFilter([]string{"ns.F", "billing.*"}, "default")["name"].(bson.M)
+
+	in := name["$in"].(bson.A)
+	if len(in) != 2 || in[0] != "ns.F" {
+		t.Fatalf("Expected ns.F plus one pattern, got %v", in)
+	}
+	if re, ok := in[1].(primitive.Regex); !ok || re.Pattern != `^billing\.` {
+		t.Errorf("Expected anchored prefix regex, got %v", in[1])
+	}
+	if re, ok := name["$not"].(primitive.Regex); !ok || !strings.Contains(re.Pattern, "fw:resume") {
+		t.Errorf("Expected resume tasks excluded, got %v", name["$not"])
+	}
+}
+
+func TestReclaimStaleTasksGracePeriod(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	stale := bson.D{
+		{Key: "uuid", Value: "task-1"},
+		{Key: "name", Value: "ns.F"},
+		{Key: "state", Value: TaskStateRunning},
+		{Key: "updated", Value: int64(100)},
+		{Key: "task_list_name", Value: "default"},
+	}
+
+	mt.Run("lease renewed during grace", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, stale),
+			// The owner renewed, so the lease no longer matches
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+		)
+
+		start := time.Now()
+		n, err := ops.ReclaimStaleTasks(context.Background(), []string{"ns.F"}, "default", time.Minute, 20*time.Millisecond)
+		if err != nil {
+			mt.Fatalf("ReclaimStaleTasks: %v", err)
+		}
+		if n != 0 {
+			mt.Errorf("Expected the renewed task not reclaimed, got %d", n)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			mt.Errorf("Expected the grace period to be waited, took %v", elapsed)
+		}
+
+		find := mt.GetStartedEvent()
+		if got := find.Command.Lookup("filter", "state").StringValue(); got != TaskStateRunning {
+			mt.Errorf("Expected running tasks searched, got %s", got)
+		}
+		update := mt.GetStartedEvent()
+		q := update.Command.Lookup("updates", "0", "q")
+		if got := q.Document().Lookup("updated").Int64(); got != 100 {
+			mt.Errorf("Expected the reset conditioned on the observed lease, got %d", got)
+		}
+	})
+
+	mt.Run("still stale", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, stale),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		n, err := ops.ReclaimStaleTasks(context.Background(), []string{"ns.F"}, "default", time.Minute, time.Millisecond)
+		if err != nil {
+			mt.Fatalf("ReclaimStaleTasks: %v", err)
+		}
+		if n != 1 {
+			mt.Errorf("Expected the stale task reclaimed, got %d", n)
+		}
+	})
+
+	mt.Run("directed tasks stay directed", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.RunnerID = "runner-a"
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, stale),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if _, err := ops.ReclaimStaleTasks(context.Background(), []string{"ns.F"}, "default", time.Minute, 0); err != nil {
+			mt.Fatalf("ReclaimStaleTasks: %v", err)
+		}
+
+		find := mt.GetStartedEvent()
+		if got := find.Command.Lookup("filter", "runner_id").StringValue(); got != "runner-a" {
+			mt.Errorf("Expected only this runner's tasks reclaimed, got runner_id %q", got)
+		}
+		set := updateStatement(mt).Lookup("u", "$set").Document()
+		if _, err := set.LookupErr("runner_id"); err == nil {
+			mt.Error("Expected the reclaim to leave runner_id alone")
+		}
+	})
+}
+
+func TestClaimTaskTimestampUnits(t *testing.T) {
+	const createdMs = int64(1700000000000)
+	cases := []struct {
+		unit    TimestampUnit
+		stored  interface{}
+		ageType bsontype.Type
+	}{
+		{TimestampMillis, createdMs, bsontype.Int64},
+		{TimestampSeconds, createdMs / 1000, bsontype.Int64},
+		{TimestampDate, primitive.DateTime(createdMs), bsontype.DateTime},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range cases {
+		tc := tc
+		mt.Run(string(tc.unit), func(mt *mtest.T) {
+			ops := NewMongoOps(mt.DB)
+			ops.OrderField = "created"
+			ops.TimestampUnit = tc.unit
+			ops.MaxTaskAge = time.Hour
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+				{Key: "uuid", Value: "task-1"},
+				{Key: "state", Value: TaskStateRunning},
+				{Key: "created", Value: tc.stored},
+				{Key: "updated", Value: tc.stored},
+			}}))
+			task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+			if err != nil {
+				mt.Fatalf("ClaimTask: %v", err)
+			}
+			if task.Created != createdMs || task.Updated != createdMs {
+				mt.Errorf("Expected timestamps decoded to %d ms, got %d/%d", createdMs, task.Created, task.Updated)
+			}
+
+			cmd := mt.GetStartedEvent().Command
+			sort := cmd.Lookup("sort").Document()
+			if dir, ok := sort.Lookup("created").AsInt64OK(); !ok || dir != 1 {
+				mt.Errorf("Expected oldest-first sort on created, got %s", sort)
+			}
+			age := cmd.Lookup("query", "created", "$gte")
+			if age.Type != tc.ageType {
+				mt.Errorf("Expected age filter stored as %s, got %s", tc.ageType, age.Type)
+			}
+			if got := cmd.Lookup("update", "$set", "updated").Type; got != tc.ageType {
+				mt.Errorf("Expected updated written as %s, got %s", tc.ageType, got)
+			}
+		})
+	}
+}
+
+func TestInsertResumeTaskTimestampUnit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("seconds", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.TimestampUnit = TimestampSeconds
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		before := NowMillis() / 1000
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", ""); err != nil {
+			mt.Fatalf("InsertResumeTask: %v", err)
+		}
+
+		doc := mt.GetStartedEvent().Command.Lookup("documents", "0").Document()
+		created, ok := doc.Lookup("created").AsInt64OK()
+		if !ok || created < before || created > before+1 {
+			mt.Errorf("Expected created in seconds near %d, got %v", before, doc.Lookup("created"))
+		}
+	})
+}
+
+func TestCompleteWithReturns(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	task := &TaskDocument{UUID: "task-1", StepID: "step-1"}
+
+	mt.Run("success", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"}); err != nil {
+			mt.Fatalf("CompleteWithReturns: %v", err)
+		}
+
+		step := mt.GetStartedEvent()
+		if got := step.Command.Lookup("update").StringValue(); got != CollectionSteps {
+			mt.Fatalf("Expected the step written first, got %s", got)
+		}
+		set := step.Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("state").StringValue(); got != StepStateCompleted {
+			mt.Errorf("Expected step completed in the same update, got %s", got)
+		}
+		if got := set.Lookup("attributes.returns.out", "value").StringValue(); got != "x" {
+			mt.Errorf("Expected return written in the same update, got %q", got)
+		}
+		if got := set.Lookup("completed_by_task").StringValue(); got != "task-1" {
+			mt.Errorf("Expected the completing task recorded, got %q", got)
+		}
+		taskUpdate := mt.GetStartedEvent()
+		if got := taskUpdate.Command.Lookup("updates", "0", "u", "$set", "state").StringValue(); got != TaskStateCompleted {
+			mt.Errorf("Expected task completed, got %s", got)
+		}
+		if extra := mt.GetStartedEvent(); extra != nil {
+			mt.Errorf("Expected two round trips, got a third: %s", extra.CommandName)
+		}
+	})
+
+	mt.Run("step not writable", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{{Key: "n", Value: 0}}),
+		)
+
+		err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"})
+		if !errors.Is(err, ErrStepNotWritable) {
+			mt.Fatalf("Expected ErrStepNotWritable, got %v", err)
+		}
+		mt.GetStartedEvent()
+		mt.GetStartedEvent()
+		if extra := mt.GetStartedEvent(); extra != nil {
+			mt.Errorf("Expected the task left alone, got %s", extra.CommandName)
+		}
+	})
+
+	mt.Run("already completed by this task", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{{Key: "n", Value: 1}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"}); err != nil {
+			mt.Fatalf("Expected a step completed by this task to count as success, got %v", err)
+		}
+		mt.GetStartedEvent()
+		count := mt.GetStartedEvent()
+		filter := count.Command.Lookup("pipeline", "0", "$match")
+		if got := filter.Document().Lookup("completed_by_task").StringValue(); got != "task-1" {
+			mt.Errorf("Expected the check scoped to the task, got %v", filter)
+		}
+		taskUpdate := mt.GetStartedEvent()
+		if taskUpdate == nil || taskUpdate.CommandName != "update" {
+			mt.Fatalf("Expected the task marked completed, got %v", taskUpdate)
+		}
+	})
+
+	mt.Run("task not marked completed", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Name: "BadValue", Message: "bad"}),
+		)
+
+		err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"})
+		if !errors.Is(err, ErrTaskNotCompleted) {
+			mt.Fatalf("Expected ErrTaskNotCompleted, got %v", err)
+		}
+	})
+
+	mt.Run("transactions unsupported", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.UseTransactions = true
+		mt.AddMockResponses(
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 20, Name: "IllegalOperation", Message: "Transaction numbers are only allowed on a replica set member or mongos"}),
+			mtest.CreateSuccessResponse(), // abortTransaction
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"}); err != nil {
+			mt.Fatalf("Expected sequential fallback, got %v", err)
+		}
+	})
+
+	mt.Run("transaction", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.UseTransactions = true
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(), // commitTransaction
+		)
+
+		if err := ops.CompleteWithReturns(context.Background(), task, "step-1", map[string]interface{}{"out": "x"}); err != nil {
+			mt.Fatalf("CompleteWithReturns: %v", err)
+		}
+		var names []string
+		for ev := mt.GetStartedEvent(); ev != nil; ev = mt.GetStartedEvent() {
+			names = append(names, ev.CommandName)
+		}
+		if strings.Join(names, ",") != "update,update,commitTransaction" {
+			mt.Errorf("Expected both updates committed in one transaction, got %v", names)
+		}
+	})
+}
+
+// BenchmarkCompletion compares CompleteWithReturns with the three-call path
+// it replaces for terminal steps. It needs a replica set or standalone server, given by
+// AFL_BENCH_MONGODB_URL, and is skipped otherwise.
+func BenchmarkCompletion(b *testing.B) {
+	url := os.Getenv("AFL_BENCH_MONGODB_URL")
+	if url == "" {
+		b.Skip("AFL_BENCH_MONGODB_URL not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database("afl_bench")
+	defer db.Drop(ctx)
+	ops := NewMongoOps(db)
+	returns := map[string]interface{}{"out": "x", "n": 3}
+
+	seq := 0
+	seed := func(b *testing.B) *TaskDocument {
+		b.StopTimer()
+		defer b.StartTimer()
+		seq++
+		task := &TaskDocument{UUID: fmt.Sprintf("task-%d", seq), StepID: fmt.Sprintf("step-%d", seq), State: TaskStateRunning}
+		if _, err := db.Collection(CollectionTasks).InsertOne(ctx, task); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := db.Collection(CollectionSteps).InsertOne(ctx, bson.M{"uuid": task.StepID, "state": StepStateEventTransmit}); err != nil {
+			b.Fatal(err)
+		}
+		return task
+	}
+
+	b.Run("three-call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			task := seed(b)
+			if err := ops.WriteStepReturns(ctx, task.StepID, returns); err != nil {
+				b.Fatal(err)
+			}
+			if err := ops.MarkStepCompleted(ctx, task.StepID); err != nil {
+				b.Fatal(err)
+			}
+			if err := ops.MarkTaskCompleted(ctx, task); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("complete-with-returns", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			task := seed(b)
+			if err := ops.CompleteWithReturns(ctx, task, task.StepID, returns); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMarkTasksBulk(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	tasks := []*TaskDocument{{UUID: "task-1"}, {UUID: "task-2", Attempts: 3}}
+
+	mt.Run("completed", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 2}))
+
+		n, err := ops.MarkTasksCompleted(context.Background(), tasks)
+		if err != nil {
+			mt.Fatalf("MarkTasksCompleted: %v", err)
+		}
+		if n != 2 {
+			mt.Errorf("Expected 2 tasks transitioned, got %d", n)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		if cmd.Lookup("ordered").Boolean() {
+			mt.Error("Expected an unordered bulk write")
+		}
+		for i, task := range tasks {
+			update := cmd.Lookup("updates", fmt.Sprint(i)).Document()
+			if got := update.Lookup("q", "uuid").StringValue(); got != task.UUID {
+				mt.Errorf("Expected update %d for %s, got %s", i, task.UUID, got)
+			}
+			if got := update.Lookup("q", "state").StringValue(); got != TaskStateRunning {
+				mt.Errorf("Expected update %d guarded on running, got %q", i, got)
+			}
+			if got := update.Lookup("u", "$set", "state").StringValue(); got != TaskStateCompleted {
+				mt.Errorf("Expected update %d to set completed, got %q", i, got)
+			}
+		}
+	})
+
+	mt.Run("failed", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		n, err := ops.MarkTasksFailed(context.Background(), tasks, "evacuated")
+		if err != nil {
+			mt.Fatalf("MarkTasksFailed: %v", err)
+		}
+		if n != 1 {
+			mt.Errorf("Expected the modified count reported, got %d", n)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		for i, task := range tasks {
+			set := cmd.Lookup("updates", fmt.Sprint(i), "u", "$set").Document()
+			if got := set.Lookup("state").StringValue(); got != TaskStateFailed {
+				mt.Errorf("Expected update %d to set failed, got %q", i, got)
+			}
+			if got := set.Lookup("error", "message").StringValue(); got != "evacuated" {
+				mt.Errorf("Expected error message on update %d, got %q", i, got)
+			}
+			if got := set.Lookup("error", "attempts").Int32(); int(got) != task.Attempts {
+				mt.Errorf("Expected attempts %d on update %d, got %d", task.Attempts, i, got)
+			}
+		}
+	})
+
+	mt.Run("empty", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		if n, err := ops.MarkTasksCompleted(context.Background(), nil); n != 0 || err != nil {
+			mt.Errorf("Expected a no-op, got %d, %v", n, err)
+		}
+		if ev := mt.GetStartedEvent(); ev != nil {
+			mt.Errorf("Expected no command, got %s", ev.CommandName)
+		}
+	})
+}
+
+func TestCanceledTasks(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("reads reasons", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch,
+			bson.D{{Key: "uuid", Value: "task-1"}, {Key: "cancel_reason", Value: "user request"},
+				{Key: "data", Value: bson.D{{Key: "cancel_reason", Value: "ignored"}}}},
+			bson.D{{Key: "uuid", Value: "task-2"}, {Key: "data", Value: bson.D{{Key: "cancel_reason", Value: "timeout"}}}},
+			bson.D{{Key: "uuid", Value: "task-3"}},
+		))
+
+		canceled, err := ops.CanceledTasks(context.Background(), []string{"task-1", "task-2", "task-3", "task-4"})
+		if err != nil {
+			mt.Fatalf("CanceledTasks: %v", err)
+		}
+		want := map[string]string{"task-1": "user request", "task-2": "timeout", "task-3": ""}
+		if !reflect.DeepEqual(canceled, want) {
+			mt.Errorf("Expected %v, got %v", want, canceled)
+		}
+		if got := mt.GetStartedEvent().Command.Lookup("filter", "state").StringValue(); got != TaskStateCanceled {
+			mt.Errorf("Expected filter on canceled, got %q", got)
+		}
+	})
+}
+
+func TestMarkTaskFailedInfo(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	cases := []struct {
+		err       error
+		wantType  string
+		retriable bool
+	}{
+		{Permanent(errors.New("bad input")), ErrorTypePermanent, false},
+		{Retriable(errors.New("upstream down")), ErrorTypeRetriable, true},
+		{&PanicError{Value: "kaboom", Stack: "goroutine 1 [running]:"}, ErrorTypePanic, false},
+		{errors.New("plain"), ErrorTypeError, false},
+	}
+
+	mt.Run("writes structured fields", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		task := &TaskDocument{UUID: "task-1", Attempts: 2}
+
+		for _, c := range cases {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			if err := ops.MarkTaskFailedInfo(context.Background(), task, newErrorInfo(task, c.err, "")); err != nil {
+				mt.Fatalf("MarkTaskFailedInfo: %v", err)
+			}
+		}
+		for _, c := range cases {
+			errDoc := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set", "error").Document()
+			if got := errDoc.Lookup("message").StringValue(); got != c.err.Error() {
+				mt.Errorf("Expected message %q, got %q", c.err.Error(), got)
+			}
+			if got := errDoc.Lookup("type").StringValue(); got != c.wantType {
+				mt.Errorf("Expected type %q, got %q", c.wantType, got)
+			}
+			if got := errDoc.Lookup("retriable").Boolean(); got != c.retriable {
+				mt.Errorf("%s: expected retriable %v, got %v", c.wantType, c.retriable, got)
+			}
+			if got := errDoc.Lookup("attempts").Int32(); got != 2 {
+				mt.Errorf("%s: expected attempts 2, got %d", c.wantType, got)
+			}
+			if errDoc.Lookup("timestamp").Int64() == 0 {
+				mt.Errorf("%s: expected timestamp set", c.wantType)
+			}
+			_, stackErr := errDoc.LookupErr("stack")
+			if (c.wantType == ErrorTypePanic) != (stackErr == nil) {
+				mt.Errorf("%s: unexpected stack presence", c.wantType)
+			}
+		}
+	})
+
+	mt.Run("framework failure", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := ops.MarkTaskFailed(context.Background(), &TaskDocument{UUID: "task-1"}, "no handler"); err != nil {
+			mt.Fatalf("MarkTaskFailed: %v", err)
+		}
+		errDoc := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set", "error").Document()
+		if got := errDoc.Lookup("type").StringValue(); got != ErrorTypeFramework {
+			mt.Errorf("Expected framework type, got %q", got)
+		}
+		if got := errDoc.Lookup("message").StringValue(); got != "no handler" {
+			mt.Errorf("Expected message kept, got %q", got)
+		}
+	})
+}
+
+func TestClaimTaskProjection(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("projects poller fields by default", func(mt *mtest.T) {
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "uuid", Value: "t1"},
+			{Key: "name", Value: "ns.F"},
+			{Key: "state", Value: TaskStateRunning},
+		}))
+
+		ops := NewMongoOps(mt.DB)
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task.Data != nil || task.Error != nil {
+			mt.Errorf("Expected data and error unset, got %v / %v", task.Data, task.Error)
+		}
+
+		fields, err := mt.GetStartedEvent().Command.LookupErr("fields")
+		if err != nil {
+			mt.Fatal("Expected a projection in findAndModify command")
+		}
+		for _, f := range []string{"uuid", "name", "step_id", "workflow_id", "task_list_name", "runner_id", "state", "updated"} {
+			if _, err := fields.Document().LookupErr(f); err != nil {
+				mt.Errorf("Expected %s projected", f)
+			}
+		}
+		for _, f := range []string{"data", "error"} {
+			if _, err := fields.Document().LookupErr(f); err == nil {
+				mt.Errorf("Expected %s not projected", f)
+			}
+		}
+	})
+
+	mt.Run("full document on request", func(mt *mtest.T) {
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "uuid", Value: "t1"},
+			{Key: "data", Value: bson.D{{Key: "blob", Value: "x"}}},
+		}))
+
+		ops := NewMongoOps(mt.DB)
+		ops.FullTaskDocument = true
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		if task.Data["blob"] != "x" {
+			mt.Errorf("Expected data decoded, got %v", task.Data)
+		}
+		if _, err := mt.GetStartedEvent().Command.LookupErr("fields"); err == nil {
+			mt.Error("Expected no projection with FullTaskDocument")
+		}
+	})
+
+	mt.Run("projection follows field map", func(mt *mtest.T) {
+		mt.AddMockResponses(claimedTaskResponse(bson.D{{Key: "id", Value: "t1"}}))
+
+		ops := NewMongoOps(mt.DB)
+		ops.FieldMap = FieldMap{"uuid": "id"}
+		if _, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default"); err != nil {
+			mt.Fatalf("ClaimTask: %v", err)
+		}
+		fields := mt.GetStartedEvent().Command.Lookup("fields").Document()
+		if _, err := fields.LookupErr("id"); err != nil {
+			mt.Error("Expected mapped uuid field projected")
+		}
+	})
+}
+
+func TestUseServerTime(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	skew := time.Hour
+
+	mt.Run("resume created follows server clock", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.UseServerTime = true
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{
+			Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now().Add(skew)),
+		}))
+		if err := ops.SyncServerTime(context.Background()); err != nil {
+			mt.Fatalf("SyncServerTime: %v", err)
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+		want := NowMillis() + skew.Milliseconds()
+		if err := ops.InsertResumeTask(context.Background(), "step-1", "wf-1", "default", ""); err != nil {
+			mt.Fatalf("InsertResumeTask: %v", err)
+		}
+		if err := ops.MarkTaskCompleted(context.Background(), &TaskDocument{UUID: "task-1"}); err != nil {
+			mt.Fatalf("MarkTaskCompleted: %v", err)
+		}
+
+		mt.GetStartedEvent() // isMaster
+		created := mt.GetStartedEvent().Command.Lookup("documents", "0", "created").Int64()
+		if created < want-1000 || created > want+1000 {
+			mt.Errorf("Expected created near server time %d, got %d", want, created)
+		}
+		updated := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set", "updated").Int64()
+		if updated < want-1000 || updated > want+1000 {
+			mt.Errorf("Expected updated near server time %d, got %d", want, updated)
+		}
+	})
+
+	mt.Run("local clock unless enabled", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{
+			Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now().Add(skew)),
+		}))
+		if err := ops.SyncServerTime(context.Background()); err != nil {
+			mt.Fatalf("SyncServerTime: %v", err)
+		}
+		if d := ops.nowMillis() - NowMillis(); d > 1000 || d < -1000 {
+			mt.Errorf("Expected local clock without UseServerTime, off by %dms", d)
+		}
+	})
+}
+
+func TestClaimTaskUndecodable(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("malformed task marked failed", func(mt *mtest.T) {
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(
+			claimedTaskResponse(bson.D{
+				{Key: "_id", Value: id},
+				{Key: "uuid", Value: "t1"},
+				{Key: "name", Value: 42}, // schema drift: not a string
+			}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		ops := NewMongoOps(mt.DB)
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if !errors.Is(err, ErrUndecodableTask) {
+			mt.Fatalf("Expected ErrUndecodableTask, got %v", err)
+		}
+		if task != nil {
+			mt.Errorf("Expected no task, got %+v", task)
+		}
+
+		mt.GetStartedEvent() // findAndModify
+		ev := mt.GetStartedEvent()
+		if ev == nil || ev.CommandName != "update" {
+			mt.Fatal("Expected the claimed task to be updated")
+		}
+		stmt := ev.Command.Lookup("updates").Array().Index(0).Value().Document()
+		if got := stmt.Lookup("q", "_id").ObjectID(); got != id {
+			mt.Errorf("Expected update by _id %v, got %v", id, got)
+		}
+		if got := stmt.Lookup("q", "state").StringValue(); got != TaskStateRunning {
+			mt.Errorf("Expected update guarded on running, got %q", got)
+		}
+		if got := stmt.Lookup("u", "$set", "state").StringValue(); got != TaskStateFailed {
+			mt.Errorf("Expected task marked failed, got %q", got)
+		}
+		msg := stmt.Lookup("u", "$set", "error", "message").StringValue()
+		if !strings.HasPrefix(msg, "decode error: ") {
+			mt.Errorf("Expected a decode error message, got %q", msg)
+		}
+	})
+}
+
+func TestHasPending(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("peeks with the claim filter", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, bson.D{{Key: "_id", Value: 1}}),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch),
+		)
+
+		ops := NewMongoOps(mt.DB)
+		pending, err := ops.HasPending(context.Background(), []string{"ns.F"}, "default")
+		if err != nil || !pending {
+			mt.Fatalf("Expected pending work, got %v, %v", pending, err)
+		}
+		pending, err = ops.HasPending(context.Background(), []string{"ns.F"}, "default")
+		if err != nil || pending {
+			mt.Fatalf("Expected no pending work, got %v, %v", pending, err)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		if cmd.Lookup("filter", "state").StringValue() != TaskStatePending {
+			mt.Error("Expected the claim filter")
+		}
+		if cmd.Lookup("limit").Int64() != 1 {
+			mt.Error("Expected a single-document peek")
+		}
+		if _, err := cmd.LookupErr("projection", "_id"); err != nil {
+			mt.Error("Expected only _id projected")
+		}
+	})
+}
+
+func TestWaitForTaskState(t *testing.T) {
+	task := func(state string) bson.D {
+		return bson.D{{Key: "uuid", Value: "task-1"}, {Key: "name", Value: "ns.F"}, {Key: "state", Value: state}}
+	}
+	noChangeStreams := mtest.CreateCommandErrorResponse(mtest.CommandError{
+		Code: 40573, Message: "The $changeStream stage is only supported on replica sets",
+	})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("change stream wakes on update", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		event := bson.D{
+			{Key: "_id", Value: bson.D{{Key: "_data", Value: "1"}}},
+			{Key: "operationType", Value: "update"},
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(1, "test.tasks", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, task(TaskStateRunning)),
+			mtest.CreateCursorResponse(1, "test.tasks", mtest.NextBatch, event),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, task(TaskStateCompleted)),
+		)
+
+		got, err := ops.WaitForTaskState(context.Background(), "task-1", []string{TaskStateCompleted, TaskStateFailed})
+		if err != nil {
+			mt.Fatalf("WaitForTaskState: %v", err)
+		}
+		if got.State != TaskStateCompleted {
+			mt.Errorf("Expected completed, got %s", got.State)
+		}
+		watch := mt.GetStartedEvent().Command
+		if got := watch.Lookup("pipeline", "1", "$match", "fullDocument.uuid").StringValue(); got != "task-1" {
+			mt.Errorf("Expected the stream filtered on the task, got %q", got)
+		}
+	})
+
+	mt.Run("polls without change streams", func(mt *mtest.T) {
+		defer func(d time.Duration) { waitPollInterval = d }(waitPollInterval)
+		waitPollInterval = time.Millisecond
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			noChangeStreams,
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch), // not inserted yet
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, task(TaskStateRunning)),
+			mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, task(TaskStateCompleted)),
+		)
+
+		got, err := ops.WaitForTaskState(context.Background(), "task-1", []string{TaskStateCompleted})
+		if err != nil {
+			mt.Fatalf("WaitForTaskState: %v", err)
+		}
+		if got.State != TaskStateCompleted {
+			mt.Errorf("Expected completed, got %s", got.State)
+		}
+	})
+
+	mt.Run("context timeout", func(mt *mtest.T) {
+		defer func(d time.Duration) { waitPollInterval = d }(waitPollInterval)
+		waitPollInterval = 20 * time.Millisecond
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(noChangeStreams)
+		for i := 0; i < 20; i++ {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.tasks", mtest.FirstBatch, task(TaskStateRunning)))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		got, err := ops.WaitForTaskState(ctx, "task-1", []string{TaskStateCompleted})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			mt.Errorf("Expected the deadline error, got %v", err)
+		}
+		if got != nil {
+			mt.Errorf("Expected no task, got %+v", got)
+		}
+	})
+}
+
+func TestWriteStepReturnsRequireStepMatch(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	noMatch := bson.E{Key: "n", Value: 0}
+
+	mt.Run("vanished step ignored by default", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(noMatch))
+		if err := ops.WriteStepReturns(context.Background(), "step-1", map[string]interface{}{"x": 1}); err != nil {
+			mt.Errorf("Expected no error, got %v", err)
+		}
+	})
+
+	mt.Run("vanished step reported", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.RequireStepMatch = true
+		mt.AddMockResponses(mtest.CreateSuccessResponse(noMatch))
+		err := ops.WriteStepReturns(context.Background(), "step-1", map[string]interface{}{"x": 1})
+		if !errors.Is(err, ErrStepNotWritable) {
+			mt.Errorf("Expected ErrStepNotWritable, got %v", err)
+		}
+	})
+
+	mt.Run("empty returns check the step", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.RequireStepMatch = true
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch))
+		err := ops.WriteStepReturns(context.Background(), "step-1", nil)
+		if !errors.Is(err, ErrStepNotWritable) {
+			mt.Errorf("Expected ErrStepNotWritable, got %v", err)
+		}
+		match := mt.GetStartedEvent().Command.Lookup("pipeline", "0", "$match").Document()
+		if got := match.Lookup("state").StringValue(); got != StepStateEventTransmit {
+			mt.Errorf("Expected the count to require EVENT_TRANSMIT, got %q", got)
+		}
+	})
+}
+
+func TestWriteAudit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("appends to the audit collection", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.AuditCollection = "task_audit"
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		err := ops.WriteAudit(context.Background(), AuditRecord{
+			TaskID: "task-1", Facet: "ns.F", ServerID: "server-1", Event: EventCompleted, Time: 1000, DurationMs: 250,
+		})
+		if err != nil {
+			mt.Fatalf("WriteAudit: %v", err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if got := cmd.Lookup("insert").StringValue(); got != "task_audit" {
+			mt.Errorf("Expected an insert into task_audit, got %q", got)
+		}
+		doc := cmd.Lookup("documents", "0").Document()
+		if doc.Lookup("event").StringValue() != EventCompleted || doc.Lookup("duration_ms").Int64() != 250 {
+			mt.Errorf("Unexpected audit document %v", doc)
+		}
+	})
+
+	mt.Run("disabled without a collection", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		if err := ops.WriteAudit(context.Background(), AuditRecord{TaskID: "task-1"}); err != nil {
+			mt.Fatalf("WriteAudit: %v", err)
+		}
+		if ev := mt.GetStartedEvent(); ev != nil {
+			mt.Errorf("Expected no command, got %s", ev.CommandName)
+		}
+	})
+}
+
+func TestRetryTaskSetsRunAt(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("run_at in the future and claims respect it", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		ops.RespectRunAt = true
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		before := NowMillis()
+		task := &TaskDocument{UUID: "task-1", Attempts: 1}
+		if err := ops.RetryTask(context.Background(), task, ErrorInfo{Message: "down", Retriable: true}, 5*time.Second); err != nil {
+			mt.Fatalf("RetryTask: %v", err)
+		}
+		update := updateStatement(mt)
+		set := update.Lookup("u", "$set").Document()
+		if got := set.Lookup("state").StringValue(); got != TaskStatePending {
+			mt.Errorf("Expected pending, got %q", got)
+		}
+		if runAt := set.Lookup("run_at").Int64(); runAt < before+5000 {
+			mt.Errorf("Expected run_at at least 5s ahead, got %d (now %d)", runAt, before)
+		}
+		if got := update.Lookup("q", "state").StringValue(); got != TaskStateRunning {
+			mt.Errorf("Expected the retry guarded on running, got %q", got)
+		}
+
+		if _, ok := ops.claimFilter([]string{"ns.F"}, "default")["run_at"]; !ok {
+			mt.Error("Expected claims to skip tasks not yet due")
+		}
+	})
+}
+
+func TestWatchTasks(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("decodes changes and resumes after a token", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		token := bson.D{{Key: "_data", Value: "token-1"}}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(1, "test.tasks", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: bson.D{{Key: "_data", Value: "token-2"}}},
+				{Key: "operationType", Value: "insert"},
+				{Key: "fullDocument", Value: bson.D{
+					{Key: "uuid", Value: "task-1"}, {Key: "name", Value: "ns.F"},
+					{Key: "state", Value: TaskStatePending}, {Key: "task_list_name", Value: "default"},
+				}},
+			}),
+			mtest.CreateSuccessResponse(),
+		)
+
+		raw, _ := bson.Marshal(token)
+		stream, err := ops.WatchTasks(context.Background(), raw)
+		if err != nil {
+			mt.Fatalf("WatchTasks: %v", err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if got := cmd.Lookup("pipeline", "0", "$changeStream", "resumeAfter", "_data").StringValue(); got != "token-1" {
+			mt.Errorf("Expected the stream resumed after token-1, got %q", got)
+		}
+		if got := cmd.Lookup("pipeline", "1", "$match", "operationType", "$in"); len(got.Array()) == 0 {
+			mt.Errorf("Expected the stream limited by operation type, got %v", got)
+		}
+
+		change, err := stream.Next(context.Background())
+		if err != nil {
+			mt.Fatalf("Next: %v", err)
+		}
+		if change.Operation != "insert" || change.Task == nil || change.Task.UUID != "task-1" || change.Task.State != TaskStatePending {
+			mt.Errorf("Expected the insert of task-1, got %+v", change)
+		}
+		if got := change.ResumeToken.Lookup("_data").StringValue(); got != "token-2" {
+			mt.Errorf("Expected resume token token-2, got %q", got)
+		}
+		stream.Close(context.Background())
+	})
+}
+
+func TestStepNeedsResume(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("leaf and non-leaf steps", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{{Key: "leaf", Value: true}}),
+			mtest.CreateCursorResponse(0, "test.steps", mtest.FirstBatch, bson.D{}),
+		)
+
+		needed, err := ops.StepNeedsResume(context.Background(), "step-leaf")
+		if err != nil || needed {
+			mt.Errorf("Expected no resume for a leaf step, got %v, %v", needed, err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if got := cmd.Lookup("projection", "leaf").Int32(); got != 1 {
+			mt.Errorf("Expected only the leaf marker read, got projection %v", cmd.Lookup("projection"))
+		}
+
+		needed, err = ops.StepNeedsResume(context.Background(), "step-inner")
+		if err != nil || !needed {
+			mt.Errorf("Expected a resume for an unmarked step, got %v, %v", needed, err)
+		}
+	})
+}
+
+func TestSubmitTask(t *testing.T) {
+	if _, err := (&MongoOps{}).SubmitTask(context.Background(), TaskSpec{}); err != ErrTaskNameRequired {
+		t.Errorf("Expected ErrTaskNameRequired without a name, got %v", err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("submitted task is claimable", func(mt *mtest.T) {
+		ops := NewMongoOps(mt.DB)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		before := NowMillis()
+		id, err := ops.SubmitTask(context.Background(), TaskSpec{
+			Name: "ns.F", StepID: "step-1", WorkflowID: "wf-1",
+			Data: map[string]interface{}{"k": "v"},
+		})
+		if err != nil {
+			mt.Fatalf("SubmitTask: %v", err)
+		}
+		if id == "" {
+			mt.Fatal("Expected a generated uuid")
+		}
+		doc := mt.GetStartedEvent().Command.Lookup("documents", "0").Document()
+		for field, want := range map[string]string{
+			"uuid": id, "name": "ns.F", "state": TaskStatePending, "task_list_name": "default",
+			"step_id": "step-1", "workflow_id": "wf-1", "runner_id": "",
+		} {
+			if got := doc.Lookup(field).StringValue(); got != want {
+				mt.Errorf("Expected %s %q, got %q", field, want, got)
+			}
+		}
+		if created := doc.Lookup("created").Int64(); created < before || doc.Lookup("updated").Int64() != created {
+			mt.Errorf("Expected created and updated set to now, got %v and %v", doc.Lookup("created"), doc.Lookup("updated"))
+		}
+		if got := doc.Lookup("data", "k").StringValue(); got != "v" {
+			mt.Errorf("Expected data carried over, got %q", got)
+		}
+
+		// Claiming finds it through the usual claim filter
+		mt.AddMockResponses(claimedTaskResponse(bson.D{
+			{Key: "uuid", Value: id}, {Key: "name", Value: "ns.F"}, {Key: "step_id", Value: "step-1"},
+			{Key: "state", Value: TaskStateRunning}, {Key: "task_list_name", Value: "default"},
+		}))
+		task, err := ops.ClaimTask(context.Background(), []string{"ns.F"}, "default")
+		if err != nil || task == nil || task.UUID != id {
+			mt.Fatalf("Expected the submitted task claimed, got %+v, %v", task, err)
+		}
+		query := mt.GetStartedEvent().Command.Lookup("query").Document()
+		if query.Lookup("state").StringValue() != TaskStatePending || query.Lookup("task_list_name").StringValue() != "default" {
+			mt.Errorf("Expected the claim to match the submitted state and list, got %v", query)
+		}
+	})
+}
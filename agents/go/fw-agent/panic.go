@@ -0,0 +1,90 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// DefaultPanicStackLimit is the default bound, in bytes, on a captured
+// panic stack.
+const DefaultPanicStackLimit = 8192
+
+// PanicError is the error a task fails with when its handler panics.
+// Stack holds the goroutine dump when Config.CapturePanicStack is set.
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// invokeHandler calls handler, converting a panic into a *PanicError so a
+// single bad task cannot take down the agent.
+func (p *AgentPoller) invokeHandler(task *TaskDocument, handler Handler, params map[string]interface{}) (result map[string]interface{}, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		perr := &PanicError{Value: r}
+		if p.cfg.CapturePanicStack {
+			perr.Stack = captureStack(p.cfg.PanicStackLimit)
+			p.logger.Info("Handler panic", map[string]interface{}{
+				"facet": task.Name,
+				"task":  task.UUID,
+				"panic": fmt.Sprint(r),
+				"stack": perr.Stack,
+			})
+		}
+		result, err = nil, perr
+	}()
+	return handler(params)
+}
+
+// guardedPollCycle runs pollCycle, recovering a panic when
+// cfg.RecoverPollPanics is set so that a bug in one cycle does not stop the
+// poll loop while heartbeats carry on. A recovered cycle claimed nothing.
+func (p *AgentPoller) guardedPollCycle(ctx context.Context) (claimed bool) {
+	if !p.cfg.RecoverPollPanics {
+		return p.pollCycle(ctx)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.counters.pollPanics, 1)
+			log.Printf("Recovered poll cycle panic: %v\n%s", r, debug.Stack())
+			claimed = false
+		}
+	}()
+	return p.pollCycle(ctx)
+}
+
+// captureStack returns the dump of all goroutines, the current one first,
+// truncated to limit bytes.
+func captureStack(limit int) string {
+	if limit <= 0 {
+		limit = DefaultPanicStackLimit
+	}
+	buf := make([]byte, limit)
+	n := runtime.Stack(buf, true)
+	return string(buf[:n])
+}
@@ -16,13 +16,19 @@ package fwagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -31,25 +37,124 @@ import (
 // It receives the step parameters and returns the result to write back.
 type Handler func(params map[string]interface{}) (map[string]interface{}, error)
 
+// PrefixWildcard, as the last character of a registered name, makes it a
+// prefix pattern: "billing.*" handles every task whose name starts with
+// "billing.". Exact and short-name registrations win over patterns.
+const PrefixWildcard = "*"
+
+// patternPrefix returns the prefix of a registered prefix pattern, and
+// false for a plain facet name.
+func patternPrefix(name string) (string, bool) {
+	if !strings.HasSuffix(name, PrefixWildcard) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, PrefixWildcard), true
+}
+
+// ErrRegistrationTimeout is returned when registering, deregistering or
+// heartbeating the server document exceeds Config.RegistrationTimeout.
+var ErrRegistrationTimeout = errors.New("server registration timed out")
+
+// ErrNotConnected is returned by ReRegister before the poller has connected
+// to MongoDB.
+var ErrNotConnected = errors.New("poller not connected")
+
+// ErrIgnoreTask may be returned (or wrapped) by a handler to signal that the
+// task does not apply. The task is marked ignored rather than failed, and no
+// returns or resume task are written.
+var ErrIgnoreTask = errors.New("task ignored by handler")
+
+// ParamsTransformer reshapes step params before they reach the handler,
+// e.g. to decrypt fields or inject tenant context. Returning an error fails
+// the task without invoking the handler.
+type ParamsTransformer func(task *TaskDocument, params map[string]interface{}) (map[string]interface{}, error)
+
+// ResultValidator checks a handler's result before its returns are written,
+// e.g. to enforce required keys or value ranges. Returning an error fails
+// the task and nothing is written.
+type ResultValidator func(task *TaskDocument, result map[string]interface{}) error
+
 // AgentPoller polls for tasks and dispatches to registered handlers.
 type AgentPoller struct {
+	// queueDepth is the last sampled pending-task count (see Stats).
+	// Kept first for 64-bit atomic alignment on 32-bit platforms.
+	queueDepth int64
+
+	// counters back Metrics; its atomics lead so they stay aligned too.
+	counters pollerCounters
+
 	cfg      Config
+	cfgMu    sync.RWMutex // guards the cfg fields ReloadConfig changes
 	serverID string
 	db       *mongo.Database
 	client   *mongo.Client
 
 	handlers map[string]Handler
+	terminal map[string]bool // registered names that skip fw:resume
+	priority map[string]int  // RegisterWithPriority overrides for patterns
+	routes   map[string][]route
+	meta     map[string]HandlerMeta // RegisterWithMeta metadata
+	disabled map[string]bool        // registered names excluded from claiming
 	mu       sync.RWMutex
 
-	ops          *MongoOps
-	registration *ServerRegistration
+	// defaultHandler, if set, handles claimed tasks no registration
+	// matches; see RegisterDefault. Guarded by mu.
+	defaultHandler Handler
+
+	// paramDefaults holds RegisterWithDefaults params by registered name.
+	// Guarded by mu.
+	paramDefaults map[string]map[string]interface{}
+
+	// generation is the current handler generation and genInFlight the
+	// number of dispatched tasks per generation still running; see
+	// ReloadHandlers. Guarded by mu.
+	generation        uint64
+	genInFlight       map[uint64]int
+	generationRetired func(generation uint64)
+
+	ops          taskStore
+	registration serverRegistry
 
 	stopCh   chan struct{}
 	wg       sync.WaitGroup
-	sem      chan struct{} // semaphore for concurrency control
+	slots    *slotPool                // MaxConcurrent handler slots
+	listSems map[string]chan struct{} // per-task-list semaphores; read-only
+	listTurn uint32                   // claimOrder rotation; atomic
 	running  bool
 	runMu    sync.Mutex
 
+	// exclusive lets an ExclusiveKey task run alone; exclusiveWaiting
+	// counts those waiting or running and is accessed atomically.
+	exclusive        sync.RWMutex
+	exclusiveWaiting int32
+
+	// regMu serializes writes of the servers document. published holds
+	// the handler names of the last successful write, nil before the
+	// first; it is guarded by mu. changed is signaled, without blocking,
+	// whenever the handler set changes.
+	regMu     sync.Mutex
+	published map[string]bool
+	changed   chan struct{}
+
+	// wake makes the poll loop run a cycle before its next tick; see
+	// Config.WatchMode.
+	wake chan struct{}
+
+	// oneShotRegistered is set once PollOnce/PollN registered the server
+	// under RegisterOneShot; guarded by runMu.
+	oneShotRegistered bool
+
+	// shutdownReport is set by Stop; guarded by runMu.
+	shutdownReport *ShutdownReport
+
+	// failoverActive is 1 while a standby has taken over its group's
+	// tasks; see standingBy.
+	failoverActive int32
+
+	// auditClaims maps the uuids of tasks claimed while auditing is
+	// enabled to their claim time.
+	auditClaims sync.Map
+
 	// topicFilter, if set, overrides RegisteredHandlers() for poll cycles.
 	// Used by RegistryRunner to restrict to DB-registered topics.
 	topicFilter func() []string
@@ -57,6 +162,80 @@ type AgentPoller struct {
 	// metadataProvider, if set, returns handler metadata for a given facet name.
 	// Used by RegistryRunner to inject _handler_metadata into handler params.
 	metadataProvider func(facetName string) map[string]interface{}
+
+	// paramsTransformer, if set, is applied to step params before dispatch.
+	paramsTransformer ParamsTransformer
+
+	// samples buffers handler samples when Config.SampleBufferSize is
+	// positive; sampleRedactor is guarded by mu.
+	samples        *sampleRing
+	sampleRedactor SampleRedactor
+
+	// resultValidator, if set, is applied to handler results before writing.
+	resultValidator ResultValidator
+
+	// completionFailed, if set, is called for tasks that could not be
+	// marked completed; see SetCompletionFailedHook.
+	completionFailed func(task *TaskDocument, err error)
+
+	// resumePending, if set, is called for tasks whose resume task could
+	// not be inserted; see SetResumePendingHook.
+	resumePending func(task *TaskDocument, err error)
+
+	// registry, if set, is the BSON registry handed to MongoOps.
+	registry *bsoncodec.Registry
+
+	// registerHook, if set, is handed to the ServerRegistration.
+	registerHook func(doc *ServerDocument)
+
+	// opRecorder, if set, receives MongoOps call timings.
+	opRecorder OpRecorder
+
+	// queueDepthGauge, if set, receives each queue-depth sample.
+	queueDepthGauge Gauge
+
+	// claimFilterFunc, if set, is handed to MongoOps.
+	claimFilterFunc ClaimFilterFunc
+
+	// sharedClient, if set, is used instead of dialing and is never
+	// disconnected by the poller; see SetMongoClient.
+	sharedClient *mongo.Client
+
+	// logger receives structured events; defaults to the standard log.
+	logger Logger
+
+	// Sustained-pressure tracking (see Pressure).
+	pressureMu     sync.Mutex
+	pressureStreak int
+	scaleOut       bool
+	pressureHook   PressureHook
+
+	// inFlightSteps maps step ids currently being processed by this agent to
+	// the step lock token held for them ("" when StepLockTTL is disabled).
+	inFlightSteps map[string]string
+	inFlightMu    sync.Mutex
+
+	// inFlightTasks tracks tasks being processed, keyed by task uuid, with
+	// the cancel func for each task's context.
+	inFlightTasks map[string]*inFlightTask
+
+	// events buffers recent decisions when Config.EventBufferSize > 0.
+	events *eventRing
+
+	// workflowLocks maps workflow id to the lock token held while one of
+	// its tasks is processed (SerializePerWorkflow).
+	workflowLocks map[string]string
+}
+
+// inFlightTask is a task being processed and the cancel func of its context.
+type inFlightTask struct {
+	task   *TaskDocument
+	cancel context.CancelFunc
+	reason *cancelReason
+
+	// requeued is set, under inFlightMu, once the task was handed back on
+	// shutdown, so its result must be discarded.
+	requeued bool
 }
 
 // NewAgentPoller creates a new AgentPoller with the given configuration.
@@ -65,33 +244,226 @@ func NewAgentPoller(cfg Config) *AgentPoller {
 		cfg:      cfg,
 		serverID: uuid.New().String(),
 		handlers: make(map[string]Handler),
-		stopCh:   make(chan struct{}),
-		sem:      make(chan struct{}, cfg.MaxConcurrent),
+		terminal: make(map[string]bool),
+		priority: make(map[string]int),
+		routes:   make(map[string][]route),
+		meta:     make(map[string]HandlerMeta),
+		disabled: make(map[string]bool),
+
+		paramDefaults: make(map[string]map[string]interface{}),
+		genInFlight:   make(map[uint64]int),
+		inFlightSteps: make(map[string]string),
+		inFlightTasks: make(map[string]*inFlightTask),
+		workflowLocks: make(map[string]string),
+		events:        newEventRing(cfg.EventBufferSize),
+		samples:       newSampleRing(cfg.SampleBufferSize),
+		logger:        stdLogger{},
+		stopCh:        make(chan struct{}),
+		slots:         newSlotPool(cfg.MaxConcurrent),
+		listSems:      newListSems(cfg.TaskListConcurrency),
+		changed:       make(chan struct{}, 1),
+		wake:          make(chan struct{}, 1),
 	}
 }
 
 // Register registers a handler for a qualified facet name.
 // The facet name can be either qualified (ns.FacetName) or short (FacetName).
+//
+// When Config.Namespace is set, facetName is qualified with it unless it
+// already starts with "<Namespace>.".
 func (p *AgentPoller) Register(facetName string, handler Handler) {
+	facetName = p.qualify(facetName)
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.handlers[facetName] = handler
+	delete(p.terminal, facetName)
+	delete(p.priority, facetName)
+	delete(p.meta, facetName)
+	delete(p.paramDefaults, facetName)
+	p.handlersChanged()
 }
 
-// RegisteredHandlers returns a list of registered handler names.
+// RegisterMany registers handler under each of facetNames, e.g. aliases or
+// versions served by one implementation, as Register would one at a time.
+// All names are added at once, so none is claimed or published without
+// the others.
+func (p *AgentPoller) RegisterMany(facetNames []string, handler Handler) {
+	qualified := make([]string, len(facetNames))
+	for i, name := range facetNames {
+		qualified[i] = p.qualify(name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, facetName := range qualified {
+		p.handlers[facetName] = handler
+		delete(p.terminal, facetName)
+		delete(p.priority, facetName)
+		delete(p.meta, facetName)
+		delete(p.paramDefaults, facetName)
+	}
+	p.handlersChanged()
+}
+
+// RegisterWithPriority registers a handler like Register, with an explicit
+// priority used when facetName is a prefix pattern (see PrefixWildcard)
+// that overlaps other patterns: the matching pattern with the highest
+// priority wins before prefix length is considered. Register uses
+// priority 0.
+func (p *AgentPoller) RegisterWithPriority(facetName string, priority int, handler Handler) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[facetName] = handler
+	delete(p.terminal, facetName)
+	p.priority[facetName] = priority
+	p.handlersChanged()
+}
+
+// RegisterTerminal registers a handler for a facet that ends its workflow
+// branch. After the handler succeeds, its returns are written and the step
+// is moved to StepStateCompleted directly; no fw:resume task is inserted.
+func (p *AgentPoller) RegisterTerminal(facetName string, handler Handler) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[facetName] = handler
+	p.terminal[facetName] = true
+	p.handlersChanged()
+}
+
+// RegisterDefault sets a catch-all handler for claimed tasks that no
+// registration matches (exact, short name, pattern or route), which would
+// otherwise fail with "no handler registered". The handler decides the
+// outcome as any other: it may forward the work, or return ErrIgnoreTask.
+//
+// Registering a default does not widen claiming: only registered names
+// (or the RegistryRunner topic filter) are claimed, so the default sees
+// tasks such as a routed facet's unmatched data or topics without a
+// handler. Set Config.ClaimUnmatched to also claim every other task,
+// within the namespace if one is set.
+func (p *AgentPoller) RegisterDefault(handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.defaultHandler = handler
+}
+
+// Unregister removes every handler registered for facetName, plain or
+// routed, along with its metadata. Tasks already in flight are unaffected;
+// a task claimed for the facet but not yet dispatched is released back to
+// pending when Config.ReleaseUnregistered is set, and fails as having no
+// handler otherwise. The name is resolved as in Register.
+func (p *AgentPoller) Unregister(facetName string) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.handlers, facetName)
+	delete(p.routes, facetName)
+	delete(p.terminal, facetName)
+	delete(p.priority, facetName)
+	delete(p.meta, facetName)
+	delete(p.paramDefaults, facetName)
+	p.handlersChanged()
+}
+
+// SetParamsTransformer installs a transformer applied to every task's step
+// params after they are read and before the handler is invoked.
+func (p *AgentPoller) SetParamsTransformer(fn ParamsTransformer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paramsTransformer = fn
+}
+
+// SetResultValidator installs a validator applied to every successful
+// handler result before its returns are written.
+func (p *AgentPoller) SetResultValidator(fn ResultValidator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resultValidator = fn
+}
+
+// SetCompletionFailedHook installs a function called when a task's work is
+// done (returns written, resume inserted) but marking it completed still
+// fails after Config.CompletionRetries, leaving it running and flagged
+// completion_failed. Operators can alert on it or reconcile the task.
+func (p *AgentPoller) SetCompletionFailedHook(fn func(task *TaskDocument, err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completionFailed = fn
+}
+
+// SetResumePendingHook installs a function called when a task's returns
+// are written but inserting its resume task still fails after
+// Config.ResumeInsertRetries, leaving the task resume_pending. The resume
+// sweeper, or an operator, can insert it later.
+func (p *AgentPoller) SetResumePendingHook(fn func(task *TaskDocument, err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resumePending = fn
+}
+
+// SetBSONRegistry sets a custom BSON codec registry used when reading step
+// params and writing returns. It must be called before Start or PollOnce.
+func (p *AgentPoller) SetBSONRegistry(registry *bsoncodec.Registry) {
+	p.registry = registry
+}
+
+// SetRegisterHook sets a function that may enrich the servers document
+// before each registration; see ServerRegistration.RegisterHook. It must be
+// called before Start.
+func (p *AgentPoller) SetRegisterHook(hook func(doc *ServerDocument)) {
+	p.registerHook = hook
+}
+
+// SetOpRecorder sets a recorder for Mongo operation latencies (claim, param
+// read, return write, resume insert). It must be called before Start or
+// PollOnce.
+func (p *AgentPoller) SetOpRecorder(r OpRecorder) {
+	p.opRecorder = r
+}
+
+// SetQueueDepthGauge sets a gauge that receives each queue-depth sample
+// (see Config.QueueDepthInterval), e.g. a Prometheus gauge. It must be
+// called before Start.
+func (p *AgentPoller) SetQueueDepthGauge(g Gauge) {
+	p.queueDepthGauge = g
+}
+
+// SetClaimFilterFunc sets a hook called on every claim to augment the claim
+// filter; see ClaimFilterFunc. It must be called before Start or PollOnce.
+func (p *AgentPoller) SetClaimFilterFunc(fn ClaimFilterFunc) {
+	p.claimFilterFunc = fn
+}
+
+// SetMongoClient makes the poller use client, already connected, instead
+// of dialing cfg.MongoURL, so several pollers in one process can share a
+// connection pool. The caller owns the client: Stop and Close leave it
+// connected. It must be called before Start or PollOnce.
+func (p *AgentPoller) SetMongoClient(client *mongo.Client) {
+	p.sharedClient = client
+}
+
+// RegisteredHandlers returns a list of registered handler names, including
+// facets that only have RegisterRouted handlers.
 func (p *AgentPoller) RegisteredHandlers() []string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	names := make([]string, 0, len(p.handlers))
+	names := make([]string, 0, len(p.handlers)+len(p.routes))
 	for name := range p.handlers {
 		names = append(names, name)
 	}
+	for name := range p.routes {
+		if _, ok := p.handlers[name]; !ok {
+			names = append(names, name)
+		}
+	}
 	return names
 }
 
 // Start connects to MongoDB and begins the poll loop.
-// This method blocks until Stop is called.
+// This method blocks until Stop is called or ctx is canceled. On
+// cancellation Start itself stops the poller, draining in-flight tasks,
+// deregistering and disconnecting, and returns any error from that cleanup.
 func (p *AgentPoller) Start(ctx context.Context) error {
 	p.runMu.Lock()
 	if p.running {
@@ -101,34 +473,186 @@ func (p *AgentPoller) Start(ctx context.Context) error {
 	p.running = true
 	p.runMu.Unlock()
 
-	// Connect to MongoDB
-	clientOpts := options.Client().ApplyURI(p.cfg.MongoURL)
-	client, err := mongo.Connect(ctx, clientOpts)
-	if err != nil {
-		return err
+	// Connect to MongoDB, unless already wired up
+	if p.ops == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
 	}
-	p.client = client
-	p.db = client.Database(p.cfg.Database)
-	p.ops = NewMongoOps(p.db)
-	p.registration = NewServerRegistration(p.db)
+
+	// Count the registration loop first, so that a Stop racing with the
+	// rest of Start never waits on an empty group that is then added to
+	p.wg.Add(1)
 
 	// Register server
-	handlers := p.RegisteredHandlers()
-	if err := p.registration.Register(ctx, p.serverID, p.cfg, handlers); err != nil {
+	if err := p.register(ctx, false); err != nil {
+		p.wg.Done()
 		return err
 	}
 
+	// Publish handler changes made from here on
+	go p.registrationLoop(ctx)
+
 	// Start heartbeat goroutine
 	p.wg.Add(1)
 	go p.heartbeatLoop(ctx)
 
+	// Reset the stale running tasks of dead agents
+	if p.cfg.ReclaimStaleAfter > 0 {
+		p.wg.Add(1)
+		go p.reclaimLoop(ctx)
+	}
+
+	// Start queue depth sampling
+	if p.cfg.QueueDepthInterval > 0 {
+		p.wg.Add(1)
+		go p.queueDepthLoop(ctx)
+	}
+
+	if p.cfg.CancelCheckInterval > 0 {
+		p.wg.Add(1)
+		go p.cancelWatchLoop(ctx)
+	}
+
+	if p.cfg.EnableResumeSweeper && p.cfg.ResumeSweepInterval > 0 {
+		p.wg.Add(1)
+		go p.resumeSweepLoop(ctx)
+	}
+
+	if watcher, ok := p.ops.(taskWatcher); ok && p.cfg.WatchMode {
+		p.wg.Add(1)
+		go p.watchLoop(ctx, watcher)
+	}
+
 	// Run poll loop
 	p.pollLoop(ctx)
 
+	// A spent task budget drains in-flight work fully before deregistering
+	if ctx.Err() == nil && p.budgetSpent() {
+		log.Printf("Processed %d tasks, exiting", p.cfg.MaxTasksBeforeExit)
+		return p.Stop(context.Background())
+	}
+
+	// A context-driven shutdown gets the same cleanup as Stop; after an
+	// explicit Stop this is a no-op.
+	if ctx.Err() != nil {
+		stopCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return p.Stop(stopCtx)
+	}
+	return nil
+}
+
+// ReRegister republishes the current handler set and the fields a
+// RegisterHook sets, e.g. to apply its changed inputs, registering the
+// server in full if its servers document is missing. start_time and the
+// lifecycle counters of a registered server are kept. Handlers registered
+// or unregistered while the poller is running are published automatically.
+// It is safe to call while the poller is running.
+func (p *AgentPoller) ReRegister(ctx context.Context) error {
+	if p.registration == nil {
+		return ErrNotConnected
+	}
+	return p.register(ctx, true)
+}
+
+// register upserts the servers document for the current handler set and,
+// once written, lets the poll loop claim for exactly that set. A change
+// racing with the write leaves changed signaled, so registrationLoop
+// publishes it next. With republish, a registry that supports it only
+// updates the handlers of the existing document, keeping its start_time.
+func (p *AgentPoller) register(ctx context.Context, republish bool) error {
+	p.regMu.Lock()
+	defer p.regMu.Unlock()
+
+	// The snapshot below covers any change signaled so far
+	select {
+	case <-p.changed:
+	default:
+	}
+	handlers := p.RegisteredHandlers()
+	write := p.registration.Register
+	if r, ok := p.registration.(republisher); ok && republish {
+		write = r.Republish
+	}
+	err := p.withRegistrationTimeout(ctx, "register", func(ctx context.Context) error {
+		return write(ctx, p.serverID, p.config(), handlers)
+	})
+	if err != nil {
+		return err
+	}
+
+	published := make(map[string]bool, len(handlers))
+	for _, name := range handlers {
+		published[name] = true
+	}
+	p.mu.Lock()
+	p.published = published
+	p.mu.Unlock()
 	return nil
 }
 
+// handlersChanged signals registrationLoop that the handler set changed.
+func (p *AgentPoller) handlersChanged() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// registrationLoop republishes the handlers whenever the handler set
+// changes while the poller runs, so the servers document follows Register
+// and Unregister without resetting its start_time.
+func (p *AgentPoller) registrationLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	// A failed write is retried a heartbeat interval later
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-retry:
+			retry = nil
+			p.handlersChanged()
+		case <-p.changed:
+			if err := p.register(ctx, true); err != nil {
+				log.Printf("Failed to re-register changed handlers: %v", err)
+				retry = time.After(p.baseHeartbeatInterval())
+			}
+		}
+	}
+}
+
+// withPublished returns names minus any not yet in the servers document,
+// so the poller never claims for a handler it has not advertised. Before
+// the first registration all names are kept.
+func (p *AgentPoller) withPublished(names []string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.published == nil {
+		return names
+	}
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		if p.published[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
 // Stop signals the poller to stop and waits for cleanup.
+//
+// By default Stop drains: it waits for in-flight tasks to finish (bounded by
+// ctx). With Config.RequeueOnShutdown it instead hands in-flight tasks back
+// to pending and cancels their handler contexts; the two are mutually
+// exclusive, since a requeued task's result is discarded.
+//
+// What Stop did is summarized by LastShutdownReport.
 func (p *AgentPoller) Stop(ctx context.Context) error {
 	p.runMu.Lock()
 	if !p.running {
@@ -138,111 +662,861 @@ func (p *AgentPoller) Stop(ctx context.Context) error {
 	p.running = false
 	p.runMu.Unlock()
 
+	start := time.Now()
+	report := &ShutdownReport{InFlight: p.inFlightCount()}
+	defer func() {
+		report.Duration = time.Since(start)
+		p.runMu.Lock()
+		p.shutdownReport = report
+		p.runMu.Unlock()
+	}()
+
 	close(p.stopCh)
-	p.wg.Wait()
+	if p.cfg.RequeueOnShutdown {
+		report.Requeued = p.requeueInFlight(ctx)
+		if report.Requeued < report.InFlight {
+			report.Abandoned = report.InFlight - report.Requeued
+		}
+		p.waitInFlight(ctx)
+	} else {
+		p.waitInFlight(ctx)
+		report.Abandoned = p.inFlightCount()
+		if report.Abandoned > report.InFlight {
+			report.Abandoned = report.InFlight
+		}
+		report.Drained = report.InFlight - report.Abandoned
+	}
 
 	// Deregister server
 	if p.registration != nil {
-		if err := p.registration.Deregister(ctx, p.serverID); err != nil {
+		err := p.withRegistrationTimeout(ctx, "deregister", func(ctx context.Context) error {
+			return p.registration.Deregister(ctx, p.serverID)
+		})
+		if err != nil {
 			log.Printf("Failed to deregister server: %v", err)
 		}
+		report.Deregistered = err == nil
+	}
+
+	// Disconnect from MongoDB, unless the caller owns the client
+	if p.client != nil && p.client != p.sharedClient {
+		if err := p.client.Disconnect(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunnerID returns the id this agent is known by: cfg.RunnerID if set,
+// otherwise the generated server id. Claims are only restricted to
+// directed tasks when cfg.RunnerID is set.
+func (p *AgentPoller) RunnerID() string {
+	if p.cfg.RunnerID != "" {
+		return p.cfg.RunnerID
+	}
+	return p.serverID
+}
+
+// connect dials MongoDB, unless a client was set with SetMongoClient, and
+// wires up the MongoOps and ServerRegistration used by the poller.
+func (p *AgentPoller) connect(ctx context.Context) error {
+	client := p.sharedClient
+	if client == nil {
+		var err error
+		client, err = mongo.Connect(ctx, p.clientOptions())
+		if err != nil {
+			return err
+		}
+	}
+	p.client = client
+	cfg := p.config()
+	p.db = client.Database(cfg.Database, cfg.databaseOptions())
+
+	ops := NewMongoOps(p.db)
+	ops.ClaimIndexHint = p.cfg.ClaimIndexHint
+	ops.ResumeTaskName = p.cfg.ResumeTaskName
+	ops.FieldMap = p.cfg.FieldMap
+	ops.OrderField = p.cfg.OrderField
+	ops.TimestampUnit = p.cfg.TimestampUnit
+	ops.MaxTaskAge = p.cfg.MaxTaskAge
+	ops.FullTaskDocument = p.cfg.ClaimFullDocument || p.hasRoutes() ||
+		p.cfg.MissingStepPolicy == MissingStepUseData
+	ops.RunnerID = p.cfg.RunnerID
+	ops.AcceptUnassigned = p.cfg.AcceptUnassigned
+	ops.AcceptedDataTypes = p.cfg.AcceptedDataTypes
+	ops.BusyWorkflows = p.busyWorkflows
+	ops.BusySteps = p.busySteps
+	ops.AllowedTaskLists = p.cfg.AllowedTaskLists
+	ops.DeniedTaskLists = p.cfg.DeniedTaskLists
+	for _, list := range p.taskLists() {
+		if !ops.taskListPermitted(list) {
+			log.Printf("Task list %q is not allowed, nothing will be claimed from it", list)
+		}
+	}
+	ops.ClaimableStates = p.cfg.ClaimableStates
+	for _, state := range p.cfg.ClaimableStates {
+		if containsString(unclaimableStates, state) {
+			log.Printf("Claimable states include %q, which is never claimed", state)
+		}
+	}
+	ops.CompressThreshold = p.cfg.CompressThreshold
+	ops.Registry = p.registry
+	ops.Recorder = p.opRecorder
+	ops.ClaimFilterFunc = p.claimFilterFunc
+	ops.SlowOpThreshold = p.cfg.SlowOpThreshold
+	ops.MaxRetries = p.cfg.MongoRetries
+	ops.RetryBackoff = p.cfg.MongoRetryBackoff
+	ops.UseServerTime = p.cfg.UseServerTime
+	ops.UseTransactions = p.cfg.UseTransactions
+	ops.RequireStepMatch = p.cfg.RequireWritableStep
+	ops.AuditCollection = p.cfg.AuditCollection
+	ops.RespectRunAt = p.cfg.RetryBackoff.MaxAttempts > 0 || p.cfg.SerializePerWorkflow ||
+		p.cfg.StepLockTTL > 0
+	p.ops = ops
+	p.syncServerTime(ctx)
+	registration := NewServerRegistration(p.db)
+	registration.RegisterHook = p.registerHook
+	registration.HandlerMeta = p.handlerMeta
+	p.registration = registration
+	return nil
+}
+
+// clientOptions returns the MongoDB client options for the configured URL,
+// with command monitoring attached when cfg.DebugCommands is set.
+func (p *AgentPoller) clientOptions() *options.ClientOptions {
+	opts := options.Client().ApplyURI(p.cfg.MongoURL)
+	if p.cfg.DebugCommands {
+		opts.SetMonitor(commandMonitor(p.logger))
+	}
+	return opts
+}
+
+// PollOnce performs a single poll cycle. Useful for testing.
+func (p *AgentPoller) PollOnce(ctx context.Context) error {
+	if err := p.prepareOneShot(ctx); err != nil {
+		return err
+	}
+	_, err := p.pollOne(ctx)
+	return err
+}
+
+// PollN claims and processes up to n tasks synchronously, one at a time,
+// stopping early once no task is available or ctx ends. It returns how
+// many tasks were processed.
+//
+// Together with Config.RegisterOneShot and Close this covers Job-style
+// runs: the first PollOnce or PollN connects and registers the server,
+// and Close deregisters and disconnects. No heartbeats are sent.
+func (p *AgentPoller) PollN(ctx context.Context, n int) (int, error) {
+	if err := p.prepareOneShot(ctx); err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for processed < n && ctx.Err() == nil {
+		ok, err := p.pollOne(ctx)
+		if err != nil {
+			return processed, err
+		}
+		if !ok {
+			break
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+// Close ends a PollOnce/PollN session: it deregisters the server if
+// RegisterOneShot registered it, and disconnects from MongoDB if the poller
+// connected itself. After Start, Close is equivalent to Stop.
+func (p *AgentPoller) Close(ctx context.Context) error {
+	p.runMu.Lock()
+	if p.running {
+		p.runMu.Unlock()
+		return p.Stop(ctx)
+	}
+	registered := p.oneShotRegistered
+	p.oneShotRegistered = false
+	p.runMu.Unlock()
+
+	if registered && p.registration != nil {
+		err := p.withRegistrationTimeout(ctx, "deregister", func(ctx context.Context) error {
+			return p.registration.Deregister(ctx, p.serverID)
+		})
+		if err != nil {
+			log.Printf("Failed to deregister server: %v", err)
+		}
+	}
+
+	if p.client != nil {
+		client := p.client
+		p.client, p.ops, p.registration = nil, nil, nil
+		if client == p.sharedClient {
+			return nil
+		}
+		return client.Disconnect(ctx)
+	}
+	return nil
+}
+
+// prepareOneShot connects if needed and, with RegisterOneShot, registers
+// the server the first time a one-shot poll runs.
+func (p *AgentPoller) prepareOneShot(ctx context.Context) error {
+	if p.ops == nil {
+		// Connect if not already connected
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if !p.cfg.RegisterOneShot || p.registration == nil {
+		return nil
+	}
+
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	if p.running || p.oneShotRegistered {
+		return nil
+	}
+	if err := p.register(ctx, false); err != nil {
+		return err
+	}
+	p.oneShotRegistered = true
+	return nil
+}
+
+// pollOne claims and synchronously processes one task, reporting whether
+// a task was processed.
+func (p *AgentPoller) pollOne(ctx context.Context) (bool, error) {
+	handlers := p.withinDeadline(ctx, p.withCatchAll(p.withoutDisabled(p.RegisteredHandlers())))
+	if len(handlers) == 0 || p.standingBy(ctx) || p.exclusivePending() {
+		return false, nil
+	}
+	var task *TaskDocument
+	for _, list := range p.taskLists() {
+		var err error
+		task, err = p.ops.ClaimTask(ctx, handlers, list)
+		if err != nil {
+			return false, err
+		}
+		if task != nil {
+			break
+		}
+	}
+	if task == nil {
+		return false, nil // No task available
+	}
+	p.recordEvent(EventClaimed, task, "")
+
+	if !p.beginStep(ctx, task) {
+		return false, nil
+	}
+	taskCtx := detachContext(ctx)
+	defer p.endStep(taskCtx, task)
+
+	// Process synchronously for PollOnce
+	p.processTask(taskCtx, task)
+	return true, nil
+}
+
+func (p *AgentPoller) pollLoop(ctx context.Context) {
+	interval := p.pollInterval()
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+
+	idle := 0
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+
+		claimed := false
+		// With adaptive polling, keep claiming until a cycle comes up empty
+		for p.guardedPollCycle(ctx) {
+			claimed = true
+			if !p.cfg.AdaptivePolling {
+				break
+			}
+			select {
+			case <-p.stopCh:
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+
+		if p.budgetSpent() {
+			return
+		}
+		if claimed {
+			idle = 0
+		} else {
+			idle++
+		}
+		if next := p.idleInterval(idle); next != interval {
+			interval = next
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+		}
+	}
+}
+
+// budgetSpent reports whether cfg.MaxTasksBeforeExit tasks have been
+// processed to a terminal outcome: completed, failed or ignored. Tasks
+// released, requeued or canceled do not count.
+func (p *AgentPoller) budgetSpent() bool {
+	max := p.cfg.MaxTasksBeforeExit
+	return max > 0 && p.tasksSettled() >= int64(max)
+}
+
+// budgetClaimed reports whether the tasks settled and those still in
+// flight cover cfg.MaxTasksBeforeExit, so that no more are claimed unless
+// an in-flight task ends without a terminal outcome.
+func (p *AgentPoller) budgetClaimed() bool {
+	max := p.cfg.MaxTasksBeforeExit
+	if max <= 0 {
+		return false
+	}
+	inFlight := atomic.LoadInt64(&p.counters.dispatched) - atomic.LoadInt64(&p.counters.finished)
+	return p.tasksSettled()+inFlight >= int64(max)
+}
+
+// tasksSettled counts the tasks that reached a terminal outcome.
+func (p *AgentPoller) tasksSettled() int64 {
+	return atomic.LoadInt64(&p.counters.completed) + atomic.LoadInt64(&p.counters.failed) +
+		atomic.LoadInt64(&p.counters.ignored)
+}
+
+// idleInterval returns the poll interval after idle consecutive cycles
+// that claimed nothing. Once idle reaches IdleBackoffAfter the interval
+// doubles per further empty cycle, up to MaxPollInterval; otherwise it is
+// PollInterval.
+func (p *AgentPoller) idleInterval(idle int) time.Duration {
+	base := p.pollInterval()
+	if p.cfg.IdleBackoffAfter <= 0 || p.cfg.MaxPollInterval <= base || idle < p.cfg.IdleBackoffAfter {
+		return base
+	}
+	interval := base
+	for i := p.cfg.IdleBackoffAfter; i <= idle && interval < p.cfg.MaxPollInterval; i++ {
+		interval *= 2
+	}
+	if interval > p.cfg.MaxPollInterval {
+		interval = p.cfg.MaxPollInterval
+	}
+	return interval
+}
+
+// EffectiveHandlers returns the handler names to poll for.
+// If a topicFilter is set (e.g., by RegistryRunner), it uses that;
+// otherwise it returns all registered handlers. Disabled facets are
+// excluded either way.
+func (p *AgentPoller) EffectiveHandlers() []string {
+	if p.topicFilter != nil {
+		return p.withCatchAll(p.withoutDisabled(p.topicFilter()))
+	}
+	return p.withCatchAll(p.withoutDisabled(p.withPublished(p.RegisteredHandlers())))
+}
+
+// withCatchAll adds a pattern matching every task name to names when
+// cfg.ClaimUnmatched is set and a default handler is registered.
+func (p *AgentPoller) withCatchAll(names []string) []string {
+	p.mu.RLock()
+	catchAll := p.cfg.ClaimUnmatched && p.defaultHandler != nil
+	p.mu.RUnlock()
+	if !catchAll {
+		return names
+	}
+	return append(names, p.qualify(PrefixWildcard))
+}
+
+// Disable stops the poller from claiming tasks for facetName without
+// unregistering its handler; tasks already in flight are unaffected.
+// The name is resolved as in Register.
+func (p *AgentPoller) Disable(facetName string) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disabled[facetName] = true
+}
+
+// Enable resumes claiming for a facet previously passed to Disable.
+func (p *AgentPoller) Enable(facetName string) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.disabled, facetName)
+}
+
+// DisabledFacets returns the facets currently excluded from claiming.
+func (p *AgentPoller) DisabledFacets() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.disabled))
+	for name := range p.disabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withoutDisabled returns names minus any disabled facets.
+func (p *AgentPoller) withoutDisabled(names []string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.disabled) == 0 {
+		return names
+	}
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		if !p.disabled[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// pollCycle tries to claim and dispatch one task. It reports whether a task
+// was claimed and handed to a worker. With StrictSerial the task is
+// processed before pollCycle returns.
+func (p *AgentPoller) pollCycle(ctx context.Context) bool {
+	if p.budgetClaimed() {
+		return false
+	}
+	handlers := p.withinDeadline(ctx, p.EffectiveHandlers())
+	if len(handlers) == 0 || p.standingBy(ctx) {
+		return false
+	}
+	if p.cfg.FullPoolPolicy == FullPoolSkipClaim && p.poolFull() {
+		return false
+	}
+	if p.exclusivePending() {
+		return false
+	}
+
+	// Try to claim a task
+	task := p.claimFromLists(ctx, handlers)
+	if task == nil {
+		return false // No task available
+	}
+	p.recordEvent(EventClaimed, task, "")
+
+	// Skip tasks whose step is already being processed
+	if !p.beginStep(ctx, task) {
+		return false
+	}
+
+	// Only the poll goroutine takes list slots, so the one checked free
+	// before claiming is still free
+	releaseList, ok := p.acquireListSlot(task.TaskListName)
+	if !ok {
+		p.endStep(ctx, task)
+		p.releaseTask(ctx, task, "task list concurrency reached")
+		return false
+	}
+
+	if p.cfg.StrictSerial {
+		// Only the poll goroutine takes slots, so one is always free
+		p.slots.take()
+		atomic.AddInt64(&p.counters.dispatched, 1)
+		defer atomic.AddInt64(&p.counters.finished, 1)
+		p.wg.Add(1)
+		defer p.wg.Done()
+		defer p.slots.release()
+		defer releaseList()
+		taskCtx := detachContext(ctx)
+		defer p.endStep(taskCtx, task)
+		p.processTask(taskCtx, task)
+		return true
+	}
+
+	// Acquire semaphore slot, as Config.FullPoolPolicy allows
+	if !p.acquireSlot(ctx) {
+		// All slots busy: hand the task back to be picked up next cycle
+		// or by another instance
+		log.Printf("Max concurrency reached, releasing task %s", task.UUID)
+		p.recordEvent(EventSkipped, task, "max concurrency reached")
+		releaseList()
+		p.endStep(ctx, task)
+		if err := p.ops.ReleaseTask(ctx, task); err != nil {
+			log.Printf("Failed to release task %s: %v", task.UUID, err)
+		}
+		return false
+	}
+
+	// Got slot, process in goroutine
+	atomic.AddInt64(&p.counters.dispatched, 1)
+	p.wg.Add(1)
+	taskCtx := detachContext(ctx)
+	go func() {
+		defer p.wg.Done()
+		defer atomic.AddInt64(&p.counters.finished, 1)
+		defer p.slots.release()
+		defer releaseList()
+		defer p.endStep(taskCtx, task)
+		p.processTask(taskCtx, task)
+	}()
+	return true
+}
+
+// stepLockKey is the locks collection key guarding a step.
+func stepLockKey(stepID string) string {
+	return "step:" + stepID
+}
+
+// workflowLockKey is the locks collection key serializing a workflow.
+func workflowLockKey(workflowID string) string {
+	return "workflow:" + workflowID
+}
+
+// beginStep marks the task's step as in flight and, with
+// SerializePerWorkflow, takes its workflow's lock. If the step or workflow is
+// already being processed, locally or by another agent, the task is handed
+// back and false is returned: a task whose step or workflow another agent
+// holds is deferred by PollInterval, so that it does not block the tasks
+// behind it.
+func (p *AgentPoller) beginStep(ctx context.Context, task *TaskDocument) bool {
+	if !p.lockStep(ctx, task) {
+		return false
+	}
+	if err := p.lockWorkflow(ctx, task); err != nil {
+		p.unlockStep(ctx, task)
+		if err == ErrLockHeld {
+			p.deferTask(ctx, task, "workflow busy")
+		} else {
+			p.releaseTask(ctx, task, "workflow lock failed")
+		}
+		return false
+	}
+	return true
+}
+
+// endStep releases everything taken by beginStep.
+func (p *AgentPoller) endStep(ctx context.Context, task *TaskDocument) {
+	p.unlockWorkflow(ctx, task)
+	p.unlockStep(ctx, task)
+}
+
+// lockWorkflow takes the workflow lock for task when SerializePerWorkflow is
+// set. The lock is held for the whole of processing, renewed by renewLocks.
+// It returns ErrLockHeld if the workflow is busy.
+func (p *AgentPoller) lockWorkflow(ctx context.Context, task *TaskDocument) error {
+	if !p.cfg.SerializePerWorkflow || task.WorkflowID == "" {
+		return nil
+	}
+
+	token, err := p.ops.AcquireLock(ctx, workflowLockKey(task.WorkflowID), p.cfg.WorkflowLockTTL)
+	if err != nil {
+		if err == ErrLockHeld {
+			log.Printf("Workflow %s busy, deferring task %s", task.WorkflowID, task.UUID)
+		} else {
+			log.Printf("Failed to lock workflow %s: %v", task.WorkflowID, err)
+		}
+		return err
+	}
+
+	p.inFlightMu.Lock()
+	p.workflowLocks[task.WorkflowID] = token
+	p.inFlightMu.Unlock()
+	return nil
+}
+
+// busyWorkflows returns the workflows this agent holds locks for, whose
+// other tasks claims skip; see MongoOps.BusyWorkflows.
+func (p *AgentPoller) busyWorkflows() []string {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	busy := make([]string, 0, len(p.workflowLocks))
+	for workflowID := range p.workflowLocks {
+		busy = append(busy, workflowID)
+	}
+	return busy
+}
+
+// unlockWorkflow releases the workflow lock taken by lockWorkflow, if any.
+func (p *AgentPoller) unlockWorkflow(ctx context.Context, task *TaskDocument) {
+	if task.WorkflowID == "" {
+		return
+	}
+
+	p.inFlightMu.Lock()
+	token, ok := p.workflowLocks[task.WorkflowID]
+	delete(p.workflowLocks, task.WorkflowID)
+	p.inFlightMu.Unlock()
+
+	if ok {
+		if err := p.ops.ReleaseLock(ctx, workflowLockKey(task.WorkflowID), token); err != nil {
+			log.Printf("Failed to unlock workflow %s: %v", task.WorkflowID, err)
+		}
+	}
+}
+
+// lockStep marks the task's step as in flight. If the step is already being
+// processed locally the task is released back to pending, and if (with
+// StepLockTTL) another agent holds it the task is deferred; either way
+// false is returned.
+func (p *AgentPoller) lockStep(ctx context.Context, task *TaskDocument) bool {
+	if task.StepID == "" {
+		return true
+	}
+
+	p.inFlightMu.Lock()
+	_, busy := p.inFlightSteps[task.StepID]
+	if !busy {
+		p.inFlightSteps[task.StepID] = ""
+	}
+	p.inFlightMu.Unlock()
+
+	if busy {
+		log.Printf("Step %s already in flight, releasing task %s", task.StepID, task.UUID)
+		p.releaseTask(ctx, task, "step already in flight")
+		return false
+	}
+
+	if p.cfg.StepLockTTL > 0 {
+		token, err := p.ops.AcquireLock(ctx, stepLockKey(task.StepID), p.cfg.StepLockTTL)
+		if err != nil {
+			p.inFlightMu.Lock()
+			delete(p.inFlightSteps, task.StepID)
+			p.inFlightMu.Unlock()
+			if err == ErrLockHeld {
+				log.Printf("Step %s locked by another agent, deferring task %s", task.StepID, task.UUID)
+				p.deferTask(ctx, task, "step locked")
+			} else {
+				log.Printf("Failed to lock step %s: %v", task.StepID, err)
+				p.releaseTask(ctx, task, "step lock failed")
+			}
+			return false
+		}
+		p.inFlightMu.Lock()
+		p.inFlightSteps[task.StepID] = token
+		p.inFlightMu.Unlock()
+	}
+	return true
+}
+
+// busySteps returns the steps this agent is processing, whose duplicate
+// tasks claims skip; see MongoOps.BusySteps.
+func (p *AgentPoller) busySteps() []string {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	busy := make([]string, 0, len(p.inFlightSteps))
+	for stepID := range p.inFlightSteps {
+		busy = append(busy, stepID)
+	}
+	return busy
+}
+
+// unlockStep clears the in-flight marker and step lock taken by lockStep.
+func (p *AgentPoller) unlockStep(ctx context.Context, task *TaskDocument) {
+	if task.StepID == "" {
+		return
+	}
+
+	p.inFlightMu.Lock()
+	token := p.inFlightSteps[task.StepID]
+	delete(p.inFlightSteps, task.StepID)
+	p.inFlightMu.Unlock()
+
+	if token != "" {
+		if err := p.ops.ReleaseLock(ctx, stepLockKey(task.StepID), token); err != nil {
+			log.Printf("Failed to unlock step %s: %v", task.StepID, err)
+		}
+	}
+}
+
+// heldLock is a locks collection lock held while a task is processed.
+type heldLock struct {
+	key   string
+	token string
+	ttl   time.Duration
+}
+
+// renewLocks keeps the step and workflow locks beginStep took for task
+// alive while it is processed, extending each at a third of the shortest
+// TTL, so a handler outliving a TTL keeps its exclusivity. A lock found
+// taken over is logged and no longer renewed. The returned func stops the
+// renewal and waits for it, so that it never races the release.
+func (p *AgentPoller) renewLocks(ctx context.Context, task *TaskDocument) func() {
+	cfg := p.config()
+	var locks []heldLock
+	p.inFlightMu.Lock()
+	if token := p.inFlightSteps[task.StepID]; task.StepID != "" && token != "" {
+		locks = append(locks, heldLock{stepLockKey(task.StepID), token, cfg.StepLockTTL})
+	}
+	if token, ok := p.workflowLocks[task.WorkflowID]; task.WorkflowID != "" && ok {
+		locks = append(locks, heldLock{workflowLockKey(task.WorkflowID), token, cfg.WorkflowLockTTL})
+	}
+	p.inFlightMu.Unlock()
+
+	interval := time.Duration(0)
+	for _, l := range locks {
+		if l.ttl > 0 && (interval == 0 || l.ttl/3 < interval) {
+			interval = l.ttl / 3
+		}
+	}
+	if interval <= 0 {
+		return func() {}
 	}
 
-	// Disconnect from MongoDB
-	if p.client != nil {
-		if err := p.client.Disconnect(ctx); err != nil {
-			return err
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for len(locks) > 0 {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			held := locks[:0]
+			for _, l := range locks {
+				err := p.ops.RenewLock(ctx, l.key, l.token, l.ttl)
+				if err == ErrLockNotHeld {
+					log.Printf("Lock %s of task %s expired and was taken over; its handler no longer runs exclusively", l.key, task.UUID)
+					continue
+				}
+				if err != nil {
+					log.Printf("Failed to renew lock %s of task %s: %v", l.key, task.UUID, err)
+				}
+				held = append(held, l)
+			}
+			locks = held
 		}
+	}()
+	return func() {
+		close(done)
+		<-exited
 	}
+}
 
-	return nil
+// trackTask registers task as in flight under a cancelable child of ctx,
+// a detached task context. The returned func must be called when
+// processing ends.
+func (p *AgentPoller) trackTask(ctx context.Context, task *TaskDocument) (context.Context, func()) {
+	reason := &cancelReason{}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, cancelReasonKey{}, reason))
+
+	p.inFlightMu.Lock()
+	p.inFlightTasks[task.UUID] = &inFlightTask{task: task, cancel: cancel, reason: reason}
+	p.inFlightMu.Unlock()
+
+	return ctx, func() {
+		p.inFlightMu.Lock()
+		delete(p.inFlightTasks, task.UUID)
+		p.inFlightMu.Unlock()
+		cancel()
+	}
 }
 
-// PollOnce performs a single poll cycle. Useful for testing.
-func (p *AgentPoller) PollOnce(ctx context.Context) error {
-	if p.db == nil {
-		// Connect if not already connected
-		clientOpts := options.Client().ApplyURI(p.cfg.MongoURL)
-		client, err := mongo.Connect(ctx, clientOpts)
-		if err != nil {
-			return err
+// requeueInFlight hands every in-flight task back to pending with its
+// runner_id cleared, then marks it requeued and cancels its handler
+// context. A task that could not be requeued is left to finish. It returns
+// how many tasks were requeued.
+func (p *AgentPoller) requeueInFlight(ctx context.Context) int {
+	p.inFlightMu.Lock()
+	tasks := make([]*inFlightTask, 0, len(p.inFlightTasks))
+	for _, t := range p.inFlightTasks {
+		tasks = append(tasks, t)
+	}
+	p.inFlightMu.Unlock()
+
+	requeued := 0
+	for _, t := range tasks {
+		p.recordEvent(EventRequeued, t.task, "shutdown")
+		if err := p.ops.RequeueTask(ctx, t.task); err != nil {
+			log.Printf("Failed to requeue task %s: %v", t.task.UUID, err)
+			continue
 		}
-		p.client = client
-		p.db = client.Database(p.cfg.Database)
-		p.ops = NewMongoOps(p.db)
-		p.registration = NewServerRegistration(p.db)
+		log.Printf("Requeued in-flight task %s on shutdown", t.task.UUID)
+		requeued++
+		p.inFlightMu.Lock()
+		t.requeued = true
+		p.inFlightMu.Unlock()
+		t.cancel()
 	}
+	return requeued
+}
 
-	handlers := p.RegisteredHandlers()
-	task, err := p.ops.ClaimTask(ctx, handlers, p.cfg.TaskList)
-	if err != nil {
-		return err
+// discardReason reports whether the result of task, processed under ctx,
+// must be discarded because another agent may own the task now: it was
+// requeued on shutdown or canceled externally. The string describes why.
+func (p *AgentPoller) discardReason(ctx context.Context, task *TaskDocument) (string, bool) {
+	if reason, ok := CancelReasonFromContext(ctx); ok {
+		return "canceled externally: " + reason, true
 	}
-	if task == nil {
-		return nil // No task available
+	p.inFlightMu.Lock()
+	t := p.inFlightTasks[task.UUID]
+	requeued := t != nil && t.requeued
+	p.inFlightMu.Unlock()
+	if requeued {
+		return "result discarded", true
 	}
-
-	// Process synchronously for PollOnce
-	p.processTask(ctx, task)
-	return nil
+	return "", false
 }
 
-func (p *AgentPoller) pollLoop(ctx context.Context) {
-	ticker := time.NewTicker(p.cfg.PollInterval)
-	defer ticker.Stop()
+// waitInFlight waits for poller goroutines to finish, or for ctx to end.
+func (p *AgentPoller) waitInFlight(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
 
-	for {
-		select {
-		case <-p.stopCh:
-			return
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			p.pollCycle(ctx)
-		}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Stop deadline reached with tasks still in flight")
 	}
 }
 
-// EffectiveHandlers returns the handler names to poll for.
-// If a topicFilter is set (e.g., by RegistryRunner), it uses that;
-// otherwise it returns all registered handlers.
-func (p *AgentPoller) EffectiveHandlers() []string {
-	if p.topicFilter != nil {
-		return p.topicFilter()
+// releaseTask returns a claimed task to pending, logging on failure.
+func (p *AgentPoller) releaseTask(ctx context.Context, task *TaskDocument, reason string) {
+	p.recordEvent(EventReleased, task, reason)
+	if err := p.ops.ReleaseTask(ctx, task); err != nil {
+		log.Printf("Failed to release task %s: %v", task.UUID, err)
 	}
-	return p.RegisteredHandlers()
 }
 
-func (p *AgentPoller) pollCycle(ctx context.Context) {
-	handlers := p.EffectiveHandlers()
-	if len(handlers) == 0 {
-		return
+// deferTask returns a claimed task to pending, not to be claimed again for
+// PollInterval, logging on failure.
+func (p *AgentPoller) deferTask(ctx context.Context, task *TaskDocument, reason string) {
+	p.recordEvent(EventReleased, task, reason)
+	if err := p.ops.DeferTask(ctx, task, p.cfg.PollInterval); err != nil {
+		log.Printf("Failed to defer task %s: %v", task.UUID, err)
 	}
+}
 
-	// Try to claim a task
-	task, err := p.ops.ClaimTask(ctx, handlers, p.cfg.TaskList)
-	if err != nil {
-		log.Printf("Error claiming task: %v", err)
-		return
-	}
-	if task == nil {
-		return // No task available
+// failTask marks task failed with errMsg as a framework error, logging on
+// failure.
+func (p *AgentPoller) failTask(ctx context.Context, task *TaskDocument, errMsg string) {
+	p.recordEvent(EventFailed, task, errMsg)
+	if err := p.ops.MarkTaskFailed(ctx, task, errMsg); err != nil {
+		log.Printf("Failed to mark task as failed: %v", err)
 	}
+}
 
-	// Acquire semaphore slot
-	select {
-	case p.sem <- struct{}{}:
-		// Got slot, process in goroutine
-		p.wg.Add(1)
-		go func() {
-			defer p.wg.Done()
-			defer func() { <-p.sem }()
-			p.processTask(ctx, task)
-		}()
-	default:
-		// All slots busy, skip this cycle
-		// Task will be picked up next cycle or by another instance
-		log.Printf("Max concurrency reached, skipping task %s", task.UUID)
+// failTaskErr marks task failed with the handler error err, classified
+// into an ErrorInfo, unless Config.RetryBackoff schedules a retry.
+func (p *AgentPoller) failTaskErr(ctx context.Context, task *TaskDocument, handlerErr error) {
+	info := newErrorInfo(task, handlerErr, "")
+	if p.scheduleRetry(ctx, task, info) {
+		return
+	}
+	p.recordEvent(EventFailed, task, handlerErr.Error())
+	if err := p.ops.MarkTaskFailedInfo(ctx, task, info); err != nil {
+		log.Printf("Failed to mark task as failed: %v", err)
 	}
 }
 
@@ -253,25 +1527,52 @@ func (p *AgentPoller) emitStepLog(ctx context.Context, stepID, workflowID, facet
 }
 
 func (p *AgentPoller) processTask(ctx context.Context, task *TaskDocument) {
+	ctx, done := p.trackTask(ctx, task)
+	defer done()
+	defer p.renewLease(ctx, task)()
+	defer p.renewLocks(ctx, task)()
+
+	// Wait for an exclusive task, or for others to drain for one
+	defer p.enterExclusive(task)()
+	if ctx.Err() != nil {
+		log.Printf("Task %s canceled before it started", task.UUID)
+		p.recordEvent(EventCanceled, task, "canceled before start")
+		return
+	}
+
+	if task.StepID == "" {
+		p.processWithoutStep(ctx, task)
+		return
+	}
+
 	// 1. Task claimed
 	p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
 		StepLogLevelInfo, fmt.Sprintf("Task claimed: %s", task.Name))
 
-	// Find handler - try qualified name first, then short name
-	handler := p.findHandler(task.Name)
+	// Find handler - try qualified name first, then short name. The
+	// handler's generation stays live until the task is done.
+	facet, handler, release := p.acquireHandler(task)
+	defer release()
+	if handler == nil && p.cfg.ReleaseUnregistered && !p.handlesName(task.Name) {
+		// Unregistered since the claim: let a registered agent have it
+		log.Printf("Handler for %s unregistered after claim, releasing task %s", task.Name, task.UUID)
+		p.releaseTask(ctx, task, "handler unregistered")
+		return
+	}
 	if handler == nil {
 		// 2. No handler found
 		errMsg := fmt.Sprintf("No handler registered for: %s", task.Name)
 		p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
 			StepLogLevelError, "Handler error: "+errMsg)
 		log.Printf("No handler for task: %s", task.Name)
-		if err := p.ops.MarkTaskFailed(ctx, task, "no handler registered"); err != nil {
-			log.Printf("Failed to mark task as failed: %v", err)
-		}
+		atomic.AddInt64(&p.counters.noHandler, 1)
+		p.failTask(ctx, task, "no handler registered")
 		return
 	}
 
 	// 3. Dispatching handler
+	p.counters.facetStarted(facet)
+	defer p.counters.facetDone(facet)
 	p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
 		StepLogLevelInfo, fmt.Sprintf("Dispatching handler: %s", task.Name))
 
@@ -279,13 +1580,51 @@ func (p *AgentPoller) processTask(ctx context.Context, task *TaskDocument) {
 
 	// Read step parameters
 	params, err := p.ops.ReadStepParams(ctx, task.StepID)
+	if errors.Is(err, ErrStepNotWritable) && !p.cfg.RequireWritableStep {
+		// E.g. a duplicate task of a step another task already finished:
+		// its result would be discarded, so the handler does not run
+		log.Printf("Step %s of task %s is no longer awaiting returns, ignoring the task", task.StepID, task.UUID)
+		p.recordEvent(EventIgnored, task, "step no longer awaiting returns")
+		if err := p.ops.MarkTaskIgnored(ctx, task); err != nil {
+			log.Printf("Failed to mark task ignored: %v", err)
+		}
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to read step params: %v", err)
-		if err := p.ops.MarkTaskFailed(ctx, task, err.Error()); err != nil {
-			log.Printf("Failed to mark task as failed: %v", err)
-		}
+		p.failTask(ctx, task, err.Error())
 		return
 	}
+	p.applyParamDefaults(facet, params)
+
+	// Move trace context out of the params and into the handler context
+	handlerCtx := withTask(ctx, task)
+	if tc, ok := takeTraceContext(params); ok {
+		handlerCtx = withTraceContext(handlerCtx, tc)
+	}
+
+	// Apply params transformer before framework keys are injected
+	p.mu.RLock()
+	transform := p.paramsTransformer
+	p.mu.RUnlock()
+	if transform != nil {
+		params, err = transform(task, params)
+		if err != nil {
+			errMsg := fmt.Sprintf("params transformer failed: %v", err)
+			p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
+				StepLogLevelError, "Handler error: "+errMsg)
+			log.Printf("Params transformer error for %s: %v", task.Name, err)
+			p.failTask(ctx, task, errMsg)
+			return
+		}
+		if params == nil {
+			params = make(map[string]interface{})
+		}
+	}
+
+	// Names of the step's own params, before framework keys are injected
+	paramKeys := sortedKeys(params)
+	sampled := p.sampleInput(params)
 
 	// Inject handler-level step_log callback
 	params["_step_log"] = func(message string, level string) {
@@ -296,6 +1635,11 @@ func (p *AgentPoller) processTask(ctx context.Context, task *TaskDocument) {
 	// Inject _facet_name
 	params["_facet_name"] = task.Name
 
+	// Inject _context carrying a read-only copy of the task, its trace
+	// context and a writer for partial returns
+	writer := &stepReturnsWriter{ops: p.ops, ctx: ctx, stepID: task.StepID}
+	params[ContextParam] = withReturnsWriter(handlerCtx, writer)
+
 	// Inject _handler_metadata if provider is available
 	if p.metadataProvider != nil {
 		if meta := p.metadataProvider(task.Name); meta != nil {
@@ -311,74 +1655,361 @@ func (p *AgentPoller) processTask(ctx context.Context, task *TaskDocument) {
 	}
 
 	// Invoke handler
-	result, err := handler(params)
+	handlerStart := time.Now()
+	result, err := p.invokeHandler(task, handler, params)
+	p.counters.observeHandler(time.Since(handlerStart))
+	p.recordSample(task, sampled, result, err, time.Since(handlerStart))
+	writer.close()
+	if detail, discard := p.discardReason(ctx, task); discard {
+		// Requeued on shutdown or canceled externally: another agent may
+		// own the task now, so the result must not be written.
+		log.Printf("Task %s canceled during processing, discarding result", task.UUID)
+		p.recordEvent(EventCanceled, task, detail)
+		return
+	}
+	if errors.Is(err, ErrIgnoreTask) {
+		p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
+			StepLogLevelInfo, fmt.Sprintf("Handler ignored task: %v", err))
+		p.recordEvent(EventIgnored, task, err.Error())
+		if err := p.ops.MarkTaskIgnored(ctx, task); err != nil {
+			log.Printf("Failed to mark task ignored: %v", err)
+		}
+		return
+	}
 	if err != nil {
 		// 5. Handler error
 		p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
 			StepLogLevelError, fmt.Sprintf("Handler error: %v", err))
 		log.Printf("Handler error for %s: %v", task.Name, err)
-		if err := p.ops.MarkTaskFailed(ctx, task, err.Error()); err != nil {
-			log.Printf("Failed to mark task as failed: %v", err)
+		p.failTaskErr(ctx, task, err)
+		return
+	}
+
+	// Extract the handler's completion control, if any
+	resume := !p.isTerminal(task.Name)
+	resumeTaskList := task.TaskListName
+	if next := takeNextTaskList(result); next != "" {
+		resumeTaskList = next
+	}
+	if completion := takeCompletion(result); completion != nil {
+		resume = completion.Resume
+		if completion.TaskList != "" {
+			resumeTaskList = completion.TaskList
+		}
+	} else if resume && p.cfg.CheckLeafSteps {
+		// Leaf steps have nothing to resume; when in doubt, resume
+		needed, err := p.ops.StepNeedsResume(ctx, task.StepID)
+		if err != nil {
+			log.Printf("Failed to check step %s for a leaf marker: %v", task.StepID, err)
+		} else {
+			resume = needed
 		}
+	}
+
+	// Store declared numeric returns with their intended BSON type
+	if err := coerceReturns(result, takeReturnTypes(result)); err != nil {
+		errMsg := fmt.Sprintf("return types: %v", err)
+		p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
+			StepLogLevelError, "Handler error: "+errMsg)
+		log.Printf("Return type error for %s: %v", task.Name, err)
+		p.failTask(ctx, task, errMsg)
 		return
 	}
 
-	// Write returns to step
-	if result != nil {
-		if err := p.ops.WriteStepReturns(ctx, task.StepID, result); err != nil {
-			log.Printf("Failed to write step returns: %v", err)
-			if err := p.ops.MarkTaskFailed(ctx, task, err.Error()); err != nil {
-				log.Printf("Failed to mark task as failed: %v", err)
-			}
+	// Enforce the integrator's output contract
+	p.mu.RLock()
+	validate := p.resultValidator
+	p.mu.RUnlock()
+	if validate != nil {
+		if err := validate(task, result); err != nil {
+			errMsg := fmt.Sprintf("result validator failed: %v", err)
+			p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
+				StepLogLevelError, "Handler error: "+errMsg)
+			log.Printf("Result validator error for %s: %v", task.Name, err)
+			p.failTask(ctx, task, errMsg)
 			return
 		}
 	}
 
-	// Insert resume task for Python RunnerService
-	if err := p.ops.InsertResumeTask(ctx, task.StepID, task.WorkflowID, task.TaskListName, task.Name); err != nil {
-		log.Printf("Failed to insert resume task: %v", err)
-		if err := p.ops.MarkTaskFailed(ctx, task, err.Error()); err != nil {
-			log.Printf("Failed to mark task as failed: %v", err)
+	// Guard against results too large for the step document
+	if p.cfg.MaxReturnBytes > 0 && len(result) > 0 {
+		size, err := p.returnsSize(result)
+		if err == nil && size > p.cfg.MaxReturnBytes {
+			err = fmt.Errorf("result too large: %d bytes exceeds limit of %d", size, p.cfg.MaxReturnBytes)
+		}
+		if err != nil {
+			p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
+				StepLogLevelError, fmt.Sprintf("Handler error: %v", err))
+			log.Printf("Rejected result for %s: %v", task.Name, err)
+			p.failTask(ctx, task, err.Error())
+			return
 		}
-		return
 	}
 
-	// Mark task completed
-	if err := p.ops.MarkTaskCompleted(ctx, task); err != nil {
-		log.Printf("Failed to mark task completed: %v", err)
+	// Terminal facet or vetoed resume: write returns, complete the step
+	// and the task in one go
+	if !resume && !task.Reexecute {
+		if !p.completeWithReturns(ctx, task, result) {
+			return
+		}
+	} else {
+		if !p.writeReturnsAndResume(ctx, task, result, resume, resumeTaskList) {
+			return
+		}
+
+		// Mark task completed
+		p.recordEvent(EventCompleted, task, "")
+		p.completeTask(ctx, task)
 	}
 
 	// 4. Handler completed
 	durationMs := time.Since(dispatchStart).Milliseconds()
 	p.emitStepLog(ctx, task.StepID, task.WorkflowID, task.Name,
 		StepLogLevelSuccess, fmt.Sprintf("Handler completed: %s (%dms)", task.Name, durationMs))
+	p.logCompletion(task, durationMs, paramKeys, sortedKeys(result))
+}
+
+// completeWithReturns finishes a task whose step needs no resume through
+// CompleteWithReturns, reporting whether the task is done. Without
+// RequireWritableStep a step that is no longer awaiting returns does not
+// fail the task, as with WriteStepReturns.
+func (p *AgentPoller) completeWithReturns(ctx context.Context, task *TaskDocument, result map[string]interface{}) bool {
+	err := p.ops.CompleteWithReturns(ctx, task, task.StepID, result)
+	switch {
+	case err == nil:
+		p.recordEvent(EventCompleted, task, "")
+		return true
+	case errors.Is(err, ErrTaskNotCompleted):
+		// The step is done; only the task write is left
+		p.recordEvent(EventCompleted, task, "")
+		p.completeTask(ctx, task)
+		return true
+	case errors.Is(err, ErrStepNotWritable) && !p.cfg.RequireWritableStep:
+		p.recordEvent(EventCompleted, task, "")
+		p.completeTask(ctx, task)
+		return true
+	}
+	p.returnsWriteFailed(ctx, task, err)
+	return false
+}
+
+// writeReturnsAndResume writes returns to the step of a task that is not
+// finished by completeWithReturns and hands the step on: it inserts the
+// resume task, or completes a re-executed step that needs no resume.
+// It reports whether the task can be marked completed.
+func (p *AgentPoller) writeReturnsAndResume(ctx context.Context, task *TaskDocument, result map[string]interface{}, resume bool, resumeTaskList string) bool {
+	// Write returns to step (an empty $set is rejected by MongoDB); a
+	// re-execution replaces those of the previous run, even with none.
+	// RequireWritableStep checks the step is still there even without
+	// returns, so no resume task is inserted for a step that is gone.
+	if task.Reexecute {
+		if err := p.ops.ReplaceStepReturns(ctx, task.StepID, result); err != nil {
+			p.returnsWriteFailed(ctx, task, err)
+			return false
+		}
+	} else if len(result) > 0 || p.cfg.RequireWritableStep {
+		if err := p.ops.WriteStepReturns(ctx, task.StepID, result); err != nil {
+			p.returnsWriteFailed(ctx, task, err)
+			return false
+		}
+	}
+
+	if !resume {
+		// Vetoed resume: finalize the step here
+		if err := p.ops.MarkStepCompleted(ctx, task.StepID); err != nil {
+			log.Printf("Failed to mark step completed: %v", err)
+			p.failTask(ctx, task, err.Error())
+			return false
+		}
+		return true
+	}
+
+	// Optionally own the step transition before handing off
+	if state := p.cfg.AdvanceStepState; state != "" {
+		if err := p.ops.AdvanceStepState(ctx, task.StepID, state); err != nil {
+			log.Printf("Failed to advance step state: %v", err)
+			p.failTask(ctx, task, err.Error())
+			return false
+		}
+	}
+
+	// Insert resume task for Python RunnerService
+	return p.insertResume(ctx, task, resumeTaskList)
+}
+
+// returnsWriteFailed fails task after its returns could not be written.
+func (p *AgentPoller) returnsWriteFailed(ctx context.Context, task *TaskDocument, err error) {
+	if errors.Is(err, ErrStepNotWritable) {
+		log.Printf("Step %s of task %s is no longer writable, discarding the result", task.StepID, task.UUID)
+		p.failTask(ctx, task, "step no longer writable")
+		return
+	}
+	log.Printf("Failed to write step returns: %v", err)
+	p.failTask(ctx, task, err.Error())
+}
+
+// returnsSize returns the BSON-encoded size of a handler result, using the
+// custom registry if one is set.
+func (p *AgentPoller) returnsSize(result map[string]interface{}) (int, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if p.registry != nil {
+		data, err = bson.MarshalWithRegistry(p.registry, result)
+	} else {
+		data, err = bson.Marshal(result)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("encoding result: %v", err)
+	}
+	return len(data), nil
 }
 
+// findHandler resolves the handler for a task name alone, i.e. for a task
+// with no data to route on.
 func (p *AgentPoller) findHandler(taskName string) Handler {
+	return p.findTaskHandler(&TaskDocument{Name: taskName})
+}
+
+// findTaskHandler resolves the handler for task: its name picks the
+// registered facet (see matchHandlerName), then its data picks among that
+// facet's routes (see RegisterRouted). Failing both, the RegisterDefault
+// handler is used.
+func (p *AgentPoller) findTaskHandler(task *TaskDocument) Handler {
+	_, handler := p.resolveHandler(task)
+	return handler
+}
+
+// resolveHandler is findTaskHandler that also returns the registered name
+// the task matched, or PrefixWildcard for the default handler.
+func (p *AgentPoller) resolveHandler(task *TaskDocument) (string, Handler) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.resolveHandlerLocked(task)
+}
+
+// resolveHandlerLocked is resolveHandler for callers holding p.mu.
+func (p *AgentPoller) resolveHandlerLocked(task *TaskDocument) (string, Handler) {
+	if name, ok := p.matchHandlerName(task.Name); ok {
+		if handler := p.selectHandler(name, task); handler != nil {
+			return name, handler
+		}
+	}
+	if p.defaultHandler != nil {
+		return PrefixWildcard, p.defaultHandler
+	}
+	return "", nil
+}
+
+// handlesName reports whether any registration, including the default
+// handler, matches taskName, regardless of routes.
+func (p *AgentPoller) handlesName(taskName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if _, ok := p.matchHandlerName(taskName); ok {
+		return true
+	}
+	return p.defaultHandler != nil
+}
+
+// isTerminal reports whether the handler matched for taskName was
+// registered with RegisterTerminal.
+func (p *AgentPoller) isTerminal(taskName string) bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
+	if name, ok := p.matchHandlerName(taskName); ok {
+		return p.terminal[name]
+	}
+	return false
+}
+
+// qualify prefixes name with Config.Namespace, if set and not already
+// present.
+func (p *AgentPoller) qualify(name string) string {
+	ns := p.cfg.Namespace
+	if ns == "" || strings.HasPrefix(name, ns+".") {
+		return name
+	}
+	return ns + "." + name
+}
+
+// matchHandlerName resolves a task name to the registered handler name.
+// An exact registration wins, then the short name (ns.Facet -> Facet), then
+// the best prefix pattern as chosen by matchPattern. With a Namespace, only
+// tasks inside it match and, since every handler is registered under its
+// qualified name, the short-name fallback never applies.
+// Callers must hold p.mu.
+func (p *AgentPoller) matchHandlerName(taskName string) (string, bool) {
+	if ns := p.cfg.Namespace; ns != "" {
+		if !strings.HasPrefix(taskName, ns+".") {
+			return "", false
+		}
+		if p.isRegistered(taskName) {
+			return taskName, true
+		}
+		return p.matchPattern(taskName)
+	}
+
 	// Try exact match first
-	if h, ok := p.handlers[taskName]; ok {
-		return h
+	if p.isRegistered(taskName) {
+		return taskName, true
 	}
 
 	// Try short name fallback (ns.Facet -> Facet)
 	if idx := strings.LastIndex(taskName, "."); idx >= 0 {
 		shortName := taskName[idx+1:]
-		if h, ok := p.handlers[shortName]; ok {
-			return h
+		if p.isRegistered(shortName) {
+			return shortName, true
 		}
 	}
 
-	return nil
+	return p.matchPattern(taskName)
+}
+
+// matchPattern picks the prefix pattern that handles taskName. When several
+// match, the highest priority wins, then the longest prefix, so
+// "billing.invoice.*" beats "billing.*"; equal candidates fall back to name
+// order to stay deterministic. Callers must hold p.mu.
+func (p *AgentPoller) matchPattern(taskName string) (string, bool) {
+	best, found := "", false
+	consider := func(name string) {
+		prefix, ok := patternPrefix(name)
+		if !ok || !strings.HasPrefix(taskName, prefix) {
+			return
+		}
+		if !found || p.betterPattern(name, best) {
+			best, found = name, true
+		}
+	}
+	for name := range p.handlers {
+		consider(name)
+	}
+	for name := range p.routes {
+		consider(name)
+	}
+	return best, found
+}
+
+// betterPattern reports whether pattern a takes precedence over b.
+func (p *AgentPoller) betterPattern(a, b string) bool {
+	if pa, pb := p.priority[a], p.priority[b]; pa != pb {
+		return pa > pb
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a < b
 }
 
 func (p *AgentPoller) heartbeatLoop(ctx context.Context) {
 	defer p.wg.Done()
 
-	ticker := time.NewTicker(p.cfg.HeartbeatInterval)
-	defer ticker.Stop()
+	interval := p.baseHeartbeatInterval()
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
 
 	for {
 		select {
@@ -387,9 +2018,188 @@ func (p *AgentPoller) heartbeatLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := p.registration.Heartbeat(ctx, p.serverID); err != nil {
+			if err := p.sendHeartbeat(ctx); err != nil {
 				log.Printf("Heartbeat error: %v", err)
 			}
+			p.syncServerTime(ctx)
+
+			if next := p.heartbeatInterval(p.load()); next != interval {
+				interval = next
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+		}
+	}
+}
+
+// syncServerTime re-measures the server clock offset when
+// cfg.UseServerTime is set. On failure the previous offset (initially
+// none, i.e. the local clock) stays in use.
+func (p *AgentPoller) syncServerTime(ctx context.Context) {
+	if !p.cfg.UseServerTime {
+		return
+	}
+	clock, ok := p.ops.(serverClock)
+	if !ok {
+		return
+	}
+	if err := clock.SyncServerTime(ctx); err != nil {
+		log.Printf("Failed to sync server time: %v", err)
+	}
+}
+
+// sendHeartbeat pings the server document, retrying up to
+// cfg.HeartbeatRetries times with jittered exponential backoff so that a
+// brief MongoDB blip does not leave ping_time stale until the next tick.
+func (p *AgentPoller) sendHeartbeat(ctx context.Context) error {
+	heartbeat := func(ctx context.Context) error {
+		return p.registration.Heartbeat(ctx, p.serverID)
+	}
+	if reporter, ok := p.registration.(loadReporter); ok && p.cfg.AdaptiveHeartbeat {
+		heartbeat = func(ctx context.Context) error {
+			return reporter.HeartbeatLoad(ctx, p.serverID, p.load())
+		}
+	}
+
+	err := p.withRegistrationTimeout(ctx, "heartbeat", heartbeat)
+	for attempt := 0; err != nil && attempt < p.cfg.HeartbeatRetries; attempt++ {
+		log.Printf("Heartbeat attempt %d failed, retrying: %v", attempt+1, err)
+		select {
+		case <-p.stopCh:
+			return err
+		case <-ctx.Done():
+			return err
+		case <-time.After(heartbeatBackoff(p.config(), attempt)):
+		}
+		err = p.withRegistrationTimeout(ctx, "heartbeat", heartbeat)
+	}
+	return err
+}
+
+// load returns the share of MaxConcurrent slots in use, from 0 to 1.
+func (p *AgentPoller) load() float64 {
+	used, limit := p.slots.usage()
+	if limit == 0 {
+		return 0
+	}
+	return float64(used) / float64(limit)
+}
+
+// heartbeatInterval returns the heartbeat interval at load. Without
+// AdaptiveHeartbeat it is HeartbeatInterval; with it the interval grows
+// linearly to twice that at full load, capped at a third of
+// ServerStaleAfter so that a busy agent still pings well before it would
+// be declared dead. The cap never shortens HeartbeatInterval itself.
+func (p *AgentPoller) heartbeatInterval(load float64) time.Duration {
+	base := p.baseHeartbeatInterval()
+	if !p.cfg.AdaptiveHeartbeat || load <= 0 {
+		return base
+	}
+	if load > 1 {
+		load = 1
+	}
+	interval := base + time.Duration(float64(base)*load)
+	if limit := p.cfg.ServerStaleAfter / 3; p.cfg.ServerStaleAfter > 0 && interval > limit {
+		interval = limit
+	}
+	if interval < base {
+		interval = base
+	}
+	return interval
+}
+
+// withRegistrationTimeout runs a server registry operation under
+// cfg.RegistrationTimeout, so that a slow MongoDB cannot block Start (or
+// Stop, or a heartbeat) indefinitely. A timeout is reported as
+// ErrRegistrationTimeout.
+func (p *AgentPoller) withRegistrationTimeout(ctx context.Context, op string, fn func(context.Context) error) error {
+	timeout := p.cfg.RegistrationTimeout
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(opCtx)
+	if err != nil && ctx.Err() == nil && opCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s did not complete within %v", ErrRegistrationTimeout, op, timeout)
+	}
+	return err
+}
+
+// heartbeatBackoff returns the delay before retry number attempt (0-based):
+// the base backoff doubled per attempt, capped at the maximum, and then
+// jittered uniformly into [d/2, d]. Without a maximum the heartbeat
+// interval caps it, or failing that DefaultHeartbeatRetryMaxBackoff.
+func heartbeatBackoff(cfg Config, attempt int) time.Duration {
+	max := cfg.HeartbeatRetryMaxBackoff
+	if max <= 0 {
+		max = cfg.HeartbeatInterval
+	}
+	if max <= 0 {
+		max = DefaultHeartbeatRetryMaxBackoff
+	}
+	d := cfg.HeartbeatRetryBackoff
+	for i := 0; i < attempt && d > 0 && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func (p *AgentPoller) queueDepthLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	p.sampleQueueDepth(ctx)
+
+	ticker := time.NewTicker(p.cfg.QueueDepthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sampleQueueDepth(ctx)
+		}
+	}
+}
+
+// sampleQueueDepth counts the pending tasks this agent could claim and
+// records the result for Stats and the queue-depth gauge.
+func (p *AgentPoller) sampleQueueDepth(ctx context.Context) {
+	handlers := p.EffectiveHandlers()
+	if len(handlers) == 0 {
+		p.storeQueueDepth(0)
+		return
+	}
+
+	var n int64
+	for _, list := range p.taskLists() {
+		count, err := p.ops.CountPending(ctx, handlers, list)
+		if err != nil {
+			log.Printf("Error sampling queue depth: %v", err)
+			return
 		}
+		n += count
+	}
+	p.storeQueueDepth(n)
+	p.recordPressure(n)
+}
+
+// storeQueueDepth records a queue-depth sample.
+func (p *AgentPoller) storeQueueDepth(n int64) {
+	atomic.StoreInt64(&p.queueDepth, n)
+	if p.queueDepthGauge != nil {
+		p.queueDepthGauge.Set(float64(n))
 	}
 }
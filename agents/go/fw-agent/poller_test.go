@@ -15,7 +15,21 @@
 package fwagent
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestNewAgentPoller(t *testing.T) {
@@ -85,6 +99,33 @@ func TestFindHandler(t *testing.T) {
 	}
 }
 
+func TestRegisterMany(t *testing.T) {
+	poller := NewAgentPoller(DefaultConfig())
+	calls := 0
+	poller.RegisterMany([]string{"ns.Resize", "ns.ResizeV2", "ns.Thumbnail"}, func(params map[string]interface{}) (map[string]interface{}, error) {
+		calls++
+		return nil, nil
+	})
+
+	for _, name := range []string{"ns.Resize", "ns.ResizeV2", "ns.Thumbnail"} {
+		h := poller.findHandler(name)
+		if h == nil {
+			t.Errorf("Should find handler for %s", name)
+			continue
+		}
+		h(nil)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the shared handler called for each name, got %d", calls)
+	}
+
+	names := poller.RegisteredHandlers()
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "ns.Resize,ns.ResizeV2,ns.Thumbnail" {
+		t.Errorf("Expected all three names registered, got %s", got)
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	cfg := DefaultConfig()
 
@@ -312,3 +353,3813 @@ func TestInferTypeHint(t *testing.T) {
 		}
 	}
 }
+
+func TestTerminalHandlerSkipsResume(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.RegisterTerminal("ns.Sink", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"delivered": true}, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Sink", StepID: "step-1", TaskListName: "default"})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	if len(store.resumes) != 0 {
+		t.Errorf("Expected no resume task for terminal handler, got %d", len(store.resumes))
+	}
+	if store.stepStates["step-1"] != StepStateCompleted {
+		t.Errorf("Expected step state %s, got %s", StepStateCompleted, store.stepStates["step-1"])
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", store.taskState("task-1"))
+	}
+	if store.returns["step-1"]["delivered"] != true {
+		t.Error("Expected returns to be written for terminal handler")
+	}
+}
+
+func TestNonTerminalHandlerInsertsResume(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", TaskListName: "default"})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	if len(store.resumes) != 1 {
+		t.Fatalf("Expected 1 resume task, got %d", len(store.resumes))
+	}
+	if store.stepStates["step-1"] != StepStateEventTransmit {
+		t.Errorf("Step state should be left for the runner, got %s", store.stepStates["step-1"])
+	}
+}
+
+func TestRegisterOverridesTerminal(t *testing.T) {
+	poller := NewAgentPoller(DefaultConfig())
+	handler := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+
+	poller.RegisterTerminal("Sink", handler)
+	if !poller.isTerminal("ns.Sink") {
+		t.Error("Expected short-name match to be terminal")
+	}
+
+	poller.Register("Sink", handler)
+	if poller.isTerminal("ns.Sink") {
+		t.Error("Re-registering with Register should clear the terminal flag")
+	}
+}
+
+func TestHeartbeatRetriesAfterFailure(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HeartbeatRetryBackoff = time.Millisecond
+	cfg.HeartbeatRetryMaxBackoff = 5 * time.Millisecond
+	poller := NewAgentPoller(cfg)
+
+	registry := newFakeRegistry()
+	registry.heartbeatErrs = []error{errors.New("connection reset")}
+	poller.registration = registry
+
+	if err := poller.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("Expected heartbeat to succeed on retry, got %v", err)
+	}
+	if registry.heartbeats != 2 {
+		t.Errorf("Expected 2 heartbeat attempts, got %d", registry.heartbeats)
+	}
+}
+
+func TestHeartbeatRetriesExhausted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HeartbeatRetries = 2
+	cfg.HeartbeatRetryBackoff = time.Millisecond
+	poller := NewAgentPoller(cfg)
+
+	fail := errors.New("no primary")
+	registry := newFakeRegistry()
+	registry.heartbeatErrs = []error{fail, fail, fail, fail}
+	poller.registration = registry
+
+	if err := poller.sendHeartbeat(context.Background()); err != fail {
+		t.Errorf("Expected last heartbeat error, got %v", err)
+	}
+	if registry.heartbeats != 3 {
+		t.Errorf("Expected 1 attempt plus 2 retries, got %d", registry.heartbeats)
+	}
+}
+
+func TestHeartbeatBackoffCapped(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HeartbeatRetryBackoff = 100 * time.Millisecond
+	cfg.HeartbeatRetryMaxBackoff = 300 * time.Millisecond
+
+	for attempt := 0; attempt < 10; attempt++ {
+		d := heartbeatBackoff(cfg, attempt)
+		if d > cfg.HeartbeatRetryMaxBackoff {
+			t.Errorf("attempt %d: backoff %v exceeds cap", attempt, d)
+		}
+		if d < cfg.HeartbeatRetryBackoff/2 {
+			t.Errorf("attempt %d: backoff %v below jitter floor", attempt, d)
+		}
+	}
+}
+
+func TestHeartbeatBackoffDefaultCap(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HeartbeatRetryBackoff = 100 * time.Millisecond
+	cfg.HeartbeatRetryMaxBackoff = 0
+	cfg.HeartbeatInterval = time.Second
+
+	if d := heartbeatBackoff(cfg, 2); d < 200*time.Millisecond {
+		t.Errorf("Expected the backoff doubled below the cap, got %v", d)
+	}
+	for _, attempt := range []int{5, 200} {
+		if d := heartbeatBackoff(cfg, attempt); d > cfg.HeartbeatInterval || d < cfg.HeartbeatInterval/2 {
+			t.Errorf("attempt %d: expected the backoff capped at the heartbeat interval, got %v", attempt, d)
+		}
+	}
+
+	cfg.HeartbeatInterval = 0
+	if d := heartbeatBackoff(cfg, 200); d > DefaultHeartbeatRetryMaxBackoff || d <= 0 {
+		t.Errorf("Expected the default cap without an interval, got %v", d)
+	}
+}
+
+// seedBacklog adds n pending tasks (each with its own step) for facetName.
+func seedBacklog(store *fakeStore, facetName string, n int) {
+	for i := 0; i < n; i++ {
+		stepID := fmt.Sprintf("step-%d", i)
+		store.addStep(stepID, map[string]interface{}{})
+		store.addTask(TaskDocument{
+			UUID:         fmt.Sprintf("task-%d", i),
+			Name:         facetName,
+			StepID:       stepID,
+			TaskListName: "default",
+		})
+	}
+}
+
+func TestAdaptivePollingDrainsBacklog(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = 100 * time.Millisecond
+	poller.cfg.AdaptivePolling = true
+	poller.Register("ns.Burst", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	seedBacklog(store, "ns.Burst", 4)
+
+	start := time.Now()
+	go poller.pollLoop(context.Background())
+	defer close(poller.stopCh)
+
+	if !waitFor(2*time.Second, func() bool { return store.countTasks(TaskStateCompleted) == 4 }) {
+		t.Fatalf("Backlog not drained, %d completed", store.countTasks(TaskStateCompleted))
+	}
+	// One-per-interval would need at least 4 ticks (400ms)
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("Expected backlog drained within one or two intervals, took %v", elapsed)
+	}
+}
+
+func TestFixedPollingClaimsOnePerInterval(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = 50 * time.Millisecond
+	poller.Register("ns.Burst", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	seedBacklog(store, "ns.Burst", 3)
+
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected pollCycle to report a claim")
+	}
+	poller.wg.Wait()
+	if got := store.countTasks(TaskStatePending); got != 2 {
+		t.Errorf("Expected one task claimed per cycle, %d still pending", got)
+	}
+}
+
+func TestParamsTransformer(t *testing.T) {
+	poller, store := newFakePoller()
+
+	var received map[string]interface{}
+	poller.Register("ns.Secure", func(params map[string]interface{}) (map[string]interface{}, error) {
+		received = params
+		return nil, nil
+	})
+	poller.SetParamsTransformer(func(task *TaskDocument, params map[string]interface{}) (map[string]interface{}, error) {
+		params["secret"] = "decrypted:" + params["secret"].(string)
+		params["tenant"] = task.WorkflowID
+		return params, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{"secret": "abc"})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Secure", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if received["secret"] != "decrypted:abc" {
+		t.Errorf("Expected transformed secret, got %v", received["secret"])
+	}
+	if received["tenant"] != "wf-1" {
+		t.Errorf("Expected injected tenant 'wf-1', got %v", received["tenant"])
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", store.taskState("task-1"))
+	}
+}
+
+func TestParamsTransformerErrorFailsTask(t *testing.T) {
+	poller, store := newFakePoller()
+
+	called := false
+	poller.Register("ns.Secure", func(params map[string]interface{}) (map[string]interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	poller.SetParamsTransformer(func(task *TaskDocument, params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("bad key")
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Secure", StepID: "step-1", TaskListName: "default"})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if called {
+		t.Error("Handler should not run when the transformer fails")
+	}
+	if store.taskState("task-1") != TaskStateFailed {
+		t.Errorf("Expected task failed, got %s", store.taskState("task-1"))
+	}
+	if store.failures["task-1"] != "params transformer failed: bad key" {
+		t.Errorf("Unexpected failure message: %q", store.failures["task-1"])
+	}
+}
+
+func TestDuplicateStepSkipped(t *testing.T) {
+	poller, store := newFakePoller()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	poller.Register("ns.Slow", func(params map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return nil, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Slow", StepID: "step-1", TaskListName: "default"})
+
+	// First task is dispatched and blocks in the handler
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected first task to be dispatched")
+	}
+	waitFor(time.Second, func() bool { mu.Lock(); defer mu.Unlock(); return calls == 1 })
+
+	// A second task for the same step arrives while the first is in flight
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Slow", StepID: "step-1", TaskListName: "default"})
+	if poller.pollCycle(context.Background()) {
+		t.Error("Expected duplicate step claim to be skipped")
+	}
+	store.mu.Lock()
+	claimed := containsString(store.claimed, "task-2")
+	store.mu.Unlock()
+	if claimed || store.taskState("task-2") != TaskStatePending {
+		t.Errorf("Expected duplicate task left pending and unclaimed, got %s", store.taskState("task-2"))
+	}
+
+	close(release)
+	poller.wg.Wait()
+
+	// The step moves on; the duplicate is then ignored without running
+	store.mu.Lock()
+	store.stepStates["step-1"] = StepStateCompleted
+	store.mu.Unlock()
+	poller.pollCycle(context.Background())
+	poller.wg.Wait()
+	if got := store.taskState("task-2"); got != TaskStateIgnored {
+		t.Errorf("Expected duplicate ignored once its step completed, got %s", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("Expected handler invoked once for the step, got %d", calls)
+	}
+	if len(store.resumes) != 1 {
+		t.Errorf("Expected a single resume task for the step, got %d", len(store.resumes))
+	}
+	if len(poller.inFlightSteps) != 0 {
+		t.Errorf("Expected no in-flight steps after completion, got %v", poller.inFlightSteps)
+	}
+}
+
+func TestStepLockHeldByOtherAgent(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.StepLockTTL = time.Minute
+
+	called := false
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		called = true
+		return nil, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", TaskListName: "default"})
+	store.locks[stepLockKey("step-1")] = "other-agent"
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if called {
+		t.Error("Handler should not run while another agent holds the step lock")
+	}
+	if store.taskState("task-1") != TaskStatePending {
+		t.Errorf("Expected task released to pending, got %s", store.taskState("task-1"))
+	}
+	if len(store.deferrals["task-1"]) != 1 {
+		t.Errorf("Expected task deferred while the lock is held, got %v", store.deferrals["task-1"])
+	}
+
+	// Once the other agent releases, the task is processed and the lock freed
+	delete(store.locks, stepLockKey("step-1"))
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if !called {
+		t.Error("Expected handler to run once the lock is free")
+	}
+	if _, held := store.locks[stepLockKey("step-1")]; held {
+		t.Error("Expected step lock released after processing")
+	}
+}
+
+func TestTaskFromContext(t *testing.T) {
+	poller, store := newFakePoller()
+
+	var got *TaskDocument
+	var found bool
+	poller.Register("ns.Route", func(params map[string]interface{}) (map[string]interface{}, error) {
+		got, found = TaskFromContext(HandlerContext(params))
+		got.Data["region"] = "mutated"
+		return nil, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{
+		UUID: "task-1", Name: "ns.Route", StepID: "step-1", WorkflowID: "wf-1",
+		FlowID: "flow-1", TaskListName: "default",
+		Data: map[string]interface{}{"region": "eu"},
+	})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if !found {
+		t.Fatal("Expected task in handler context")
+	}
+	if got.UUID != "task-1" || got.WorkflowID != "wf-1" || got.FlowID != "flow-1" {
+		t.Errorf("Unexpected task in context: %+v", got)
+	}
+	if store.tasks["task-1"].Data["region"] != "eu" {
+		t.Error("Mutating the context task should not affect the stored task")
+	}
+}
+
+func TestTraceContextMovedToHandlerContext(t *testing.T) {
+	poller, store := newFakePoller()
+
+	var seen map[string]interface{}
+	var tc TraceContext
+	var found bool
+	poller.Register("ns.Traced", func(params map[string]interface{}) (map[string]interface{}, error) {
+		seen = params
+		tc, found = TraceContextFromContext(HandlerContext(params))
+		return nil, nil
+	})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	store.addStep("step-1", map[string]interface{}{
+		"input":          1,
+		TraceParentParam: traceparent,
+		BaggageParam:     "tenant=acme",
+		TraceStateParam:  42,
+	})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Traced", StepID: "step-1", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	for _, key := range []string{TraceParentParam, TraceStateParam, BaggageParam} {
+		if _, ok := seen[key]; ok {
+			t.Errorf("Expected %s stripped from handler params", key)
+		}
+	}
+	if seen["input"] != 1 {
+		t.Errorf("Expected ordinary params untouched, got %v", seen["input"])
+	}
+	if !found {
+		t.Fatal("Expected trace context in handler context")
+	}
+	if tc.Get("traceparent") != traceparent || tc.Get("baggage") != "tenant=acme" {
+		t.Errorf("Unexpected trace context: %+v", tc)
+	}
+	if keys := strings.Join(tc.Keys(), ","); keys != "traceparent,baggage" {
+		t.Errorf("Expected non-string tracestate dropped, got keys %s", keys)
+	}
+}
+
+func TestTraceContextAbsent(t *testing.T) {
+	poller, store := newFakePoller()
+	found := true
+	poller.Register("ns.Plain", func(params map[string]interface{}) (map[string]interface{}, error) {
+		_, found = TraceContextFromContext(HandlerContext(params))
+		return nil, nil
+	})
+
+	runSingle(t, poller, store, "ns.Plain")
+
+	if found {
+		t.Error("Expected no trace context for a step without trace params")
+	}
+}
+
+func TestHandlerContextDefault(t *testing.T) {
+	ctx := HandlerContext(map[string]interface{}{})
+	if _, ok := TaskFromContext(ctx); ok {
+		t.Error("Expected no task without an injected context")
+	}
+}
+
+// runSingle seeds one task for facetName and processes it with PollOnce.
+func runSingle(t *testing.T, poller *AgentPoller, store *fakeStore, facetName string) {
+	t.Helper()
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: facetName, StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+}
+
+func TestCompletionVetoesResume(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Check", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": false, CompletionKey: Completion{Resume: false}}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Check")
+
+	if len(store.resumes) != 0 {
+		t.Errorf("Expected resume vetoed, got %d resume tasks", len(store.resumes))
+	}
+	if store.stepStates["step-1"] != StepStateCompleted {
+		t.Errorf("Expected vetoed step finalized, got %s", store.stepStates["step-1"])
+	}
+	if _, written := store.returns["step-1"][CompletionKey]; written {
+		t.Error("Completion control must not be written as a return")
+	}
+	if store.returns["step-1"]["ok"] != false {
+		t.Error("Expected ordinary returns still written")
+	}
+}
+
+func TestCompletionResumeOnOtherTaskList(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Route", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{CompletionKey: &Completion{Resume: true, TaskList: "gpu"}}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Route")
+
+	if len(store.resumes) != 1 {
+		t.Fatalf("Expected 1 resume task, got %d", len(store.resumes))
+	}
+	if store.resumes[0].TaskListName != "gpu" {
+		t.Errorf("Expected resume on 'gpu', got %q", store.resumes[0].TaskListName)
+	}
+}
+
+func TestNextTaskListKeyRoutesResume(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Route", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1, NextTaskListKey: "gpu"}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Route")
+
+	if len(store.resumes) != 1 || store.resumes[0].TaskListName != "gpu" {
+		t.Fatalf("Expected resume on 'gpu', got %+v", store.resumes)
+	}
+	if _, ok := store.returns["step-1"][NextTaskListKey]; ok {
+		t.Error("Expected next task list key not persisted as a return")
+	}
+	if store.returns["step-1"]["out"] != 1 {
+		t.Error("Expected ordinary returns still written")
+	}
+}
+
+func TestNextTaskListKeyIgnoredUnlessString(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Route", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{NextTaskListKey: 7}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Route")
+
+	if len(store.resumes) != 1 || store.resumes[0].TaskListName != "default" {
+		t.Errorf("Expected resume on the originating list, got %+v", store.resumes)
+	}
+	if _, ok := store.returns["step-1"][NextTaskListKey]; ok {
+		t.Error("Expected next task list key stripped even when unusable")
+	}
+}
+
+func TestCompletionTaskListOverridesNextTaskListKey(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Route", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			NextTaskListKey: "cpu",
+			CompletionKey:   Completion{Resume: true, TaskList: "gpu"},
+		}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Route")
+
+	if len(store.resumes) != 1 || store.resumes[0].TaskListName != "gpu" {
+		t.Errorf("Expected Completion.TaskList to win, got %+v", store.resumes)
+	}
+}
+
+func TestCompletionCanResumeTerminalHandler(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.RegisterTerminal("ns.Maybe", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{CompletionKey: Completion{Resume: true}}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Maybe")
+
+	if len(store.resumes) != 1 || store.resumes[0].TaskListName != "default" {
+		t.Errorf("Expected resume on the originating list, got %+v", store.resumes)
+	}
+}
+
+func TestQueueDepthSampling(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Work", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	var gauge []float64
+	poller.SetQueueDepthGauge(GaugeFunc(func(v float64) {
+		gauge = append(gauge, v)
+	}))
+	seedBacklog(store, "ns.Work", 3)
+	store.addTask(TaskDocument{UUID: "other", Name: "ns.Unhandled", TaskListName: "default"})
+
+	if poller.Stats().QueueDepth != 0 {
+		t.Error("Expected zero queue depth before sampling")
+	}
+
+	poller.sampleQueueDepth(context.Background())
+	if got := poller.Stats().QueueDepth; got != 3 {
+		t.Errorf("Expected queue depth 3, got %d", got)
+	}
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	poller.sampleQueueDepth(context.Background())
+	if got := poller.Stats().QueueDepth; got != 2 {
+		t.Errorf("Expected queue depth 2 after one claim, got %d", got)
+	}
+	if got := poller.Metrics().QueueDepth; got != 2 {
+		t.Errorf("Expected the sample in Metrics, got %d", got)
+	}
+	if len(gauge) != 2 || gauge[0] != 3 || gauge[1] != 2 {
+		t.Errorf("Expected each sample set on the gauge, got %v", gauge)
+	}
+}
+
+func TestHandlerIgnoresTask(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Filter", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"partial": 1}, fmt.Errorf("not our region: %w", ErrIgnoreTask)
+	})
+
+	runSingle(t, poller, store, "ns.Filter")
+
+	if got := store.taskState("task-1"); got != TaskStateIgnored {
+		t.Errorf("Expected task %s, got %s", TaskStateIgnored, got)
+	}
+	if len(store.returns["step-1"]) != 0 {
+		t.Errorf("Expected no returns written, got %v", store.returns["step-1"])
+	}
+	if len(store.resumes) != 0 {
+		t.Errorf("Expected no resume task, got %d", len(store.resumes))
+	}
+	if _, failed := store.failures["task-1"]; failed {
+		t.Error("Ignored task should not be marked failed")
+	}
+}
+
+func TestRequeueOnShutdown(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.RequeueOnShutdown = true
+	poller.running = true
+
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	poller.Register("ns.Long", func(params map[string]interface{}) (map[string]interface{}, error) {
+		close(started)
+		<-HandlerContext(params).Done()
+		close(canceled)
+		return map[string]interface{}{"late": true}, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Long", StepID: "step-1", RunnerID: "me", TaskListName: "default"})
+
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected task to be dispatched")
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := poller.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	select {
+	case <-canceled:
+	default:
+		t.Error("Expected handler context to be canceled")
+	}
+	if got := store.taskState("task-1"); got != TaskStatePending {
+		t.Errorf("Expected task requeued to pending, got %s", got)
+	}
+	if store.tasks["task-1"].RunnerID != "" {
+		t.Errorf("Expected runner_id cleared, got %q", store.tasks["task-1"].RunnerID)
+	}
+	if len(store.returns["step-1"]) != 0 || len(store.resumes) != 0 {
+		t.Error("Requeued task's late result must be discarded")
+	}
+	if report, _ := poller.LastShutdownReport(); report.InFlight != 1 || report.Requeued != 1 || report.Drained != 0 || report.Abandoned != 0 {
+		t.Errorf("Expected one task requeued in the report, got %+v", report)
+	}
+}
+
+func TestStopDrainsByDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.running = true
+
+	release := make(chan struct{})
+	poller.Register("ns.Long", func(params map[string]interface{}) (map[string]interface{}, error) {
+		<-release
+		return map[string]interface{}{"done": true}, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Long", StepID: "step-1", TaskListName: "default"})
+	poller.pollCycle(context.Background())
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected drained task completed, got %s", got)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.registration = newFakeRegistry()
+	poller.running = true
+	if _, ok := poller.LastShutdownReport(); ok {
+		t.Fatal("Expected no report before Stop")
+	}
+
+	quick := make(chan struct{})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var started sync.WaitGroup
+	started.Add(3)
+	poller.Register("ns.Quick", func(params map[string]interface{}) (map[string]interface{}, error) {
+		started.Done()
+		<-quick
+		return nil, nil
+	})
+	poller.Register("ns.Stuck", func(params map[string]interface{}) (map[string]interface{}, error) {
+		started.Done()
+		<-stuck
+		return nil, nil
+	})
+	for i, facet := range []string{"ns.Quick", "ns.Quick", "ns.Stuck"} {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: facet, StepID: step, TaskListName: "default"})
+		poller.pollCycle(context.Background())
+	}
+	started.Wait()
+
+	// The quick tasks finish during the drain; the stuck one outlives it
+	close(quick)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := poller.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	report, ok := poller.LastShutdownReport()
+	if !ok {
+		t.Fatal("Expected a report after Stop")
+	}
+	if report.InFlight != 3 || report.Drained != 2 || report.Requeued != 0 || report.Abandoned != 1 {
+		t.Errorf("Expected 3 in flight, 2 drained, 1 abandoned, got %+v", report)
+	}
+	if !report.Deregistered {
+		t.Error("Expected deregistration reported")
+	}
+	if report.Duration < 100*time.Millisecond {
+		t.Errorf("Expected the duration to cover the drain deadline, got %v", report.Duration)
+	}
+}
+
+// newNamespacedPoller returns a poller scoped to ns over store, whose
+// "Facet" handler records the uuids of the tasks it processed.
+func newNamespacedPoller(ns string, store *fakeStore, seen *[]string) *AgentPoller {
+	cfg := DefaultConfig()
+	cfg.Namespace = ns
+	poller := NewAgentPoller(cfg)
+	poller.ops = store
+	poller.Register("Facet", func(params map[string]interface{}) (map[string]interface{}, error) {
+		task, _ := TaskFromContext(HandlerContext(params))
+		*seen = append(*seen, task.UUID)
+		return nil, nil
+	})
+	return poller
+}
+
+func TestNamespaceScopesClaims(t *testing.T) {
+	store := newFakeStore()
+	var seenA, seenB []string
+	pollerA := newNamespacedPoller("tenantA", store, &seenA)
+	pollerB := newNamespacedPoller("tenantB", store, &seenB)
+
+	if got := pollerA.RegisteredHandlers(); len(got) != 1 || got[0] != "tenantA.Facet" {
+		t.Fatalf("Expected [tenantA.Facet], got %v", got)
+	}
+
+	store.addStep("step-a", map[string]interface{}{})
+	store.addStep("step-b", map[string]interface{}{})
+	store.addStep("step-c", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-b", Name: "tenantB.Facet", StepID: "step-b", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-a", Name: "tenantA.Facet", StepID: "step-a", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-bare", Name: "Facet", StepID: "step-c", TaskListName: "default"})
+
+	for i := 0; i < 3; i++ {
+		if err := pollerA.PollOnce(context.Background()); err != nil {
+			t.Fatalf("PollOnce A: %v", err)
+		}
+	}
+	if len(seenA) != 1 || seenA[0] != "task-a" {
+		t.Errorf("tenantA should only process task-a, got %v", seenA)
+	}
+	if got := store.taskState("task-b"); got != TaskStatePending {
+		t.Errorf("tenantB task must not be claimed by tenantA, got %s", got)
+	}
+
+	if err := pollerB.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce B: %v", err)
+	}
+	if len(seenB) != 1 || seenB[0] != "task-b" {
+		t.Errorf("tenantB should only process task-b, got %v", seenB)
+	}
+	if got := store.taskState("task-bare"); got != TaskStatePending {
+		t.Errorf("Unqualified task must not be claimed by a namespaced agent, got %s", got)
+	}
+}
+
+func TestNamespaceDisablesCrossNamespaceFallback(t *testing.T) {
+	store := newFakeStore()
+	var seen []string
+	poller := newNamespacedPoller("tenantA", store, &seen)
+	poller.Register("tenantA.Other", func(map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	if poller.findHandler("tenantA.Facet") == nil {
+		t.Error("Expected handler for tenantA.Facet")
+	}
+	if poller.findHandler("tenantB.Facet") != nil {
+		t.Error("Short-name fallback must not match another namespace")
+	}
+	if poller.findHandler("Facet") != nil {
+		t.Error("Unqualified task name must not match in a namespaced agent")
+	}
+	if poller.findHandler("tenantA.Other") == nil {
+		t.Error("Already-qualified registration must not be double-prefixed")
+	}
+}
+
+// captureLogger records structured log events.
+type captureLogger struct {
+	mu     sync.Mutex
+	msgs   []string
+	fields []map[string]interface{}
+}
+
+func (l *captureLogger) Debug(msg string, fields map[string]interface{}) {
+	l.Info(msg, fields)
+}
+
+func (l *captureLogger) Info(msg string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+	l.fields = append(l.fields, fields)
+}
+
+func TestLogCompletionsKeysOnly(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.LogCompletions = true
+	logger := &captureLogger{}
+	poller.SetLogger(logger)
+	poller.Register("ns.Login", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"token": "tok-abc123"}, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{"user": "alice", "password": "hunter2"})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Login", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	if len(logger.fields) != 1 {
+		t.Fatalf("Expected one completion summary, got %d", len(logger.fields))
+	}
+	fields := logger.fields[0]
+	if fields["facet"] != "ns.Login" {
+		t.Errorf("Expected facet ns.Login, got %v", fields["facet"])
+	}
+	if _, ok := fields["duration_ms"].(int64); !ok {
+		t.Errorf("Expected int64 duration_ms, got %T", fields["duration_ms"])
+	}
+	if got := fmt.Sprint(fields["param_keys"]); got != "[password user]" {
+		t.Errorf("Expected param_keys [password user], got %s", got)
+	}
+	if got := fmt.Sprint(fields["return_keys"]); got != "[token]" {
+		t.Errorf("Expected return_keys [token], got %s", got)
+	}
+
+	dump := fmt.Sprint(fields)
+	for _, secret := range []string{"alice", "hunter2", "tok-abc123"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("Completion summary leaked value %q: %s", secret, dump)
+		}
+	}
+}
+
+func TestLogCompletionsDisabledByDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	logger := &captureLogger{}
+	poller.SetLogger(logger)
+	poller.Register("ns.Facet", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"x": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Facet")
+
+	if len(logger.msgs) != 0 {
+		t.Errorf("Expected no completion summary by default, got %v", logger.msgs)
+	}
+}
+
+func TestMaxReturnBytesRejectsOversizedResult(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.MaxReturnBytes = 1024
+	poller.Register("ns.Big", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"blob": strings.Repeat("x", 4096)}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Big")
+
+	if got := store.taskState("task-1"); got != TaskStateFailed {
+		t.Fatalf("Expected oversized result to fail the task, got %s", got)
+	}
+	if msg := store.failures["task-1"]; !strings.Contains(msg, "result too large") {
+		t.Errorf("Expected result too large error, got %q", msg)
+	}
+	if len(store.returns["step-1"]) != 0 {
+		t.Error("Oversized result must not be written")
+	}
+	if len(store.resumes) != 0 {
+		t.Error("No resume task expected for a rejected result")
+	}
+}
+
+func TestMaxReturnBytesAllowsSmallResult(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.MaxReturnBytes = 1024
+	poller.Register("ns.Small", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Small")
+
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected small result to complete, got %s", got)
+	}
+}
+
+func TestStartFailsFastOnSlowRegistration(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.RegistrationTimeout = 50 * time.Millisecond
+	reg := newFakeRegistry()
+	reg.blockRegister = true
+	poller.registration = reg
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrRegistrationTimeout) {
+			t.Errorf("Expected ErrRegistrationTimeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start hung on a slow registration")
+	}
+}
+
+func TestReRegisterWhileRunning(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	reg := newFakeRegistry()
+	poller.registration = reg
+	noop := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("ns.A", noop)
+
+	if err := NewAgentPoller(DefaultConfig()).ReRegister(context.Background()); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected before connecting, got %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	registered := func() []string {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return reg.registered[poller.serverID]
+	}
+	if !waitFor(time.Second, func() bool { return len(registered()) == 1 }) {
+		t.Fatal("Expected Start to register")
+	}
+
+	poller.Register("ns.B", noop)
+	if err := poller.ReRegister(context.Background()); err != nil {
+		t.Fatalf("ReRegister: %v", err)
+	}
+	if got := registered(); len(got) != 2 {
+		t.Errorf("Expected both handlers registered, got %v", got)
+	}
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+}
+
+func TestHandlerChangeRepublishes(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	reg := newFakeRegistry()
+	poller.registration = reg
+	noop := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("ns.A", noop)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	state := func() (int, int) {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return len(reg.registered[poller.serverID]), reg.republished
+	}
+	if !waitFor(time.Second, func() bool { n, _ := state(); return n == 1 }) {
+		t.Fatal("Expected Start to register")
+	}
+	if _, republished := state(); republished != 0 {
+		t.Errorf("Expected Start to register in full, got %d republishes", republished)
+	}
+
+	poller.Register("ns.B", noop)
+	if !waitFor(time.Second, func() bool { n, r := state(); return n == 2 && r == 1 }) {
+		n, r := state()
+		t.Errorf("Expected the change republished, got %d handlers after %d republishes", n, r)
+	}
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+}
+
+func TestRegisterDuringStartStaysPublished(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	reg := newFakeRegistry()
+	poller.registration = reg
+	noop := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("ns.A", noop)
+
+	registered := func() map[string]bool {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		names := make(map[string]bool)
+		for _, name := range reg.registered[poller.serverID] {
+			names[name] = true
+		}
+		return names
+	}
+
+	// Claims must never cover a handler missing from the servers document
+	stop := make(chan struct{})
+	violations := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			poller.mu.RLock()
+			started := poller.published != nil
+			poller.mu.RUnlock()
+			if !started {
+				continue
+			}
+			// The document is written before it is published, so read it last
+			claimed := poller.EffectiveHandlers()
+			doc := registered()
+			for _, name := range claimed {
+				if !doc[name] {
+					select {
+					case violations <- name:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				poller.Register(fmt.Sprintf("ns.F%d_%d", i, j), noop)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if !waitFor(2*time.Second, func() bool { return len(registered()) == 101 }) {
+		t.Errorf("Expected all 101 handlers published, got %d", len(registered()))
+	}
+	close(stop)
+	select {
+	case name := <-violations:
+		t.Errorf("Claimed for %s before it was published", name)
+	default:
+	}
+
+	poller.Unregister("ns.A")
+	if !waitFor(time.Second, func() bool { return !registered()["ns.A"] }) {
+		t.Error("Expected Unregister to be published")
+	}
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+}
+
+func TestRegistrationTimeoutKeepsCallerCancellation(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.RegistrationTimeout = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := poller.withRegistrationTimeout(ctx, "register", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected the caller's context.Canceled, got %v", err)
+	}
+}
+
+// requireKeys is a ResultValidator demanding the given return keys.
+func requireKeys(keys ...string) ResultValidator {
+	return func(task *TaskDocument, result map[string]interface{}) error {
+		for _, k := range keys {
+			if _, ok := result[k]; !ok {
+				return fmt.Errorf("missing return %q", k)
+			}
+		}
+		return nil
+	}
+}
+
+func TestResultValidatorPasses(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.SetResultValidator(requireKeys("score"))
+	poller.Register("ns.Score", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"score": 7}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Score")
+
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected completed, got %s", got)
+	}
+	if store.returns["step-1"]["score"] != 7 {
+		t.Errorf("Expected returns written, got %v", store.returns["step-1"])
+	}
+}
+
+func TestResultValidatorFailsTask(t *testing.T) {
+	poller, store := newFakePoller()
+	var seen *TaskDocument
+	poller.SetResultValidator(func(task *TaskDocument, result map[string]interface{}) error {
+		seen = task
+		return requireKeys("score")(task, result)
+	})
+	poller.Register("ns.Score", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"other": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Score")
+
+	if seen == nil || seen.UUID != "task-1" {
+		t.Errorf("Expected validator to receive the task, got %+v", seen)
+	}
+	if got := store.taskState("task-1"); got != TaskStateFailed {
+		t.Fatalf("Expected failed, got %s", got)
+	}
+	if msg := store.failures["task-1"]; !strings.Contains(msg, `missing return "score"`) {
+		t.Errorf("Expected validator error in failure, got %q", msg)
+	}
+	if len(store.returns["step-1"]) != 0 || len(store.resumes) != 0 {
+		t.Error("Nothing may be written for an invalid result")
+	}
+}
+
+func TestStartCleansUpOnContextCancel(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PollInterval = 10 * time.Millisecond
+	reg := newFakeRegistry()
+	poller.registration = reg
+
+	// Connect is lazy, so an unreachable address is enough for a client
+	// whose disconnection can be observed.
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("mongo.Connect: %v", err)
+	}
+	poller.client = client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(ctx) }()
+
+	if !waitFor(time.Second, func() bool {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return len(reg.registered) == 1
+	}) {
+		t.Fatal("Expected server to register")
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after cancellation")
+	}
+
+	reg.mu.Lock()
+	deregistered := reg.deregistered[poller.serverID]
+	reg.mu.Unlock()
+	if !deregistered {
+		t.Error("Expected server deregistered on context cancellation")
+	}
+	if _, err := client.ListDatabaseNames(context.Background(), bson.D{}); err != mongo.ErrClientDisconnected {
+		t.Errorf("Expected client disconnected, got %v", err)
+	}
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Errorf("Stop after context shutdown should be a no-op, got %v", err)
+	}
+}
+
+func TestStartContextCancelDrainsInFlightTask(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = 10 * time.Millisecond
+	poller.registration = newFakeRegistry()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handlerCtxErr error
+	poller.Register("ns.Long", func(params map[string]interface{}) (map[string]interface{}, error) {
+		close(started)
+		<-release
+		handlerCtxErr = HandlerContext(params).Err()
+		return map[string]interface{}{"done": true}, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Long", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(ctx) }()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the task to be dispatched")
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after cancellation")
+	}
+
+	if handlerCtxErr != nil {
+		t.Errorf("Expected the handler context to outlive the poller context, got %v", handlerCtxErr)
+	}
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected the in-flight task drained to completed, got %s", got)
+	}
+	if store.returns["step-1"]["done"] != true || len(store.resumes) != 1 {
+		t.Errorf("Expected returns and resume written, got %v / %v", store.returns, store.resumes)
+	}
+	if report, _ := poller.LastShutdownReport(); report.Drained != 1 || report.Abandoned != 0 {
+		t.Errorf("Expected one task drained in the report, got %+v", report)
+	}
+}
+
+func TestDisableEnableFacet(t *testing.T) {
+	poller, store := newFakePoller()
+	noop := func(map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("ns.Bad", noop)
+	poller.Register("ns.Good", noop)
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-bad", Name: "ns.Bad", StepID: "step-1", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-good", Name: "ns.Good", StepID: "step-2", TaskListName: "default"})
+
+	poller.Disable("ns.Bad")
+	if got := poller.Stats().Disabled; len(got) != 1 || got[0] != "ns.Bad" {
+		t.Errorf("Expected Stats().Disabled [ns.Bad], got %v", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatalf("PollOnce: %v", err)
+		}
+	}
+	if got := store.taskState("task-bad"); got != TaskStatePending {
+		t.Errorf("Disabled facet must not be claimed, got %s", got)
+	}
+	if got := store.taskState("task-good"); got != TaskStateCompleted {
+		t.Errorf("Enabled facet should still be claimed, got %s", got)
+	}
+	for _, name := range poller.EffectiveHandlers() {
+		if name == "ns.Bad" {
+			t.Error("Disabled facet must not be in EffectiveHandlers")
+		}
+	}
+	if len(poller.RegisteredHandlers()) != 2 {
+		t.Error("Disable must not unregister the handler")
+	}
+
+	poller.Enable("ns.Bad")
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if got := store.taskState("task-bad"); got != TaskStateCompleted {
+		t.Errorf("Re-enabled facet should be claimed, got %s", got)
+	}
+	if got := poller.Stats().Disabled; len(got) != 0 {
+		t.Errorf("Expected no disabled facets, got %v", got)
+	}
+}
+
+func TestPressureWindow(t *testing.T) {
+	poller, _ := newFakePoller() // capacity 5, window 3, threshold 1.0
+	var fired []PressureInfo
+	poller.SetPressureHook(func(info PressureInfo) { fired = append(fired, info) })
+
+	poller.recordPressure(10)
+	poller.recordPressure(10)
+	poller.recordPressure(2) // below capacity: streak resets
+	poller.recordPressure(10)
+	poller.recordPressure(10)
+	if len(fired) != 0 || poller.Pressure().ScaleOut {
+		t.Fatalf("Expected no scale-out before a full window, got %v", fired)
+	}
+
+	poller.recordPressure(10)
+	if len(fired) != 1 || !fired[0].ScaleOut {
+		t.Fatalf("Expected one scale-out signal, got %v", fired)
+	}
+	if fired[0].Saturation != 2.0 || fired[0].QueueDepth != 10 || fired[0].Capacity != 5 {
+		t.Errorf("Unexpected pressure info %+v", fired[0])
+	}
+
+	poller.recordPressure(12)
+	if len(fired) != 1 {
+		t.Errorf("Hook must only fire on changes, got %d calls", len(fired))
+	}
+
+	poller.recordPressure(0)
+	if len(fired) != 2 || fired[1].ScaleOut {
+		t.Fatalf("Expected pressure-relieved signal, got %v", fired)
+	}
+	if poller.Pressure().ScaleOut {
+		t.Error("Expected ScaleOut cleared")
+	}
+}
+
+func TestPressureCountsInFlight(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PressureWindow = 1
+	for i := 0; i < 4; i++ {
+		poller.slots.take()
+	}
+	sample := func(depth int64) {
+		atomic.StoreInt64(&poller.queueDepth, depth)
+		poller.recordPressure(depth)
+	}
+
+	sample(1) // (4 + 1) / 5: at capacity, not above
+	if info := poller.Pressure(); info.ScaleOut || info.Saturation != 1.0 || info.InFlight != 4 {
+		t.Errorf("Expected saturation 1.0 without scale-out, got %+v", info)
+	}
+
+	sample(2)
+	if !poller.Pressure().ScaleOut {
+		t.Error("Expected scale-out once in-flight plus backlog exceeds capacity")
+	}
+}
+
+func TestPressureFromQueueDepthSampling(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PressureWindow = 1
+	poller.Register("ns.Work", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	seedBacklog(store, "ns.Work", 8)
+
+	poller.sampleQueueDepth(context.Background())
+	if info := poller.Pressure(); !info.ScaleOut || info.QueueDepth != 8 {
+		t.Errorf("Expected scale-out from sampled depth 8, got %+v", info)
+	}
+}
+
+func TestLocksRenewedWhileHandlerRuns(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.StepLockTTL = 30 * time.Millisecond
+	poller.cfg.SerializePerWorkflow = true
+	poller.cfg.WorkflowLockTTL = 30 * time.Millisecond
+	poller.Register("ns.Slow", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+
+	runSingle(t, poller, store, "ns.Slow")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, key := range []string{stepLockKey("step-1"), workflowLockKey("wf-1")} {
+		if store.lockRenewals[key] == 0 {
+			t.Errorf("Expected %s renewed while the handler outlived its TTL", key)
+		}
+		if _, held := store.locks[key]; held {
+			t.Errorf("Expected %s released after processing", key)
+		}
+	}
+}
+
+func TestSerializePerWorkflow(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.SerializePerWorkflow = true
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Step", StepID: "step-2", WorkflowID: "wf-1", TaskListName: "default"})
+
+	ctx := context.Background()
+	if !poller.pollCycle(ctx) {
+		t.Fatal("Expected first task dispatched")
+	}
+	if poller.pollCycle(ctx) {
+		t.Fatal("Second task of a busy workflow must not be dispatched")
+	}
+	if got := store.countTasks(TaskStatePending); got != 1 {
+		t.Errorf("Expected the second task released to pending, got %d pending", got)
+	}
+
+	close(release)
+	if !waitFor(time.Second, func() bool { return store.countTasks(TaskStateCompleted) == 1 }) {
+		t.Fatal("First task did not complete")
+	}
+	poller.wg.Wait()
+	if _, held := store.locks[workflowLockKey("wf-1")]; held {
+		t.Error("Workflow lock must be released after processing")
+	}
+
+	if !poller.pollCycle(ctx) {
+		t.Fatal("Expected second task dispatched once the workflow is free")
+	}
+	poller.wg.Wait()
+	if got := store.countTasks(TaskStateCompleted); got != 2 {
+		t.Errorf("Expected both tasks completed, got %d", got)
+	}
+	if maxRunning != 1 {
+		t.Errorf("Expected at most one step of wf-1 at a time, saw %d", maxRunning)
+	}
+}
+
+func TestSerializePerWorkflowOtherWorkflowsRunConcurrently(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.SerializePerWorkflow = true
+	release := make(chan struct{})
+	defer close(release)
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Step", StepID: "step-2", WorkflowID: "wf-2", TaskListName: "default"})
+
+	if !poller.pollCycle(context.Background()) || !poller.pollCycle(context.Background()) {
+		t.Error("Tasks of different workflows should run concurrently")
+	}
+}
+
+func TestSerializePerWorkflowClaimsPastBusyWorkflow(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.SerializePerWorkflow = true
+	release := make(chan struct{})
+	defer close(release)
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	for _, id := range []string{"1", "2", "3"} {
+		store.addStep("step-"+id, map[string]interface{}{})
+	}
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+
+	ctx := context.Background()
+	if !poller.pollCycle(ctx) {
+		t.Fatal("Expected the first task of wf-1 dispatched")
+	}
+
+	// wf-1 is busy here; another wf-1 task must not be claimed ahead of wf-2
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Step", StepID: "step-2", WorkflowID: "wf-1", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "task-3", Name: "ns.Step", StepID: "step-3", WorkflowID: "wf-2", TaskListName: "default"})
+	for i := 0; i < 5 && store.taskState("task-3") != TaskStateRunning; i++ {
+		poller.pollCycle(ctx)
+	}
+
+	if got := store.taskState("task-3"); got != TaskStateRunning {
+		t.Errorf("Expected wf-2's task claimed past busy wf-1, got %s", got)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if containsString(store.claimed, "task-2") {
+		t.Errorf("Expected the busy workflow's task never claimed, claims %v", store.claimed)
+	}
+}
+
+func TestSerializePerWorkflowDefersRemotelyLocked(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.SerializePerWorkflow = true
+	poller.cfg.PollInterval = 2 * time.Second
+	poller.Register("ns.Step", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	// Another agent holds wf-1
+	store.locks[workflowLockKey("wf-1")] = "other-agent"
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Step", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default"})
+
+	if poller.pollCycle(context.Background()) {
+		t.Fatal("Task of a remotely locked workflow must not be dispatched")
+	}
+
+	if got := store.taskState("task-1"); got != TaskStatePending {
+		t.Errorf("Expected task returned to pending, got %s", got)
+	}
+	if got := store.deferrals["task-1"]; len(got) != 1 || got[0] != 2*time.Second {
+		t.Errorf("Expected task deferred by PollInterval, got %v", got)
+	}
+}
+
+func TestReturnsWriterPersistsBeforeCompletion(t *testing.T) {
+	poller, store := newFakePoller()
+
+	var writer ReturnsWriter
+	var seenDuringHandler interface{}
+	poller.Register("ns.Aggregate", func(params map[string]interface{}) (map[string]interface{}, error) {
+		w, ok := ReturnsWriterFromContext(HandlerContext(params))
+		if !ok {
+			return nil, errors.New("no returns writer")
+		}
+		writer = w
+		if err := w.Write("progress", 50); err != nil {
+			return nil, err
+		}
+		if err := w.Write("partial_sum", 10); err != nil {
+			return nil, err
+		}
+
+		store.mu.Lock()
+		seenDuringHandler = store.returns["step-1"]["progress"]
+		store.mu.Unlock()
+
+		return map[string]interface{}{"progress": 100, "sum": 42}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Aggregate")
+
+	if seenDuringHandler != 50 {
+		t.Errorf("Expected partial return on the step before the handler returned, got %v", seenDuringHandler)
+	}
+	returns := store.returns["step-1"]
+	if returns["progress"] != 100 || returns["sum"] != 42 {
+		t.Errorf("Expected final result to overwrite partials, got %v", returns)
+	}
+	if returns["partial_sum"] != 10 {
+		t.Errorf("Expected partial-only return to remain, got %v", returns)
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected completed, got %s", store.taskState("task-1"))
+	}
+
+	if err := writer.Write("late", 1); err == nil {
+		t.Error("Expected Write after the handler returned to fail")
+	}
+}
+
+func TestAdvanceStepState(t *testing.T) {
+	handler := func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	}
+
+	poller, store := newFakePoller()
+	poller.Register("ns.Facet", handler)
+	runSingle(t, poller, store, "ns.Facet")
+	if got := store.stepStates["step-1"]; got != StepStateEventTransmit {
+		t.Errorf("Expected step left in EVENT_TRANSMIT by default, got %s", got)
+	}
+
+	poller, store = newFakePoller()
+	poller.cfg.AdvanceStepState = StepStateCompleted
+	poller.Register("ns.Facet", handler)
+	runSingle(t, poller, store, "ns.Facet")
+	if got := store.stepStates["step-1"]; got != StepStateCompleted {
+		t.Errorf("Expected step advanced to %s, got %s", StepStateCompleted, got)
+	}
+	if len(store.resumes) != 1 {
+		t.Errorf("Expected the resume task still inserted, got %d", len(store.resumes))
+	}
+	if store.returns["step-1"]["ok"] != true {
+		t.Error("Expected returns written before the transition")
+	}
+}
+
+func panickingHandler(params map[string]interface{}) (map[string]interface{}, error) {
+	panic("kaboom")
+}
+
+func TestHandlerPanicFailsTask(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Boom", panickingHandler)
+
+	runSingle(t, poller, store, "ns.Boom")
+
+	if store.tasks["task-1"].State != TaskStateFailed {
+		t.Fatalf("Expected task failed, got %s", store.tasks["task-1"].State)
+	}
+	if got := store.failures["task-1"]; got != "handler panic: kaboom" {
+		t.Errorf("Unexpected failure message %q", got)
+	}
+	if store.stacks["task-1"] != "" {
+		t.Error("Expected no stack when capture is disabled")
+	}
+}
+
+func TestHandlerPanicCapturesStack(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.CapturePanicStack = true
+	poller.cfg.PanicStackLimit = 4096
+	logger := &captureLogger{}
+	poller.SetLogger(logger)
+	poller.Register("ns.Boom", panickingHandler)
+
+	runSingle(t, poller, store, "ns.Boom")
+
+	stack := store.stacks["task-1"]
+	if !strings.Contains(stack, "panickingHandler") {
+		t.Errorf("Expected stack to name the panicking handler, got %q", stack)
+	}
+	if len(stack) > 4096 {
+		t.Errorf("Expected stack bounded to 4096 bytes, got %d", len(stack))
+	}
+	if got := store.failures["task-1"]; got != "handler panic: kaboom" {
+		t.Errorf("Unexpected failure message %q", got)
+	}
+	if len(logger.msgs) != 1 || logger.msgs[0] != "Handler panic" || logger.fields[0]["stack"] != stack {
+		t.Errorf("Expected the stack logged once, got %v", logger.msgs)
+	}
+}
+
+func TestStrictSerialProcessesInClaimOrder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StrictSerial = true
+	cfg.EventBufferSize = 32
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	var (
+		mu      sync.Mutex
+		order   []string
+		running int32
+	)
+	poller.Register("ns.Serial", func(params map[string]interface{}) (map[string]interface{}, error) {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("Expected no overlapping handler calls")
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(5 * time.Millisecond)
+		task, _ := TaskFromContext(params[ContextParam].(context.Context))
+		mu.Lock()
+		order = append(order, task.UUID)
+		mu.Unlock()
+		return nil, nil
+	})
+
+	for i := 1; i <= 4; i++ {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: "ns.Serial", StepID: step, TaskListName: "default"})
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if !poller.pollCycle(ctx) {
+			t.Fatalf("Expected cycle %d to claim a task", i)
+		}
+		// Processing finished before pollCycle returned
+		if len(order) != i+1 {
+			t.Fatalf("Expected %d tasks processed after cycle %d, got %d", i+1, i, len(order))
+		}
+	}
+
+	var claimed []string
+	for _, evt := range poller.RecentEvents(0) {
+		if evt.Kind == EventClaimed {
+			claimed = append(claimed, evt.TaskID)
+		}
+	}
+	if fmt.Sprint(claimed) != fmt.Sprint(order) {
+		t.Errorf("Expected processing in claim order %v, got %v", claimed, order)
+	}
+}
+
+func TestPrefixPatternsLongestMatchWins(t *testing.T) {
+	poller, _ := newFakePoller()
+	noop := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("billing.*", noop)
+	poller.Register("billing.invoice.*", noop)
+	poller.Register("billing.invoice.Void", noop)
+
+	cases := map[string]string{
+		"billing.invoice.Create": "billing.invoice.*",
+		"billing.refund.Issue":   "billing.*",
+		"billing.invoice.Void":   "billing.invoice.Void",
+	}
+	for task, want := range cases {
+		poller.mu.RLock()
+		got, ok := poller.matchHandlerName(task)
+		poller.mu.RUnlock()
+		if !ok || got != want {
+			t.Errorf("%s: expected %s, got %q", task, want, got)
+		}
+	}
+
+	poller.mu.RLock()
+	_, ok := poller.matchHandlerName("shipping.Send")
+	poller.mu.RUnlock()
+	if ok {
+		t.Error("Expected no handler outside the registered prefixes")
+	}
+}
+
+func TestPrefixPatternPriorityOverride(t *testing.T) {
+	poller, store := newFakePoller()
+	var got string
+	poller.Register("billing.invoice.*", func(params map[string]interface{}) (map[string]interface{}, error) {
+		got = "specific"
+		return nil, nil
+	})
+	poller.RegisterWithPriority("billing.*", 10, func(params map[string]interface{}) (map[string]interface{}, error) {
+		got = "priority"
+		return nil, nil
+	})
+
+	runSingle(t, poller, store, "billing.invoice.Create")
+
+	if got != "priority" {
+		t.Errorf("Expected the higher-priority pattern to handle the task, got %q", got)
+	}
+	if store.tasks["task-1"].State != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", store.tasks["task-1"].State)
+	}
+}
+
+func TestMetricsAfterProcessing(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Ok", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(2 * time.Millisecond)
+		return nil, nil
+	})
+	poller.Register("ns.Bad", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("boom")
+	})
+
+	ctx := context.Background()
+	for i, name := range []string{"ns.Ok", "ns.Ok", "ns.Bad"} {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: name, StepID: step, TaskListName: "default"})
+		if err := poller.PollOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A task claimed without a handler counts as both, unless released
+	poller.cfg.ReleaseUnregistered = false
+	poller.processTask(ctx, &TaskDocument{UUID: "task-x", Name: "ns.Gone", StepID: "step-x"})
+
+	m := poller.Metrics()
+	if m.Claimed != 3 || m.Completed != 2 || m.Failed != 2 || m.NoHandler != 1 {
+		t.Errorf("Unexpected counters %+v", m)
+	}
+	if m.CapacityExceeded != 0 || m.InFlight != 0 {
+		t.Errorf("Expected no capacity skips or in-flight tasks, got %+v", m)
+	}
+	// Two of three handler calls slept 2ms
+	if m.AvgHandlerDuration < time.Millisecond {
+		t.Errorf("Expected average handler duration >= 1ms, got %v", m.AvgHandlerDuration)
+	}
+}
+
+func TestMetricsCapacityExceeded(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConcurrent = 1
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	release := make(chan struct{})
+	poller.Register("ns.Slow", func(params map[string]interface{}) (map[string]interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	for i := 0; i < 2; i++ {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: "ns.Slow", StepID: step, TaskListName: "default"})
+	}
+
+	ctx := context.Background()
+	if !poller.pollCycle(ctx) {
+		t.Fatal("Expected the first cycle to dispatch")
+	}
+	if poller.pollCycle(ctx) {
+		t.Fatal("Expected the second cycle to find the pool full")
+	}
+
+	m := poller.Metrics()
+	if m.CapacityExceeded != 1 || m.Claimed != 2 {
+		t.Errorf("Unexpected counters %+v", m)
+	}
+	close(release)
+	poller.wg.Wait()
+	if got := poller.Metrics().InFlight; got != 0 {
+		t.Errorf("Expected nothing in flight after drain, got %d", got)
+	}
+}
+
+func TestLeaseRenewedWhileProcessing(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReclaimStaleAfter = 30 * time.Millisecond
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+	poller.Register("ns.Slow", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(60 * time.Millisecond)
+		return nil, nil
+	})
+
+	runSingle(t, poller, store, "ns.Slow")
+
+	store.mu.Lock()
+	renewals := store.renewals
+	store.mu.Unlock()
+	if renewals == 0 {
+		t.Error("Expected the lease renewed during a long handler")
+	}
+}
+
+func TestReclaimStaleResetsAbandonedTasks(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReclaimStaleAfter = time.Minute
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	store.addTask(TaskDocument{UUID: "old", Name: "ns.F", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "fresh", Name: "ns.F", TaskListName: "default"})
+	store.tasks["old"].State = TaskStateRunning
+	store.tasks["old"].Updated = NowMillis() - 2*time.Minute.Milliseconds()
+	store.tasks["fresh"].State = TaskStateRunning
+	store.tasks["fresh"].Updated = NowMillis()
+
+	poller.reclaimStale(context.Background())
+
+	if store.tasks["old"].State != TaskStatePending {
+		t.Errorf("Expected the stale task reclaimed, got %s", store.tasks["old"].State)
+	}
+	if store.tasks["fresh"].State != TaskStateRunning {
+		t.Errorf("Expected the live task untouched, got %s", store.tasks["fresh"].State)
+	}
+}
+
+func TestResumeSweeperInsertsMissingResume(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EnableResumeSweeper = true
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	// Completed, but the step still waits for a resume that was lost
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", WorkflowID: "wf-1", TaskListName: "default", State: TaskStateCompleted})
+	// Terminal: the step was completed directly
+	store.addStep("step-2", map[string]interface{}{})
+	store.stepStates["step-2"] = StepStateCompleted
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.F", StepID: "step-2", TaskListName: "default", State: TaskStateCompleted})
+	// Resumed normally
+	store.addStep("step-3", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-3", Name: "ns.F", StepID: "step-3", TaskListName: "default", State: TaskStateCompleted})
+	store.resumes = append(store.resumes, TaskDocument{Name: ResumeTaskName + ":ns.F", StepID: "step-3"})
+
+	ctx := context.Background()
+	if n := poller.sweepResumes(ctx); n != 1 {
+		t.Fatalf("Expected 1 resume inserted, got %d", n)
+	}
+	if n := poller.sweepResumes(ctx); n != 0 {
+		t.Errorf("Expected a second sweep to insert nothing, got %d", n)
+	}
+
+	if len(store.resumes) != 2 {
+		t.Fatalf("Expected exactly one resume added, got %v", store.resumes)
+	}
+	got := store.resumes[1]
+	if got.StepID != "step-1" || got.WorkflowID != "wf-1" || got.TaskListName != "default" {
+		t.Errorf("Unexpected resume task: %+v", got)
+	}
+	if len(store.locks) != 0 {
+		t.Errorf("Expected the sweep lock released, got %v", store.locks)
+	}
+}
+
+func TestResumeSweeperHealsResumePending(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.ResumeInsertRetries = 0
+	store.resumeErrs = []error{errors.New("not primary")}
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{NextTaskListKey: "gpu"}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+	if store.taskState("task-1") != TaskStateResumePending {
+		t.Fatalf("Expected task resume_pending, got %s", store.taskState("task-1"))
+	}
+
+	if n := poller.sweepResumes(context.Background()); n != 1 {
+		t.Fatalf("Expected 1 resume inserted, got %d", n)
+	}
+	if len(store.resumes) != 1 || store.resumes[0].TaskListName != "gpu" {
+		t.Errorf("Expected the resume on the recorded list, got %v", store.resumes)
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected the task completed, got %s", store.taskState("task-1"))
+	}
+}
+
+func TestResumeSweeperSkipsLockedList(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default", State: TaskStateCompleted})
+	store.locks[resumeSweepLockKey("default")] = "other-agent"
+
+	if n := poller.sweepResumes(context.Background()); n != 0 || len(store.resumes) != 0 {
+		t.Errorf("Expected a list swept by another agent skipped, got %d / %v", n, store.resumes)
+	}
+}
+
+func TestRegisterRoutedDispatchesOnData(t *testing.T) {
+	poller, store := newFakePoller()
+	var got []string
+	record := func(name string) Handler {
+		return func(params map[string]interface{}) (map[string]interface{}, error) {
+			got = append(got, name)
+			return nil, nil
+		}
+	}
+	poller.RegisterRouted("ns.Ingest", "kind", "csv", record("csv"))
+	poller.RegisterRouted("ns.Ingest", "kind", "json", record("json"))
+	poller.Register("ns.Ingest", record("default"))
+
+	ctx := context.Background()
+	for i, data := range []map[string]interface{}{
+		{"kind": "json"},
+		{"kind": "csv"},
+		{"kind": "xml"},
+		nil,
+	} {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: "ns.Ingest", StepID: step, TaskListName: "default", Data: data})
+		if err := poller.PollOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := "[json csv default default]"; fmt.Sprint(got) != want {
+		t.Errorf("Expected dispatch %s, got %v", want, got)
+	}
+}
+
+func TestRegisterRoutedWithoutDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.RegisterRouted("ns.Ingest", "version", "2", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	// A routed-only facet is still claimed
+	if names := poller.RegisteredHandlers(); len(names) != 1 || names[0] != "ns.Ingest" {
+		t.Fatalf("Expected ns.Ingest registered, got %v", names)
+	}
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Ingest", StepID: "step-1", TaskListName: "default", Data: map[string]interface{}{"version": int32(2)}})
+	store.addStep("step-2", map[string]interface{}{})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Ingest", StepID: "step-2", TaskListName: "default", Data: map[string]interface{}{"version": int32(1)}})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.tasks["task-1"].State != TaskStateCompleted {
+		t.Errorf("Expected numeric route value matched, got %s", store.tasks["task-1"].State)
+	}
+	if store.failures["task-2"] != "no handler registered" {
+		t.Errorf("Expected unmatched route without default to fail, got %q", store.failures["task-2"])
+	}
+}
+
+func TestPollNThenCloseRegistrationLifecycle(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RegisterOneShot = true
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	registry := newFakeRegistry()
+	poller.ops = store
+	poller.registration = registry
+	poller.Register("ns.Job", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: "ns.Job", StepID: step, TaskListName: "default"})
+	}
+
+	n, err := poller.PollN(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("PollN: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 tasks processed, got %d", n)
+	}
+	if handlers, ok := registry.registered[poller.serverID]; !ok || len(handlers) != 1 {
+		t.Fatalf("Expected the server registered with its handler, got %v", registry.registered)
+	}
+	if registry.deregistered[poller.serverID] {
+		t.Fatal("Expected the server still registered before Close")
+	}
+
+	if err := poller.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !registry.deregistered[poller.serverID] {
+		t.Error("Expected Close to deregister the server")
+	}
+}
+
+func TestPollOnceWithoutRegisterOneShot(t *testing.T) {
+	poller, store := newFakePoller()
+	registry := newFakeRegistry()
+	poller.registration = registry
+	poller.Register("ns.Job", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	runSingle(t, poller, store, "ns.Job")
+
+	if err := poller.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if len(registry.registered) != 0 || len(registry.deregistered) != 0 {
+		t.Errorf("Expected no registration lifecycle by default, got %v / %v", registry.registered, registry.deregistered)
+	}
+}
+
+func TestMetricsInFlightByFacet(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConcurrent = 4
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	handler := func(params map[string]interface{}) (map[string]interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	}
+	poller.Register("billing.*", handler)
+	poller.Register("ns.Other", handler)
+
+	for i, name := range []string{"billing.Invoice", "billing.Refund", "ns.Other"} {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: name, StepID: step, TaskListName: "default"})
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if !poller.pollCycle(ctx) {
+			t.Fatalf("Expected cycle %d to dispatch", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	byFacet := poller.Metrics().InFlightByFacet
+	if byFacet["billing.*"] != 2 || byFacet["ns.Other"] != 1 || len(byFacet) != 2 {
+		t.Errorf("Expected 2 billing.* and 1 ns.Other in flight, got %v", byFacet)
+	}
+
+	close(release)
+	poller.wg.Wait()
+	if byFacet := poller.Metrics().InFlightByFacet; len(byFacet) != 0 {
+		t.Errorf("Expected no facets in flight after completion, got %v", byFacet)
+	}
+}
+
+func TestPollNStopsClaimingNearDeadline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinRemainingTime = 150 * time.Millisecond
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+	poller.Register("ns.Work", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	})
+	for i := 0; i < 10; i++ {
+		step := fmt.Sprintf("step-%d", i)
+		store.addStep(step, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: fmt.Sprintf("task-%d", i), Name: "ns.Work", StepID: step, TaskListName: "default"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	n, err := poller.PollN(ctx, 10)
+	if err != nil {
+		t.Fatalf("PollN: %v", err)
+	}
+
+	// Claims happen at ~0, 50, 100ms; by 150ms too little time is left
+	if n < 1 || n > 4 {
+		t.Errorf("Expected claiming to stop before the budget ran out, processed %d", n)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected PollN to return before the deadline")
+	}
+	if pending := store.countTasks(TaskStatePending); pending != 10-n {
+		t.Errorf("Expected %d tasks left pending, got %d", 10-n, pending)
+	}
+}
+
+func TestFacetEstimatesSkipLongFacetsNearDeadline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FacetEstimates = map[string]time.Duration{"ns.Long": time.Hour}
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+	noop := func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	poller.Register("ns.Long", noop)
+	poller.Register("ns.Short", noop)
+
+	store.addStep("step-1", map[string]interface{}{})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "long", Name: "ns.Long", StepID: "step-1", TaskListName: "default"})
+	store.addTask(TaskDocument{UUID: "short", Name: "ns.Short", StepID: "step-2", TaskListName: "default"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if n, err := poller.PollN(ctx, 5); err != nil || n != 1 {
+		t.Fatalf("Expected only the short task processed, got %d (%v)", n, err)
+	}
+	if store.tasks["long"].State != TaskStatePending {
+		t.Errorf("Expected the long task left unclaimed, got %s", store.tasks["long"].State)
+	}
+
+	// Without a deadline the estimate does not apply
+	if n, err := poller.PollN(context.Background(), 5); err != nil || n != 1 {
+		t.Errorf("Expected the long task processed without a deadline, got %d (%v)", n, err)
+	}
+}
+
+func TestHandlerErrorInfoByCategory(t *testing.T) {
+	cases := []struct {
+		err       error
+		wantType  string
+		retriable bool
+	}{
+		{Permanent(errors.New("bad input")), ErrorTypePermanent, false},
+		{Retriable(fmt.Errorf("fetch: %w", errors.New("upstream down"))), ErrorTypeRetriable, true},
+		{errors.New("plain"), ErrorTypeError, false},
+	}
+	for _, c := range cases {
+		poller, store := newFakePoller()
+		handlerErr := c.err
+		poller.Register("ns.Fail", func(params map[string]interface{}) (map[string]interface{}, error) {
+			return nil, handlerErr
+		})
+
+		runSingle(t, poller, store, "ns.Fail")
+
+		info := store.errorInfos["task-1"]
+		if info.Type != c.wantType || info.Retriable != c.retriable {
+			t.Errorf("Expected %s (retriable=%v), got %+v", c.wantType, c.retriable, info)
+		}
+		if info.Message != c.err.Error() || info.Attempts != 1 {
+			t.Errorf("%s: unexpected message or attempts: %+v", c.wantType, info)
+		}
+	}
+
+	poller, store := newFakePoller()
+	poller.Register("ns.Boom", panickingHandler)
+	runSingle(t, poller, store, "ns.Boom")
+	if info := store.errorInfos["task-1"]; info.Type != ErrorTypePanic || info.Message != "handler panic: kaboom" {
+		t.Errorf("Expected panic error info, got %+v", info)
+	}
+}
+
+func TestIdleBackoffGrowsAndResets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PollInterval = 100 * time.Millisecond
+	cfg.IdleBackoffAfter = 3
+	cfg.MaxPollInterval = time.Second
+	poller := NewAgentPoller(cfg)
+
+	// Simulated cycles: true claimed a task
+	cycles := []bool{false, false, false, false, false, false, false, true, false}
+	want := []time.Duration{
+		100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+		400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second,
+		100 * time.Millisecond, 100 * time.Millisecond,
+	}
+	idle := 0
+	for i, claimed := range cycles {
+		if claimed {
+			idle = 0
+		} else {
+			idle++
+		}
+		if got := poller.idleInterval(idle); got != want[i] {
+			t.Errorf("Cycle %d: expected interval %v, got %v", i, want[i], got)
+		}
+	}
+
+	poller.cfg.IdleBackoffAfter = 0
+	if got := poller.idleInterval(100); got != cfg.PollInterval {
+		t.Errorf("Expected no backoff when disabled, got %v", got)
+	}
+}
+
+func TestIdleBackoffSlowsPollLoop(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = 5 * time.Millisecond
+	poller.cfg.IdleBackoffAfter = 1
+	poller.cfg.MaxPollInterval = time.Hour
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		poller.pollLoop(ctx)
+		close(done)
+	}()
+
+	// Intervals double from 10ms, so the loop soon waits far longer than
+	// the base interval and a new task is not picked up promptly
+	time.Sleep(200 * time.Millisecond)
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default"})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	if got := store.taskState("task-1"); got != TaskStatePending {
+		t.Errorf("Expected idle-backed-off loop not to claim yet, got %s", got)
+	}
+}
+
+func TestMaxTasksBeforeExit(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	poller.cfg.AdaptivePolling = true
+	poller.cfg.MaxTasksBeforeExit = 2
+	reg := newFakeRegistry()
+	poller.registration = reg
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	})
+	for i := 1; i <= 4; i++ {
+		id := fmt.Sprintf("%d", i)
+		store.addStep("step-"+id, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: "task-" + id, Name: "ns.F", StepID: "step-" + id, TaskListName: "default"})
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Start to return after the task budget")
+	}
+
+	if got := store.countTasks(TaskStateCompleted); got != 2 {
+		t.Errorf("Expected 2 tasks completed before exit, got %d", got)
+	}
+	if got := store.countTasks(TaskStatePending); got != 2 {
+		t.Errorf("Expected 2 tasks left pending, got %d", got)
+	}
+	if !reg.deregistered[poller.serverID] {
+		t.Error("Expected deregistration on self-termination")
+	}
+}
+
+func TestMaxTasksBeforeExitCountsTerminalOutcomes(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	poller.cfg.MaxTasksBeforeExit = 2
+	poller.cfg.RetryBackoff = RetryBackoff{Strategy: BackoffFixed, Base: time.Millisecond, MaxAttempts: 3}
+	poller.registration = newFakeRegistry()
+	var mu sync.Mutex
+	calls := 0
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return nil, Retriable(errors.New("downstream unavailable"))
+		}
+		return nil, nil
+	})
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("%d", i)
+		store.addStep("step-"+id, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: "task-" + id, Name: "ns.F", StepID: "step-" + id, TaskListName: "default"})
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Start to return after the task budget")
+	}
+
+	// The retried attempt is not a terminal outcome
+	if got := store.countTasks(TaskStateCompleted); got != 2 {
+		t.Errorf("Expected 2 tasks completed before exit, got %d", got)
+	}
+	if got := store.countTasks(TaskStatePending); got != 1 {
+		t.Errorf("Expected 1 task left pending, got %d", got)
+	}
+}
+
+func TestRegisterDefaultHandlesUnmatchedRoute(t *testing.T) {
+	poller, store := newFakePoller()
+	var got []string
+	poller.RegisterRouted("ns.Route", "region", "eu", func(params map[string]interface{}) (map[string]interface{}, error) {
+		got = append(got, "eu")
+		return nil, nil
+	})
+	poller.RegisterDefault(func(params map[string]interface{}) (map[string]interface{}, error) {
+		got = append(got, "default:"+params["_facet_name"].(string))
+		return nil, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Route", StepID: "step-1", TaskListName: "default",
+		Data: map[string]interface{}{"region": "us"}})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	if len(got) != 1 || got[0] != "default:ns.Route" {
+		t.Errorf("Expected the default handler for an unmatched route, got %v", got)
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", store.taskState("task-1"))
+	}
+}
+
+func TestRegisterDefaultDoesNotWidenClaims(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Known", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	poller.RegisterDefault(func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, ErrIgnoreTask
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Other", StepID: "step-1", TaskListName: "default"})
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if store.taskState("task-1") != TaskStatePending {
+		t.Fatalf("Expected unregistered task left unclaimed, got %s", store.taskState("task-1"))
+	}
+
+	poller.cfg.ClaimUnmatched = true
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if store.taskState("task-1") != TaskStateIgnored {
+		t.Errorf("Expected the default handler to ignore the task, got %s", store.taskState("task-1"))
+	}
+}
+
+func TestClaimUnmatchedNeedsDefaultHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClaimUnmatched = true
+	cfg.Namespace = "ns"
+	poller := NewAgentPoller(cfg)
+	poller.Register("Known", nil)
+
+	if got := poller.EffectiveHandlers(); len(got) != 1 {
+		t.Errorf("Expected no catch-all without a default handler, got %v", got)
+	}
+	poller.RegisterDefault(func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	got := poller.EffectiveHandlers()
+	if len(got) != 2 || got[1] != "ns.*" {
+		t.Errorf("Expected a namespaced catch-all pattern, got %v", got)
+	}
+}
+
+func TestCompletionRetriedAfterSideEffects(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.CompletionRetryBackoff = time.Millisecond
+	store.completeErrs = []error{errors.New("not primary")}
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected completion to succeed on retry, got %s", store.taskState("task-1"))
+	}
+	if len(store.completionFlags) != 0 {
+		t.Errorf("Expected no completion_failed flag, got %v", store.completionFlags)
+	}
+}
+
+func TestTerminalStepCompletionRetried(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.CheckLeafSteps = true
+	poller.cfg.CompletionRetryBackoff = time.Millisecond
+	store.leafSteps = map[string]bool{"step-1": true}
+	store.completeErrs = []error{errors.New("not primary")}
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+
+	if store.completions != 1 || store.stepStates["step-1"] != StepStateCompleted {
+		t.Fatalf("Expected the step completed by CompleteWithReturns, got %d calls, state %s", store.completions, store.stepStates["step-1"])
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected only the task write retried, got %s", store.taskState("task-1"))
+	}
+	if len(store.resumes) != 0 {
+		t.Errorf("Expected no resume task for a terminal step, got %+v", store.resumes)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	fail := errors.New("not primary")
+	calls := 0
+	err := retryWithBackoff(context.Background(), 2, time.Millisecond, "test", func() error {
+		calls++
+		if calls < 3 {
+			return fail
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the last retry, got %v after %d calls", err, calls)
+	}
+
+	// A canceled context ends the retries with the last error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = retryWithBackoff(ctx, 5, time.Hour, "test", func() error {
+		calls++
+		return fail
+	})
+	if err != fail || calls != 1 {
+		t.Errorf("Expected one call and its error once ctx ended, got %v after %d calls", err, calls)
+	}
+}
+
+func TestCompletionFailureFlaggedAfterRetries(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.CompletionRetries = 2
+	poller.cfg.CompletionRetryBackoff = time.Millisecond
+	poller.cfg.EventBufferSize = 16
+	poller.events = newEventRing(poller.cfg.EventBufferSize)
+	fail := errors.New("not primary")
+	store.completeErrs = []error{fail, fail, fail}
+	var hooked error
+	poller.SetCompletionFailedHook(func(task *TaskDocument, err error) {
+		hooked = err
+	})
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+
+	// Side effects happened, but the task is left running and flagged
+	if store.returns["step-1"]["out"] != 1 || len(store.resumes) != 1 {
+		t.Fatalf("Expected returns and resume written, got %v / %v", store.returns, store.resumes)
+	}
+	if store.taskState("task-1") != TaskStateRunning {
+		t.Errorf("Expected task still running, got %s", store.taskState("task-1"))
+	}
+	if got := store.completionFlags["task-1"]; got != "not primary" {
+		t.Errorf("Expected completion_failed flag, got %q", got)
+	}
+	if len(store.completeErrs) != 0 {
+		t.Errorf("Expected 1 attempt plus 2 retries, %d errors unused", len(store.completeErrs))
+	}
+	if hooked != fail {
+		t.Errorf("Expected hook called with the last error, got %v", hooked)
+	}
+	events := poller.RecentEvents(0)
+	if last := events[len(events)-1]; last.Kind != EventCompletionFailed {
+		t.Errorf("Expected a completion_failed event, got %s", last.Kind)
+	}
+}
+
+func TestResumeInsertRetried(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.ResumeInsertRetryBackoff = time.Millisecond
+	store.resumeErrs = []error{errors.New("not primary")}
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+
+	if len(store.resumes) != 1 {
+		t.Fatalf("Expected the resume inserted on retry, got %v", store.resumes)
+	}
+	if store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", store.taskState("task-1"))
+	}
+}
+
+func TestResumeInsertFailureLeavesResumePending(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.ResumeInsertRetries = 2
+	poller.cfg.ResumeInsertRetryBackoff = time.Millisecond
+	poller.cfg.EventBufferSize = 16
+	poller.events = newEventRing(poller.cfg.EventBufferSize)
+	fail := errors.New("not primary")
+	store.resumeErrs = []error{fail, fail, fail}
+	var hooked error
+	poller.SetResumePendingHook(func(task *TaskDocument, err error) {
+		hooked = err
+	})
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"out": 1}, nil
+	})
+
+	runSingle(t, poller, store, "ns.F")
+
+	// Returns are written, so the task is not failed
+	if store.returns["step-1"]["out"] != 1 {
+		t.Fatalf("Expected returns written, got %v", store.returns)
+	}
+	if len(store.resumes) != 0 {
+		t.Errorf("Expected no resume inserted, got %v", store.resumes)
+	}
+	if store.taskState("task-1") != TaskStateResumePending {
+		t.Errorf("Expected task resume_pending, got %s", store.taskState("task-1"))
+	}
+	if _, failed := store.failures["task-1"]; failed {
+		t.Errorf("Expected task not failed, got %q", store.failures["task-1"])
+	}
+	if got, ok := store.resumePending["task-1"]; !ok || got != "default" {
+		t.Errorf("Expected resume list default recorded, got %q", got)
+	}
+	if len(store.resumeErrs) != 0 {
+		t.Errorf("Expected 1 attempt plus 2 retries, %d errors unused", len(store.resumeErrs))
+	}
+	if hooked != fail {
+		t.Errorf("Expected hook called with the last error, got %v", hooked)
+	}
+	events := poller.RecentEvents(0)
+	if last := events[len(events)-1]; last.Kind != EventResumePending {
+		t.Errorf("Expected a resume_pending event, got %s", last.Kind)
+	}
+}
+
+func TestSecondaryPrecheckSkipsClaim(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.UseSecondaryPrecheck = true
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	if poller.pollCycle(context.Background()) {
+		t.Fatal("Expected nothing claimed from an empty queue")
+	}
+	if store.claims != 0 {
+		t.Errorf("Expected the claim skipped when the pre-check finds nothing, got %d claims", store.claims)
+	}
+
+	// A lagging secondary hides new work until it catches up
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default"})
+	store.stalePrecheck = true
+	poller.pollCycle(context.Background())
+	if store.claims != 0 {
+		t.Errorf("Expected no claim while the pre-check is stale, got %d", store.claims)
+	}
+
+	store.stalePrecheck = false
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected the task claimed once the pre-check sees it")
+	}
+	poller.wg.Wait()
+	if store.claims != 1 || store.taskState("task-1") != TaskStateCompleted {
+		t.Errorf("Expected one claim completing the task, got %d claims, state %s", store.claims, store.taskState("task-1"))
+	}
+}
+
+func TestPollLoopRecoversCyclePanic(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	store.claimPanics = 2
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		poller.pollLoop(ctx)
+		close(done)
+	}()
+	ok := waitFor(time.Second, func() bool { return store.taskState("task-1") == TaskStateCompleted })
+	cancel()
+	<-done
+
+	if !ok {
+		t.Fatal("Expected cycles after the panics to claim the task")
+	}
+	if got := poller.Stats().PollPanics; got != 2 {
+		t.Errorf("Expected 2 recovered poll panics, got %d", got)
+	}
+}
+
+func TestTaskListConcurrencyCaps(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.MaxConcurrent = 10
+	poller.cfg.TaskList = "batch"
+	poller.cfg.TaskLists = []string{"interactive"}
+	poller.listSems = newListSems(map[string]int{"batch": 2, "interactive": 3})
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running := map[string]int{}
+	peak := map[string]int{}
+	blocking := func(list string) Handler {
+		return func(params map[string]interface{}) (map[string]interface{}, error) {
+			mu.Lock()
+			running[list]++
+			if running[list] > peak[list] {
+				peak[list] = running[list]
+			}
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running[list]--
+			mu.Unlock()
+			return nil, nil
+		}
+	}
+	poller.Register("ns.Batch", blocking("batch"))
+	poller.Register("ns.Interactive", blocking("interactive"))
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("%d", i)
+		store.addStep("b-step-"+id, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: "b-" + id, Name: "ns.Batch", StepID: "b-step-" + id, TaskListName: "batch"})
+		store.addStep("i-step-"+id, map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: "i-" + id, Name: "ns.Interactive", StepID: "i-step-" + id, TaskListName: "interactive"})
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		poller.pollCycle(ctx)
+	}
+	ok := waitFor(time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running["batch"] == 2 && running["interactive"] == 3
+	})
+	if !ok {
+		mu.Lock()
+		t.Errorf("Expected 2 batch and 3 interactive tasks running, got %v", running)
+		mu.Unlock()
+	}
+	if got := store.countTasks(TaskStatePending); got != 5 {
+		t.Errorf("Expected capped lists to leave 5 tasks pending, got %d", got)
+	}
+
+	// Freed slots are claimed again, still within each cap
+	close(release)
+	for store.countTasks(TaskStatePending) > 0 {
+		poller.pollCycle(ctx)
+		time.Sleep(time.Millisecond)
+	}
+	poller.wg.Wait()
+
+	if peak["batch"] > 2 || peak["interactive"] > 3 {
+		t.Errorf("Expected per-list caps to hold, peaks were %v", peak)
+	}
+	if got := store.countTasks(TaskStateCompleted); got != 10 {
+		t.Errorf("Expected all 10 tasks completed, got %d", got)
+	}
+}
+
+func TestTaskListsRotateClaimOrder(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.TaskList = "a"
+	poller.cfg.TaskLists = []string{"b", "a", "c"}
+
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		firsts = append(firsts, poller.claimOrder()[0])
+	}
+	if got := strings.Join(firsts, ","); got != "a,b,c,a" {
+		t.Errorf("Expected claim order to rotate as a,b,c,a, got %s", got)
+	}
+}
+
+func TestUnregisterAfterClaimReleasesTask(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Keep", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	poller.Register("ns.Gone", func(params map[string]interface{}) (map[string]interface{}, error) {
+		t.Error("Unregistered handler should not run")
+		return nil, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Gone", StepID: "step-1", TaskListName: "default"})
+
+	ctx := context.Background()
+	task, err := store.ClaimTask(ctx, poller.RegisteredHandlers(), "default")
+	if err != nil || task == nil {
+		t.Fatalf("ClaimTask: %v, %v", task, err)
+	}
+	poller.Unregister("ns.Gone")
+	poller.processTask(ctx, task)
+
+	if got := store.taskState("task-1"); got != TaskStatePending {
+		t.Errorf("Expected task released to pending, got %s", got)
+	}
+	if m := poller.Metrics(); m.NoHandler != 0 {
+		t.Errorf("Expected no no-handler failure, got %d", m.NoHandler)
+	}
+	for _, name := range poller.RegisteredHandlers() {
+		if name == "ns.Gone" {
+			t.Error("Expected ns.Gone unregistered")
+		}
+	}
+}
+
+func TestReturnTypesCoerceNumbers(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Count", func(params map[string]interface{}) (map[string]interface{}, error) {
+		var out map[string]interface{}
+		if err := json.Unmarshal([]byte(`{"count": 3, "mean": 1}`), &out); err != nil {
+			return nil, err
+		}
+		out[ReturnTypesKey] = map[string]interface{}{"count": "Long", "mean": "Double"}
+		return out, nil
+	})
+
+	runSingle(t, poller, store, "ns.Count")
+
+	returns := store.returns["step-1"]
+	if got, ok := returns["count"].(int64); !ok || got != 3 {
+		t.Errorf("Expected count coerced to int64 3, got %#v", returns["count"])
+	}
+	if _, ok := returns["mean"].(float64); !ok {
+		t.Errorf("Expected mean kept as float64, got %#v", returns["mean"])
+	}
+	if _, ok := returns[ReturnTypesKey]; ok {
+		t.Error("Expected the return types key stripped from returns")
+	}
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected task completed, got %s", got)
+	}
+}
+
+func TestReturnTypesRejectInexactLong(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Count", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"count":        2.5,
+			ReturnTypesKey: map[string]string{"count": "Long"},
+		}, nil
+	})
+
+	runSingle(t, poller, store, "ns.Count")
+
+	if got := store.taskState("task-1"); got != TaskStateFailed {
+		t.Errorf("Expected task failed, got %s", got)
+	}
+	if _, ok := store.returns["step-1"]["count"]; ok {
+		t.Error("Expected no returns written")
+	}
+}
+
+func TestCancelReasonFromContext(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = time.Millisecond
+	poller.cfg.CancelCheckInterval = time.Millisecond
+	poller.registration = newFakeRegistry()
+
+	started := make(chan struct{})
+	reasons := make(chan string, 1)
+	poller.Register("ns.Long", func(params map[string]interface{}) (map[string]interface{}, error) {
+		ctx := HandlerContext(params)
+		if _, ok := CancelReasonFromContext(ctx); ok {
+			t.Error("Expected no cancel reason before cancellation")
+		}
+		close(started)
+		<-ctx.Done()
+		reason, ok := CancelReasonFromContext(ctx)
+		if !ok {
+			reason = "(none)"
+		}
+		reasons <- reason
+		return map[string]interface{}{"late": true}, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Long", StepID: "step-1", TaskListName: "default"})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- poller.Start(context.Background()) }()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to start")
+	}
+	store.cancelTask("task-1", "superseded by run 42")
+
+	select {
+	case got := <-reasons:
+		if got != "superseded by run 42" {
+			t.Errorf("Expected the cancel reason in the handler context, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler context canceled")
+	}
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+	if _, ok := store.returns["step-1"]["late"]; ok {
+		t.Error("Expected the canceled task's result discarded")
+	}
+	if got := store.taskState("task-1"); got != TaskStateCanceled {
+		t.Errorf("Expected task left canceled, got %s", got)
+	}
+}
+
+func TestHeartbeatIntervalBounds(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.HeartbeatInterval = 10 * time.Second
+
+	if got := poller.heartbeatInterval(1); got != 10*time.Second {
+		t.Errorf("Expected a fixed interval unless adaptive, got %v", got)
+	}
+
+	poller.cfg.AdaptiveHeartbeat = true
+	for _, stale := range []time.Duration{0, 45 * time.Second, 20 * time.Second} {
+		poller.cfg.ServerStaleAfter = stale
+		prev := time.Duration(0)
+		for _, load := range []float64{0, 0.25, 0.5, 1, 3} {
+			got := poller.heartbeatInterval(load)
+			if got < 10*time.Second || got > 20*time.Second {
+				t.Errorf("stale %v, load %v: interval %v outside [10s, 20s]", stale, load, got)
+			}
+			if stale > 0 && got > stale/3 && got != 10*time.Second {
+				t.Errorf("stale %v, load %v: interval %v exceeds a third of the threshold", stale, load, got)
+			}
+			if got < prev {
+				t.Errorf("stale %v: interval shrank from %v to %v as load grew", stale, prev, got)
+			}
+			prev = got
+		}
+	}
+	poller.cfg.ServerStaleAfter = 0
+	if got := poller.heartbeatInterval(0.5); got != 15*time.Second {
+		t.Errorf("Expected 15s at half load, got %v", got)
+	}
+}
+
+func TestHeartbeatCarriesLoad(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.MaxConcurrent = 4
+	poller.slots = newSlotPool(4)
+	reg := newFakeRegistry()
+	poller.registration = reg
+
+	poller.slots.take()
+	if err := poller.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat: %v", err)
+	}
+	if len(reg.loads) != 0 {
+		t.Errorf("Expected no load reported unless adaptive, got %v", reg.loads)
+	}
+
+	poller.cfg.AdaptiveHeartbeat = true
+	poller.slots.take()
+	poller.slots.take()
+	if err := poller.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat: %v", err)
+	}
+	if len(reg.loads) != 1 || reg.loads[0] != 0.75 {
+		t.Errorf("Expected the ping to carry load 0.75, got %v", reg.loads)
+	}
+	if reg.heartbeats != 2 {
+		t.Errorf("Expected 2 heartbeats, got %d", reg.heartbeats)
+	}
+}
+
+func TestReexecuteReplacesReturns(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Double", func(params map[string]interface{}) (map[string]interface{}, error) {
+		x := params["x"].(int)
+		result := map[string]interface{}{"doubled": x * 2}
+		if x == 1 {
+			result["first_run_only"] = true
+		}
+		return result, nil
+	})
+	store.addStep("step-1", map[string]interface{}{"x": 1})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Double", StepID: "step-1", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+	if got := store.returns["step-1"]["doubled"]; got != 2 {
+		t.Fatalf("Expected doubled 2 on the first run, got %v", got)
+	}
+
+	// An operator edits the params and asks for a re-run
+	store.addStep("step-1", map[string]interface{}{"x": 5})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Double", StepID: "step-1", TaskListName: "default", Reexecute: true})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatalf("PollOnce: %v", err)
+	}
+
+	returns := store.returns["step-1"]
+	if got := returns["doubled"]; got != 10 {
+		t.Errorf("Expected doubled 10 from the edited params, got %v", got)
+	}
+	if _, ok := returns["first_run_only"]; ok {
+		t.Error("Expected returns of the earlier run replaced, not merged")
+	}
+	if got := store.taskState("task-2"); got != TaskStateCompleted {
+		t.Errorf("Expected re-execute task completed, got %s", got)
+	}
+}
+
+func TestSharedMongoClientNotDisconnected(t *testing.T) {
+	ctx := context.Background()
+	// Connect does not dial; nothing needs to listen on the address
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	cfgA := DefaultConfig()
+	cfgA.TaskList = "batch"
+	cfgB := DefaultConfig()
+	cfgB.TaskList = "interactive"
+	pollers := []*AgentPoller{NewAgentPoller(cfgA), NewAgentPoller(cfgB)}
+	for i, p := range pollers {
+		p.SetMongoClient(client)
+		if err := p.connect(ctx); err != nil {
+			t.Fatalf("connect %d: %v", i, err)
+		}
+		if p.db.Client() != client {
+			t.Errorf("Poller %d: expected the shared client, got its own", i)
+		}
+		p.registration = newFakeRegistry()
+	}
+
+	// One poller is stopped after running, the other closed after one-shot use
+	pollers[0].running = true
+	if err := pollers[0].Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := pollers[1].Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Disconnecting an already disconnected client fails
+	if err := client.Disconnect(ctx); err != nil {
+		t.Errorf("Expected the shared client still connected, got %v", err)
+	}
+}
+
+func TestFailoverStandbyClaimsOnceGroupStale(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.FailoverForGroup = "primary"
+	poller.cfg.FailoverStaleAfter = time.Second
+	registry := newFakeRegistry()
+	poller.registration = registry
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default"})
+
+	// The primary group pinged recently
+	registry.groupPings["primary"] = NowMillis() - 500
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.taskState("task-1"); got != TaskStatePending {
+		t.Fatalf("Expected the standby not to claim while the primary is alive, got %s", got)
+	}
+
+	// Its heartbeats stop
+	registry.groupPings["primary"] = NowMillis() - 1500
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.taskState("task-1"); got != TaskStateCompleted {
+		t.Errorf("Expected the standby to take over once the primary is stale, got %s", got)
+	}
+}
+
+func TestRegisterWithDefaults(t *testing.T) {
+	poller, store := newFakePoller()
+	seen := make(map[string]map[string]interface{})
+	poller.RegisterWithDefaults("ns.Fetch", func(params map[string]interface{}) (map[string]interface{}, error) {
+		seen[params["id"].(string)] = params
+		params["retry"].(map[string]interface{})["max"] = 99 // must not leak into the defaults
+		return nil, nil
+	}, map[string]interface{}{
+		"endpoint": "https://api.example.com",
+		"timeout":  30,
+		"retry":    map[string]interface{}{"max": 3, "backoff": "1s"},
+	})
+
+	store.addStep("step-1", map[string]interface{}{
+		"id":      "overridden",
+		"timeout": 5,
+		"retry":   map[string]interface{}{"max": 10},
+	})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Fetch", StepID: "step-1", TaskListName: "default"})
+	store.addStep("step-2", map[string]interface{}{"id": "filled"})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Fetch", StepID: "step-2", TaskListName: "default"})
+	for i := 0; i < 2; i++ {
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != 2 {
+		t.Fatalf("Expected 2 tasks handled, got %d", len(seen))
+	}
+
+	overridden, filled := seen["overridden"], seen["filled"]
+	if got := overridden["endpoint"]; got != "https://api.example.com" {
+		t.Errorf("Expected missing endpoint filled in, got %v", got)
+	}
+	if got := overridden["timeout"]; got != 5 {
+		t.Errorf("Expected the task's timeout to win, got %v", got)
+	}
+	if got := overridden["retry"].(map[string]interface{})["backoff"]; got != "1s" {
+		t.Errorf("Expected nested default merged in, got %v", got)
+	}
+	if got := filled["timeout"]; got != 30 {
+		t.Errorf("Expected default timeout for a task without one, got %v", got)
+	}
+	if got := filled["retry"].(map[string]interface{}); len(got) != 2 {
+		t.Errorf("Expected default retry document, got %v", got)
+	}
+	if got := poller.paramDefaults["ns.Fetch"]["retry"].(map[string]interface{})["max"]; got != 3 {
+		t.Errorf("Expected the handler's change not to reach the defaults, got max %v", got)
+	}
+
+	poller.Register("ns.Fetch", func(params map[string]interface{}) (map[string]interface{}, error) {
+		seen[params["id"].(string)] = params
+		return nil, nil
+	})
+	store.addStep("step-3", map[string]interface{}{"id": "plain"})
+	store.addTask(TaskDocument{UUID: "task-3", Name: "ns.Fetch", StepID: "step-3", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := seen["plain"]["endpoint"]; ok {
+		t.Error("Expected Register to drop the defaults")
+	}
+}
+
+func TestMergeDefaultsIntoBSONDocument(t *testing.T) {
+	params := map[string]interface{}{
+		"retry": primitive.D{{Key: "max", Value: int32(10)}},
+		"tags":  nil,
+	}
+	mergeDefaults(params, map[string]interface{}{
+		"retry": map[string]interface{}{"max": 3, "jitter": true, "backoff": "1s"},
+		"tags":  []interface{}{"default"},
+	})
+
+	want := primitive.D{{Key: "max", Value: int32(10)}, {Key: "backoff", Value: "1s"}, {Key: "jitter", Value: true}}
+	if got := fmt.Sprint(params["retry"]); got != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %s", want, got)
+	}
+	if params["tags"] != nil {
+		t.Errorf("Expected a null param to win over its default, got %v", params["tags"])
+	}
+}
+
+func TestRequireWritableStepFailsWhenStepVanishes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result map[string]interface{}
+	}{
+		{"with returns", map[string]interface{}{"ok": true}},
+		{"without returns", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			poller, store := newFakePoller()
+			poller.cfg.RequireWritableStep = true
+			store.requireStep = true
+			poller.Register("ns.Slow", func(params map[string]interface{}) (map[string]interface{}, error) {
+				store.removeStep("step-1") // deleted while the handler runs
+				return tc.result, nil
+			})
+
+			runSingle(t, poller, store, "ns.Slow")
+
+			if got := store.failures["task-1"]; got != "step no longer writable" {
+				t.Errorf("Expected task failed as step no longer writable, got %q", got)
+			}
+			if len(store.resumes) != 0 {
+				t.Errorf("Expected no resume task, got %d", len(store.resumes))
+			}
+			if len(store.returns["step-1"]) != 0 {
+				t.Errorf("Expected no returns written, got %v", store.returns["step-1"])
+			}
+		})
+	}
+}
+
+func TestMissingStepPolicies(t *testing.T) {
+	seed := func(store *fakeStore) {
+		store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Exec", TaskListName: "default",
+			Data: map[string]interface{}{"command": "reindex"}})
+	}
+
+	for _, policy := range []MissingStepPolicy{"", MissingStepFail} {
+		poller, store := newFakePoller()
+		poller.cfg.MissingStepPolicy = policy
+		called := false
+		poller.Register("ns.Exec", func(params map[string]interface{}) (map[string]interface{}, error) {
+			called = true
+			return nil, nil
+		})
+		seed(store)
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.failures["task-1"]; got != "missing step_id" {
+			t.Errorf("Policy %q: expected task failed with missing step_id, got %q", policy, got)
+		}
+		if called {
+			t.Errorf("Policy %q: expected the handler not called", policy)
+		}
+	}
+
+	t.Run("ignore", func(t *testing.T) {
+		poller, store := newFakePoller()
+		poller.cfg.MissingStepPolicy = MissingStepIgnore
+		poller.Register("ns.Exec", func(params map[string]interface{}) (map[string]interface{}, error) {
+			t.Error("Expected the handler not called")
+			return nil, nil
+		})
+		seed(store)
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.taskState("task-1"); got != TaskStateIgnored {
+			t.Errorf("Expected task ignored, got %s", got)
+		}
+	})
+
+	t.Run("data", func(t *testing.T) {
+		poller, store := newFakePoller()
+		poller.cfg.MissingStepPolicy = MissingStepUseData
+		var command interface{}
+		poller.Register("ns.Exec", func(params map[string]interface{}) (map[string]interface{}, error) {
+			command = params["command"]
+			return map[string]interface{}{"done": true}, nil
+		})
+		seed(store)
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if command != "reindex" {
+			t.Errorf("Expected the handler to get the task data, got command %v", command)
+		}
+		if got := store.taskState("task-1"); got != TaskStateCompleted {
+			t.Errorf("Expected task completed, got %s", got)
+		}
+		if len(store.resumes) != 0 || len(store.returns) != 0 {
+			t.Errorf("Expected no returns or resume without a step, got %v / %d", store.returns, len(store.resumes))
+		}
+	})
+}
+
+func TestAuditRecordsClaimAndOutcome(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.AuditCollection = "audit"
+	poller.Register("ns.Audited", func(params map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return map[string]interface{}{"ok": true}, nil
+	})
+	runSingle(t, poller, store, "ns.Audited")
+
+	if len(store.audits) != 2 {
+		t.Fatalf("Expected claim and completion audited, got %+v", store.audits)
+	}
+	claim, done := store.audits[0], store.audits[1]
+	if claim.Event != EventClaimed || done.Event != EventCompleted {
+		t.Errorf("Expected claimed then completed, got %s then %s", claim.Event, done.Event)
+	}
+	for _, r := range store.audits {
+		if r.TaskID != "task-1" || r.StepID != "step-1" || r.Facet != "ns.Audited" || r.ServerID != poller.serverID || r.Time == 0 {
+			t.Errorf("Incomplete audit record %+v", r)
+		}
+	}
+	if claim.DurationMs != 0 || done.DurationMs < 5 {
+		t.Errorf("Expected the completion to carry the time since claim, got %d / %d", claim.DurationMs, done.DurationMs)
+	}
+
+	// A failure is audited as the outcome too, with its reason
+	poller.Register("ns.Audited", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Audited", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if last := store.audits[len(store.audits)-1]; last.TaskID != "task-2" || last.Event != EventFailed || last.Reason != "boom" {
+		t.Errorf("Expected task-2 failure audited, got %+v", last)
+	}
+}
+
+func TestNoAuditByDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	runSingle(t, poller, store, "ns.F")
+	if len(store.audits) != 0 {
+		t.Errorf("Expected no audit records without AuditCollection, got %d", len(store.audits))
+	}
+}
+
+func TestRetryBackoffDelays(t *testing.T) {
+	base, limit := 100*time.Millisecond, time.Second
+
+	fixed := RetryBackoff{Strategy: BackoffFixed, Base: base, Cap: limit}
+	for attempt := 1; attempt <= 6; attempt++ {
+		if got := fixed.Delay(attempt); got != base {
+			t.Errorf("Fixed attempt %d: expected %v, got %v", attempt, base, got)
+		}
+	}
+
+	exp := RetryBackoff{Strategy: BackoffExponential, Base: base, Cap: limit}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := exp.Delay(i + 1); got != w*time.Millisecond {
+			t.Errorf("Exponential attempt %d: expected %v, got %v", i+1, w*time.Millisecond, got)
+		}
+	}
+	if got := exp.Delay(1000); got != limit {
+		t.Errorf("Expected the cap to hold for high attempts, got %v", got)
+	}
+
+	jitter := RetryBackoff{Strategy: BackoffFullJitter, Base: base, Cap: limit}
+	for i, w := range want {
+		distinct := make(map[time.Duration]bool)
+		for n := 0; n < 50; n++ {
+			got := jitter.Delay(i + 1)
+			if got < 0 || got > w*time.Millisecond {
+				t.Fatalf("Full jitter attempt %d: %v outside [0, %v]", i+1, got, w*time.Millisecond)
+			}
+			distinct[got] = true
+		}
+		if len(distinct) < 2 {
+			t.Errorf("Full jitter attempt %d: expected spread delays, got %v", i+1, distinct)
+		}
+	}
+}
+
+func TestRetriableFailureScheduledWithBackoff(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.RetryBackoff = RetryBackoff{Strategy: BackoffExponential, Base: time.Second, Cap: time.Minute, MaxAttempts: 3}
+	poller.Register("ns.Flaky", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, Retriable(errors.New("downstream unavailable"))
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Flaky", StepID: "step-1", TaskListName: "default"})
+
+	for i := 0; i < 3; i++ {
+		if err := poller.PollOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := store.retries["task-1"]
+	if len(got) != 2 || got[0] != time.Second || got[1] != 2*time.Second {
+		t.Errorf("Expected retries after 1s and 2s, got %v", got)
+	}
+	if state := store.taskState("task-1"); state != TaskStateFailed {
+		t.Errorf("Expected the last attempt to fail the task, got %s", state)
+	}
+
+	// Permanent errors are never retried
+	poller.Register("ns.Flaky", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, Permanent(errors.New("bad input"))
+	})
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Flaky", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.retries["task-2"]) != 0 || store.taskState("task-2") != TaskStateFailed {
+		t.Errorf("Expected a permanent error to fail at once, got %s after %v", store.taskState("task-2"), store.retries["task-2"])
+	}
+}
+
+func TestRetryAfterReleasesCountsHandlerRuns(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConcurrent = 1
+	cfg.RetryBackoff = RetryBackoff{Strategy: BackoffExponential, Base: time.Second, Cap: time.Minute, MaxAttempts: 2}
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	release := make(chan struct{})
+	poller.Register("ns.Busy", func(params map[string]interface{}) (map[string]interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	poller.Register("ns.Flaky", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, Retriable(errors.New("downstream unavailable"))
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Busy", StepID: "step-1", TaskListName: "default"})
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected task-1 dispatched")
+	}
+
+	// task-2 is claimed and released while the pool is full
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Flaky", StepID: "step-2", TaskListName: "default"})
+	for i := 0; i < 3; i++ {
+		if poller.pollCycle(context.Background()) {
+			t.Fatal("Expected no dispatch while the pool is full")
+		}
+	}
+	close(release)
+	poller.wg.Wait()
+
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.retries["task-2"]; len(got) != 1 || got[0] != time.Second {
+		t.Errorf("Expected the first handler failure retried after 1s, got %v", got)
+	}
+	if state := store.taskState("task-2"); state != TaskStatePending {
+		t.Errorf("Expected the task pending for its retry, got %s", state)
+	}
+}
+
+func TestReloadHandlersKeepsInFlightGeneration(t *testing.T) {
+	poller, store := newFakePoller()
+	var mu sync.Mutex
+	var retired []uint64
+	poller.SetGenerationRetiredFunc(func(generation uint64) {
+		mu.Lock()
+		retired = append(retired, generation)
+		mu.Unlock()
+	})
+	retiredGens := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint64(nil), retired...)
+	}
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	poller.Register("ns.Plugin", func(params map[string]interface{}) (map[string]interface{}, error) {
+		close(started)
+		<-proceed
+		return map[string]interface{}{"version": 1}, nil
+	})
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Plugin", StepID: "step-1", TaskListName: "default"})
+
+	done := make(chan error, 1)
+	go func() { done <- poller.PollOnce(context.Background()) }()
+	<-started
+
+	gen := poller.ReloadHandlers(map[string]Handler{
+		"ns.Plugin": func(params map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"version": 2}, nil
+		},
+	})
+	if gen != 1 || poller.HandlerGeneration() != 1 {
+		t.Fatalf("Expected generation 1 after the reload, got %d", gen)
+	}
+	if live := poller.LiveGenerations(); len(live) != 2 || live[0] != 0 || live[1] != 1 {
+		t.Errorf("Expected generations 0 and 1 live while task-1 runs, got %v", live)
+	}
+	if got := retiredGens(); len(got) != 0 {
+		t.Errorf("Expected no generation retired while in flight, got %v", got)
+	}
+
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if store.returns["step-1"]["version"] != 1 {
+		t.Errorf("Expected the in-flight task to finish on generation 0, got %v", store.returns["step-1"])
+	}
+	if got := retiredGens(); len(got) != 1 || got[0] != 0 {
+		t.Errorf("Expected generation 0 retired once idle, got %v", got)
+	}
+	if live := poller.LiveGenerations(); len(live) != 1 || live[0] != 1 {
+		t.Errorf("Expected only generation 1 live, got %v", live)
+	}
+
+	// New claims use the new generation
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Plugin", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.returns["step-2"]["version"] != 2 {
+		t.Errorf("Expected task-2 to run on generation 1, got %v", store.returns["step-2"])
+	}
+
+	// An idle generation is retired by the reload itself
+	poller.ReloadHandlers(map[string]Handler{})
+	if got := retiredGens(); len(got) != 2 || got[1] != 1 {
+		t.Errorf("Expected generation 1 retired on reload, got %v", got)
+	}
+	if names := poller.RegisteredHandlers(); len(names) != 0 {
+		t.Errorf("Expected the reload to drop ns.Plugin, got %v", names)
+	}
+}
+
+func TestWatchModeClaimsOnChangeEvents(t *testing.T) {
+	defer func(d time.Duration) { watchReconnectDelay = d }(watchReconnectDelay)
+	watchReconnectDelay = time.Millisecond
+
+	poller, store := newFakePoller()
+	// Only stream events can trigger a claim within the test
+	poller.cfg.PollInterval = time.Hour
+	poller.Register("ns.Watched", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+	first, second := newFakeChangeStream(), newFakeChangeStream()
+	store.streams = []*fakeChangeStream{first, second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	poller.wg.Add(1)
+	go poller.watchLoop(ctx, store)
+	loopDone := make(chan struct{})
+	go func() {
+		poller.pollLoop(ctx)
+		close(loopDone)
+	}()
+
+	insert := func(stream *fakeChangeStream, uuid, token string) {
+		t.Helper()
+		task := TaskDocument{UUID: uuid, Name: "ns.Watched", StepID: "step-" + uuid, TaskListName: "default", State: TaskStatePending}
+		store.addStep(task.StepID, map[string]interface{}{})
+		store.addTask(task)
+		resumeToken, _ := bson.Marshal(bson.M{"_data": token})
+		stream.changes <- TaskChange{Operation: "insert", Task: &task, ResumeToken: resumeToken}
+		if !waitFor(time.Second, func() bool { return store.taskState(uuid) == TaskStateCompleted }) {
+			t.Fatalf("Expected %s claimed and completed from its change event, got %s", uuid, store.taskState(uuid))
+		}
+	}
+
+	insert(first, "task-1", "token-1")
+
+	// Changes that cannot be claimed do not wake the poll loop
+	store.addStep("step-x", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-x", Name: "ns.Watched", StepID: "step-x", TaskListName: "default"})
+	first.changes <- TaskChange{Operation: "update", Task: &TaskDocument{UUID: "task-x", TaskListName: "other", State: TaskStatePending}}
+	first.changes <- TaskChange{Operation: "update", Task: &TaskDocument{UUID: "task-x", TaskListName: "default", State: TaskStateCanceled}}
+	first.changes <- TaskChange{Operation: "update"}
+	time.Sleep(20 * time.Millisecond)
+	if state := store.taskState("task-x"); state != TaskStatePending {
+		t.Errorf("Expected no claim for unclaimable changes, got %s", state)
+	}
+	store.mu.Lock()
+	delete(store.tasks, "task-x")
+	store.mu.Unlock()
+
+	// The stream fails: the next one resumes after the last change seen
+	close(first.changes)
+	insert(second, "task-2", "token-2")
+
+	store.mu.Lock()
+	tokens := append([]bson.Raw(nil), store.watchTokens...)
+	store.mu.Unlock()
+	if len(tokens) != 2 || tokens[0] != nil {
+		t.Fatalf("Expected a fresh stream then a resumed one, got %v", tokens)
+	}
+	if got := tokens[1].Lookup("_data").StringValue(); got != "token-1" {
+		t.Errorf("Expected the stream resumed after token-1, got %q", got)
+	}
+
+	cancel()
+	<-loopDone
+	poller.wg.Wait()
+}
+
+func TestCheckLeafStepsSkipsResumeForLeaves(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.CheckLeafSteps = true
+	poller.Register("ns.Work", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"done": true}, nil
+	})
+	store.leafSteps = map[string]bool{"step-leaf": true}
+	store.addStep("step-leaf", map[string]interface{}{})
+	store.addStep("step-inner", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-leaf", Name: "ns.Work", StepID: "step-leaf", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store.addTask(TaskDocument{UUID: "task-inner", Name: "ns.Work", StepID: "step-inner", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.stepStates["step-leaf"] != StepStateCompleted || store.returns["step-leaf"]["done"] != true {
+		t.Errorf("Expected the leaf step completed with its returns, got %s %v", store.stepStates["step-leaf"], store.returns["step-leaf"])
+	}
+	if store.completions != 1 {
+		t.Errorf("Expected the leaf task finished by one CompleteWithReturns call, got %d", store.completions)
+	}
+	if len(store.resumes) != 1 || store.resumes[0].StepID != "step-inner" {
+		t.Fatalf("Expected a resume task for step-inner only, got %+v", store.resumes)
+	}
+	if store.stepStates["step-inner"] == StepStateCompleted {
+		t.Error("Expected the non-leaf step left for the resume task")
+	}
+	for _, id := range []string{"task-leaf", "task-inner"} {
+		if state := store.taskState(id); state != TaskStateCompleted {
+			t.Errorf("Expected %s completed, got %s", id, state)
+		}
+	}
+
+	// Without the option the marker is not read
+	poller.cfg.CheckLeafSteps = false
+	store.leafSteps["step-2"] = true
+	store.addStep("step-2", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Work", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.resumes) != 2 {
+		t.Errorf("Expected a resume task for a leaf step with CheckLeafSteps off, got %d", len(store.resumes))
+	}
+}
+
+func TestFullPoolPolicies(t *testing.T) {
+	// saturate returns a poller with one slot, taken by task-1 until
+	// release is closed, and task-2 pending behind it.
+	saturate := func(t *testing.T, policy FullPoolPolicy, wait time.Duration) (*AgentPoller, *fakeStore, chan struct{}) {
+		t.Helper()
+		cfg := DefaultConfig()
+		cfg.MaxConcurrent = 1
+		cfg.FullPoolPolicy = policy
+		cfg.FullPoolWait = wait
+		poller := NewAgentPoller(cfg)
+		store := newFakeStore()
+		poller.ops = store
+
+		release := make(chan struct{})
+		poller.Register("ns.Busy", func(params map[string]interface{}) (map[string]interface{}, error) {
+			if params["slow"] == true {
+				<-release
+			}
+			return nil, nil
+		})
+		store.addStep("step-1", map[string]interface{}{"slow": true})
+		store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Busy", StepID: "step-1", TaskListName: "default"})
+		if !poller.pollCycle(context.Background()) {
+			t.Fatal("Expected task-1 dispatched")
+		}
+		store.addStep("step-2", map[string]interface{}{})
+		store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Busy", StepID: "step-2", TaskListName: "default"})
+		return poller, store, release
+	}
+
+	t.Run("drop releases the claim", func(t *testing.T) {
+		poller, store, release := saturate(t, FullPoolDrop, 0)
+		defer poller.wg.Wait()
+		defer close(release)
+		if poller.pollCycle(context.Background()) {
+			t.Error("Expected no dispatch while the pool is full")
+		}
+		if store.claims != 2 || store.taskState("task-2") != TaskStatePending {
+			t.Errorf("Expected task-2 claimed then released to pending, got %d claims and %s", store.claims, store.taskState("task-2"))
+		}
+	})
+
+	t.Run("skip-claim claims nothing", func(t *testing.T) {
+		poller, store, release := saturate(t, FullPoolSkipClaim, 0)
+		defer poller.wg.Wait()
+		defer close(release)
+		if poller.pollCycle(context.Background()) {
+			t.Error("Expected no dispatch while the pool is full")
+		}
+		if store.claims != 1 || store.taskState("task-2") != TaskStatePending {
+			t.Errorf("Expected task-2 left unclaimed, got %d claims and %s", store.claims, store.taskState("task-2"))
+		}
+	})
+
+	t.Run("block waits for a slot", func(t *testing.T) {
+		poller, store, release := saturate(t, FullPoolBlock, 5*time.Second)
+		time.AfterFunc(20*time.Millisecond, func() { close(release) })
+		if !poller.pollCycle(context.Background()) {
+			t.Error("Expected task-2 dispatched once task-1 freed its slot")
+		}
+		poller.wg.Wait()
+		if store.claims != 2 || store.taskState("task-2") != TaskStateCompleted {
+			t.Errorf("Expected task-2 kept and completed, got %d claims and %s", store.claims, store.taskState("task-2"))
+		}
+	})
+
+	t.Run("block gives up after the wait", func(t *testing.T) {
+		poller, store, release := saturate(t, FullPoolBlock, 20*time.Millisecond)
+		defer poller.wg.Wait()
+		defer close(release)
+		start := time.Now()
+		if poller.pollCycle(context.Background()) {
+			t.Error("Expected no dispatch while the pool stays full")
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("Expected to wait for a slot, gave up after %v", elapsed)
+		}
+		if store.taskState("task-2") != TaskStatePending {
+			t.Errorf("Expected task-2 released to pending, got %s", store.taskState("task-2"))
+		}
+	})
+}
+
+func TestExclusiveTaskRunsAlone(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConcurrent = 4
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	var mu sync.Mutex
+	var order []string
+	running := 0
+	gates := map[string]chan struct{}{"a": make(chan struct{}), "x": make(chan struct{})}
+	poller.Register("ns.Job", func(params map[string]interface{}) (map[string]interface{}, error) {
+		id := params["id"].(string)
+		mu.Lock()
+		running++
+		order = append(order, fmt.Sprintf("start %s (%d running)", id, running))
+		mu.Unlock()
+		if gate, ok := gates[id]; ok {
+			<-gate
+		}
+		mu.Lock()
+		running--
+		order = append(order, "end "+id)
+		mu.Unlock()
+		return nil, nil
+	})
+	events := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), order...)
+	}
+	add := func(id string, data map[string]interface{}) {
+		store.addStep("step-"+id, map[string]interface{}{"id": id})
+		store.addTask(TaskDocument{UUID: "task-" + id, Name: "ns.Job", StepID: "step-" + id, TaskListName: "default", Data: data})
+	}
+
+	add("a", nil)
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected task-a dispatched")
+	}
+	waitFor(time.Second, func() bool { return len(events()) == 1 })
+
+	add("x", map[string]interface{}{ExclusiveKey: true})
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected task-x dispatched")
+	}
+	if !waitFor(time.Second, poller.exclusivePending) {
+		t.Fatal("Expected task-x waiting to run alone")
+	}
+
+	// Nothing is claimed while the exclusive task waits or runs
+	add("b", nil)
+	if poller.pollCycle(context.Background()) || store.taskState("task-b") != TaskStatePending {
+		t.Fatalf("Expected no claim behind an exclusive task, got task-b %s", store.taskState("task-b"))
+	}
+	if got := events(); len(got) != 1 {
+		t.Fatalf("Expected task-x to wait for task-a, got %v", got)
+	}
+
+	close(gates["a"])
+	waitFor(time.Second, func() bool { return len(events()) == 3 })
+	if poller.pollCycle(context.Background()) {
+		t.Error("Expected no claim while the exclusive task runs")
+	}
+	close(gates["x"])
+	if !waitFor(time.Second, func() bool { return !poller.exclusivePending() }) {
+		t.Fatal("Expected task-x to finish")
+	}
+
+	if !poller.pollCycle(context.Background()) {
+		t.Fatal("Expected task-b dispatched once task-x finished")
+	}
+	poller.wg.Wait()
+
+	want := []string{"start a (1 running)", "end a", "start x (1 running)", "end x", "start b (1 running)", "end b"}
+	if got := events(); strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
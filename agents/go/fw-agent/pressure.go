@@ -0,0 +1,97 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "sync/atomic"
+
+// PressureInfo describes how loaded the agent is relative to its capacity.
+type PressureInfo struct {
+	// QueueDepth is the last sampled number of claimable pending tasks.
+	QueueDepth int64
+
+	// InFlight is the number of tasks currently being processed.
+	InFlight int
+
+	// Capacity is the maximum number of concurrent tasks (MaxConcurrent).
+	Capacity int
+
+	// Saturation is (InFlight + QueueDepth) / Capacity. Above 1 the backlog
+	// exceeds what this agent can take on right now.
+	Saturation float64
+
+	// ScaleOut reports sustained pressure: the last Config.PressureWindow
+	// queue-depth samples all had Saturation above Config.PressureThreshold.
+	ScaleOut bool
+}
+
+// PressureHook is called when ScaleOut changes, with the sample that
+// changed it.
+type PressureHook func(PressureInfo)
+
+// SetPressureHook installs a hook fired whenever sustained pressure starts
+// (ScaleOut true) or ends (ScaleOut false). Pressure is evaluated on each
+// queue-depth sample, so Config.QueueDepthInterval must be set.
+func (p *AgentPoller) SetPressureHook(fn PressureHook) {
+	p.pressureMu.Lock()
+	defer p.pressureMu.Unlock()
+	p.pressureHook = fn
+}
+
+// Pressure returns the agent's current load relative to capacity.
+func (p *AgentPoller) Pressure() PressureInfo {
+	p.pressureMu.Lock()
+	scaleOut := p.scaleOut
+	p.pressureMu.Unlock()
+
+	info := p.pressureSample(atomic.LoadInt64(&p.queueDepth))
+	info.ScaleOut = scaleOut
+	return info
+}
+
+// pressureSample computes PressureInfo, without ScaleOut, for depth.
+func (p *AgentPoller) pressureSample(depth int64) PressureInfo {
+	used, limit := p.slots.usage()
+	info := PressureInfo{
+		QueueDepth: depth,
+		InFlight:   used,
+		Capacity:   limit,
+	}
+	if info.Capacity > 0 {
+		info.Saturation = float64(int64(info.InFlight)+depth) / float64(info.Capacity)
+	}
+	return info
+}
+
+// recordPressure updates the sustained-pressure window with a new
+// queue-depth sample and fires the pressure hook if ScaleOut changed.
+func (p *AgentPoller) recordPressure(depth int64) {
+	info := p.pressureSample(depth)
+
+	p.pressureMu.Lock()
+	if info.Saturation > p.cfg.PressureThreshold {
+		p.pressureStreak++
+	} else {
+		p.pressureStreak = 0
+	}
+	info.ScaleOut = p.cfg.PressureWindow > 0 && p.pressureStreak >= p.cfg.PressureWindow
+	changed := info.ScaleOut != p.scaleOut
+	p.scaleOut = info.ScaleOut
+	hook := p.pressureHook
+	p.pressureMu.Unlock()
+
+	if changed && hook != nil {
+		hook(info)
+	}
+}
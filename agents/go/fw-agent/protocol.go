@@ -41,6 +41,11 @@ const (
 	TaskStateFailed    = "failed"
 	TaskStateIgnored   = "ignored"
 	TaskStateCanceled  = "canceled"
+
+	// TaskStateResumePending marks a task whose returns were written but
+	// whose resume task could not be inserted; see
+	// Config.ResumeInsertRetries.
+	TaskStateResumePending = "resume_pending"
 )
 
 // Step states
@@ -0,0 +1,88 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// reclaimLoop periodically resets tasks whose lease went stale, e.g. because
+// the agent processing them died, back to pending.
+func (p *AgentPoller) reclaimLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.ReclaimStaleAfter)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reclaimStale(ctx)
+		}
+	}
+}
+
+// reclaimStale runs one reclaim pass over this agent's handlers.
+func (p *AgentPoller) reclaimStale(ctx context.Context) {
+	handlers := p.EffectiveHandlers()
+	if len(handlers) == 0 {
+		return
+	}
+
+	for _, list := range p.taskLists() {
+		n, err := p.ops.ReclaimStaleTasks(ctx, handlers, list,
+			p.cfg.ReclaimStaleAfter, p.cfg.ReclaimGracePeriod)
+		if err != nil {
+			log.Printf("Error reclaiming stale tasks: %v", err)
+			return
+		}
+		if n > 0 {
+			log.Printf("Reclaimed %d stale task(s) from %s", n, list)
+		}
+	}
+}
+
+// renewLease keeps task's lease fresh while it is processed, so other
+// agents do not reclaim it. The returned func stops the renewal.
+func (p *AgentPoller) renewLease(ctx context.Context, task *TaskDocument) func() {
+	if p.cfg.ReclaimStaleAfter <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.cfg.ReclaimStaleAfter / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.ops.RenewTaskLease(ctx, task); err != nil {
+					log.Printf("Failed to renew lease for task %s: %v", task.UUID, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
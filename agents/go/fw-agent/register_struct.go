@@ -0,0 +1,115 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// StructTag is the struct field tag naming the facet a Handler field serves.
+const StructTag = "afl"
+
+var handlerType = reflect.TypeOf(Handler(nil))
+
+// RegisterStruct registers handlers found on v, which must be a struct or a
+// pointer to one:
+//
+//   - every exported method with the Handler signature
+//     func(map[string]interface{}) (map[string]interface{}, error)
+//     is registered under the method name; methods with other signatures
+//     are ignored;
+//   - every exported field tagged `afl:"FacetName"` is registered under the
+//     tag value. Tagged fields must be non-nil and of a type convertible to
+//     Handler.
+//
+// Names are resolved the same way as Register. If two entries on v resolve
+// to the same facet name, or a tagged field is invalid, RegisterStruct
+// returns an error and registers nothing. Existing registrations with the
+// same name are replaced, as with Register.
+func (p *AgentPoller) RegisterStruct(v interface{}) error {
+	handlers, err := structHandlers(v)
+	if err != nil {
+		return err
+	}
+	for name, h := range handlers {
+		p.Register(name, h)
+	}
+	return nil
+}
+
+// structHandlers collects the handlers RegisterStruct would register.
+func structHandlers(v interface{}) (map[string]Handler, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil, fmt.Errorf("RegisterStruct: nil value")
+	}
+	sv := reflect.Indirect(rv)
+	if sv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("RegisterStruct: expected struct or pointer to struct, got %s", rv.Type())
+	}
+
+	handlers := make(map[string]Handler)
+	sources := make(map[string]string)
+	add := func(name, source string, h Handler) error {
+		if prev, ok := sources[name]; ok {
+			return fmt.Errorf("RegisterStruct: facet %q bound by both %s and %s", name, prev, source)
+		}
+		handlers[name] = h
+		sources[name] = source
+		return nil
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumMethod(); i++ {
+		m := rt.Method(i)
+		fn := rv.Method(i)
+		if !fn.Type().ConvertibleTo(handlerType) {
+			continue
+		}
+		h := fn.Convert(handlerType).Interface().(Handler)
+		if err := add(m.Name, "method "+m.Name, h); err != nil {
+			return nil, err
+		}
+	}
+
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		name, ok := f.Tag.Lookup(StructTag)
+		if !ok {
+			continue
+		}
+		if f.PkgPath != "" {
+			return nil, fmt.Errorf("RegisterStruct: tagged field %s is unexported", f.Name)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("RegisterStruct: field %s has an empty %s tag", f.Name, StructTag)
+		}
+		fv := sv.Field(i)
+		if !f.Type.ConvertibleTo(handlerType) {
+			return nil, fmt.Errorf("RegisterStruct: field %s has type %s, not a Handler", f.Name, f.Type)
+		}
+		if fv.IsNil() {
+			return nil, fmt.Errorf("RegisterStruct: field %s is nil", f.Name)
+		}
+		h := fv.Convert(handlerType).Interface().(Handler)
+		if err := add(name, "field "+f.Name, h); err != nil {
+			return nil, err
+		}
+	}
+
+	return handlers, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+type geoHandlers struct {
+	calls []string
+
+	Lookup Handler `afl:"geo.Lookup"`
+}
+
+func (g *geoHandlers) Geocode(params map[string]interface{}) (map[string]interface{}, error) {
+	g.calls = append(g.calls, "Geocode")
+	return map[string]interface{}{"lat": 1.0}, nil
+}
+
+func (g *geoHandlers) Reverse(params map[string]interface{}) (map[string]interface{}, error) {
+	g.calls = append(g.calls, "Reverse")
+	return map[string]interface{}{"address": "x"}, nil
+}
+
+// Helper has the wrong signature and must be ignored.
+func (g *geoHandlers) Helper() string { return "" }
+
+func TestRegisterStruct(t *testing.T) {
+	poller, store := newFakePoller()
+	g := &geoHandlers{}
+	g.Lookup = func(map[string]interface{}) (map[string]interface{}, error) {
+		g.calls = append(g.calls, "Lookup")
+		return nil, nil
+	}
+
+	if err := poller.RegisterStruct(g); err != nil {
+		t.Fatalf("RegisterStruct: %v", err)
+	}
+
+	names := poller.RegisteredHandlers()
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "Geocode,Reverse,geo.Lookup" {
+		t.Fatalf("Expected Geocode,Reverse,geo.Lookup, got %s", got)
+	}
+
+	runSingle(t, poller, store, "Reverse")
+	if len(g.calls) != 1 || g.calls[0] != "Reverse" {
+		t.Errorf("Expected Reverse method dispatched, got %v", g.calls)
+	}
+	if store.returns["step-1"]["address"] != "x" {
+		t.Errorf("Expected method returns written, got %v", store.returns["step-1"])
+	}
+}
+
+type collidingHandlers struct {
+	Other Handler `afl:"Run"`
+}
+
+func (collidingHandlers) Run(params map[string]interface{}) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func TestRegisterStructErrors(t *testing.T) {
+	noop := func(map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+
+	cases := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"nil", nil, "nil value"},
+		{"not a struct", noop, "expected struct"},
+		{"collision", collidingHandlers{Other: noop}, "bound by both"},
+		{"nil field", &struct {
+			H Handler `afl:"ns.H"`
+		}{}, "is nil"},
+		{"wrong field type", &struct {
+			H string `afl:"ns.H"`
+		}{}, "not a Handler"},
+	}
+
+	for _, tc := range cases {
+		poller, _ := newFakePoller()
+		err := poller.RegisterStruct(tc.v)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+		if n := len(poller.RegisteredHandlers()); n != 0 {
+			t.Errorf("%s: expected nothing registered on error, got %d", tc.name, n)
+		}
+	}
+}
@@ -130,7 +130,7 @@ func (rr *RegistryRunner) Start(ctx context.Context) error {
 		return err
 	}
 	rr.client = client
-	rr.db = client.Database(rr.Poller.cfg.Database)
+	rr.db = client.Database(rr.Poller.cfg.Database, rr.Poller.cfg.databaseOptions())
 
 	// Initial refresh
 	rr.RefreshTopics(ctx, rr.db)
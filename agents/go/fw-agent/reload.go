@@ -0,0 +1,114 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ReloadConfig applies cfg to the running poller as far as that is possible
+// without a restart:
+//
+//   - PollInterval, from the next poll cycle, which runs at once
+//   - MaxConcurrent; tasks running above a lowered limit finish undisturbed
+//   - HeartbeatInterval, from the next heartbeat
+//
+// Zero values are ignored. ReloadConfig returns the names of the fields it
+// changed, and of the other Config fields whose value differs from the
+// poller's, which only take effect on restart. Both are logged. RunAgent
+// calls it on SIGHUP.
+func (p *AgentPoller) ReloadConfig(cfg Config) (applied, restart []string) {
+	p.cfgMu.Lock()
+	current := p.cfg
+	if cfg.PollInterval > 0 && cfg.PollInterval != p.cfg.PollInterval {
+		p.cfg.PollInterval = cfg.PollInterval
+		applied = append(applied, "PollInterval")
+	}
+	if cfg.MaxConcurrent > 0 && cfg.MaxConcurrent != p.cfg.MaxConcurrent {
+		p.cfg.MaxConcurrent = cfg.MaxConcurrent
+		p.slots.setLimit(cfg.MaxConcurrent)
+		applied = append(applied, "MaxConcurrent")
+	}
+	if cfg.HeartbeatInterval > 0 && cfg.HeartbeatInterval != p.cfg.HeartbeatInterval {
+		p.cfg.HeartbeatInterval = cfg.HeartbeatInterval
+		applied = append(applied, "HeartbeatInterval")
+	}
+	p.cfgMu.Unlock()
+
+	restart = restartConfigFields(current, cfg)
+	if len(applied) > 0 {
+		log.Printf("Config reloaded, applied: %s", strings.Join(applied, ", "))
+		p.wakePoll()
+	} else {
+		log.Printf("Config reloaded, nothing to apply")
+	}
+	if len(restart) > 0 {
+		log.Printf("Config changes needing a restart: %s", strings.Join(restart, ", "))
+	}
+	return applied, restart
+}
+
+// reloadableFields are the Config fields ReloadConfig applies, and those
+// that never call for a restart.
+var reloadableFields = map[string]bool{
+	"PollInterval":      true,
+	"MaxConcurrent":     true,
+	"HeartbeatInterval": true,
+	"ConfigPath":        true,
+}
+
+// restartConfigFields returns the names of the fields other than
+// reloadableFields that differ between a and b.
+func restartConfigFields(a, b Config) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var names []string
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if reloadableFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// config returns a copy of the poller's Config. Goroutines that may run
+// alongside ReloadConfig must use it, or the accessors below, rather than
+// copying p.cfg or reading the fields ReloadConfig writes.
+func (p *AgentPoller) config() Config {
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
+	return p.cfg
+}
+
+// pollInterval returns Config.PollInterval, which ReloadConfig may change.
+func (p *AgentPoller) pollInterval() time.Duration {
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
+	return p.cfg.PollInterval
+}
+
+// baseHeartbeatInterval returns Config.HeartbeatInterval, which
+// ReloadConfig may change.
+func (p *AgentPoller) baseHeartbeatInterval() time.Duration {
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
+	return p.cfg.HeartbeatInterval
+}
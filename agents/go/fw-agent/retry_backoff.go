@@ -0,0 +1,97 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy is how RetryBackoff grows the delay between retries.
+type BackoffStrategy string
+
+const (
+	// BackoffFixed waits Base before every retry.
+	BackoffFixed BackoffStrategy = "fixed"
+
+	// BackoffExponential waits Base, doubled for each earlier attempt.
+	BackoffExponential BackoffStrategy = "exponential"
+
+	// BackoffFullJitter waits a uniformly random time between zero and the
+	// exponential delay, so tasks that failed together do not retry
+	// together. It is the default.
+	BackoffFullJitter BackoffStrategy = "full_jitter"
+)
+
+// RetryBackoff schedules retries of tasks whose handler failed with a
+// Retriable error: such a task goes back to pending with a run_at that no
+// agent claims it before, instead of failing. Claims then skip tasks whose
+// run_at is in the future.
+type RetryBackoff struct {
+	Strategy BackoffStrategy
+
+	// Base is the delay before the first retry.
+	Base time.Duration
+
+	// Cap, if positive, bounds every delay.
+	Cap time.Duration
+
+	// MaxAttempts is how many times a task's handler may run before a
+	// retriable failure is final; claims handed back without running it
+	// do not count. Zero disables retry scheduling.
+	MaxAttempts int
+}
+
+// Delay returns the wait before retrying after the given failed attempt,
+// counted from 1.
+func (b RetryBackoff) Delay(attempt int) time.Duration {
+	d := b.Base
+	if b.Strategy != BackoffFixed {
+		for i := 1; i < attempt && (b.Cap <= 0 || d < b.Cap); i++ {
+			d *= 2
+		}
+	}
+	if b.Cap > 0 && d > b.Cap {
+		d = b.Cap
+	}
+	if d <= 0 {
+		return 0
+	}
+	if b.Strategy == BackoffFullJitter || b.Strategy == "" {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
+
+// scheduleRetry puts task back to pending for a later attempt if its
+// failure is retriable and attempts remain, and reports whether it did.
+func (p *AgentPoller) scheduleRetry(ctx context.Context, task *TaskDocument, info ErrorInfo) bool {
+	backoff := p.cfg.RetryBackoff
+	if !info.Retriable || backoff.MaxAttempts <= 0 || task.Attempts >= backoff.MaxAttempts {
+		return false
+	}
+
+	delay := backoff.Delay(task.Attempts)
+	if err := p.ops.RetryTask(ctx, task, info, delay); err != nil {
+		log.Printf("Failed to schedule retry of task %s: %v", task.UUID, err)
+		return false
+	}
+	log.Printf("Task %s failed (attempt %d), retrying in %v: %s", task.UUID, task.Attempts, delay, info.Message)
+	p.recordEvent(EventRetried, task, fmt.Sprintf("retry in %v: %s", delay, info.Message))
+	return true
+}
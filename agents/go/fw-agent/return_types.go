@@ -0,0 +1,124 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// ReturnTypesKey is the reserved result key under which a handler may
+// declare the intended type of numeric returns, as a map from return name
+// to type hint ("Long" or "Double"). Numbers often surface as float64
+// after a JSON round trip, so without it a count of 3 would be stored as a
+// Double. Declared returns are converted before they are written, and the
+// task fails if a value cannot be represented exactly, e.g. 2.5 as a Long:
+//
+//	return map[string]interface{}{
+//		"count":        payload["count"], // float64 from encoding/json
+//		ReturnTypesKey: map[string]string{"count": "Long"},
+//	}, nil
+//
+// The key is removed from the result before returns are written.
+const ReturnTypesKey = "__return_types__"
+
+// takeReturnTypes removes ReturnTypesKey from result and returns the
+// declared hints. Entries whose hint is not a string are ignored.
+func takeReturnTypes(result map[string]interface{}) map[string]string {
+	v, ok := result[ReturnTypesKey]
+	if !ok {
+		return nil
+	}
+	delete(result, ReturnTypesKey)
+
+	switch types := v.(type) {
+	case map[string]string:
+		return types
+	case map[string]interface{}:
+		hints := make(map[string]string, len(types))
+		for name, hint := range types {
+			if s, ok := hint.(string); ok {
+				hints[name] = s
+			}
+		}
+		return hints
+	}
+	return nil
+}
+
+// coerceReturns converts each return named in types to its declared
+// numeric type in place. Returns absent from result are skipped.
+func coerceReturns(result map[string]interface{}, types map[string]string) error {
+	for name, hint := range types {
+		v, ok := result[name]
+		if !ok {
+			continue
+		}
+		coerced, err := coerceNumber(v, hint)
+		if err != nil {
+			return fmt.Errorf("return %q: %w", name, err)
+		}
+		result[name] = coerced
+	}
+	return nil
+}
+
+// coerceNumber converts v to int64 for "Long" or float64 for "Double".
+func coerceNumber(v interface{}, hint string) (interface{}, error) {
+	switch hint {
+	case "Long":
+		switch n := v.(type) {
+		case int:
+			return int64(n), nil
+		case int32:
+			return int64(n), nil
+		case int64:
+			return n, nil
+		case float32:
+			return floatToLong(float64(n))
+		case float64:
+			return floatToLong(n)
+		case json.Number:
+			return n.Int64()
+		}
+	case "Double":
+		switch n := v.(type) {
+		case int:
+			return float64(n), nil
+		case int32:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float32:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		case json.Number:
+			return n.Float64()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type hint %q", hint)
+	}
+	return nil, fmt.Errorf("cannot store %T as %s", v, hint)
+}
+
+// floatToLong converts f to int64 if it is a whole number in range.
+func floatToLong(f float64) (interface{}, error) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("cannot store %v as Long", f)
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "fmt"
+
+// route is a handler selected by a value in the task's data.
+type route struct {
+	key     string
+	value   string
+	handler Handler
+}
+
+// RegisterRouted registers a handler for facetName that only handles tasks
+// whose data[routeKey] equals routeValue (compared in its fmt.Sprint form,
+// so numeric values match their decimal string).
+//
+// Precedence for a task of a facet with routes: the first route registered
+// whose key and value match wins; if none match, the facet's plain Register
+// handler runs; if there is none, the RegisterDefault handler runs, and
+// without one the task fails as having no handler.
+// Registering the same key and value again replaces that route's handler.
+// The facet name is resolved as in Register. Register routes before Start
+// so that claims fetch task data (see Config.ClaimFullDocument).
+func (p *AgentPoller) RegisterRouted(facetName, routeKey, routeValue string, handler Handler) {
+	facetName = p.qualify(facetName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes := p.routes[facetName]
+	for i := range routes {
+		if routes[i].key == routeKey && routes[i].value == routeValue {
+			routes[i].handler = handler
+			return
+		}
+	}
+	p.routes[facetName] = append(routes, route{key: routeKey, value: routeValue, handler: handler})
+	p.handlersChanged()
+}
+
+// hasRoutes reports whether any RegisterRouted handler exists, in which
+// case claims must fetch task data to select among them.
+func (p *AgentPoller) hasRoutes() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.routes) > 0
+}
+
+// isRegistered reports whether name has a plain or routed handler.
+// Callers must hold p.mu.
+func (p *AgentPoller) isRegistered(name string) bool {
+	if _, ok := p.handlers[name]; ok {
+		return true
+	}
+	return len(p.routes[name]) > 0
+}
+
+// selectHandler picks the handler for task among those registered under
+// name, applying the RegisterRouted precedence. Callers must hold p.mu.
+func (p *AgentPoller) selectHandler(name string, task *TaskDocument) Handler {
+	for _, r := range p.routes[name] {
+		v, ok := task.Data[r.key]
+		if ok && fmt.Sprint(v) == r.value {
+			return r.handler
+		}
+	}
+	return p.handlers[name]
+}
@@ -0,0 +1,115 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long RunAgent, or Start on context
+// cancellation, waits for Stop to drain in-flight tasks, deregister and
+// disconnect.
+var shutdownTimeout = 30 * time.Second
+
+// RunAgent is a one-shot entry point for agent binaries. It creates an
+// AgentPoller for cfg, calls register to attach handlers, and runs the poller
+// until ctx is canceled or the process receives SIGINT or SIGTERM, then stops
+// it cleanly. A shutdown triggered by ctx or a signal returns nil.
+//
+// On SIGHUP, if cfg.ConfigPath is set, the config is resolved again from it
+// and applied with ReloadConfig. Without a ConfigPath SIGHUP is logged and
+// ignored, so that a config built in code is never replaced by file or
+// default values.
+//
+//	func main() {
+//		cfg := fwagent.ResolveConfig("")
+//		err := fwagent.RunAgent(context.Background(), cfg, func(p *fwagent.AgentPoller) {
+//			p.Register("ns.MyFacet", myHandler)
+//		})
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+func RunAgent(ctx context.Context, cfg Config, register func(*AgentPoller)) error {
+	poller := NewAgentPoller(cfg)
+	if register != nil {
+		register(poller)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	go handleSignals(ctx, poller, sigCh, cancel, reloadFunc(cfg))
+
+	startErr := poller.Start(ctx)
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer stopCancel()
+	stopErr := poller.Stop(stopCtx)
+
+	if startErr != nil && ctx.Err() == nil {
+		return startErr
+	}
+	return stopErr
+}
+
+// reloadFunc returns the config resolver SIGHUP applies for cfg: its
+// ConfigPath resolved again, or nil if it has none.
+func reloadFunc(cfg Config) func() Config {
+	if cfg.ConfigPath == "" {
+		return nil
+	}
+	return func() Config {
+		return ResolveConfig(cfg.ConfigPath)
+	}
+}
+
+// handleSignals cancels the run on SIGINT or SIGTERM, and applies the
+// config returned by resolve on SIGHUP, until ctx ends. With a nil resolve
+// SIGHUP is ignored.
+func handleSignals(ctx context.Context, poller *AgentPoller, sigCh <-chan os.Signal, cancel context.CancelFunc, resolve func() Config) {
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				if resolve == nil {
+					log.Printf("Received %v, but there is no ConfigPath to reload", sig)
+					continue
+				}
+				log.Printf("Received %v, reloading config", sig)
+				poller.ReloadConfig(resolve())
+				continue
+			}
+			log.Printf("Received %v, shutting down", sig)
+			cancel()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
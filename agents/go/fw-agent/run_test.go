@@ -0,0 +1,170 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunAgentCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var registered []string
+	done := make(chan error, 1)
+	go func() {
+		done <- RunAgent(ctx, DefaultConfig(), func(p *AgentPoller) {
+			p.Register("ns.A", func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil })
+			p.Register("ns.B", func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil })
+			registered = p.RegisteredHandlers()
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean return on canceled context, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunAgent did not return after context cancellation")
+	}
+
+	if len(registered) != 2 {
+		t.Errorf("Expected register callback to attach 2 handlers, got %d", len(registered))
+	}
+}
+
+func TestSIGHUPReloadsConfig(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.cfg.PollInterval = time.Hour
+	poller.Register("ns.F", func(params map[string]interface{}) (map[string]interface{}, error) { return nil, nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loopDone := make(chan struct{})
+	go func() {
+		poller.pollLoop(ctx)
+		close(loopDone)
+	}()
+
+	reloaded := poller.cfg
+	reloaded.PollInterval = 10 * time.Millisecond
+	reloaded.MaxConcurrent = 3
+	reloaded.Database = "elsewhere"
+	sigCh := make(chan os.Signal, 1)
+	signalsDone := make(chan struct{})
+	go func() {
+		handleSignals(ctx, poller, sigCh, cancel, func() Config { return reloaded })
+		close(signalsDone)
+	}()
+
+	// Re-registering snapshots the config while the reload writes it
+	poller.registration = newFakeRegistry()
+	reregistered := make(chan error, 1)
+	go func() { reregistered <- poller.ReRegister(ctx) }()
+
+	sigCh <- syscall.SIGHUP
+	if !waitFor(time.Second, func() bool { return poller.pollInterval() == 10*time.Millisecond }) {
+		t.Fatalf("Expected the poll interval reloaded, got %v", poller.pollInterval())
+	}
+	if _, limit := poller.slots.usage(); limit != 3 {
+		t.Errorf("Expected MaxConcurrent reloaded to 3, got %d", limit)
+	}
+	if err := <-reregistered; err != nil {
+		t.Fatalf("ReRegister: %v", err)
+	}
+
+	// The reload wakes the poll loop once; wait for that cycle's claim so
+	// the task below can only be claimed by a later tick at the new
+	// interval, not by the wake-up
+	if !waitFor(time.Second, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.claims >= 1
+	}) {
+		t.Fatal("Expected the reload to wake the poll loop")
+	}
+	store.addStep("step-1", map[string]interface{}{})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.F", StepID: "step-1", TaskListName: "default"})
+	if !waitFor(time.Second, func() bool { return store.taskState("task-1") == TaskStateCompleted }) {
+		t.Errorf("Expected task-1 claimed on the reloaded interval, got %s", store.taskState("task-1"))
+	}
+
+	// SIGHUP does not stop the run; SIGTERM does
+	if ctx.Err() != nil {
+		t.Fatal("Expected SIGHUP to keep the agent running")
+	}
+	sigCh <- syscall.SIGTERM
+	<-signalsDone
+	<-loopDone
+	poller.wg.Wait()
+}
+
+func TestSIGHUPWithoutConfigPathIgnored(t *testing.T) {
+	poller, _ := newFakePoller()
+	poller.cfg.PollInterval = 5 * time.Second
+	poller.cfg.MaxConcurrent = 7
+
+	cfg := poller.cfg
+	if reloadFunc(cfg) != nil {
+		t.Fatal("Expected no reload without a ConfigPath")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 2)
+	sigCh <- syscall.SIGHUP
+	sigCh <- syscall.SIGTERM
+	handleSignals(ctx, poller, sigCh, cancel, reloadFunc(cfg))
+
+	if got := poller.pollInterval(); got != 5*time.Second {
+		t.Errorf("Expected the programmatic poll interval kept, got %v", got)
+	}
+	if got := poller.cfg.MaxConcurrent; got != 7 {
+		t.Errorf("Expected the programmatic MaxConcurrent kept, got %d", got)
+	}
+
+	cfg.ConfigPath = "runner.json"
+	if reloadFunc(cfg) == nil {
+		t.Error("Expected a reload from the ConfigPath")
+	}
+}
+
+func TestReloadConfigReportsRestartFields(t *testing.T) {
+	poller, _ := newFakePoller()
+	cfg := poller.cfg
+	cfg.HeartbeatInterval = 2 * cfg.HeartbeatInterval
+	cfg.Database = "other"
+	cfg.TaskLists = []string{"batch"}
+
+	applied, restart := poller.ReloadConfig(cfg)
+	if strings.Join(applied, ",") != "HeartbeatInterval" {
+		t.Errorf("Expected HeartbeatInterval applied, got %v", applied)
+	}
+	if strings.Join(restart, ",") != "TaskLists,Database" && strings.Join(restart, ",") != "Database,TaskLists" {
+		t.Errorf("Expected Database and TaskLists to need a restart, got %v", restart)
+	}
+	if poller.baseHeartbeatInterval() != cfg.HeartbeatInterval {
+		t.Errorf("Expected heartbeat interval %v, got %v", cfg.HeartbeatInterval, poller.baseHeartbeatInterval())
+	}
+	if poller.cfg.Database == "other" {
+		t.Error("Expected Database left for a restart")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// HandlerSample is one handler invocation recorded for debugging: the
+// step's params as read, before framework keys were added, and what the
+// handler returned.
+type HandlerSample struct {
+	Time     time.Time
+	TaskID   string
+	StepID   string
+	Facet    string
+	Params   map[string]interface{}
+	Result   map[string]interface{}
+	Error    string
+	Duration time.Duration
+}
+
+// SampleRedactor strips secrets from a sample's params or result before it
+// is stored. It receives a copy of the values and may modify it freely.
+type SampleRedactor func(facet string, values map[string]interface{})
+
+// SetSampleRedactor installs the redactor applied to every sample's params
+// and result before it is stored; see Config.SampleBufferSize.
+func (p *AgentPoller) SetSampleRedactor(fn SampleRedactor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sampleRedactor = fn
+}
+
+// LastSamples returns up to n of the most recent handler samples, oldest
+// first; n <= 0 returns everything buffered. It returns nil unless
+// Config.SampleBufferSize is positive.
+func (p *AgentPoller) LastSamples(n int) []HandlerSample {
+	if p.samples == nil {
+		return nil
+	}
+	return p.samples.last(n)
+}
+
+// sampleInput copies params for a sample, or returns nil when sampling is
+// off. It must be called before the handler can modify params.
+func (p *AgentPoller) sampleInput(params map[string]interface{}) map[string]interface{} {
+	if p.samples == nil {
+		return nil
+	}
+	return copySampleDoc(params)
+}
+
+// recordSample stores a redacted sample of a handler invocation on task,
+// if sampling is on. input is from sampleInput.
+func (p *AgentPoller) recordSample(task *TaskDocument, input, result map[string]interface{}, handlerErr error, duration time.Duration) {
+	if p.samples == nil {
+		return
+	}
+	sample := HandlerSample{
+		Time:     time.Now(),
+		TaskID:   task.UUID,
+		StepID:   task.StepID,
+		Facet:    task.Name,
+		Params:   input,
+		Result:   copySampleDoc(result),
+		Duration: duration,
+	}
+	if handlerErr != nil {
+		sample.Error = handlerErr.Error()
+	}
+
+	p.mu.RLock()
+	redact := p.sampleRedactor
+	p.mu.RUnlock()
+	if redact != nil {
+		if sample.Params != nil {
+			redact(task.Name, sample.Params)
+		}
+		if sample.Result != nil {
+			redact(task.Name, sample.Result)
+		}
+	}
+	p.samples.add(sample)
+}
+
+// copySampleDoc deep-copies doc, so a redactor cannot reach the handler's
+// values through nested documents or arrays.
+func copySampleDoc(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = copySampleValue(v)
+	}
+	return out
+}
+
+func copySampleValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copySampleDoc(v)
+	case primitive.M:
+		return primitive.M(copySampleDoc(v))
+	case primitive.D:
+		out := make(primitive.D, len(v))
+		for i, e := range v {
+			out[i] = primitive.E{Key: e.Key, Value: copySampleValue(e.Value)}
+		}
+		return out
+	case primitive.A:
+		out := make(primitive.A, len(v))
+		for i, e := range v {
+			out[i] = copySampleValue(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = copySampleValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// sampleRing is a fixed-size, thread-safe buffer of the most recent
+// samples; see eventRing.
+type sampleRing struct {
+	mu      sync.Mutex
+	samples []HandlerSample
+	next    int
+	full    bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	if size <= 0 {
+		return nil
+	}
+	return &sampleRing{samples: make([]HandlerSample, size)}
+}
+
+func (r *sampleRing) add(s HandlerSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to n of the most recent samples, oldest first.
+func (r *sampleRing) last(n int) []HandlerSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := r.next
+	if r.full {
+		size = len(r.samples)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+
+	out := make([]HandlerSample, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.samples)
+	}
+	for i := range out {
+		out[i] = r.samples[(start+i)%len(r.samples)]
+	}
+	return out
+}
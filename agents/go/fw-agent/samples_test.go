@@ -0,0 +1,118 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHandlerSamplesRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SampleBufferSize = 8
+	poller := NewAgentPoller(cfg)
+	store := newFakeStore()
+	poller.ops = store
+
+	var seen interface{}
+	poller.Register("ns.Login", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"token": "secret-token", "user": params["user"]}, nil
+	})
+	poller.Register("ns.Bad", func(params map[string]interface{}) (map[string]interface{}, error) {
+		seen = params["password"]
+		return nil, errors.New("boom")
+	})
+	poller.SetSampleRedactor(func(facet string, values map[string]interface{}) {
+		for _, key := range []string{"password", "token"} {
+			if _, ok := values[key]; ok {
+				values[key] = "***"
+			}
+		}
+	})
+
+	ctx := context.Background()
+	store.addStep("step-1", map[string]interface{}{"user": "ada", "password": "hunter2"})
+	store.addTask(TaskDocument{UUID: "task-1", Name: "ns.Login", StepID: "step-1", TaskListName: "default"})
+	if err := poller.PollOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.addStep("step-2", map[string]interface{}{"password": "hunter2"})
+	store.addTask(TaskDocument{UUID: "task-2", Name: "ns.Bad", StepID: "step-2", TaskListName: "default"})
+	if err := poller.PollOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := poller.LastSamples(0)
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %+v", samples)
+	}
+	first := samples[0]
+	if first.TaskID != "task-1" || first.Facet != "ns.Login" || first.StepID != "step-1" {
+		t.Errorf("Unexpected sample identity: %+v", first)
+	}
+	if first.Params["user"] != "ada" || first.Params["password"] != "***" {
+		t.Errorf("Expected redacted params, got %+v", first.Params)
+	}
+	if _, ok := first.Params["_facet_name"]; ok {
+		t.Errorf("Expected only the step's own params, got %+v", first.Params)
+	}
+	if first.Result["user"] != "ada" || first.Result["token"] != "***" {
+		t.Errorf("Expected redacted result, got %+v", first.Result)
+	}
+	if got := store.returns["step-1"]["token"]; got != "secret-token" {
+		t.Errorf("Redaction must not touch the returned values, got %v", got)
+	}
+
+	if seen != "hunter2" {
+		t.Errorf("Redaction must not touch the handler's params, got %v", seen)
+	}
+	if samples[1].Error != "boom" || samples[1].Params["password"] != "***" {
+		t.Errorf("Expected redacted failure sample, got %+v", samples[1])
+	}
+
+	if last := poller.LastSamples(1); len(last) != 1 || last[0].TaskID != "task-2" {
+		t.Errorf("Expected the most recent sample only, got %+v", last)
+	}
+}
+
+func TestHandlerSamplesDisabledByDefault(t *testing.T) {
+	poller, store := newFakePoller()
+	poller.Register("ns.Ok", func(params map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+	runSingle(t, poller, store, "ns.Ok")
+
+	if samples := poller.LastSamples(10); samples != nil {
+		t.Errorf("Expected no samples when capture is disabled, got %+v", samples)
+	}
+}
+
+func TestCopySampleDocIsDeep(t *testing.T) {
+	orig := map[string]interface{}{
+		"creds": map[string]interface{}{"password": "hunter2"},
+		"list":  []interface{}{map[string]interface{}{"key": "k"}},
+	}
+	cp := copySampleDoc(orig)
+	cp["creds"].(map[string]interface{})["password"] = "***"
+	cp["list"].([]interface{})[0].(map[string]interface{})["key"] = "***"
+
+	if orig["creds"].(map[string]interface{})["password"] != "hunter2" {
+		t.Error("Nested document was shared with the copy")
+	}
+	if orig["list"].([]interface{})[0].(map[string]interface{})["key"] != "k" {
+		t.Error("Nested array was shared with the copy")
+	}
+}
@@ -17,6 +17,7 @@ package fwagent
 import (
 	"context"
 	"net"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -26,6 +27,16 @@ import (
 // ServerRegistration handles server lifecycle in MongoDB.
 type ServerRegistration struct {
 	db *mongo.Database
+
+	// RegisterHook, if set, is called with the server document just before
+	// Register upserts it, so integrators can add bespoke fields via Extra
+	// or adjust fields such as Topics. Identity and state fields are
+	// restored afterwards and cannot be changed by the hook.
+	RegisterHook func(doc *ServerDocument)
+
+	// HandlerMeta, if set, returns the metadata to publish for a handler
+	// name; handlers without any are listed by bare name.
+	HandlerMeta func(name string) (HandlerMeta, bool)
 }
 
 // NewServerRegistration creates a new ServerRegistration instance.
@@ -38,7 +49,68 @@ func (s *ServerRegistration) Register(ctx context.Context, serverID string, cfg
 	collection := s.db.Collection(CollectionServers)
 
 	now := NowMillis()
-	server := ServerDocument{
+	server := s.serverDocument(serverID, cfg, handlers, now)
+
+	// Carry lifecycle counters forward from the previous incarnation
+	prev, err := s.findPrevious(ctx, serverID, cfg)
+	if err != nil {
+		return err
+	}
+	carryForwardLifecycle(&server, prev)
+
+	if s.RegisterHook != nil {
+		s.RegisterHook(&server)
+		restoreMandatory(&server, serverID, cfg, handlerEntries(handlers, s.HandlerMeta), now)
+	}
+
+	opts := options.Update().SetUpsert(true)
+	_, err = collection.UpdateOne(
+		ctx,
+		bson.M{"uuid": serverID},
+		bson.M{"$set": server},
+		opts,
+	)
+	return err
+}
+
+// Republish updates the servers document of an already registered server
+// for a changed handler set: only topics, handlers and the fields a
+// RegisterHook adds are set. start_time, ping_time and the lifecycle
+// counters are left alone, so the running incarnation keeps its uptime.
+// A server without a document, e.g. one removed by hand, is registered
+// with Register instead.
+func (s *ServerRegistration) Republish(ctx context.Context, serverID string, cfg Config, handlers []string) error {
+	collection := s.db.Collection(CollectionServers)
+
+	now := NowMillis()
+	server := s.serverDocument(serverID, cfg, handlers, now)
+	if s.RegisterHook != nil {
+		s.RegisterHook(&server)
+		restoreMandatory(&server, serverID, cfg, handlerEntries(handlers, s.HandlerMeta), now)
+	}
+
+	set := bson.M{
+		"topics":   server.Topics,
+		"handlers": server.Handlers,
+	}
+	for key, value := range server.Extra {
+		set[key] = value
+	}
+
+	res, err := collection.UpdateOne(ctx, bson.M{"uuid": serverID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return s.Register(ctx, serverID, cfg, handlers)
+	}
+	return nil
+}
+
+// serverDocument returns the servers document of a server starting now
+// with handlers, before lifecycle counters and the RegisterHook apply.
+func (s *ServerRegistration) serverDocument(serverID string, cfg Config, handlers []string, now int64) ServerDocument {
+	return ServerDocument{
 		UUID:        serverID,
 		ServerGroup: cfg.ServerGroup,
 		ServiceName: cfg.ServiceName,
@@ -47,19 +119,70 @@ func (s *ServerRegistration) Register(ctx context.Context, serverID string, cfg
 		StartTime:   now,
 		PingTime:    now,
 		Topics:      handlers,
-		Handlers:    handlers,
+		Handlers:    handlerEntries(handlers, s.HandlerMeta),
 		Handled:     nil,
 		State:       ServerStateRunning,
 	}
+}
 
-	opts := options.Update().SetUpsert(true)
-	_, err := collection.UpdateOne(
-		ctx,
-		bson.M{"uuid": serverID},
-		bson.M{"$set": server},
-		opts,
-	)
-	return err
+// findPrevious returns the most recently started server document with the
+// same logical identity (server_group, service_name, server_name) but a
+// different uuid, or nil if this is the first registration.
+func (s *ServerRegistration) findPrevious(ctx context.Context, serverID string, cfg Config) (*ServerDocument, error) {
+	collection := s.db.Collection(CollectionServers)
+
+	filter := bson.M{
+		"server_group": cfg.ServerGroup,
+		"service_name": cfg.ServiceName,
+		"server_name":  cfg.ServerName,
+		"uuid":         bson.M{"$ne": serverID},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "start_time", Value: -1}})
+
+	var prev ServerDocument
+	err := collection.FindOne(ctx, filter, opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &prev, nil
+}
+
+// carryForwardLifecycle increments the restart counter and accumulates the
+// uptime of the previous incarnation (start_time to last ping_time).
+func carryForwardLifecycle(server *ServerDocument, prev *ServerDocument) {
+	if prev == nil {
+		return
+	}
+	server.RestartCount = prev.RestartCount + 1
+	server.PreviousStartTime = prev.StartTime
+	server.TotalUptimeMs = prev.TotalUptimeMs
+	if prev.PingTime > prev.StartTime {
+		server.TotalUptimeMs += prev.PingTime - prev.StartTime
+	}
+}
+
+// restoreMandatory re-sets the fields a RegisterHook must not change and
+// drops Extra keys that would shadow them.
+func restoreMandatory(server *ServerDocument, serverID string, cfg Config, handlers []HandlerEntry, now int64) {
+	server.UUID = serverID
+	server.ServerGroup = cfg.ServerGroup
+	server.ServiceName = cfg.ServiceName
+	server.ServerName = cfg.ServerName
+	server.StartTime = now
+	server.PingTime = now
+	server.Handlers = handlers
+	server.State = ServerStateRunning
+
+	for _, key := range []string{
+		"_id", "uuid", "server_group", "service_name", "server_name", "server_ips",
+		"start_time", "ping_time", "topics", "handlers", "handled", "state",
+		"restart_count", "previous_start_time", "total_uptime_ms",
+	} {
+		delete(server.Extra, key)
+	}
 }
 
 // Deregister marks a server as shutdown.
@@ -91,6 +214,37 @@ func (s *ServerRegistration) Heartbeat(ctx context.Context, serverID string) err
 	return err
 }
 
+// HeartbeatLoad updates the server's ping time like Heartbeat and records
+// load, the share of its concurrency slots in use, from 0 to 1.
+func (s *ServerRegistration) HeartbeatLoad(ctx context.Context, serverID string, load float64) error {
+	collection := s.db.Collection(CollectionServers)
+
+	update := bson.M{
+		"$set": bson.M{
+			"ping_time": NowMillis(),
+			"load":      load,
+		},
+	}
+
+	_, err := collection.UpdateOne(ctx, bson.M{"uuid": serverID}, update)
+	return err
+}
+
+// GroupAlive reports whether any server of group other than excludeID is
+// not shut down and has pinged within staleAfter.
+func (s *ServerRegistration) GroupAlive(ctx context.Context, group, excludeID string, staleAfter time.Duration) (bool, error) {
+	collection := s.db.Collection(CollectionServers)
+
+	filter := bson.M{
+		"server_group": group,
+		"uuid":         bson.M{"$ne": excludeID},
+		"state":        bson.M{"$ne": ServerStateShutdown},
+		"ping_time":    bson.M{"$gte": NowMillis() - staleAfter.Milliseconds()},
+	}
+	n, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
 func getLocalIPs() []string {
 	var ips []string
 	addrs, err := net.InterfaceAddrs()
@@ -0,0 +1,364 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// registeredServer decodes the $set document of the last upsert issued by
+// ServerRegistration.Register.
+func registeredServer(mt *mtest.T) ServerDocument {
+	var update *bson.Raw
+	for {
+		ev := mt.GetStartedEvent()
+		if ev == nil {
+			break
+		}
+		if ev.CommandName == "update" {
+			raw := ev.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$set").Document()
+			update = &raw
+		}
+	}
+	if update == nil {
+		mt.Fatal("Expected an update command")
+	}
+	var server ServerDocument
+	if err := bson.Unmarshal(*update, &server); err != nil {
+		mt.Fatalf("decode server: %v", err)
+	}
+	return server
+}
+
+func TestRegisterRestartCount(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("first registration", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+
+		reg := NewServerRegistration(mt.DB)
+		if err := reg.Register(context.Background(), "server-1", DefaultConfig(), nil); err != nil {
+			mt.Fatalf("Register: %v", err)
+		}
+
+		server := registeredServer(mt)
+		if server.RestartCount != 0 {
+			mt.Errorf("Expected restart_count 0, got %d", server.RestartCount)
+		}
+		if server.PreviousStartTime != 0 {
+			mt.Errorf("Expected no previous_start_time, got %d", server.PreviousStartTime)
+		}
+	})
+
+	mt.Run("re-registration increments", func(mt *mtest.T) {
+		prev := bson.D{
+			{Key: "uuid", Value: "server-0"},
+			{Key: "start_time", Value: int64(1000)},
+			{Key: "ping_time", Value: int64(5000)},
+			{Key: "restart_count", Value: 2},
+			{Key: "total_uptime_ms", Value: int64(100)},
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch, prev),
+			mtest.CreateSuccessResponse(),
+		)
+
+		reg := NewServerRegistration(mt.DB)
+		if err := reg.Register(context.Background(), "server-1", DefaultConfig(), nil); err != nil {
+			mt.Fatalf("Register: %v", err)
+		}
+
+		server := registeredServer(mt)
+		if server.RestartCount != 3 {
+			mt.Errorf("Expected restart_count 3, got %d", server.RestartCount)
+		}
+		if server.PreviousStartTime != 1000 {
+			mt.Errorf("Expected previous_start_time 1000, got %d", server.PreviousStartTime)
+		}
+		if server.TotalUptimeMs != 4100 {
+			mt.Errorf("Expected total_uptime_ms 4100, got %d", server.TotalUptimeMs)
+		}
+	})
+}
+
+func TestRegisterHook(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("custom fields persisted", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+
+		reg := NewServerRegistration(mt.DB)
+		reg.RegisterHook = func(doc *ServerDocument) {
+			doc.Extra = map[string]interface{}{
+				"datacenter":    "eu-west-1",
+				"deployment_id": "deploy-42",
+				"uuid":          "hijacked",
+			}
+			doc.Topics = append(doc.Topics, "custom.topic")
+			doc.UUID = ""
+			doc.State = ServerStateShutdown
+			doc.Handlers = nil
+		}
+		cfg := DefaultConfig()
+		if err := reg.Register(context.Background(), "server-1", cfg, []string{"ns.A"}); err != nil {
+			mt.Fatalf("Register: %v", err)
+		}
+
+		server := registeredServer(mt)
+		if server.Extra["datacenter"] != "eu-west-1" || server.Extra["deployment_id"] != "deploy-42" {
+			mt.Errorf("Expected custom fields persisted, got %v", server.Extra)
+		}
+		if len(server.Topics) != 2 || server.Topics[1] != "custom.topic" {
+			mt.Errorf("Expected hook topics persisted, got %v", server.Topics)
+		}
+		if server.UUID != "server-1" || server.State != ServerStateRunning {
+			mt.Errorf("Expected mandatory fields restored, got uuid=%q state=%q", server.UUID, server.State)
+		}
+		if len(server.Handlers) != 1 || server.Handlers[0].Name != "ns.A" {
+			mt.Errorf("Expected handlers restored, got %v", server.Handlers)
+		}
+		if server.ServerName != cfg.ServerName {
+			mt.Errorf("Expected server_name %q, got %q", cfg.ServerName, server.ServerName)
+		}
+	})
+}
+
+func TestReRegisterRefreshesDocument(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("changed label", func(mt *mtest.T) {
+		label := "blue"
+		poller := NewAgentPoller(DefaultConfig())
+		reg := NewServerRegistration(mt.DB)
+		reg.RegisterHook = func(doc *ServerDocument) {
+			doc.Extra = map[string]interface{}{"label": label}
+		}
+		poller.registration = reg
+
+		// No document yet: registered in full
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+		if err := poller.ReRegister(context.Background()); err != nil {
+			mt.Fatalf("ReRegister: %v", err)
+		}
+		server := registeredServer(mt)
+		if got := server.Extra["label"]; got != "blue" {
+			mt.Fatalf("Expected label blue, got %v", got)
+		}
+		if server.UUID != poller.serverID {
+			mt.Errorf("Expected same server uuid, got %q", server.UUID)
+		}
+
+		label = "green"
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		if err := poller.ReRegister(context.Background()); err != nil {
+			mt.Fatalf("ReRegister: %v", err)
+		}
+		update := mt.GetStartedEvent()
+		filter := update.Command.Lookup("updates", "0", "q").Document()
+		if got := filter.Lookup("uuid").StringValue(); got != poller.serverID {
+			mt.Errorf("Expected same server uuid, got %q", got)
+		}
+		set := update.Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("label").StringValue(); got != "green" {
+			mt.Errorf("Expected label green after ReRegister, got %v", got)
+		}
+		for _, key := range []string{"start_time", "restart_count", "previous_start_time", "total_uptime_ms"} {
+			if _, err := set.LookupErr(key); err == nil {
+				mt.Errorf("Expected %s to survive ReRegister, got it set", key)
+			}
+		}
+		if extra := mt.GetStartedEvent(); extra != nil {
+			mt.Errorf("Expected only the update, got %s", extra.CommandName)
+		}
+	})
+}
+
+func TestRepublish(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("keeps the lifecycle fields", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		reg := NewServerRegistration(mt.DB)
+		reg.RegisterHook = func(doc *ServerDocument) {
+			doc.Extra = map[string]interface{}{"label": "blue"}
+		}
+		if err := reg.Republish(context.Background(), "server-1", DefaultConfig(), []string{"ns.A", "ns.B"}); err != nil {
+			mt.Fatalf("Republish: %v", err)
+		}
+
+		update := mt.GetStartedEvent()
+		if update.CommandName != "update" {
+			mt.Fatalf("Expected a single update, got %s", update.CommandName)
+		}
+		set := update.Command.Lookup("updates", "0", "u", "$set").Document()
+		for _, key := range []string{"start_time", "ping_time", "restart_count", "previous_start_time", "total_uptime_ms", "state"} {
+			if _, err := set.LookupErr(key); err == nil {
+				mt.Errorf("Expected %s left alone, got it set", key)
+			}
+		}
+		if topics, _ := set.Lookup("topics").Array().Values(); len(topics) != 2 {
+			mt.Errorf("Expected topics updated, got %v", topics)
+		}
+		if got := set.Lookup("label").StringValue(); got != "blue" {
+			mt.Errorf("Expected the hook's label updated, got %q", got)
+		}
+		if extra := mt.GetStartedEvent(); extra != nil {
+			mt.Errorf("Expected no lookup of the previous incarnation, got %s", extra.CommandName)
+		}
+	})
+
+	mt.Run("registers a missing document", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+
+		reg := NewServerRegistration(mt.DB)
+		if err := reg.Republish(context.Background(), "server-1", DefaultConfig(), []string{"ns.A"}); err != nil {
+			mt.Fatalf("Republish: %v", err)
+		}
+		if server := registeredServer(mt); server.StartTime == 0 || server.State != ServerStateRunning {
+			mt.Errorf("Expected a full registration, got %+v", server)
+		}
+	})
+}
+
+func TestRegisterHandlerMeta(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("metadata persisted", func(mt *mtest.T) {
+		poller := NewAgentPoller(DefaultConfig())
+		poller.Register("ns.Plain", nil)
+		poller.RegisterWithMeta("ns.Geocode", nil, HandlerMeta{
+			Description: "Resolve an address",
+			Version:     "1.2.0",
+			Params:      map[string]string{"address": "String"},
+			Returns:     map[string]string{"lat": "Double", "lon": "Double"},
+		})
+
+		reg := NewServerRegistration(mt.DB)
+		reg.HandlerMeta = poller.handlerMeta
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+		if err := reg.Register(context.Background(), "server-1", DefaultConfig(), []string{"ns.Plain", "ns.Geocode"}); err != nil {
+			mt.Fatalf("Register: %v", err)
+		}
+
+		mt.GetStartedEvent() // find previous
+		set := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set").Document()
+		handlers := set.Lookup("handlers").Array()
+		if name, ok := handlers.Index(0).Value().StringValueOK(); !ok || name != "ns.Plain" {
+			mt.Errorf("Expected a bare name for a handler without meta, got %v", handlers.Index(0).Value())
+		}
+		doc, ok := handlers.Index(1).Value().DocumentOK()
+		if !ok {
+			mt.Fatalf("Expected a document for a handler with meta, got %v", handlers.Index(1).Value())
+		}
+		if doc.Lookup("name").StringValue() != "ns.Geocode" || doc.Lookup("version").StringValue() != "1.2.0" {
+			mt.Errorf("Unexpected handler document %v", doc)
+		}
+
+		var server ServerDocument
+		if err := bson.Unmarshal(set, &server); err != nil {
+			mt.Fatalf("decode server: %v", err)
+		}
+		if server.Handlers[0].Meta != nil || server.Handlers[1].Meta == nil ||
+			server.Handlers[1].Meta.Params["address"] != "String" || server.Handlers[1].Meta.Description != "Resolve an address" {
+			mt.Errorf("Expected metadata to round-trip, got %+v", server.Handlers)
+		}
+	})
+}
+
+func TestRegisterClearsHandlerMeta(t *testing.T) {
+	poller := NewAgentPoller(DefaultConfig())
+	poller.RegisterWithMeta("ns.F", nil, HandlerMeta{Version: "1"})
+	if meta, ok := poller.handlerMeta("ns.F"); !ok || meta.Version != "1" {
+		t.Fatalf("Expected metadata registered, got %+v", meta)
+	}
+	poller.Register("ns.F", nil)
+	if _, ok := poller.handlerMeta("ns.F"); ok {
+		t.Error("Expected Register without meta to clear it")
+	}
+}
+
+func TestHeartbeatLoad(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("ping carries load", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		reg := NewServerRegistration(mt.DB)
+		if err := reg.HeartbeatLoad(context.Background(), "server-1", 0.75); err != nil {
+			mt.Fatalf("HeartbeatLoad: %v", err)
+		}
+
+		set := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("load").Double(); got != 0.75 {
+			mt.Errorf("Expected load 0.75, got %v", got)
+		}
+		if set.Lookup("ping_time").Int64() == 0 {
+			mt.Error("Expected ping_time set")
+		}
+	})
+}
+
+func TestGroupAlive(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("counts recent pings of other servers", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.servers", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: int32(1)}}))
+
+		reg := NewServerRegistration(mt.DB)
+		before := NowMillis()
+		alive, err := reg.GroupAlive(context.Background(), "primary", "standby-1", time.Minute)
+		if err != nil {
+			mt.Fatalf("GroupAlive: %v", err)
+		}
+		if !alive {
+			mt.Error("Expected the group alive")
+		}
+
+		match := mt.GetStartedEvent().Command.Lookup("pipeline", "0", "$match").Document()
+		if got := match.Lookup("server_group").StringValue(); got != "primary" {
+			mt.Errorf("Expected server_group primary, got %q", got)
+		}
+		if got := match.Lookup("uuid", "$ne").StringValue(); got != "standby-1" {
+			mt.Errorf("Expected own server excluded, got %q", got)
+		}
+		if got := match.Lookup("ping_time", "$gte").Int64(); got < before-time.Minute.Milliseconds() {
+			mt.Errorf("Expected pings within a minute, got cutoff %d", got)
+		}
+	})
+}
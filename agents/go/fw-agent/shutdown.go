@@ -0,0 +1,60 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "time"
+
+// ShutdownReport summarizes what Stop did, for verifying clean shutdowns.
+// Every task in flight when Stop began is counted as exactly one of
+// Drained, Requeued or Abandoned.
+type ShutdownReport struct {
+	// InFlight is the number of tasks being processed when Stop began.
+	InFlight int
+
+	// Drained is how many of them finished normally during the drain.
+	Drained int
+
+	// Requeued is how many were handed back to pending under
+	// Config.RequeueOnShutdown.
+	Requeued int
+
+	// Abandoned is how many were left running: still in flight when the
+	// Stop deadline was reached, or whose requeue failed.
+	Abandoned int
+
+	// Deregistered reports whether the servers document was removed.
+	Deregistered bool
+
+	// Duration is how long Stop took.
+	Duration time.Duration
+}
+
+// LastShutdownReport returns the report of the most recent Stop, and false
+// if the poller has not been stopped.
+func (p *AgentPoller) LastShutdownReport() (ShutdownReport, bool) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	if p.shutdownReport == nil {
+		return ShutdownReport{}, false
+	}
+	return *p.shutdownReport, true
+}
+
+// inFlightCount returns the number of tasks currently being processed.
+func (p *AgentPoller) inFlightCount() int {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	return len(p.inFlightTasks)
+}
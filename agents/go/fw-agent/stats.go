@@ -0,0 +1,189 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time view of the poller's runtime state.
+type Stats struct {
+	// QueueDepth is the last sampled number of pending tasks this agent
+	// could claim. Only maintained when Config.QueueDepthInterval is set.
+	QueueDepth int64
+
+	// InFlight is the number of tasks currently being processed.
+	InFlight int
+
+	// Capacity is the maximum number of concurrent tasks (MaxConcurrent).
+	Capacity int
+
+	// Disabled lists the facets excluded from claiming via Disable.
+	Disabled []string
+
+	// PollPanics is the number of poll cycles that panicked and were
+	// recovered; see Config.RecoverPollPanics.
+	PollPanics int64
+}
+
+// Stats returns the poller's current runtime statistics.
+func (p *AgentPoller) Stats() Stats {
+	used, limit := p.slots.usage()
+	return Stats{
+		QueueDepth: atomic.LoadInt64(&p.queueDepth),
+		InFlight:   used,
+		Capacity:   limit,
+		Disabled:   p.DisabledFacets(),
+		PollPanics: atomic.LoadInt64(&p.counters.pollPanics),
+	}
+}
+
+// MetricsSnapshot holds the poller's cumulative counters and gauges as
+// plain values, for export to any metrics system.
+type MetricsSnapshot struct {
+	// Claimed is the number of tasks claimed.
+	Claimed int64
+
+	// Completed is the number of tasks completed successfully.
+	Completed int64
+
+	// Failed is the number of tasks marked failed, including NoHandler.
+	Failed int64
+
+	// NoHandler is the number of claimed tasks with no matching handler.
+	NoHandler int64
+
+	// CapacityExceeded is the number of claims skipped because every
+	// concurrency slot was busy.
+	CapacityExceeded int64
+
+	// InFlight is the number of tasks currently being processed.
+	InFlight int
+
+	// QueueDepth is the last sampled number of pending tasks this agent
+	// could claim; see Config.QueueDepthInterval.
+	QueueDepth int64
+
+	// InFlightByFacet is the number of tasks currently dispatched to each
+	// handler, keyed by the registered name they matched (e.g. a prefix
+	// pattern or short name, not the raw task name). Facets with nothing
+	// in flight are omitted.
+	InFlightByFacet map[string]int
+
+	// AvgHandlerDuration is the mean handler run time over all calls.
+	AvgHandlerDuration time.Duration
+}
+
+// pollerCounters are the counters behind Metrics. The int64 fields come
+// first so they stay 64-bit aligned for atomic access.
+type pollerCounters struct {
+	claimed          int64
+	completed        int64
+	failed           int64
+	ignored          int64
+	noHandler        int64
+	capacityExceeded int64
+	pollPanics       int64
+
+	// dispatched counts tasks handed to processTask and finished those for
+	// which it returned, for Config.MaxTasksBeforeExit.
+	dispatched int64
+	finished   int64
+
+	// The duration sum and count change together, under handlerMu.
+	handlerMu    sync.Mutex
+	handlerCalls int64
+	handlerTotal time.Duration
+
+	facetMu       sync.Mutex
+	facetInFlight map[string]int
+}
+
+// count bumps the counter for a recorded event kind.
+func (c *pollerCounters) count(kind string) {
+	switch kind {
+	case EventClaimed:
+		atomic.AddInt64(&c.claimed, 1)
+	case EventCompleted:
+		atomic.AddInt64(&c.completed, 1)
+	case EventFailed:
+		atomic.AddInt64(&c.failed, 1)
+	case EventIgnored:
+		atomic.AddInt64(&c.ignored, 1)
+	case EventSkipped:
+		atomic.AddInt64(&c.capacityExceeded, 1)
+	}
+}
+
+// observeHandler adds one handler run to the duration average.
+func (c *pollerCounters) observeHandler(d time.Duration) {
+	c.handlerMu.Lock()
+	c.handlerCalls++
+	c.handlerTotal += d
+	c.handlerMu.Unlock()
+}
+
+// facetStarted counts a task dispatched to the handler registered as facet.
+func (c *pollerCounters) facetStarted(facet string) {
+	c.facetMu.Lock()
+	defer c.facetMu.Unlock()
+	if c.facetInFlight == nil {
+		c.facetInFlight = make(map[string]int)
+	}
+	c.facetInFlight[facet]++
+}
+
+// facetDone undoes facetStarted once the task is finished.
+func (c *pollerCounters) facetDone(facet string) {
+	c.facetMu.Lock()
+	defer c.facetMu.Unlock()
+	if c.facetInFlight[facet]--; c.facetInFlight[facet] <= 0 {
+		delete(c.facetInFlight, facet)
+	}
+}
+
+// Metrics returns a snapshot of the poller's counters. Counters are read
+// atomically; the handler average is computed under a brief lock so its
+// sum and count always match.
+func (p *AgentPoller) Metrics() MetricsSnapshot {
+	c := &p.counters
+	m := MetricsSnapshot{
+		Claimed:          atomic.LoadInt64(&c.claimed),
+		Completed:        atomic.LoadInt64(&c.completed),
+		Failed:           atomic.LoadInt64(&c.failed),
+		NoHandler:        atomic.LoadInt64(&c.noHandler),
+		CapacityExceeded: atomic.LoadInt64(&c.capacityExceeded),
+		QueueDepth:       atomic.LoadInt64(&p.queueDepth),
+	}
+	c.handlerMu.Lock()
+	if c.handlerCalls > 0 {
+		m.AvgHandlerDuration = c.handlerTotal / time.Duration(c.handlerCalls)
+	}
+	c.handlerMu.Unlock()
+
+	c.facetMu.Lock()
+	m.InFlightByFacet = make(map[string]int, len(c.facetInFlight))
+	for facet, n := range c.facetInFlight {
+		m.InFlightByFacet[facet] = n
+	}
+	c.facetMu.Unlock()
+
+	p.inFlightMu.Lock()
+	m.InFlight = len(p.inFlightTasks)
+	p.inFlightMu.Unlock()
+	return m
+}
@@ -0,0 +1,102 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// taskStore is the set of persistence operations the poller relies on.
+// MongoOps is the production implementation; tests substitute a fake.
+type taskStore interface {
+	ClaimTask(ctx context.Context, taskNames []string, taskList string) (*TaskDocument, error)
+	CountPending(ctx context.Context, taskNames []string, taskList string) (int64, error)
+	HasPending(ctx context.Context, taskNames []string, taskList string) (bool, error)
+	ReadStepParams(ctx context.Context, stepID string) (map[string]interface{}, error)
+	StepNeedsResume(ctx context.Context, stepID string) (bool, error)
+	WriteStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) error
+	UpdateStepReturns(ctx context.Context, stepID string, partial map[string]interface{}) error
+	ReplaceStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) error
+	MarkStepCompleted(ctx context.Context, stepID string) error
+	CompleteWithReturns(ctx context.Context, task *TaskDocument, stepID string, returns map[string]interface{}) error
+	AdvanceStepState(ctx context.Context, stepID, state string) error
+	MarkTaskCompleted(ctx context.Context, task *TaskDocument) error
+	FlagCompletionFailed(ctx context.Context, task *TaskDocument, errorMsg string) error
+	MarkTaskFailed(ctx context.Context, task *TaskDocument, errorMsg string) error
+	MarkTaskFailedInfo(ctx context.Context, task *TaskDocument, info ErrorInfo) error
+	MarkTaskIgnored(ctx context.Context, task *TaskDocument) error
+	MarkTaskResumePending(ctx context.Context, task *TaskDocument, resumeTaskList, errorMsg string) error
+	ReleaseTask(ctx context.Context, task *TaskDocument) error
+	DeferTask(ctx context.Context, task *TaskDocument, delay time.Duration) error
+	RequeueTask(ctx context.Context, task *TaskDocument) error
+	RetryTask(ctx context.Context, task *TaskDocument, info ErrorInfo, delay time.Duration) error
+	RenewTaskLease(ctx context.Context, task *TaskDocument) error
+	CanceledTasks(ctx context.Context, uuids []string) (map[string]string, error)
+	ReclaimStaleTasks(ctx context.Context, taskNames []string, taskList string, staleAfter, grace time.Duration) (int, error)
+	InsertResumeTask(ctx context.Context, stepID, workflowID, taskList, facetName string) error
+	FindUnresumedSteps(ctx context.Context, taskNames []string, taskList string, limit int) ([]UnresumedStep, error)
+	InsertStepLog(ctx context.Context, stepID, workflowID, runnerID, facetName, source, level, message string)
+	AcquireLock(ctx context.Context, key string, ttl time.Duration) (string, error)
+	ReleaseLock(ctx context.Context, key, token string) error
+	RenewLock(ctx context.Context, key, token string, ttl time.Duration) error
+}
+
+// serverClock is implemented by stores whose timestamps can follow the
+// database server's clock; see MongoOps.UseServerTime.
+type serverClock interface {
+	SyncServerTime(ctx context.Context) error
+}
+
+// loadReporter is implemented by registries whose heartbeat can carry the
+// agent's load; see Config.AdaptiveHeartbeat.
+type loadReporter interface {
+	HeartbeatLoad(ctx context.Context, serverID string, load float64) error
+}
+
+// republisher is implemented by registries that can update the handlers of
+// a registered server without restarting its lifecycle; see
+// ServerRegistration.Republish.
+type republisher interface {
+	Republish(ctx context.Context, serverID string, cfg Config, handlers []string) error
+}
+
+// groupMonitor is implemented by registries that can tell whether another
+// server group is alive; see Config.FailoverForGroup.
+type groupMonitor interface {
+	GroupAlive(ctx context.Context, group, excludeID string, staleAfter time.Duration) (bool, error)
+}
+
+// auditWriter is implemented by stores that can append audit records; see
+// Config.AuditCollection.
+type auditWriter interface {
+	WriteAudit(ctx context.Context, record AuditRecord) error
+}
+
+// taskWatcher is implemented by stores that can stream task changes; see
+// Config.WatchMode.
+type taskWatcher interface {
+	WatchTasks(ctx context.Context, resumeAfter bson.Raw) (TaskChangeStream, error)
+}
+
+// serverRegistry is the set of server lifecycle operations the poller
+// relies on. ServerRegistration is the production implementation.
+type serverRegistry interface {
+	Register(ctx context.Context, serverID string, cfg Config, handlers []string) error
+	Deregister(ctx context.Context, serverID string) error
+	Heartbeat(ctx context.Context, serverID string) error
+}
@@ -0,0 +1,721 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// fakeStore is an in-memory taskStore used to exercise processTask
+// without a MongoDB server.
+type fakeStore struct {
+	mu sync.Mutex
+
+	tasks  map[string]*TaskDocument
+	params map[string]map[string]interface{}
+
+	returns    map[string]map[string]interface{}
+	stepStates map[string]string
+	resumes    []TaskDocument
+	failures   map[string]string
+	stacks     map[string]string
+	errorInfos map[string]ErrorInfo
+	logs       []string
+	locks      map[string]string // key -> token
+	nextToken  int
+	renewals   int
+
+	// lockRenewals counts RenewLock calls by key.
+	lockRenewals map[string]int
+
+	// completeErrs is consumed one entry per MarkTaskCompleted call.
+	completeErrs    []error
+	completionFlags map[string]string
+
+	// resumeErrs is consumed one entry per InsertResumeTask call;
+	// resumePending maps resume_pending tasks to their resume task list.
+	resumeErrs    []error
+	resumePending map[string]string
+
+	// stalePrecheck makes HasPending report nothing pending, as a lagging
+	// secondary would; claims counts ClaimTask calls.
+	stalePrecheck bool
+	claims        int
+
+	// claimPanics makes that many ClaimTask calls panic.
+	claimPanics int
+
+	// requireStep mirrors MongoOps.RequireStepMatch.
+	requireStep bool
+
+	// leafSteps holds the steps marked leaf, for StepNeedsResume.
+	leafSteps map[string]bool
+
+	// completions counts CompleteWithReturns calls.
+	completions int
+
+	audits []AuditRecord
+
+	// retries records the delay of each RetryTask call, by task.
+	retries map[string][]time.Duration
+
+	// claimed records the uuid of each task ClaimTask hands out.
+	claimed []string
+
+	// deferrals records the delay of each DeferTask call, by task.
+	deferrals map[string][]time.Duration
+
+	// busyWorkflows and busySteps mirror MongoOps.BusyWorkflows and
+	// BusySteps: ClaimTask skips their tasks.
+	busyWorkflows func() []string
+	busySteps     func() []string
+
+	// streams are handed out by WatchTasks in order; watchTokens records
+	// the resume token each was opened with.
+	streams     []*fakeChangeStream
+	watchTokens []bson.Raw
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		tasks:      make(map[string]*TaskDocument),
+		params:     make(map[string]map[string]interface{}),
+		returns:    make(map[string]map[string]interface{}),
+		stepStates: make(map[string]string),
+		failures:   make(map[string]string),
+		stacks:     make(map[string]string),
+		errorInfos: make(map[string]ErrorInfo),
+		locks:      make(map[string]string),
+		retries:    make(map[string][]time.Duration),
+		deferrals:  make(map[string][]time.Duration),
+
+		completionFlags: make(map[string]string),
+		resumePending:   make(map[string]string),
+		lockRenewals:    make(map[string]int),
+	}
+}
+
+// addStep seeds a step in EVENT_TRANSMIT with the given params.
+func (f *fakeStore) addStep(stepID string, params map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.params[stepID] = params
+	f.stepStates[stepID] = StepStateEventTransmit
+}
+
+// addTask seeds a pending task.
+func (f *fakeStore) addTask(task TaskDocument) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if task.State == "" {
+		task.State = TaskStatePending
+	}
+	f.tasks[task.UUID] = &task
+}
+
+func (f *fakeStore) taskState(uuid string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[uuid]; ok {
+		return t.State
+	}
+	return ""
+}
+
+func (f *fakeStore) ClaimTask(ctx context.Context, taskNames []string, taskList string) (*TaskDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.claims++
+	if f.claimPanics > 0 {
+		f.claimPanics--
+		panic("claim bug")
+	}
+	var busyWorkflows, busySteps []string
+	if f.busyWorkflows != nil {
+		busyWorkflows = f.busyWorkflows()
+	}
+	if f.busySteps != nil {
+		busySteps = f.busySteps()
+	}
+	for _, t := range f.tasks {
+		if t.State != TaskStatePending || t.TaskListName != taskList ||
+			containsString(busyWorkflows, t.WorkflowID) || containsString(busySteps, t.StepID) {
+			continue
+		}
+		for _, name := range taskNames {
+			if nameMatches(t.Name, name) {
+				t.State = TaskStateRunning
+				t.Attempts++
+				f.claimed = append(f.claimed, t.UUID)
+				claimed := *t
+				return &claimed, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// nameMatches mirrors the claim filter: exact names, or prefix patterns.
+func nameMatches(taskName, registered string) bool {
+	if prefix, ok := patternPrefix(registered); ok {
+		return strings.HasPrefix(taskName, prefix)
+	}
+	return taskName == registered
+}
+
+func (f *fakeStore) CountPending(ctx context.Context, taskNames []string, taskList string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, t := range f.tasks {
+		if t.State != TaskStatePending || t.TaskListName != taskList {
+			continue
+		}
+		for _, name := range taskNames {
+			if nameMatches(t.Name, name) {
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+func (f *fakeStore) HasPending(ctx context.Context, taskNames []string, taskList string) (bool, error) {
+	if f.stalePrecheck {
+		return false, nil
+	}
+	n, err := f.CountPending(ctx, taskNames, taskList)
+	return n > 0, err
+}
+
+func (f *fakeStore) ReadStepParams(ctx context.Context, stepID string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if state, ok := f.stepStates[stepID]; ok && state != StepStateEventTransmit {
+		return nil, fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+	result := make(map[string]interface{})
+	for k, v := range f.params[stepID] {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (f *fakeStore) ReplaceStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) error {
+	if err := f.checkWritable(stepID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	delete(f.returns, stepID)
+	f.mu.Unlock()
+	return f.UpdateStepReturns(ctx, stepID, returns)
+}
+
+func (f *fakeStore) WriteStepReturns(ctx context.Context, stepID string, returns map[string]interface{}) error {
+	if err := f.checkWritable(stepID); err != nil {
+		return err
+	}
+	return f.UpdateStepReturns(ctx, stepID, returns)
+}
+
+// checkWritable fails like MongoOps with RequireStepMatch for a step that
+// is not awaiting returns.
+func (f *fakeStore) checkWritable(stepID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.requireStep && f.stepStates[stepID] != StepStateEventTransmit {
+		return fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+	return nil
+}
+
+func (f *fakeStore) WriteAudit(ctx context.Context, record AuditRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audits = append(f.audits, record)
+	return nil
+}
+
+func (f *fakeStore) WatchTasks(ctx context.Context, resumeAfter bson.Raw) (TaskChangeStream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watchTokens = append(f.watchTokens, resumeAfter)
+	if len(f.streams) == 0 {
+		return nil, errors.New("no change stream")
+	}
+	stream := f.streams[0]
+	f.streams = f.streams[1:]
+	return stream, nil
+}
+
+// fakeChangeStream is a TaskChangeStream fed by the test through changes;
+// closing changes ends the stream.
+type fakeChangeStream struct {
+	changes chan TaskChange
+}
+
+func newFakeChangeStream() *fakeChangeStream {
+	return &fakeChangeStream{changes: make(chan TaskChange)}
+}
+
+func (s *fakeChangeStream) Next(ctx context.Context) (TaskChange, error) {
+	select {
+	case change, ok := <-s.changes:
+		if !ok {
+			return TaskChange{}, errChangeStreamEnded
+		}
+		return change, nil
+	case <-ctx.Done():
+		return TaskChange{}, ctx.Err()
+	}
+}
+
+func (s *fakeChangeStream) Close(ctx context.Context) error {
+	return nil
+}
+
+// removeStep deletes a step, as a concurrent cleanup would.
+func (f *fakeStore) removeStep(stepID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.params, stepID)
+	delete(f.stepStates, stepID)
+}
+
+func (f *fakeStore) UpdateStepReturns(ctx context.Context, stepID string, partial map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.returns[stepID] == nil {
+		f.returns[stepID] = make(map[string]interface{})
+	}
+	for k, v := range partial {
+		f.returns[stepID][k] = v
+	}
+	return nil
+}
+
+func (f *fakeStore) StepNeedsResume(ctx context.Context, stepID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.stepStates[stepID]; !ok {
+		return false, &NotFoundError{Kind: "step", UUID: stepID}
+	}
+	return !f.leafSteps[stepID], nil
+}
+
+func (f *fakeStore) MarkStepCompleted(ctx context.Context, stepID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stepStates[stepID] = StepStateCompleted
+	return nil
+}
+
+func (f *fakeStore) CompleteWithReturns(ctx context.Context, task *TaskDocument, stepID string, returns map[string]interface{}) error {
+	f.mu.Lock()
+	f.completions++
+	if f.stepStates[stepID] != StepStateEventTransmit {
+		f.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrStepNotWritable, stepID)
+	}
+	f.stepStates[stepID] = StepStateCompleted
+	f.mu.Unlock()
+
+	if err := f.UpdateStepReturns(ctx, stepID, returns); err != nil {
+		return err
+	}
+	if err := f.MarkTaskCompleted(ctx, task); err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskNotCompleted, err)
+	}
+	return nil
+}
+
+func (f *fakeStore) AdvanceStepState(ctx context.Context, stepID, state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stepStates[stepID] == StepStateEventTransmit {
+		f.stepStates[stepID] = state
+	}
+	return nil
+}
+
+func (f *fakeStore) MarkTaskCompleted(ctx context.Context, task *TaskDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.completeErrs) > 0 {
+		err := f.completeErrs[0]
+		f.completeErrs = f.completeErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	if t, ok := f.tasks[task.UUID]; ok {
+		t.State = TaskStateCompleted
+	}
+	return nil
+}
+
+func (f *fakeStore) FlagCompletionFailed(ctx context.Context, task *TaskDocument, errorMsg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completionFlags[task.UUID] = errorMsg
+	return nil
+}
+
+func (f *fakeStore) MarkTaskResumePending(ctx context.Context, task *TaskDocument, resumeTaskList, errorMsg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok {
+		t.State = TaskStateResumePending
+	}
+	f.resumePending[task.UUID] = resumeTaskList
+	return nil
+}
+
+func (f *fakeStore) FindUnresumedSteps(ctx context.Context, taskNames []string, taskList string, limit int) ([]UnresumedStep, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resumed := make(map[string]bool)
+	for _, r := range f.resumes {
+		resumed[r.StepID] = true
+	}
+	var steps []UnresumedStep
+	examined := 0
+	// resume_pending tasks are examined first, as by MongoOps
+	for _, state := range []string{TaskStateResumePending, TaskStateCompleted} {
+		for _, t := range f.tasks {
+			if t.State != state || t.TaskListName != taskList || !containsString(taskNames, t.Name) {
+				continue
+			}
+			if limit > 0 && examined >= limit {
+				return steps, nil
+			}
+			examined++
+			if resumed[t.StepID] {
+				continue
+			}
+			step := UnresumedStep{StepID: t.StepID, WorkflowID: t.WorkflowID, FacetName: t.Name, TaskUUID: t.UUID, TaskList: t.TaskListName}
+			if state == TaskStateResumePending {
+				step.ResumePending = true
+				step.TaskList = f.resumePending[t.UUID]
+			} else if f.stepStates[t.StepID] != StepStateEventTransmit {
+				continue
+			}
+			resumed[t.StepID] = true
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+func (f *fakeStore) MarkTaskFailed(ctx context.Context, task *TaskDocument, errorMsg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok {
+		t.State = TaskStateFailed
+	}
+	f.failures[task.UUID] = errorMsg
+	return nil
+}
+
+func (f *fakeStore) MarkTaskFailedInfo(ctx context.Context, task *TaskDocument, info ErrorInfo) error {
+	f.MarkTaskFailed(ctx, task, info.Message)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stacks[task.UUID] = info.Stack
+	f.errorInfos[task.UUID] = info
+	return nil
+}
+
+func (f *fakeStore) MarkTaskIgnored(ctx context.Context, task *TaskDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok {
+		t.State = TaskStateIgnored
+	}
+	return nil
+}
+
+func (f *fakeStore) ReleaseTask(ctx context.Context, task *TaskDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok && t.State == TaskStateRunning {
+		t.State = TaskStatePending
+		t.Attempts--
+	}
+	return nil
+}
+
+func (f *fakeStore) DeferTask(ctx context.Context, task *TaskDocument, delay time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok && t.State == TaskStateRunning {
+		t.State = TaskStatePending
+		t.Attempts--
+	}
+	f.deferrals[task.UUID] = append(f.deferrals[task.UUID], delay)
+	return nil
+}
+
+func (f *fakeStore) RequeueTask(ctx context.Context, task *TaskDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok && t.State == TaskStateRunning {
+		t.State = TaskStatePending
+		t.Attempts--
+		t.RunnerID = ""
+	}
+	return nil
+}
+
+func (f *fakeStore) RetryTask(ctx context.Context, task *TaskDocument, info ErrorInfo, delay time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tasks[task.UUID]; ok && t.State == TaskStateRunning {
+		t.State = TaskStatePending
+	}
+	f.errorInfos[task.UUID] = info
+	f.retries[task.UUID] = append(f.retries[task.UUID], delay)
+	return nil
+}
+
+// CanceledTasks reads reasons from data.cancel_reason; see cancelTask.
+func (f *fakeStore) CanceledTasks(ctx context.Context, uuids []string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	canceled := make(map[string]string)
+	for _, id := range uuids {
+		if t, ok := f.tasks[id]; ok && t.State == TaskStateCanceled {
+			reason, _ := t.Data[CancelReasonField].(string)
+			canceled[id] = reason
+		}
+	}
+	return canceled, nil
+}
+
+// cancelTask cancels a task externally, as the engine would, with reason.
+func (f *fakeStore) cancelTask(uuid, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.tasks[uuid]
+	t.State = TaskStateCanceled
+	t.Data = map[string]interface{}{CancelReasonField: reason}
+}
+
+func (f *fakeStore) RenewTaskLease(ctx context.Context, task *TaskDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renewals++
+	if t, ok := f.tasks[task.UUID]; ok && t.State == TaskStateRunning {
+		t.Updated = NowMillis()
+	}
+	return nil
+}
+
+func (f *fakeStore) ReclaimStaleTasks(ctx context.Context, taskNames []string, taskList string, staleAfter, grace time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cutoff := NowMillis() - staleAfter.Milliseconds()
+	n := 0
+	for _, t := range f.tasks {
+		if t.State != TaskStateRunning || t.TaskListName != taskList || t.Updated >= cutoff {
+			continue
+		}
+		for _, name := range taskNames {
+			if nameMatches(t.Name, name) {
+				t.State = TaskStatePending
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+func (f *fakeStore) AcquireLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, held := f.locks[key]; held {
+		return "", ErrLockHeld
+	}
+	f.nextToken++
+	token := fmt.Sprintf("token-%d", f.nextToken)
+	f.locks[key] = token
+	return token, nil
+}
+
+func (f *fakeStore) ReleaseLock(ctx context.Context, key, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locks[key] != token {
+		return ErrLockNotHeld
+	}
+	delete(f.locks, key)
+	return nil
+}
+
+func (f *fakeStore) RenewLock(ctx context.Context, key, token string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locks[key] != token {
+		return ErrLockNotHeld
+	}
+	f.lockRenewals[key]++
+	return nil
+}
+
+func (f *fakeStore) InsertResumeTask(ctx context.Context, stepID, workflowID, taskList, facetName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.resumeErrs) > 0 {
+		err := f.resumeErrs[0]
+		f.resumeErrs = f.resumeErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	f.resumes = append(f.resumes, TaskDocument{
+		Name:         ResumeTaskName + ":" + facetName,
+		StepID:       stepID,
+		WorkflowID:   workflowID,
+		TaskListName: taskList,
+		State:        TaskStatePending,
+	})
+	return nil
+}
+
+func (f *fakeStore) InsertStepLog(ctx context.Context, stepID, workflowID, runnerID, facetName, source, level, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs = append(f.logs, message)
+}
+
+// newFakePoller returns a poller wired to a fresh fakeStore.
+func newFakePoller() (*AgentPoller, *fakeStore) {
+	store := newFakeStore()
+	poller := NewAgentPoller(DefaultConfig())
+	poller.ops = store
+	store.busyWorkflows = poller.busyWorkflows
+	store.busySteps = poller.busySteps
+	return poller, store
+}
+
+// fakeRegistry is an in-memory serverRegistry. heartbeatErrs is consumed
+// one entry per Heartbeat call, letting tests script transient failures.
+type fakeRegistry struct {
+	mu sync.Mutex
+
+	registered    map[string][]string
+	republished   int // Republish calls
+	deregistered  map[string]bool
+	heartbeats    int
+	heartbeatErrs []error
+	loads         []float64        // one per HeartbeatLoad call
+	groupPings    map[string]int64 // latest ping per server group
+
+	// blockRegister makes Register hang until its context ends.
+	blockRegister bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		registered:   make(map[string][]string),
+		deregistered: make(map[string]bool),
+		groupPings:   make(map[string]int64),
+	}
+}
+
+func (f *fakeRegistry) Register(ctx context.Context, serverID string, cfg Config, handlers []string) error {
+	if f.blockRegister {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registered[serverID] = handlers
+	return nil
+}
+
+func (f *fakeRegistry) Republish(ctx context.Context, serverID string, cfg Config, handlers []string) error {
+	f.mu.Lock()
+	f.republished++
+	f.mu.Unlock()
+	return f.Register(ctx, serverID, cfg, handlers)
+}
+
+func (f *fakeRegistry) Deregister(ctx context.Context, serverID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deregistered[serverID] = true
+	return nil
+}
+
+func (f *fakeRegistry) HeartbeatLoad(ctx context.Context, serverID string, load float64) error {
+	f.mu.Lock()
+	f.loads = append(f.loads, load)
+	f.mu.Unlock()
+	return f.Heartbeat(ctx, serverID)
+}
+
+func (f *fakeRegistry) GroupAlive(ctx context.Context, group, excludeID string, staleAfter time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ping, ok := f.groupPings[group]
+	return ok && ping >= NowMillis()-staleAfter.Milliseconds(), nil
+}
+
+func (f *fakeRegistry) Heartbeat(ctx context.Context, serverID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heartbeats++
+	if len(f.heartbeatErrs) > 0 {
+		err := f.heartbeatErrs[0]
+		f.heartbeatErrs = f.heartbeatErrs[1:]
+		return err
+	}
+	return nil
+}
+
+// countTasks returns how many seeded tasks are in the given state.
+func (f *fakeStore) countTasks(state string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, t := range f.tasks {
+		if t.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor polls cond until it returns true or the timeout elapses.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,88 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrTaskNameRequired is returned by SubmitTask for a TaskSpec without a
+// Name.
+var ErrTaskNameRequired = errors.New("task name is required")
+
+// TaskSpec describes a task for SubmitTask. Only Name is required.
+type TaskSpec struct {
+	// UUID identifies the task. Empty means a generated one.
+	UUID string
+
+	// Name is the facet or system task name agents claim the task for.
+	Name string
+
+	// TaskListName is the task list to submit to. Empty means "default".
+	TaskListName string
+
+	WorkflowID string
+	FlowID     string
+	StepID     string
+	DataType   string
+	Data       map[string]interface{}
+}
+
+// SubmitTask inserts a pending task built from spec and returns its uuid,
+// for tests and for agents that enqueue follow-up work without writing the
+// task document by hand. created and updated are set to the current time
+// and the task has no runner, so any agent serving its name and task list
+// may claim it.
+func (m *MongoOps) SubmitTask(ctx context.Context, spec TaskSpec) (string, error) {
+	if spec.Name == "" {
+		return "", ErrTaskNameRequired
+	}
+	id := spec.UUID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	taskList := spec.TaskListName
+	if taskList == "" {
+		taskList = "default"
+	}
+
+	now := m.nowMillis()
+	task := TaskDocument{
+		UUID:         id,
+		Name:         spec.Name,
+		WorkflowID:   spec.WorkflowID,
+		FlowID:       spec.FlowID,
+		StepID:       spec.StepID,
+		State:        TaskStatePending,
+		Created:      now,
+		Updated:      now,
+		TaskListName: taskList,
+		DataType:     spec.DataType,
+		Data:         spec.Data,
+	}
+
+	// Not retried, as a retry could insert the task twice; see retry
+	doc, err := m.encode(task)
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.collection(CollectionTasks).InsertOne(ctx, doc); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// UnresumedStep is a step whose handler task finished but which has no
+// resume task; see MongoOps.FindUnresumedSteps.
+type UnresumedStep struct {
+	StepID     string
+	WorkflowID string
+	FacetName  string
+
+	// TaskUUID is the handler task; ResumePending is true if it was left
+	// resume_pending rather than completed.
+	TaskUUID      string
+	ResumePending bool
+
+	// TaskList is the list the resume task belongs on.
+	TaskList string
+}
+
+// resumeSweepLockKey is the locks collection key serializing sweeps of a
+// task list across agents.
+func resumeSweepLockKey(taskList string) string {
+	return "resume-sweep:" + taskList
+}
+
+// resumeSweepLoop periodically inserts the missing resume tasks of steps
+// this agent's handlers finished; see Config.EnableResumeSweeper.
+func (p *AgentPoller) resumeSweepLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.ResumeSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweepResumes(ctx)
+		}
+	}
+}
+
+// sweepResumes runs one sweep over this agent's handlers and task lists,
+// returning how many resume tasks it inserted. A list another agent is
+// sweeping is skipped.
+func (p *AgentPoller) sweepResumes(ctx context.Context) int {
+	handlers := p.EffectiveHandlers()
+	if len(handlers) == 0 {
+		return 0
+	}
+
+	inserted := 0
+	for _, list := range p.taskLists() {
+		token, err := p.ops.AcquireLock(ctx, resumeSweepLockKey(list), p.cfg.ResumeSweepInterval)
+		if errors.Is(err, ErrLockHeld) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error locking resume sweep of %s: %v", list, err)
+			return inserted
+		}
+		inserted += p.sweepResumeList(ctx, handlers, list)
+		if err := p.ops.ReleaseLock(ctx, resumeSweepLockKey(list), token); err != nil {
+			log.Printf("Failed to release resume sweep lock of %s: %v", list, err)
+		}
+	}
+	return inserted
+}
+
+// sweepResumeList inserts the missing resume tasks for one task list and
+// completes the resume_pending tasks they belong to.
+func (p *AgentPoller) sweepResumeList(ctx context.Context, handlers []string, list string) int {
+	steps, err := p.ops.FindUnresumedSteps(ctx, handlers, list, p.cfg.ResumeSweepLimit)
+	if err != nil {
+		log.Printf("Error finding unresumed steps: %v", err)
+		return 0
+	}
+
+	inserted := 0
+	for _, step := range steps {
+		if err := p.ops.InsertResumeTask(ctx, step.StepID, step.WorkflowID, step.TaskList, step.FacetName); err != nil {
+			log.Printf("Failed to insert missing resume task for step %s: %v", step.StepID, err)
+			continue
+		}
+		inserted++
+		if step.ResumePending {
+			if err := p.ops.MarkTaskCompleted(ctx, &TaskDocument{UUID: step.TaskUUID}); err != nil {
+				log.Printf("Failed to mark task %s completed: %v", step.TaskUUID, err)
+			}
+		}
+	}
+	if inserted > 0 {
+		log.Printf("Inserted %d missing resume task(s) on %s", inserted, list)
+	}
+	return inserted
+}
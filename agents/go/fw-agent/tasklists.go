@@ -0,0 +1,111 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// taskLists returns the task lists this agent serves: TaskList first, then
+// TaskLists, without duplicates.
+func (p *AgentPoller) taskLists() []string {
+	lists := []string{p.cfg.TaskList}
+	seen := map[string]bool{p.cfg.TaskList: true}
+	for _, list := range p.cfg.TaskLists {
+		if list == "" || seen[list] {
+			continue
+		}
+		seen[list] = true
+		lists = append(lists, list)
+	}
+	return lists
+}
+
+// claimOrder returns the served task lists rotated by one position per
+// call, so no list is always tried first.
+func (p *AgentPoller) claimOrder() []string {
+	lists := p.taskLists()
+	if len(lists) == 1 {
+		return lists
+	}
+	start := int(atomic.AddUint32(&p.listTurn, 1)-1) % len(lists)
+	return append(lists[start:], lists[:start]...)
+}
+
+// newListSems builds a semaphore for each task list with a positive cap in
+// limits.
+func newListSems(limits map[string]int) map[string]chan struct{} {
+	sems := make(map[string]chan struct{})
+	for list, n := range limits {
+		if n > 0 {
+			sems[list] = make(chan struct{}, n)
+		}
+	}
+	return sems
+}
+
+// listHasCapacity reports whether list is below its TaskListConcurrency
+// cap. Lists without a cap always have capacity.
+func (p *AgentPoller) listHasCapacity(list string) bool {
+	sem := p.listSems[list]
+	return sem == nil || len(sem) < cap(sem)
+}
+
+// acquireListSlot takes a slot from list's semaphore without blocking. The
+// returned func gives the slot back; ok is false if the list is at its cap.
+func (p *AgentPoller) acquireListSlot(list string) (release func(), ok bool) {
+	sem := p.listSems[list]
+	if sem == nil {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
+
+// claimFromLists claims a task from the first served list, in claimOrder,
+// that has capacity and pending work.
+func (p *AgentPoller) claimFromLists(ctx context.Context, handlers []string) *TaskDocument {
+	for _, list := range p.claimOrder() {
+		if !p.listHasCapacity(list) {
+			continue
+		}
+
+		// Skip the claim's primary write when a secondary sees no work
+		if p.cfg.UseSecondaryPrecheck {
+			pending, err := p.ops.HasPending(ctx, handlers, list)
+			if err != nil {
+				log.Printf("Claim pre-check failed, claiming anyway: %v", err)
+			} else if !pending {
+				continue
+			}
+		}
+
+		task, err := p.ops.ClaimTask(ctx, handlers, list)
+		if err != nil {
+			log.Printf("Error claiming task: %v", err)
+			continue
+		}
+		if task != nil {
+			return task
+		}
+	}
+	return nil
+}
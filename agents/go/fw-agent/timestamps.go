@@ -0,0 +1,144 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TimestampUnit is how a deployment stores the created and updated fields
+// of task documents.
+type TimestampUnit string
+
+const (
+	// TimestampMillis stores milliseconds since the Unix epoch as an
+	// integer, as NowMillis does. It is the default.
+	TimestampMillis TimestampUnit = "millis"
+
+	// TimestampSeconds stores seconds since the Unix epoch as an integer.
+	TimestampSeconds TimestampUnit = "seconds"
+
+	// TimestampDate stores a BSON date.
+	TimestampDate TimestampUnit = "date"
+)
+
+// timestampFields are the canonical task fields held in TimestampUnit.
+var timestampFields = []string{"created", "updated"}
+
+// storesMillis reports whether timestamps need no conversion.
+func (m *MongoOps) storesMillis() bool {
+	return m.TimestampUnit == "" || m.TimestampUnit == TimestampMillis
+}
+
+// timestamp returns ms, milliseconds since the epoch, in the stored unit.
+func (m *MongoOps) timestamp(ms int64) interface{} {
+	switch m.TimestampUnit {
+	case TimestampSeconds:
+		return ms / 1000
+	case TimestampDate:
+		return primitive.DateTime(ms)
+	default:
+		return ms
+	}
+}
+
+// now returns the current time in the stored unit.
+func (m *MongoOps) now() interface{} {
+	return m.timestamp(m.nowMillis())
+}
+
+// nowMillis returns the current time in milliseconds since the epoch, on
+// the server's clock when UseServerTime is set.
+func (m *MongoOps) nowMillis() int64 {
+	if !m.UseServerTime {
+		return NowMillis()
+	}
+	return NowMillis() + atomic.LoadInt64(&m.clockOffset)
+}
+
+// SyncServerTime measures the offset between the MongoDB server's clock
+// and the local one, as used by UseServerTime. The server's localTime is
+// taken to be read halfway through the round trip. Call it on connect and
+// periodically thereafter to follow drift.
+func (m *MongoOps) SyncServerTime(ctx context.Context) error {
+	var reply struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	sent := time.Now()
+	if err := m.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply); err != nil {
+		return err
+	}
+	local := sent.Add(time.Since(sent) / 2)
+	atomic.StoreInt64(&m.clockOffset, reply.LocalTime.Sub(local).Milliseconds())
+	return nil
+}
+
+// timestampMillis converts a stored timestamp to milliseconds since the
+// epoch. Values not in the configured unit are reported as not ok.
+func (m *MongoOps) timestampMillis(v bson.RawValue) (int64, bool) {
+	switch m.TimestampUnit {
+	case TimestampSeconds:
+		if s, ok := v.AsInt64OK(); ok {
+			return s * 1000, true
+		}
+	case TimestampDate:
+		if v.Type == bsontype.DateTime {
+			return v.DateTime(), true
+		}
+	default:
+		return v.AsInt64OK()
+	}
+	return 0, false
+}
+
+// convertTimestamps re-encodes raw with its canonical timestamp fields
+// converted to milliseconds (toStored false) or to the stored unit
+// (toStored true), so TaskDocument always holds milliseconds.
+func (m *MongoOps) convertTimestamps(raw bson.Raw, toStored bool) ([]byte, error) {
+	elems, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	out := make(bson.D, 0, len(elems))
+	for _, e := range elems {
+		var value interface{} = e.Value()
+		if isTimestampField(e.Key()) {
+			if toStored {
+				if ms, ok := e.Value().AsInt64OK(); ok {
+					value = m.timestamp(ms)
+				}
+			} else if ms, ok := m.timestampMillis(e.Value()); ok {
+				value = ms
+			}
+		}
+		out = append(out, bson.E{Key: e.Key(), Value: value})
+	}
+	return bson.Marshal(out)
+}
+
+func isTimestampField(key string) bool {
+	for _, f := range timestampFields {
+		if key == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import "context"
+
+// Reserved step params carrying W3C trace context. A workflow that wants
+// its handlers' spans linked to its own sets them on the step as strings;
+// processTask removes them from the handler's params and exposes them
+// through TraceContextFromContext instead.
+const (
+	TraceParentParam = "_traceparent"
+	TraceStateParam  = "_tracestate"
+	BaggageParam     = "_baggage"
+)
+
+// TraceContext is the W3C trace context read from a step's reserved params.
+// Its Get, Set and Keys methods use the HTTP header names (traceparent,
+// tracestate, baggage), so it can be passed directly as a carrier to an
+// OpenTelemetry TextMapPropagator:
+//
+//	tc, _ := fwagent.TraceContextFromContext(ctx)
+//	ctx = otel.GetTextMapPropagator().Extract(ctx, &tc)
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+	Baggage     string
+}
+
+// traceHeaders maps each header name to its reserved param.
+var traceHeaders = []struct{ header, param string }{
+	{"traceparent", TraceParentParam},
+	{"tracestate", TraceStateParam},
+	{"baggage", BaggageParam},
+}
+
+// field returns the TraceContext field holding header, or nil.
+func (tc *TraceContext) field(header string) *string {
+	switch header {
+	case "traceparent":
+		return &tc.TraceParent
+	case "tracestate":
+		return &tc.TraceState
+	case "baggage":
+		return &tc.Baggage
+	}
+	return nil
+}
+
+// Get returns the value of header, or "" if unset or unknown.
+func (tc *TraceContext) Get(header string) string {
+	if f := tc.field(header); f != nil {
+		return *f
+	}
+	return ""
+}
+
+// Set stores value under header; unknown headers are ignored.
+func (tc *TraceContext) Set(header, value string) {
+	if f := tc.field(header); f != nil {
+		*f = value
+	}
+}
+
+// Keys returns the names of the headers that are set.
+func (tc *TraceContext) Keys() []string {
+	var keys []string
+	for _, h := range traceHeaders {
+		if tc.Get(h.header) != "" {
+			keys = append(keys, h.header)
+		}
+	}
+	return keys
+}
+
+type traceContextKey struct{}
+
+// TraceContextFromContext returns the trace context of the step being
+// processed. ok is false if the step carried no trace params.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// withTraceContext returns a child context carrying tc.
+func withTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// takeTraceContext removes the reserved trace params from params and
+// returns their string values. ok is false if none was a non-empty string.
+func takeTraceContext(params map[string]interface{}) (tc TraceContext, ok bool) {
+	for _, h := range traceHeaders {
+		v, present := params[h.param]
+		if !present {
+			continue
+		}
+		delete(params, h.param)
+		if s, isString := v.(string); isString && s != "" {
+			tc.Set(h.header, s)
+			ok = true
+		}
+	}
+	return tc, ok
+}
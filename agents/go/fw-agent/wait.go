@@ -0,0 +1,100 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// waitPollInterval is how often WaitForTaskState re-reads the task when
+// no change stream is available.
+var waitPollInterval = 100 * time.Millisecond
+
+// WaitForTaskState blocks until the task with uuid is in one of states and
+// returns it, or until ctx ends. It follows the tasks collection with a
+// change stream where the deployment supports one (replica sets, sharded
+// clusters) and otherwise re-reads the task every waitPollInterval. A task
+// that does not exist yet is waited for like any other.
+func (m *MongoOps) WaitForTaskState(ctx context.Context, uuid string, states []string) (*TaskDocument, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"fullDocument." + m.path("uuid"): uuid}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	stream, err := m.collection(CollectionTasks).Watch(ctx, pipeline, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return m.pollTaskState(ctx, uuid, states)
+	}
+	defer stream.Close(context.Background())
+
+	// The task is checked only once the stream is open, and again after
+	// every change to it, so no transition is missed
+	for {
+		task, err := m.taskInState(ctx, uuid, states)
+		if task != nil || err != nil {
+			return task, err
+		}
+		if !stream.Next(ctx) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// The stream ended, e.g. it was invalidated; keep waiting
+			return m.pollTaskState(ctx, uuid, states)
+		}
+	}
+}
+
+// pollTaskState is WaitForTaskState without a change stream.
+func (m *MongoOps) pollTaskState(ctx context.Context, uuid string, states []string) (*TaskDocument, error) {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		task, err := m.taskInState(ctx, uuid, states)
+		if task != nil || err != nil {
+			return task, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// taskInState returns the task with uuid if it exists and is in one of
+// states, and nil otherwise.
+func (m *MongoOps) taskInState(ctx context.Context, uuid string, states []string) (*TaskDocument, error) {
+	task, err := m.GetTask(ctx, uuid)
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if task.State == state {
+			return task, nil
+		}
+	}
+	return nil, nil
+}
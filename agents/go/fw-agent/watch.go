@@ -0,0 +1,203 @@
+// Copyright 2025 Ralph Lemke
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fwagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// watchReconnectDelay is how long watch mode waits before reopening a
+// failed change stream.
+var watchReconnectDelay = time.Second
+
+// errChangeStreamEnded is returned by TaskChangeStream.Next once the stream
+// has closed, e.g. after an invalidate event.
+var errChangeStreamEnded = errors.New("change stream ended")
+
+// TaskChange is an insert, update or replace of a task seen on a change
+// stream.
+type TaskChange struct {
+	// Operation is the change stream operationType.
+	Operation string
+
+	// Task is the task document after the change, or nil if it was
+	// deleted since or could not be decoded.
+	Task *TaskDocument
+
+	// ResumeToken resumes a stream right after this change.
+	ResumeToken bson.Raw
+}
+
+// TaskChangeStream yields task changes in order; see MongoOps.WatchTasks.
+// Next blocks until a change arrives and returns an error once the stream
+// fails or ends, or ctx is done.
+type TaskChangeStream interface {
+	Next(ctx context.Context) (TaskChange, error)
+	Close(ctx context.Context) error
+}
+
+// WatchTasks opens a change stream over task inserts, updates and replaces,
+// with the full task document looked up for updates. A non-nil resumeAfter
+// resumes after the change carrying that token. Change streams need a
+// replica set or sharded cluster.
+func (m *MongoOps) WatchTasks(ctx context.Context, resumeAfter bson.Raw) (TaskChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	stream, err := m.collection(CollectionTasks).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoTaskStream{ops: m, stream: stream}, nil
+}
+
+// mongoTaskStream is the TaskChangeStream of a Mongo change stream.
+type mongoTaskStream struct {
+	ops    *MongoOps
+	stream *mongo.ChangeStream
+}
+
+func (s *mongoTaskStream) Next(ctx context.Context) (TaskChange, error) {
+	if !s.stream.Next(ctx) {
+		if err := s.stream.Err(); err != nil {
+			return TaskChange{}, err
+		}
+		if err := ctx.Err(); err != nil {
+			return TaskChange{}, err
+		}
+		return TaskChange{}, errChangeStreamEnded
+	}
+	var event struct {
+		OperationType string   `bson:"operationType"`
+		FullDocument  bson.Raw `bson:"fullDocument"`
+	}
+	if err := s.stream.Decode(&event); err != nil {
+		return TaskChange{}, err
+	}
+	change := TaskChange{Operation: event.OperationType, ResumeToken: s.stream.ResumeToken()}
+	if len(event.FullDocument) > 0 {
+		var task TaskDocument
+		if err := s.ops.decodeRaw(event.FullDocument, &task); err == nil {
+			change.Task = &task
+		}
+	}
+	return change, nil
+}
+
+func (s *mongoTaskStream) Close(ctx context.Context) error {
+	return s.stream.Close(ctx)
+}
+
+// watchLoop follows task changes while Config.WatchMode is set and wakes
+// the poll loop for each change that may be claimable, so new tasks are
+// picked up without waiting out the poll interval. A failed stream is
+// reopened after the last change seen.
+func (p *AgentPoller) watchLoop(ctx context.Context, watcher taskWatcher) {
+	defer p.wg.Done()
+
+	// Next blocks, so Stop has to end the stream through its context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var token bson.Raw
+	for {
+		stream, err := watcher.WatchTasks(ctx, token)
+		if err == nil {
+			token = p.followChanges(ctx, stream, token)
+			stream.Close(context.Background())
+		} else if ctx.Err() == nil {
+			log.Printf("Failed to watch tasks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchReconnectDelay):
+		}
+	}
+}
+
+// followChanges wakes the poll loop for claimable changes until stream
+// fails, and returns the resume token of the last change seen.
+func (p *AgentPoller) followChanges(ctx context.Context, stream TaskChangeStream, token bson.Raw) bson.Raw {
+	for {
+		change, err := stream.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Task change stream failed: %v", err)
+			}
+			return token
+		}
+		if change.ResumeToken != nil {
+			token = change.ResumeToken
+		}
+		if p.claimableChange(change) {
+			p.wakePoll()
+		}
+	}
+}
+
+// claimableChange reports whether change left a task this agent might
+// claim: in a claimable state on one of its task lists. Whether its name
+// is handled is left to the claim.
+func (p *AgentPoller) claimableChange(change TaskChange) bool {
+	task := change.Task
+	if task == nil {
+		return false
+	}
+	states := []string{TaskStatePending}
+	if len(p.cfg.ClaimableStates) > 0 {
+		states = claimableStates(p.cfg.ClaimableStates)
+	}
+	if !containsString(states, task.State) {
+		return false
+	}
+	return containsString(p.taskLists(), task.TaskListName)
+}
+
+// wakePoll makes the poll loop run a cycle now, without blocking.
+func (p *AgentPoller) wakePoll() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// containsString reports whether values holds s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}